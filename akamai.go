@@ -0,0 +1,237 @@
+package cclient_v2
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/useflyent/fhttp/http2"
+)
+
+// AkamaiFingerprint is an http2 fingerprint in the akamai format SETTINGS|WINDOW_UPDATE|PRIORITY|PSEUDO_HEADER_ORDER,
+// like 1:65536;3:1000;4:6291456|15663105|0|m,a,s,p. It is passed to NewClient as optional parameter of tls clients
+type AkamaiFingerprint string
+
+// HTTP2Fingerprint is what a tls client sends when it opens an http2 connection and the pseudo header order of its
+// requests, it is passed to NewClient as optional parameter of tls clients or set on the Profile.
+// The settings replace the http2 settings of the client and the priorities replace the Frames of its HTTP2Priority.
+// The transport buffers at most 4 MiB of unread data per stream, with a larger initial window size the data the server
+// sends beyond it is held until the response body is read
+type HTTP2Fingerprint struct {
+	// Settings are the settings of the SETTINGS frame in the order they are sent
+	Settings []http2.Setting
+	// WindowUpdate is the increment of the connection WINDOW_UPDATE frame, none is sent if it is zero
+	WindowUpdate uint32
+	// Priorities are the PRIORITY frames sent after the window update
+	Priorities []PriorityFrame
+	// PseudoHeaderOrder is the pseudo header order of requests
+	PseudoHeaderOrder []string
+}
+
+const (
+	// defaultHTTP2WindowUpdate is the connection window update of the fhttp transport
+	defaultHTTP2WindowUpdate = 1 << 30
+	// defaultHTTP2HeaderTableSize is the header table size of the fhttp transport and the spec
+	defaultHTTP2HeaderTableSize = 4096
+)
+
+// defaultHTTP2Settings are the settings of the fhttp transport in the order it sends them
+var defaultHTTP2Settings = []http2.Setting{
+	{ID: http2.SettingEnablePush, Val: 0},
+	{ID: http2.SettingInitialWindowSize, Val: 4 << 20},
+	{ID: http2.SettingHeaderTableSize, Val: defaultHTTP2HeaderTableSize},
+	{ID: http2.SettingMaxHeaderListSize, Val: 10 << 20},
+}
+
+// akamaiPseudoHeaders maps the letters of the akamai pseudo header order to the pseudo headers
+var akamaiPseudoHeaders = map[string]string{"m": ":method", "a": ":authority", "s": ":scheme", "p": ":path"}
+
+// ParseAkamaiFingerprint parses an http2 fingerprint in the akamai format
+func ParseAkamaiFingerprint(s string) (*HTTP2Fingerprint, error) {
+	parts := strings.Split(strings.TrimSpace(s), "|")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("akamai fingerprint %q does not have 4 parts", s)
+	}
+
+	f := &HTTP2Fingerprint{}
+	if parts[0] != "" {
+		for _, setting := range strings.Split(parts[0], ";") {
+			id, value, ok := strings.Cut(setting, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid akamai setting %q", setting)
+			}
+			i, err := strconv.ParseUint(id, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid akamai setting %q", setting)
+			}
+			v, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid akamai setting %q", setting)
+			}
+			f.Settings = append(f.Settings, http2.Setting{ID: http2.SettingID(i), Val: uint32(v)})
+		}
+	}
+
+	if parts[1] != "00" && parts[1] != "0" {
+		v, err := strconv.ParseUint(parts[1], 10, 31)
+		if err != nil || v == 0 {
+			return nil, fmt.Errorf("invalid akamai window update %q", parts[1])
+		}
+		f.WindowUpdate = uint32(v)
+	}
+
+	if parts[2] != "0" {
+		for _, priority := range strings.Split(parts[2], ",") {
+			fields := strings.Split(priority, ":")
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("invalid akamai priority %q", priority)
+			}
+			stream, err1 := strconv.ParseUint(fields[0], 10, 31)
+			exclusive, err2 := strconv.ParseUint(fields[1], 10, 1)
+			dep, err3 := strconv.ParseUint(fields[2], 10, 31)
+			weight, err4 := strconv.ParseUint(fields[3], 10, 16)
+			if err1 != nil || err2 != nil || err3 != nil || err4 != nil || weight < 1 || weight > 256 {
+				return nil, fmt.Errorf("invalid akamai priority %q", priority)
+			}
+			f.Priorities = append(f.Priorities, PriorityFrame{
+				StreamID: uint32(stream),
+				Priority: http2.PriorityParam{StreamDep: uint32(dep), Exclusive: exclusive == 1, Weight: uint8(weight - 1)},
+			})
+		}
+	}
+
+	for _, letter := range strings.Split(parts[3], ",") {
+		f.PseudoHeaderOrder = append(f.PseudoHeaderOrder, akamaiPseudoHeaders[letter])
+	}
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// String returns the fingerprint in the akamai format
+func (f *HTTP2Fingerprint) String() string {
+	settings := make([]string, len(f.Settings))
+	for i, s := range f.Settings {
+		settings[i] = fmt.Sprintf("%d:%d", s.ID, s.Val)
+	}
+
+	windowUpdate := "00"
+	if f.WindowUpdate != 0 {
+		windowUpdate = strconv.FormatUint(uint64(f.WindowUpdate), 10)
+	}
+
+	priorities := "0"
+	if len(f.Priorities) > 0 {
+		p := make([]string, len(f.Priorities))
+		for i, frame := range f.Priorities {
+			exclusive := 0
+			if frame.Priority.Exclusive {
+				exclusive = 1
+			}
+			p[i] = fmt.Sprintf("%d:%d:%d:%d", frame.StreamID, exclusive, frame.Priority.StreamDep, int(frame.Priority.Weight)+1)
+		}
+		priorities = strings.Join(p, ",")
+	}
+
+	pseudo := make([]string, len(f.PseudoHeaderOrder))
+	for i, h := range f.PseudoHeaderOrder {
+		pseudo[i] = strings.TrimPrefix(h, ":")[:1]
+	}
+
+	return strings.Join([]string{strings.Join(settings, ";"), windowUpdate, priorities, strings.Join(pseudo, ",")}, "|")
+}
+
+// validate checks the settings and priorities against the http2 spec and that every pseudo header is ordered once
+func (f *HTTP2Fingerprint) validate() error {
+	for _, s := range f.Settings {
+		if err := s.Valid(); err != nil {
+			return fmt.Errorf("invalid http2 setting %v: %w", s, err)
+		}
+	}
+	if f.WindowUpdate >= 1<<31 {
+		return errors.New("http2 window update larger than 2^31-1")
+	}
+	for _, p := range f.Priorities {
+		if p.StreamID == 0 || p.StreamID >= 1<<31 || p.Priority.StreamDep == p.StreamID {
+			return fmt.Errorf("invalid http2 priority of stream %d", p.StreamID)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, h := range f.PseudoHeaderOrder {
+		letter := strings.TrimPrefix(h, ":")
+		if letter == "" || akamaiPseudoHeaders[letter[:1]] != h || seen[h] {
+			return fmt.Errorf("invalid pseudo header order %v", f.PseudoHeaderOrder)
+		}
+		seen[h] = true
+	}
+	if len(seen) != len(akamaiPseudoHeaders) {
+		return fmt.Errorf("pseudo header order %v does not order every pseudo header", f.PseudoHeaderOrder)
+	}
+	return nil
+}
+
+// setting returns the value of a setting, false if it is not sent
+func (f *HTTP2Fingerprint) setting(id http2.SettingID) (uint32, bool) {
+	for _, s := range f.Settings {
+		if s.ID == id {
+			return s.Val, true
+		}
+	}
+	return 0, false
+}
+
+// streamOffset returns what is added to the streams of requests to start them after the streams of the priorities
+func (f *HTTP2Fingerprint) streamOffset() uint32 {
+	var highest uint32
+	for _, p := range f.Priorities {
+		if p.StreamID > highest {
+			highest = p.StreamID
+		}
+	}
+	return highest + highest%2
+}
+
+// http2Fingerprint returns the fingerprint of the http2 connections of a tls client. Without fingerprint it is the one of
+// the fhttp transport with the overridden settings, the priority frames and the default pseudo header order
+func http2Fingerprint(fingerprint *HTTP2Fingerprint, overriddenSettings map[http2.SettingID]uint32, priority HTTP2Priority) *HTTP2Fingerprint {
+	if fingerprint != nil {
+		return fingerprint
+	}
+
+	f := &HTTP2Fingerprint{
+		WindowUpdate:      defaultHTTP2WindowUpdate,
+		Priorities:        priority.Frames,
+		PseudoHeaderOrder: defaultPHeaderOrder,
+	}
+	for _, s := range defaultHTTP2Settings {
+		if v, ok := overriddenSettings[s.ID]; ok {
+			s.Val = v
+		}
+		f.Settings = append(f.Settings, s)
+	}
+
+	var added []http2.Setting
+	for id, v := range overriddenSettings {
+		if _, ok := f.setting(id); !ok {
+			added = append(added, http2.Setting{ID: id, Val: v})
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].ID < added[j].ID })
+	f.Settings = append(f.Settings, added...)
+	return f
+}
+
+// AkamaiFingerprint returns the akamai fingerprint of the http2 connections of the client, empty for non tls clients
+func (c *Client) AkamaiFingerprint() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.useTLS {
+		return ""
+	}
+	return http2Fingerprint(c.http2Fingerprint, c.http2Headers, c.http2Priority).String()
+}
@@ -0,0 +1,47 @@
+package cclient_v2
+
+import (
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+func TestAkamaiFingerprint(t *testing.T) {
+	fingerprints := []string{
+		"1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p",
+		"1:65536;4:131072;5:16384|12517377|3:0:0:201,5:0:0:101,7:0:0:1,9:0:7:1,11:0:3:1,13:0:0:241|m,p,a,s",
+		"2:0;4:2097152;3:100|10485760|0|m,s,p,a",
+	}
+	for _, fingerprint := range fingerprints {
+		t.Run(fingerprint, func(t *testing.T) {
+			parsed, err := ParseAkamaiFingerprint(fingerprint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parsed.String(); got != fingerprint {
+				t.Errorf("string: got %s", got)
+			}
+
+			srv := fingerprinttest.NewServer()
+			defer srv.Close()
+
+			c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, AkamaiFingerprint(fingerprint), TLSVerification{RootCAs: srv.CertPool()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = c.NewRequest().SetURL(srv.URL).Do(); err != nil {
+				t.Fatal(err)
+			}
+			f, ok := srv.LastFingerprint()
+			if !ok {
+				t.Fatal("no fingerprint recorded")
+			}
+			if f.Akamai != fingerprint {
+				t.Errorf("akamai fingerprint sent: got %s", f.Akamai)
+			}
+		})
+	}
+}
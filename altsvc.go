@@ -0,0 +1,251 @@
+package cclient_v2
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// altSvcDefaultMaxAge is the lifetime of alternative services advertised without ma parameter
+	altSvcDefaultMaxAge = 24 * time.Hour
+	// altSvcBrokenDuration is how long an alternative service is not used after connecting to it failed
+	altSvcBrokenDuration = 5 * time.Minute
+)
+
+// AltService is an alternative service an origin advertised in an Alt-Svc header
+type AltService struct {
+	// Protocol is the alpn protocol id of the alternative, like h3 or h2
+	Protocol string
+	// Host is the host of the alternative, the host of the origin if it is empty
+	Host string
+	// Port is the port of the alternative
+	Port string
+	// Expires is when the alternative was advertised until
+	Expires time.Time
+}
+
+// endpoint returns the address of the alternative of the origin at addr
+func (s AltService) endpoint(addr string) string {
+	host := s.Host
+	if host == "" {
+		host, _, _ = net.SplitHostPort(addr)
+	}
+	return net.JoinHostPort(host, s.Port)
+}
+
+// AltSvcCache saves the alternative services origins advertise in Alt-Svc headers of https responses until they expire,
+// it is passed to NewClient as optional parameter of tls clients and can be shared between clients. Clients without one
+// send every request to the origin.
+// Requests are sent to the first alternative of their origin the client supports, h3 alternatives by clients with
+// HTTP3 and h2 and http/1.1 alternatives over tcp. The tls handshake with an alternative is made for the host of the
+// origin. An alternative is not used for five minutes after connecting to it failed, its requests are sent to the
+// origin then. Origins are keyed by host:port
+type AltSvcCache struct {
+	mu      sync.Mutex
+	origins map[string][]AltService
+}
+
+// NewAltSvcCache creates an empty alt-svc cache
+func NewAltSvcCache() *AltSvcCache {
+	return &AltSvcCache{origins: make(map[string][]AltService)}
+}
+
+// Alternatives returns the unexpired alternatives of the origin at addr in the order it advertised them
+func (c *AltSvcCache) Alternatives(addr string) []AltService {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]AltService(nil), c.alternatives(addr, time.Now())...)
+}
+
+// Remove removes the alternatives of the origin at addr
+func (c *AltSvcCache) Remove(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.origins, addr)
+}
+
+// Clear removes the alternatives of all origins
+func (c *AltSvcCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.origins = make(map[string][]AltService)
+}
+
+// alternatives returns the unexpired alternatives of addr and drops the expired ones, c.mu is held
+func (c *AltSvcCache) alternatives(addr string, now time.Time) []AltService {
+	var alternatives []AltService
+	for _, s := range c.origins[addr] {
+		if now.Before(s.Expires) {
+			alternatives = append(alternatives, s)
+		}
+	}
+	if len(alternatives) == 0 {
+		delete(c.origins, addr)
+	} else {
+		c.origins[addr] = alternatives
+	}
+	return alternatives
+}
+
+// observe replaces the alternatives of the origin at addr with the ones of an Alt-Svc header value
+func (c *AltSvcCache) observe(addr, value string) {
+	now := time.Now()
+	services, cleared := parseAltSvc(value, now)
+	if !cleared && len(services) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cleared {
+		delete(c.origins, addr)
+		return
+	}
+	c.origins[addr] = services
+}
+
+// find returns the first unexpired alternative of addr that supported accepts
+func (c *AltSvcCache) find(addr string, supported func(AltService) bool) (AltService, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, s := range c.alternatives(addr, time.Now()) {
+		if supported(s) {
+			return s, true
+		}
+	}
+	return AltService{}, false
+}
+
+// parseAltSvc parses the alternative services of an Alt-Svc header value, cleared is true if it clears them
+func parseAltSvc(value string, now time.Time) (services []AltService, cleared bool) {
+	value = strings.TrimSpace(value)
+	if value == "clear" {
+		return nil, true
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		params := strings.Split(entry, ";")
+		protocol, authority, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !ok {
+			continue
+		}
+		host, port, err := net.SplitHostPort(strings.Trim(authority, `"`))
+		if err != nil || port == "" {
+			continue
+		}
+		if protocol, err = altSvcProtocol(protocol); err != nil {
+			continue
+		}
+
+		maxAge := altSvcDefaultMaxAge
+		for _, param := range params[1:] {
+			name, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.TrimSpace(name) == "ma" {
+				if seconds, err := strconv.ParseUint(strings.Trim(strings.TrimSpace(v), `"`), 10, 32); err == nil {
+					maxAge = time.Duration(seconds) * time.Second
+				}
+			}
+		}
+		services = append(services, AltService{Protocol: protocol, Host: host, Port: port, Expires: now.Add(maxAge)})
+	}
+	return services, false
+}
+
+// altSvcProtocol decodes the percent encoded protocol id of an alternative, like http%2F1.1
+func altSvcProtocol(protocol string) (string, error) {
+	return url.PathUnescape(strings.TrimSpace(protocol))
+}
+
+// brokenAlternatives are the alternatives of origins connecting to failed recently
+type brokenAlternatives struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func brokenKey(addr string, s AltService) string {
+	return addr + " " + s.Protocol + " " + s.endpoint(addr)
+}
+
+// mark marks the alternative of addr as broken
+func (b *brokenAlternatives) mark(addr string, s AltService) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.until == nil {
+		b.until = make(map[string]time.Time)
+	}
+	b.until[brokenKey(addr, s)] = time.Now().Add(altSvcBrokenDuration)
+}
+
+// broken reports whether the alternative of addr is broken
+func (b *brokenAlternatives) broken(addr string, s AltService) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := brokenKey(addr, s)
+	until, ok := b.until[key]
+	if ok && time.Now().After(until) {
+		delete(b.until, key)
+		return false
+	}
+	return ok
+}
+
+// altSvcDialError is the error of connecting to an alternative, the request was not sent
+type altSvcDialError struct {
+	alternative AltService
+	err         error
+}
+
+func (e *altSvcDialError) Error() string {
+	return e.err.Error()
+}
+
+func (e *altSvcDialError) Unwrap() error {
+	return e.err
+}
+
+// route is how the last hop of a request was sent, the round tripper fills it in
+type route struct {
+	mu          sync.Mutex
+	alternative *AltService
+}
+
+func (r *route) set(alternative *AltService) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.alternative = alternative
+}
+
+func (r *route) get() *AltService {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.alternative
+}
+
+type routeKey struct{}
+
+// withRoute returns a context carrying the route of a request to the round tripper
+func withRoute(ctx context.Context, r *route) context.Context {
+	return context.WithValue(ctx, routeKey{}, r)
+}
+
+// AltSvcCache returns the alt-svc cache of the client, nil if it does not use alternative services
+func (c *Client) AltSvcCache() *AltSvcCache {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.altSvc
+}
@@ -0,0 +1,76 @@
+package cclient_v2
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+)
+
+// newAltSvcServers starts an origin advertising an h2 alternative and the alternative, both answer with their name
+func newAltSvcServers(t *testing.T) (origin, alternative *httptest.Server) {
+	alternative = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("alternative"))
+	}))
+	alternative.EnableHTTP2 = true
+	alternative.StartTLS()
+	t.Cleanup(alternative.Close)
+
+	_, port, _ := net.SplitHostPort(alternative.Listener.Addr().String())
+	origin = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Alt-Svc", `h2=":`+port+`"; ma=60`)
+		_, _ = w.Write([]byte("origin"))
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+	return origin, alternative
+}
+
+func TestAltSvc(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []interface{}
+		bodies []string
+	}{
+		{"disabled by default", nil, []string{"origin", "origin"}},
+		{"with cache", []interface{}{NewAltSvcCache()}, []string{"origin", "alternative"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			origin, alternative := newAltSvcServers(t)
+			roots := x509.NewCertPool()
+			roots.AddCert(origin.Certificate())
+
+			params := append([]interface{}{tlsUtls.HelloChrome_102, TLSVerification{RootCAs: roots}}, test.params...)
+			c, err := NewClient("", 5*time.Second, true, params...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, want := range test.bodies {
+				resp, err := c.NewRequest().SetURL(origin.URL).Do()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := string(resp.Body()); got != want {
+					t.Errorf("request %d: got %s, want %s", i+1, got, want)
+				}
+				if (resp.AltSvc() != nil) != (want == "alternative") {
+					t.Errorf("request %d: alternative %v", i+1, resp.AltSvc())
+				}
+			}
+
+			if cache := c.AltSvcCache(); cache != nil {
+				_, port, _ := net.SplitHostPort(alternative.Listener.Addr().String())
+				if alternatives := cache.Alternatives(origin.Listener.Addr().String()); len(alternatives) != 1 || alternatives[0].Port != port {
+					t.Errorf("alternatives: got %v", alternatives)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package cclient_v2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	tlsHttp "github.com/useflyent/fhttp"
+	"github.com/useflyent/fhttp/http2"
+)
+
+// backend sends prepared requests over one kind of transport
+type backend interface {
+	// do sends the request, redirect hops get their cookie header from cookies and
+	// response cookies of every hop are handed to it
+	do(req *preparedRequest, cookies *cookieHandler) (*backendResponse, error)
+	// close closes the idle connections of the backend, requests that are sent meanwhile finish on their connections
+	close()
+}
+
+// sharedBackend is the backend of a client and the clones sharing its transport, it is closed when the last of them
+// replaced it or was closed
+type sharedBackend struct {
+	backend
+	users int32
+}
+
+func newSharedBackend(b backend) *sharedBackend {
+	return &sharedBackend{backend: b, users: 1}
+}
+
+// share adds a client using the backend
+func (b *sharedBackend) share() *sharedBackend {
+	atomic.AddInt32(&b.users, 1)
+	return b
+}
+
+// release removes a client using the backend, the backend is closed when no client uses it
+func (b *sharedBackend) release() {
+	if atomic.AddInt32(&b.users, -1) == 0 {
+		b.close()
+	}
+}
+
+// preparedRequest is the backend independent form of a request, as it is built by Request.Do and Client.Do
+type preparedRequest struct {
+	ctx           context.Context
+	method        string
+	url           *url.URL
+	host          string
+	header        http.Header
+	headerOrder   []string
+	pHeaderOrder  []string
+	body          io.Reader
+	contentLength int64
+	getBody       func() (io.ReadCloser, error)
+	cookies       []*http.Cookie
+	cookieMode    CookieMode
+	http2Priority *http2.PriorityParam
+	// stream is set for responses whose body is read as it arrives, the timeout of the client applies until the
+	// response headers arrived
+	stream bool
+}
+
+// backendResponse is the backend independent form of the response to the last hop of a request
+type backendResponse struct {
+	status     string
+	statusCode int
+	header     http.Header
+	body       io.ReadCloser
+	url        *url.URL
+	proto      string
+	altSvc     *AltService
+	conn       ConnInfo
+	sent       *wireRequest
+	// received are the header fields of the response in the order they were received, nil if the connection did not
+	// record them
+	received []headerField
+	// uncompressed is whether the transport decoded the body, http2 bodies keep their Content-Encoding header
+	uncompressed bool
+}
+
+// newBackend creates the backend for the profile and settings of a client with the specified proxy, without proxy if empty
+func newBackend(c *Client, proxyUrl string) (backend, error) {
+	if !c.useTLS {
+		return newHTTPBackend(proxyUrl, c.timeout, c.verification, c.keyLog)
+	}
+
+	if c.clientHello.Client == "" {
+		return nil, errors.New("missing client hello")
+	}
+	return newTLSBackend(c, proxyUrl)
+}
+
+// send passes the request through the middleware of the client and sends it with the client backend, the cookie header
+// of the first hop is added after the middleware for the url the request is sent to
+func (c *Client) send(req *preparedRequest) (*Response, error) {
+	b := c.currentBackend()
+	middleware, hooks := c.interceptors.snapshot()
+	recorders := c.interceptors.harRecorders()
+	req.ctx = withHooks(req.ctx, hooks)
+	host := req.url.Hostname()
+
+	send := func(req *preparedRequest) (*Response, error) {
+		cookies := c.addCookies(req, host)
+		req.ctx = withHARExchange(withTimings(req.ctx), recorders)
+		resp, err := b.do(req, cookies)
+		var response *Response
+		if err == nil {
+			response, err = newResponse(req, resp)
+		}
+		harExchangeFrom(req.ctx).finish(recorders, err)
+		if err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+	if len(middleware) == 0 {
+		return send(req)
+	}
+
+	handler := Handler(func(r *http.Request) (*Response, error) {
+		return send(req.withRequest(r))
+	})
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	r, err := req.request()
+	if err != nil {
+		return nil, err
+	}
+	return handler(r)
+}
+
+// open adds the cookie header of the first hop and sends the request with the client backend, the body of the
+// response is not read. The request is not passed through the middleware of the client
+func (c *Client) open(req *preparedRequest) (*backendResponse, error) {
+	b := c.currentBackend()
+	cookies := c.addCookies(req, req.url.Hostname())
+	_, hooks := c.interceptors.snapshot()
+	req.ctx = withHooks(req.ctx, hooks)
+
+	return b.do(req, cookies)
+}
+
+// currentBackend returns the backend the client sends requests with
+func (c *Client) currentBackend() backend {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.backend
+}
+
+// addCookies adds the cookie header of the first hop, it returns the cookie handler of the request. Cookies of the
+// request without domain are only sent to host, cookie headers set by middleware are sent as request cookies
+func (c *Client) addCookies(req *preparedRequest, host string) *cookieHandler {
+	req.cookies = append(extractCookies(req.header), req.cookies...)
+	cookies := &cookieHandler{
+		jar:     c.jar,
+		mode:    req.cookieMode,
+		cookies: req.cookies,
+		host:    host,
+	}
+	if value := cookies.header(req.url); value != "" {
+		req.header.Set("Cookie", value)
+	}
+	return cookies
+}
+
+// request returns the request as it is passed to middleware, with its body and its header orders under the fhttp
+// order keys of its header
+func (r *preparedRequest) request() (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.ctx, r.method, r.url.String(), r.body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = r.url
+	req.Host = r.host
+	if r.contentLength != 0 || r.getBody != nil {
+		req.ContentLength = r.contentLength
+		req.GetBody = r.getBody
+	}
+
+	req.Header = r.header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if len(r.headerOrder) > 0 {
+		req.Header[tlsHttp.HeaderOrderKey] = append([]string(nil), r.headerOrder...)
+	}
+	if len(r.pHeaderOrder) > 0 {
+		req.Header[tlsHttp.PHeaderOrderKey] = append([]string(nil), r.pHeaderOrder...)
+	}
+	return req, nil
+}
+
+// withRequest returns the prepared request of a request passed through middleware, the header orders of r replace
+// those of the prepared request if its header has them
+func (r *preparedRequest) withRequest(req *http.Request) *preparedRequest {
+	if req == nil {
+		return r
+	}
+
+	prepared := *r
+	prepared.ctx = req.Context()
+	prepared.method = req.Method
+	prepared.url = req.URL
+	prepared.host = req.Host
+	prepared.setHeader(req.Header)
+
+	prepared.body, prepared.contentLength, prepared.getBody = nil, 0, nil
+	if req.Body != nil && req.Body != http.NoBody {
+		prepared.body = req.Body
+		prepared.contentLength = req.ContentLength
+		prepared.getBody = req.GetBody
+	}
+	return &prepared
+}
+
+// sentRequest returns the request as it was sent, without its body
+func (r *preparedRequest) sentRequest() *http.Request {
+	req := &http.Request{
+		Method:        r.method,
+		URL:           r.url,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        r.header.Clone(),
+		ContentLength: r.contentLength,
+		GetBody:       r.getBody,
+		Host:          r.host,
+	}
+	if req.Host == "" {
+		req.Host = r.url.Host
+	}
+
+	if r.ctx != nil {
+		return req.WithContext(r.ctx)
+	}
+	return req
+}
@@ -0,0 +1,268 @@
+package cclient_v2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	tlsHttp "github.com/useflyent/fhttp"
+)
+
+// fhttpBackend sends requests over an fhttp round tripper, which writes headers in header order
+// and keeps the key casing they were set with
+type fhttpBackend struct {
+	transport tlsHttp.RoundTripper
+	timeout   time.Duration
+	// proxy is the redacted url of the proxy of the client, empty without proxy
+	proxy string
+}
+
+// canonicalHeaders are the headers fhttp looks up by their canonical key, they are always sent canonical
+var canonicalHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+}
+
+func (b *fhttpBackend) close() {
+	switch t := b.transport.(type) {
+	case *roundTripper:
+		t.close()
+	case *tlsHttp.Transport:
+		t.CloseIdleConnections()
+	}
+}
+
+func (b *fhttpBackend) do(req *preparedRequest, cookies *cookieHandler) (*backendResponse, error) {
+	r, err := req.fhttpRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	if req.ctx != nil {
+		r = r.WithContext(req.ctx)
+	}
+	if req.http2Priority != nil {
+		r = r.WithContext(withHTTP2Priority(r.Context(), *req.http2Priority))
+	}
+	route := &route{}
+	r = r.WithContext(withRoute(r.Context(), route))
+	ctx, hop := withHopRecorder(r.Context())
+	r = r.WithContext(ctx)
+
+	client := &tlsHttp.Client{
+		Transport:     &fhttpHopTransport{next: b.transport, cookies: cookies},
+		Timeout:       b.timeout,
+		CheckRedirect: checkRedirect,
+	}
+
+	var cancel context.CancelFunc
+	var timer *time.Timer
+	// streamed bodies are read without timeout, it applies until the response headers arrived
+	if req.stream && b.timeout > 0 {
+		client.Timeout = 0
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(r.Context())
+		r = r.WithContext(ctx)
+		timer = time.AfterFunc(b.timeout, cancel)
+	}
+
+	resp, err := client.Do(r)
+	if timer != nil && !timer.Stop() && err == nil {
+		_ = resp.Body.Close()
+		err = fmt.Errorf("timeout awaiting response headers of %s", req.url.Redacted())
+	}
+	if err != nil {
+		if cancel != nil {
+			cancel()
+		}
+		return nil, err
+	}
+
+	body := resp.Body
+	if cancel != nil {
+		body = &cancelBody{ReadCloser: body, cancel: cancel}
+	}
+
+	conn := hop.info(resp, b.proxy)
+	var header = http.Header{}
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+
+	return &backendResponse{
+		status:       resp.Status,
+		statusCode:   resp.StatusCode,
+		header:       header,
+		body:         body,
+		url:          resp.Request.URL,
+		proto:        resp.Proto,
+		altSvc:       route.get(),
+		conn:         conn,
+		sent:         hop.sent(resp.Request, conn.Protocol),
+		received:     decodedFields(hop.receivedFields(), header),
+		uncompressed: resp.Uncompressed,
+	}, nil
+}
+
+// checkRedirect reports redirects to the hooks of the request and stops after 10 redirects, like fhttp does by default
+func checkRedirect(req *tlsHttp.Request, via []*tlsHttp.Request) error {
+	if hooks := hooksFrom(req.Context()); len(hooks) > 0 {
+		sent := make([]*http.Request, len(via))
+		for i, r := range via {
+			sent[i] = transformRequest(r)
+		}
+		hooks.redirect(transformRequest(req), sent)
+	}
+
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// cancelBody cancels the context of a streamed response when its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// fhttpRequest builds the fhttp request of the request, without its context
+func (r *preparedRequest) fhttpRequest() (*tlsHttp.Request, error) {
+	req, err := tlsHttp.NewRequest(r.method, r.url.String(), r.body)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.contentLength != 0 || r.getBody != nil {
+		req.ContentLength = r.contentLength
+		req.GetBody = r.getBody
+	}
+
+	var host string
+	req.Header, host = r.fhttpHeader()
+
+	if len(r.host) > 0 {
+		req.Host = r.host
+	} else if len(host) > 0 {
+		req.Host = host
+	}
+	return req, nil
+}
+
+// fhttpHeader returns the header of the request as fhttp header with the header order keys set
+// and the value of a host header, which is sent as request host instead.
+// Keys keep their casing, keys that only differ in casing are merged into the first one in sorted order
+func (r *preparedRequest) fhttpHeader() (tlsHttp.Header, string) {
+	header := make(tlsHttp.Header)
+	if len(r.headerOrder) > 0 {
+		// fhttp matches the order against lowercase keys
+		order := make([]string, len(r.headerOrder))
+		for i, k := range r.headerOrder {
+			order[i] = strings.ToLower(k)
+		}
+		header[tlsHttp.HeaderOrderKey] = order
+	}
+	if len(r.pHeaderOrder) > 0 {
+		header[tlsHttp.PHeaderOrderKey] = r.pHeaderOrder
+	}
+
+	keys := make([]string, 0, len(r.header))
+	for k := range r.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var host string
+	sent := make(map[string]string)
+	for _, k := range keys {
+		canonical := http.CanonicalHeaderKey(k)
+		if canonical == "Host" {
+			if v := r.header[k]; len(v) > 0 && host == "" {
+				host = v[0]
+			}
+			continue
+		}
+
+		key := k
+		if canonicalHeaders[canonical] {
+			key = canonical
+		}
+		if first, ok := sent[canonical]; ok {
+			key = first
+		}
+		sent[canonical] = key
+
+		header[key] = append(header[key], r.header[k]...)
+	}
+
+	return header, host
+}
+
+// setHeader sets the header of the request from the header of a request passed to Client.Do,
+// taking the header order from the fhttp header order keys
+func (r *preparedRequest) setHeader(header map[string][]string) {
+	r.header = make(http.Header)
+	for k, v := range header {
+		switch k {
+		case tlsHttp.HeaderOrderKey:
+			r.headerOrder = v
+		case tlsHttp.PHeaderOrderKey:
+			r.pHeaderOrder = v
+		default:
+			r.header[k] = append([]string(nil), v...)
+		}
+	}
+}
+
+// fhttpHopTransport hands the cookies of every hop of a request to its cookie handler
+type fhttpHopTransport struct {
+	next    tlsHttp.RoundTripper
+	cookies *cookieHandler
+}
+
+func (t *fhttpHopTransport) RoundTrip(req *tlsHttp.Request) (*tlsHttp.Response, error) {
+	if ctx := req.Context(); len(hooksFrom(ctx)) > 0 {
+		req = req.WithContext(withTrace(ctx, req.URL.Hostname()))
+	}
+	if req.Response != nil {
+		req = req.Clone(req.Context())
+		req.Header.Del("Cookie")
+		if value := t.cookies.header(req.URL); value != "" {
+			req.Header.Set("Cookie", value)
+		}
+	}
+
+	har := harExchangeFrom(req.Context())
+	har.startHop(req)
+	resp, err := t.next.RoundTrip(req)
+	har.endHop(resp, err)
+	if err != nil {
+		proxyConnectFrom(req.Context()).done(err)
+		return nil, err
+	}
+
+	if rc := resp.Cookies(); len(rc) > 0 && t.cookies.stores() {
+		var cookies []*http.Cookie
+		for _, cookie := range rc {
+			cookies = append(cookies, fromTLSCookie(cookie))
+		}
+
+		observed := transformResponse(resp)
+		observed.Body = http.NoBody
+		t.cookies.store(req.URL, cookies, observed)
+	}
+
+	return resp, nil
+}
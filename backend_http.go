@@ -0,0 +1,57 @@
+package cclient_v2
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	tlsHttp "github.com/useflyent/fhttp"
+)
+
+// newHTTPBackend creates a backend that sends requests over a plain fhttp transport, without a client hello fingerprint.
+// fhttp writes headers in header order, unlike net/http
+func newHTTPBackend(proxyUrl string, timeout time.Duration, verification TLSVerification, keyLog io.Writer) (*fhttpBackend, error) {
+	transport := &tlsHttp.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   verification.tlsConfig(),
+	}
+	transport.TLSClientConfig.KeyLogWriter = keyLog
+	b := &fhttpBackend{
+		transport: transport,
+		timeout:   timeout,
+	}
+
+	if len(proxyUrl) > 0 {
+		p, err := url.Parse(proxyUrl)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = tlsHttp.ProxyURL(p)
+		b.proxy = p.Redacted()
+		transport.GetProxyConnectHeader = func(ctx context.Context, proxyURL *url.URL, target string) (tlsHttp.Header, error) {
+			proxyConnectFrom(ctx).start(proxyURL.Host, target)
+			return nil, nil
+		}
+	}
+
+	return b, nil
+}
+
+// prepareHTTPRequest turns a request passed to Client.Do into a prepared request
+func prepareHTTPRequest(r *http.Request) *preparedRequest {
+	req := &preparedRequest{
+		ctx:           r.Context(),
+		method:        r.Method,
+		url:           r.URL,
+		host:          r.Host,
+		body:          r.Body,
+		contentLength: r.ContentLength,
+		getBody:       r.GetBody,
+	}
+
+	req.setHeader(r.Header)
+	req.cookies = extractCookies(req.header)
+	return req
+}
@@ -0,0 +1,120 @@
+package cclient_v2
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveHeaderLines starts a server answering http/1.1 requests with the header lines of the request as they were sent
+func serveHeaderLines(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := textproto.NewReader(bufio.NewReader(conn))
+				for {
+					var lines []string
+					if _, err := r.ReadLine(); err != nil {
+						return
+					}
+					for {
+						line, err := r.ReadLine()
+						if err != nil {
+							return
+						}
+						if line == "" {
+							break
+						}
+						lines = append(lines, line)
+					}
+					body := strings.Join(lines, "\n")
+					if _, err := fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestHTTPHeaderOrder(t *testing.T) {
+	url := serveHeaderLines(t)
+	host := strings.TrimPrefix(url, "http://")
+
+	tests := []struct {
+		name        string
+		masterOrder []string
+		order       []string
+		headers     [][2]string
+		want        []string
+	}{
+		{
+			name:    "request order and casing",
+			order:   []string{"x-b", "User-Agent", "x-a", "accept"},
+			headers: [][2]string{{"x-a", "a"}, {"Accept", "*/*"}, {"X-B", "b"}, {"user-agent", "agent"}},
+			want:    []string{"X-B: b", "user-agent: agent", "x-a: a", "Accept: */*", "Host: " + host, "Accept-Encoding: gzip, deflate, br"},
+		},
+		{
+			name:        "master order",
+			masterOrder: []string{"x-a", "x-b"},
+			headers:     [][2]string{{"x-b", "b"}, {"x-a", "a"}},
+			want:        []string{"x-a: a", "x-b: b", "Host: " + host, "User-Agent: Go-http-client/1.1", "Accept-Encoding: gzip, deflate, br"},
+		},
+		{
+			name:        "request order over master order",
+			masterOrder: []string{"x-a", "x-b"},
+			order:       []string{"x-b", "x-a"},
+			headers:     [][2]string{{"x-b", "b"}, {"x-a", "a"}},
+			want:        []string{"x-b: b", "x-a: a", "Host: " + host, "User-Agent: Go-http-client/1.1", "Accept-Encoding: gzip, deflate, br"},
+		},
+		{
+			name:    "host in the order",
+			order:   []string{"host", "connection", "x-a"},
+			headers: [][2]string{{"x-a", "a"}, {"connection", "keep-alive"}},
+			want:    []string{"Host: " + host, "Connection: keep-alive", "x-a: a", "User-Agent: Go-http-client/1.1", "Accept-Encoding: gzip, deflate, br"},
+		},
+		{
+			name:    "keys differing in casing",
+			order:   []string{"x-dup"},
+			headers: [][2]string{{"x-dup", "2"}, {"X-Dup", "1"}},
+			want:    []string{"X-Dup: 1", "X-Dup: 2", "Host: " + host, "User-Agent: Go-http-client/1.1", "Accept-Encoding: gzip, deflate, br"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewClient("", 5*time.Second, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.SetMasterHeaderOrder(test.masterOrder)
+			req := c.NewRequest().SetURL(url).SetHeaderOrder(test.order)
+			for _, h := range test.headers {
+				req.SetHeader(h[0], h[1])
+			}
+			resp, err := req.Do()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Split(resp.BodyAsString(), "\n"); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package cclient_v2
+
+import (
+	"fmt"
+	"net/url"
+
+	tlsUtls "github.com/refraction-networking/utls"
+	tlsHttp "github.com/useflyent/fhttp"
+	"golang.org/x/net/proxy"
+)
+
+// newTLSBackend creates a backend that sends requests with the fingerprinted utls round tripper
+func newTLSBackend(c *Client, proxyUrl string) (*fhttpBackend, error) {
+	if c.randomization.Mode != RandomizeNever {
+		if _, err := randomizableSpec(c.clientHello, c.clientHelloSpec); err != nil {
+			return nil, err
+		}
+	}
+	// presets are built as spec to resume sessions
+	if c.sessionCache != nil && c.clientHelloSpec == nil {
+		if _, err := tlsUtls.UTLSIdToSpec(c.clientHello); err != nil {
+			return nil, fmt.Errorf("client hello %s cannot resume sessions: %w", c.clientHello.Str(), err)
+		}
+	}
+
+	if len(proxyUrl) > 0 {
+		p, err := url.Parse(proxyUrl)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig := c.verification.tlsConfig()
+		tlsConfig.KeyLogWriter = c.keyLog
+		dialer, err := newConnectDialer(proxyUrl, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		// quic can not be tunneled through the proxy, requests are sent over tcp
+		return &fhttpBackend{
+			transport: newRoundTripper(c, nil, dialer),
+			timeout:   c.timeout,
+			proxy:     p.Redacted(),
+		}, nil
+	}
+
+	return &fhttpBackend{
+		transport: newRoundTripper(c, c.http3, proxy.Direct),
+		timeout:   c.timeout,
+	}, nil
+}
+
+// prepareTLSRequest turns a request passed to Client.Do into a prepared request
+func prepareTLSRequest(r *tlsHttp.Request) *preparedRequest {
+	req := &preparedRequest{
+		ctx:           r.Context(),
+		method:        r.Method,
+		url:           r.URL,
+		host:          r.Host,
+		body:          r.Body,
+		contentLength: r.ContentLength,
+		getBody:       r.GetBody,
+	}
+
+	req.setHeader(r.Header)
+	req.cookies = extractCookies(req.header)
+	return req
+}
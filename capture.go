@@ -0,0 +1,417 @@
+package cclient_v2
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	recordTypeHandshake    = 0x16
+	handshakeClientHello   = 0x01
+	maxClientHelloRecord   = 0xffff
+	pcapMagicMicroseconds  = 0xa1b2c3d4
+	pcapMagicNanoseconds   = 0xa1b23c4d
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngInterfaceBlock   = 0x00000001
+	pcapngSimplePacket     = 0x00000003
+	pcapngEnhancedPacket   = 0x00000006
+	linkTypeNull           = 0
+	linkTypeEthernet       = 1
+	linkTypeRaw            = 101
+	linkTypeLoop           = 108
+	linkTypeLinuxSLL       = 113
+	linkTypeIPv4           = 228
+	linkTypeIPv6           = 229
+	linkTypeLinuxSLL2      = 276
+	etherTypeIPv4          = 0x0800
+	etherTypeIPv6          = 0x86dd
+	etherTypeVLAN          = 0x8100
+	ipProtocolTCP          = 6
+	ipv6HopByHop           = 0
+	ipv6Routing            = 43
+	ipv6DestinationOptions = 60
+)
+
+// DecodeClientHello returns the tls record of a captured client hello.
+// The capture can be a pcap or pcapng file, raw bytes or hex or base64 encoded bytes of the record or handshake message.
+// A client hello that spans several tcp segments or tls records is reassembled into one record
+func DecodeClientHello(data []byte) ([]byte, error) {
+	if isPcap(data) {
+		return clientHelloFromPcap(data)
+	}
+
+	raw, err := decodeClientHelloBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	record, complete, err := clientHelloRecord(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		return nil, errors.New("client hello is truncated")
+	}
+	return record, nil
+}
+
+// decodeClientHelloBytes decodes hex or base64 encoded client hello bytes, raw bytes are returned as they are
+func decodeClientHelloBytes(data []byte) ([]byte, error) {
+	if len(data) > 1 && (data[0] == recordTypeHandshake || data[0] == handshakeClientHello) && data[1] <= 0x03 {
+		return data, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	cleaned := strings.NewReplacer(" ", "", "\n", "", "\r", "", "\t", "", ":", "", "0x", "").Replace(text)
+	if b, err := hex.DecodeString(cleaned); err == nil {
+		return b, nil
+	}
+
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := encoding.DecodeString(text); err == nil {
+			return b, nil
+		}
+	}
+
+	return nil, errors.New("client hello is neither raw, hex nor base64 encoded")
+}
+
+// clientHelloRecord joins the handshake records at the start of data into one record holding the whole client hello.
+// A handshake message without record header gets one. complete is false if data ends before the client hello
+func clientHelloRecord(data []byte) (record []byte, complete bool, err error) {
+	if len(data) > 0 && data[0] == handshakeClientHello {
+		data = append([]byte{recordTypeHandshake, 0x03, 0x01, byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+
+	if len(data) < 5 {
+		return nil, false, nil
+	}
+	if data[0] != recordTypeHandshake {
+		return nil, false, errors.New("data does not start with a handshake record")
+	}
+	version := data[1:3]
+
+	var message []byte
+	for len(data) >= 5 {
+		if data[0] != recordTypeHandshake {
+			return nil, false, errors.New("client hello is followed by a non handshake record")
+		}
+
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			message = append(message, data[5:]...)
+			break
+		}
+
+		message = append(message, data[5:5+length]...)
+		data = data[5+length:]
+
+		if len(message) >= 4 && len(message) >= 4+messageLength(message) {
+			break
+		}
+	}
+
+	if len(message) < 4 {
+		return nil, false, nil
+	}
+	if message[0] != handshakeClientHello {
+		return nil, false, errors.New("handshake message is not a client hello")
+	}
+
+	length := 4 + messageLength(message)
+	if len(message) < length {
+		return nil, false, nil
+	}
+	if length > maxClientHelloRecord {
+		return nil, false, errors.New("client hello is too large")
+	}
+
+	record = append([]byte{recordTypeHandshake, version[0], version[1], byte(length >> 8), byte(length)}, message[:length]...)
+	return record, true, nil
+}
+
+func messageLength(message []byte) int {
+	return int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+}
+
+func isPcap(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		switch order.Uint32(data) {
+		case pcapMagicMicroseconds, pcapMagicNanoseconds, pcapngSectionHeader:
+			return true
+		}
+	}
+	return false
+}
+
+// capturedPacket is a link layer frame of a capture
+type capturedPacket struct {
+	linkType uint32
+	data     []byte
+}
+
+// tcpSegment is the payload of a tcp segment
+type tcpSegment struct {
+	flow    string
+	seq     uint32
+	payload []byte
+}
+
+// clientHelloFromPcap returns the first client hello of a pcap or pcapng capture
+func clientHelloFromPcap(data []byte) ([]byte, error) {
+	var packets []capturedPacket
+	var err error
+	if binary.BigEndian.Uint32(data) == pcapngSectionHeader {
+		packets, err = readPcapng(data)
+	} else {
+		packets, err = readPcap(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []tcpSegment
+	for _, p := range packets {
+		if s, ok := parseTCPSegment(p); ok && len(s.payload) > 0 {
+			segments = append(segments, s)
+		}
+	}
+
+	for i, s := range segments {
+		if len(s.payload) < 6 || s.payload[0] != recordTypeHandshake || s.payload[5] != handshakeClientHello {
+			continue
+		}
+		return reassembleClientHello(s, segments[i+1:])
+	}
+
+	return nil, errors.New("no client hello found in capture")
+}
+
+// reassembleClientHello appends the following segments of the flow of first until the client hello is complete
+func reassembleClientHello(first tcpSegment, segments []tcpSegment) ([]byte, error) {
+	stream := append([]byte(nil), first.payload...)
+	next := first.seq + uint32(len(first.payload))
+
+	for {
+		record, complete, err := clientHelloRecord(stream)
+		if err != nil {
+			return nil, err
+		}
+		if complete {
+			return record, nil
+		}
+
+		found := false
+		for _, s := range segments {
+			if s.flow != first.flow {
+				continue
+			}
+
+			// take the part of a retransmitted or overlapping segment that is new
+			offset := next - s.seq
+			if offset < uint32(len(s.payload)) {
+				stream = append(stream, s.payload[offset:]...)
+				next = s.seq + uint32(len(s.payload))
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("client hello is truncated in capture")
+		}
+	}
+}
+
+// readPcap reads the packets of a classic pcap capture
+func readPcap(data []byte) ([]capturedPacket, error) {
+	if len(data) < 24 {
+		return nil, errors.New("pcap header is truncated")
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if magic := binary.BigEndian.Uint32(data); magic == pcapMagicMicroseconds || magic == pcapMagicNanoseconds {
+		order = binary.BigEndian
+	}
+	linkType := order.Uint32(data[20:24]) & 0x0fffffff
+
+	var packets []capturedPacket
+	data = data[24:]
+	for len(data) >= 16 {
+		length := int(order.Uint32(data[8:12]))
+		if len(data) < 16+length {
+			break
+		}
+
+		packets = append(packets, capturedPacket{linkType: linkType, data: data[16 : 16+length]})
+		data = data[16+length:]
+	}
+
+	return packets, nil
+}
+
+// readPcapng reads the packets of a pcapng capture
+func readPcapng(data []byte) ([]capturedPacket, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	var linkTypes []uint32
+	var packets []capturedPacket
+
+	for len(data) >= 12 {
+		blockType := order.Uint32(data)
+		if binary.BigEndian.Uint32(data) == pcapngSectionHeader {
+			blockType = pcapngSectionHeader
+			if binary.BigEndian.Uint32(data[8:12]) == pcapngByteOrderMagic {
+				order = binary.BigEndian
+			} else {
+				order = binary.LittleEndian
+			}
+			linkTypes = nil
+		}
+
+		length := int(order.Uint32(data[4:8]))
+		if length < 12 || length > len(data) {
+			return nil, errors.New("pcapng block is truncated")
+		}
+		body := data[8 : length-4]
+		data = data[length:]
+
+		switch blockType {
+		case pcapngInterfaceBlock:
+			if len(body) < 2 {
+				return nil, errors.New("pcapng interface block is truncated")
+			}
+			linkTypes = append(linkTypes, uint32(order.Uint16(body)))
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return nil, errors.New("pcapng packet block is truncated")
+			}
+			iface := int(order.Uint32(body))
+			captured := int(order.Uint32(body[12:16]))
+			if iface >= len(linkTypes) || len(body) < 20+captured {
+				return nil, errors.New("invalid pcapng packet block")
+			}
+			packets = append(packets, capturedPacket{linkType: linkTypes[iface], data: body[20 : 20+captured]})
+		case pcapngSimplePacket:
+			if len(body) < 4 || len(linkTypes) == 0 {
+				return nil, errors.New("invalid pcapng simple packet block")
+			}
+			captured := int(order.Uint32(body))
+			if captured > len(body)-4 {
+				captured = len(body) - 4
+			}
+			packets = append(packets, capturedPacket{linkType: linkTypes[0], data: body[4 : 4+captured]})
+		}
+	}
+
+	return packets, nil
+}
+
+// parseTCPSegment returns the tcp segment of an ipv4 or ipv6 packet in a link layer frame
+func parseTCPSegment(p capturedPacket) (tcpSegment, bool) {
+	ip, ok := ipPacket(p)
+	if !ok || len(ip) < 1 {
+		return tcpSegment{}, false
+	}
+
+	var src, dst, tcp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		headerLength := int(ip[0]&0x0f) * 4
+		if len(ip) < 20 || headerLength < 20 || len(ip) < headerLength || ip[9] != ipProtocolTCP {
+			return tcpSegment{}, false
+		}
+		if total := int(binary.BigEndian.Uint16(ip[2:4])); total >= headerLength && total < len(ip) {
+			ip = ip[:total]
+		}
+		src, dst, tcp = ip[12:16], ip[16:20], ip[headerLength:]
+	case 6:
+		if len(ip) < 40 {
+			return tcpSegment{}, false
+		}
+		if total := 40 + int(binary.BigEndian.Uint16(ip[4:6])); total < len(ip) {
+			ip = ip[:total]
+		}
+		src, dst = ip[8:24], ip[24:40]
+
+		next, payload := ip[6], ip[40:]
+		for next == ipv6HopByHop || next == ipv6Routing || next == ipv6DestinationOptions {
+			if len(payload) < 8 {
+				return tcpSegment{}, false
+			}
+			length := (int(payload[1]) + 1) * 8
+			if len(payload) < length {
+				return tcpSegment{}, false
+			}
+			next, payload = payload[0], payload[length:]
+		}
+		if next != ipProtocolTCP {
+			return tcpSegment{}, false
+		}
+		tcp = payload
+	default:
+		return tcpSegment{}, false
+	}
+
+	if len(tcp) < 20 {
+		return tcpSegment{}, false
+	}
+	offset := int(tcp[12]>>4) * 4
+	if offset < 20 || len(tcp) < offset {
+		return tcpSegment{}, false
+	}
+
+	return tcpSegment{
+		flow:    fmt.Sprintf("%x:%x>%x:%x", src, tcp[0:2], dst, tcp[2:4]),
+		seq:     binary.BigEndian.Uint32(tcp[4:8]),
+		payload: tcp[offset:],
+	}, true
+}
+
+// ipPacket strips the link layer header of a frame
+func ipPacket(p capturedPacket) ([]byte, bool) {
+	data := p.data
+
+	switch p.linkType {
+	case linkTypeNull, linkTypeLoop:
+		if len(data) < 4 {
+			return nil, false
+		}
+		return data[4:], true
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return data, true
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType, data := binary.BigEndian.Uint16(data[12:14]), data[14:]
+		for etherType == etherTypeVLAN {
+			if len(data) < 4 {
+				return nil, false
+			}
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+		return data, etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[14:16])
+		return data[16:], etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+	case linkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[0:2])
+		return data[20:], etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+	}
+
+	return nil, false
+}
@@ -0,0 +1,248 @@
+package cclient_v2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+
+	tlsUtls "github.com/refraction-networking/utls"
+)
+
+// chromeClientHello returns the record of a client hello of chrome 102
+func chromeClientHello(t *testing.T) []byte {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn := tlsUtls.UClient(client, &tlsUtls.Config{ServerName: "example.com"}, tlsUtls.HelloChrome_102)
+	if err := conn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	message := conn.HandshakeState.Hello.Raw
+	return append([]byte{recordTypeHandshake, 0x03, 0x01, byte(len(message) >> 8), byte(len(message))}, message...)
+}
+
+// capturedSegment is a tcp segment of a capture, the flow is told apart by the source port
+type capturedSegment struct {
+	port    uint16
+	seq     uint32
+	payload []byte
+}
+
+// tcpHeader returns the tcp header of a segment from port to port 443
+func tcpHeader(s capturedSegment) []byte {
+	h := make([]byte, 20)
+	binary.BigEndian.PutUint16(h[0:2], s.port)
+	binary.BigEndian.PutUint16(h[2:4], 443)
+	binary.BigEndian.PutUint32(h[4:8], s.seq)
+	h[12] = 5 << 4
+	return append(h, s.payload...)
+}
+
+func ipv4Packet(s capturedSegment) []byte {
+	tcp := tcpHeader(s)
+	h := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, ipProtocolTCP, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	binary.BigEndian.PutUint16(h[2:4], uint16(20+len(tcp)))
+	// ethernet frames can have padding after the ip packet
+	return append(append(h, tcp...), 0, 0)
+}
+
+// ipv6Packet returns an ipv6 packet with a hop by hop options header before the tcp segment
+func ipv6Packet(s capturedSegment) []byte {
+	tcp := append([]byte{ipProtocolTCP, 0, 0, 0, 0, 0, 0, 0}, tcpHeader(s)...)
+	h := make([]byte, 40)
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:6], uint16(len(tcp)))
+	h[6], h[7] = ipv6HopByHop, 64
+	copy(h[8:24], net.ParseIP("2001:db8::1"))
+	copy(h[24:40], net.ParseIP("2001:db8::2"))
+	return append(h, tcp...)
+}
+
+func ethernetFrame(etherType uint16, packet []byte) []byte {
+	h := make([]byte, 12)
+	return append(append(h, byte(etherType>>8), byte(etherType)), packet...)
+}
+
+// pcapFile returns a classic pcap capture of the frames in the byte order and with the magic number
+func pcapFile(order binary.ByteOrder, magic, linkType uint32, frames [][]byte) []byte {
+	h := make([]byte, 24)
+	order.PutUint32(h[0:4], magic)
+	order.PutUint16(h[4:6], 2)
+	order.PutUint16(h[6:8], 4)
+	order.PutUint32(h[16:20], 0xffff)
+	order.PutUint32(h[20:24], linkType)
+	for _, f := range frames {
+		record := make([]byte, 16)
+		order.PutUint32(record[8:12], uint32(len(f)))
+		order.PutUint32(record[12:16], uint32(len(f)))
+		h = append(append(h, record...), f...)
+	}
+	return h
+}
+
+// byteOrder is the byte order of a capture file
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// pcapngBlock returns a pcapng block with its body padded to 32 bits
+func pcapngBlock(order byteOrder, blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	b := make([]byte, 8, 12+len(body))
+	order.PutUint32(b[0:4], blockType)
+	order.PutUint32(b[4:8], uint32(12+len(body)))
+	b = append(b, body...)
+	return order.AppendUint32(b, uint32(12+len(body)))
+}
+
+// pcapngFile returns a pcapng capture of the frames, the first one in a simple packet block and the others in enhanced
+// packet blocks
+func pcapngFile(order byteOrder, linkType uint16, frames [][]byte) []byte {
+	section := order.AppendUint32(nil, pcapngByteOrderMagic)
+	section = append(order.AppendUint16(order.AppendUint16(section, 1), 0), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	f := pcapngBlock(order, pcapngSectionHeader, section)
+	f = append(f, pcapngBlock(order, pcapngInterfaceBlock, order.AppendUint32(order.AppendUint16(order.AppendUint16(nil, linkType), 0), 0xffff))...)
+	for i, frame := range frames {
+		if i == 0 {
+			f = append(f, pcapngBlock(order, pcapngSimplePacket, append(order.AppendUint32(nil, uint32(len(frame))), frame...))...)
+			continue
+		}
+		body := make([]byte, 20)
+		order.PutUint32(body[12:16], uint32(len(frame)))
+		order.PutUint32(body[16:20], uint32(len(frame)))
+		f = append(f, pcapngBlock(order, pcapngEnhancedPacket, append(body, frame...))...)
+	}
+	return f
+}
+
+// splitSegments splits the record into tcp segments of the flow of port 50000, with a retransmission of the first
+// segment overlapping the second and a segment of another flow in between
+func splitSegments(record []byte) []capturedSegment {
+	const seq = 1000
+	return []capturedSegment{
+		{port: 50001, seq: 7, payload: []byte("GET / HTTP/1.1\r\n")},
+		{port: 50000, seq: seq, payload: record[:100]},
+		{port: 50001, seq: 5000, payload: record[100:300]},
+		{port: 50000, seq: seq, payload: record[:150]},
+		{port: 50000, seq: seq + 100, payload: record[100:300]},
+		{port: 50000, seq: seq + 300, payload: record[300:]},
+	}
+}
+
+func frames(segments []capturedSegment, frame func(capturedSegment) []byte) [][]byte {
+	var f [][]byte
+	for _, s := range segments {
+		f = append(f, frame(s))
+	}
+	return f
+}
+
+func TestDecodeClientHello(t *testing.T) {
+	record := chromeClientHello(t)
+	segments := splitSegments(record)
+	message := record[5:]
+
+	// the client hello split into two records
+	fragmented := append([]byte{recordTypeHandshake, 0x03, 0x01, 0, 200}, message[:200]...)
+	fragmented = append(append(fragmented, recordTypeHandshake, 0x03, 0x01, byte((len(message)-200)>>8), byte(len(message)-200)), message[200:]...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"record", record},
+		{"handshake message", message},
+		{"record followed by other records", append(append([]byte(nil), record...), 0x14, 0x03, 0x03, 0, 1, 1)},
+		{"fragmented records", fragmented},
+		{"hex", []byte(hex.EncodeToString(record))},
+		{"hex with separators", []byte(" 0x" + strings.Join(strings.SplitAfter(hex.EncodeToString(record), "0"), ":") + "\n")},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(record))},
+		{"raw base64 url", []byte(base64.RawURLEncoding.EncodeToString(record))},
+		{"pcap ethernet", pcapFile(binary.LittleEndian, pcapMagicMicroseconds, linkTypeEthernet, frames(segments, func(s capturedSegment) []byte {
+			return ethernetFrame(etherTypeIPv4, ipv4Packet(s))
+		}))},
+		{"pcap vlan", pcapFile(binary.BigEndian, pcapMagicNanoseconds, linkTypeEthernet, frames(segments, func(s capturedSegment) []byte {
+			return ethernetFrame(etherTypeVLAN, append([]byte{0, 1, 0x86, 0xdd}, ipv6Packet(s)...))
+		}))},
+		{"pcap raw", pcapFile(binary.LittleEndian, pcapMagicNanoseconds, linkTypeRaw, frames(segments, ipv4Packet))},
+		{"pcap null", pcapFile(binary.BigEndian, pcapMagicMicroseconds, linkTypeNull, frames(segments, func(s capturedSegment) []byte {
+			return append([]byte{0, 0, 0, 2}, ipv4Packet(s)...)
+		}))},
+		{"pcapng linux sll", pcapngFile(binary.LittleEndian, linkTypeLinuxSLL, frames(segments, func(s capturedSegment) []byte {
+			return append(append(make([]byte, 14), 0x86, 0xdd), ipv6Packet(s)...)
+		}))},
+		{"pcapng linux sll2", pcapngFile(binary.BigEndian, linkTypeLinuxSLL2, frames(segments, func(s capturedSegment) []byte {
+			return append(append([]byte{0x08, 0x00}, make([]byte, 18)...), ipv4Packet(s)...)
+		}))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := DecodeClientHello(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, record) {
+				t.Errorf("got %x, want %x", got, record)
+			}
+		})
+	}
+}
+
+func TestDecodeClientHelloErrors(t *testing.T) {
+	record := chromeClientHello(t)
+	segments := splitSegments(record)
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"not encoded", []byte("client hello"), "neither raw, hex nor base64"},
+		{"truncated", record[:len(record)-1], "client hello is truncated"},
+		{"application data", []byte("17 03 03 00 01 00"), "does not start with a handshake record"},
+		{"server hello", []byte{recordTypeHandshake, 0x03, 0x03, 0, 4, 0x02, 0, 0, 0}, "not a client hello"},
+		{"followed by application data", append(append([]byte{recordTypeHandshake, 0x03, 0x01, 0, 200}, record[5:205]...), 0x17, 0x03, 0x03, 0, 1, 0),
+			"non handshake record"},
+		{"truncated pcap header", pcapFile(binary.LittleEndian, pcapMagicMicroseconds, linkTypeRaw, nil)[:20], "pcap header is truncated"},
+		{"truncated pcapng block", pcapngFile(binary.LittleEndian, linkTypeRaw, nil)[:40], "pcapng block is truncated"},
+		{"no client hello", pcapFile(binary.LittleEndian, pcapMagicMicroseconds, linkTypeRaw, frames(segments[:1], ipv4Packet)), "no client hello found"},
+		{"missing segment", pcapFile(binary.LittleEndian, pcapMagicMicroseconds, linkTypeRaw, frames(segments[:4], ipv4Packet)), "truncated in capture"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DecodeClientHello(test.data)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestFingerprintClientHello(t *testing.T) {
+	record := chromeClientHello(t)
+	spec, report, err := FingerprintClientHello([]byte(hex.EncodeToString(record)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Faithful() {
+		t.Errorf("report: got %+v, want a faithful copy", report)
+	}
+
+	captured, err := (&tlsUtls.Fingerprinter{AllowBluntMimicry: true}).FingerprintClientHello(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := applySpec(t, spec).HandshakeState.Hello
+	if len(spec.Extensions) != len(captured.Extensions) || len(hello.CipherSuites) != len(captured.CipherSuites) {
+		t.Errorf("got %d extensions and %d cipher suites, want %d and %d", len(spec.Extensions), len(hello.CipherSuites),
+			len(captured.Extensions), len(captured.CipherSuites))
+	}
+}
@@ -2,139 +2,227 @@ package cclient_v2
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"strings"
 	"time"
 
 	tlsUtls "github.com/refraction-networking/utls"
 	tlsHttp "github.com/useflyent/fhttp"
-	tlsJar "github.com/useflyent/fhttp/cookiejar"
 	"github.com/useflyent/fhttp/http2"
-	"golang.org/x/net/proxy"
-)
-
-var (
-	noTlsConfig = &tls.Config{
-		InsecureSkipVerify: true,
-	}
 )
 
+// NewClient creates a client, tls clients need a tlsUtls.ClientHelloID or a *ClientHelloSpec as first optional parameter
+// and can take their http2 settings, an AkamaiFingerprint or *HTTP2Fingerprint, an HTTP2Priority, a Randomization of the
+// client hello, a *SessionCache, ClientCertificates, HTTP3 and an *AltSvcCache as further optional parameters.
+// Tls clients only resume sessions when a *SessionCache is passed, resumption reads unexported session state of utls.
+// They only send requests to the alternative services origins advertise in Alt-Svc headers when an *AltSvcCache is passed.
+// All clients take a TLSVerification and a KeyLog as optional parameters
 func NewClient(proxyUrl string, timeout time.Duration, useTLS bool, optParams ...interface{}) (*Client, error) {
-	jar, _ := tlsJar.New(nil)
-
-	// handle non tls client
-	if !useTLS {
-		jar, _ := cookiejar.New(nil)
+	var clientHello tlsUtls.ClientHelloID
+	var clientHelloSpec *ClientHelloSpec
+	var http2Headers map[http2.SettingID]uint32
+	var http2Priority HTTP2Priority
+	var http2Fingerprint *HTTP2Fingerprint
+	var h3 *HTTP3
+	var randomization Randomization
+	var sessionCache *SessionCache
+	var altSvc *AltSvcCache
+	var verification TLSVerification
+	var clientCerts ClientCertificates
+	var keyLog io.Writer
+	keyLogSet := false
 
-		transport := &http.Transport{
-			ForceAttemptHTTP2: true,
-			TLSClientConfig:   noTlsConfig,
+	if useTLS {
+		if len(optParams) == 0 {
+			log.Println("missing client hello when creating tls client")
+			return nil, errors.New("missing client hello")
 		}
 
-		if len(proxyUrl) > 0 {
-			p, err := url.Parse(proxyUrl)
-			if err != nil {
-				return nil, err
+		switch hello := optParams[0].(type) {
+		case tlsUtls.ClientHelloID:
+			clientHello = hello
+		case *ClientHelloSpec:
+			clientHello = tlsUtls.HelloCustom
+			clientHelloSpec = hello
+		default:
+			return nil, errors.New("invalid client hello")
+		}
+		for _, param := range optParams[1:] {
+			switch param := param.(type) {
+			case map[http2.SettingID]uint32:
+				http2Headers = param
+			case HTTP2Priority:
+				http2Priority = param
+			case AkamaiFingerprint:
+				f, err := ParseAkamaiFingerprint(string(param))
+				if err != nil {
+					return nil, err
+				}
+				http2Fingerprint = f
+			case *HTTP2Fingerprint:
+				if param != nil {
+					if err := param.validate(); err != nil {
+						return nil, err
+					}
+				}
+				http2Fingerprint = param
+			case HTTP3:
+				if err := param.validate(); err != nil {
+					return nil, err
+				}
+				h3 = &param
+			case *HTTP3:
+				if param != nil {
+					if err := param.validate(); err != nil {
+						return nil, err
+					}
+				}
+				h3 = param
+			case Randomization:
+				randomization = param.seeded()
+			case *SessionCache:
+				sessionCache = param
+			case *AltSvcCache:
+				altSvc = param
+			case TLSVerification:
+				verification = param
+			case ClientCertificates:
+				if err := param.validate(); err != nil {
+					return nil, err
+				}
+				clientCerts = param
+			case KeyLog:
+				keyLog, keyLogSet = param.writer(), true
+			default:
+				return nil, fmt.Errorf("invalid optional parameter of type %T", param)
+			}
+		}
+	} else {
+		for _, param := range optParams {
+			switch param := param.(type) {
+			case TLSVerification:
+				verification = param
+			case ClientCertificates:
+				return nil, errors.New("client certificates need a tls client")
+			case HTTP3, *HTTP3:
+				return nil, errors.New("http3 needs a tls client")
+			case KeyLog:
+				keyLog, keyLogSet = param.writer(), true
+			default:
+				return nil, fmt.Errorf("invalid optional parameter of type %T", param)
 			}
-			transport.Proxy = http.ProxyURL(p)
 		}
-
-		return &Client{
-			httpClient: &http.Client{
-				Transport: transport,
-				Jar:       jar,
-				Timeout:   timeout,
-			},
-			http2Headers: nil,
-			useTLS:       false,
-			proxy:        proxyUrl,
-		}, nil
 	}
-
-	if len(optParams) == 0 {
-		log.Println("missing client hello when creating tls client")
-		return nil, errors.New("missing client hello")
+	if !keyLogSet {
+		keyLog = sslKeyLogFile()
+	}
+	if err := verification.validate(); err != nil {
+		return nil, err
+	}
+	if err := h3.checkAltSvcCache(altSvc); err != nil {
+		return nil, err
 	}
 
-	// handle tls client with proxy
-	clientHello := optParams[0].(tlsUtls.ClientHelloID)
-	var http2Headers map[http2.SettingID]uint32
-	if len(optParams) == 1 {
-		http2Headers = nil
-	} else {
-		http2Headers = optParams[1].(map[http2.SettingID]uint32)
+	observers := newCookieObservers()
+	tracker := newCookieTracker(observers)
+
+	c := &Client{
+		useTLS:           useTLS,
+		timeout:          timeout,
+		clientHello:      clientHello,
+		clientHelloSpec:  clientHelloSpec,
+		http2Headers:     http2Headers,
+		http2Priority:    http2Priority,
+		http2Fingerprint: http2Fingerprint,
+		http3:            h3,
+		randomization:    randomization,
+		sessionCache:     sessionCache,
+		altSvc:           altSvc,
+		verification:     verification,
+		clientCerts:      clientCerts,
+		keyLog:           keyLog,
+		proxy:            proxyUrl,
+		jar:              newCookieJar(tracker),
+		cookieTracker:    tracker,
+		cookieObservers:  observers,
+		interceptors:     newInterceptors(),
+	}
+
+	b, err := newBackend(c, proxyUrl)
+	if err != nil {
+		return nil, err
 	}
+	c.backend = newSharedBackend(b)
 
-	if len(proxyUrl) > 0 {
-		_, err := url.Parse(proxyUrl)
-		if err != nil {
-			return nil, err
-		}
+	return c, nil
+}
 
-		dialer, err := newConnectDialer(proxyUrl)
-		if err != nil {
-			return nil, err
-		}
+// SessionCache returns the tls session cache of the client, nil if it does not resume sessions
+func (c *Client) SessionCache() *SessionCache {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.sessionCache
+}
 
-		return &Client{
-			tlsClient: &tlsHttp.Client{
-				Jar:       jar,
-				Transport: newRoundTripper(clientHello, http2Headers, dialer),
-				Timeout:   timeout,
-			},
-			useTLS:       true,
-			clientHello:  clientHello,
-			http2Headers: http2Headers,
-			proxy:        proxyUrl,
-		}, nil
+// Close detaches the cookie observers of the client from the jar, which it may share with its clones, and closes its
+// idle connections unless a clone shares its transport. The client must not be used after it is closed
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
 	}
+	c.closed = true
+	c.cookieTracker.detach(c.cookieObservers)
+	c.backend.release()
+}
 
-	// handle tls client with no proxy
-	return &Client{
-		tlsClient: &tlsHttp.Client{
-			Transport: newRoundTripper(clientHello, http2Headers, proxy.Direct),
-			Timeout:   timeout,
-			Jar:       jar,
-		},
-		useTLS:       true,
-		http2Headers: http2Headers,
-		proxy:        proxyUrl,
-	}, nil
+// replaceBackend replaces the backend of the client, the idle connections of the old one are closed unless a clone
+// shares it. It must be called with c.mu locked
+func (c *Client) replaceBackend(b backend) {
+	old := c.backend
+	c.backend = newSharedBackend(b)
+	old.release()
+}
+
+// SetTLSVerification changes how the client verifies certificates, idle connections of the client are closed
+func (c *Client) SetTLSVerification(v TLSVerification) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old := c.verification
+	c.verification = v
+	b, err := newBackend(c, c.proxy)
+	if err != nil {
+		c.verification = old
+		return err
+	}
+	c.replaceBackend(b)
 
+	return nil
 }
 
-// SetMasterHeaderOrder sets header order for all requests, tls only
+// SetMasterHeaderOrder sets header order for all requests
 func (c *Client) SetMasterHeaderOrder(order []string) {
-	if c.useTLS {
-		c.MasterHeaderOrder = order
-	}
+	c.MasterHeaderOrder = order
 }
 
 func (c *Client) NewRequest() *Request {
-	if c.useTLS {
-		return &Request{
-			Context: c.Context,
-			useTLS:  true,
-			TLSRequest: TLSRequest{
-				client: c,
-				header: make(tlsHttp.Header),
-			},
-		}
-	}
-
 	return &Request{
+		client:  c,
 		Context: c.Context,
-		useTLS:  false,
-		HTTPRequest: HTTPRequest{
-			client: c,
-			header: make(http.Header),
-		},
+		header:  make(http.Header),
 	}
 }
 
@@ -145,76 +233,23 @@ func (c *Client) SetContext(ctx context.Context) {
 
 func (c *Client) GetCookies(cookieUrl string) []*http.Cookie {
 	u, _ := url.Parse(cookieUrl)
-	if c.useTLS {
-		var cookies []*http.Cookie
-		for _, i := range c.tlsClient.Jar.Cookies(u) {
-			cookies = append(cookies, &http.Cookie{
-				Name:       i.Name,
-				Value:      i.Value,
-				Path:       i.Path,
-				Domain:     i.Domain,
-				Expires:    i.Expires,
-				RawExpires: i.RawExpires,
-				MaxAge:     i.MaxAge,
-				Secure:     i.Secure,
-				HttpOnly:   i.HttpOnly,
-				SameSite:   0,
-				Raw:        i.Raw,
-				Unparsed:   i.Unparsed,
-			})
-		}
-
-		return cookies
-	}
-
-	return c.httpClient.Jar.Cookies(u)
-
+	return c.jar.Cookies(u)
 }
 
 func (c *Client) GetCookiesMap(cookieUrl string) map[string]string {
 	u, _ := url.Parse(cookieUrl)
 
 	cookieMap := make(map[string]string)
-	if c.useTLS {
-		for _, v := range c.tlsClient.Jar.Cookies(u) {
-			cookieMap[v.Name] = v.Value
-		}
-		return cookieMap
-	}
-
-	for _, v := range c.httpClient.Jar.Cookies(u) {
+	for _, v := range c.jar.Cookies(u) {
 		cookieMap[v.Name] = v.Value
 	}
 	return cookieMap
-
 }
 
 func (c *Client) GetCookieVal(cookieUrl string, cookieName string) (*http.Cookie, error) {
 	u, _ := url.Parse(cookieUrl)
 
-	if c.useTLS {
-		for _, v := range c.tlsClient.Jar.Cookies(u) {
-			if v.Name == cookieName {
-				return &http.Cookie{
-					Name:       v.Name,
-					Value:      v.Value,
-					Path:       v.Path,
-					Domain:     v.Domain,
-					Expires:    v.Expires,
-					RawExpires: v.RawExpires,
-					MaxAge:     v.MaxAge,
-					Secure:     v.Secure,
-					HttpOnly:   v.HttpOnly,
-					SameSite:   0,
-					Raw:        v.Raw,
-					Unparsed:   v.Unparsed,
-				}, nil
-			}
-		}
-		return nil, errors.New("not found")
-	}
-
-	for _, v := range c.httpClient.Jar.Cookies(u) {
+	for _, v := range c.jar.Cookies(u) {
 		if v.Name == cookieName {
 			return v, nil
 		}
@@ -223,37 +258,16 @@ func (c *Client) GetCookieVal(cookieUrl string, cookieName string) (*http.Cookie
 }
 
 func (c *Client) UpdateProxy(p string) bool {
-	if c.useTLS {
-		if len(p) > 0 {
-			dialer, err := newConnectDialer(p)
-			if err != nil {
-				return false
-			}
-
-			c.tlsClient.Transport = newRoundTripper(c.clientHello, c.http2Headers, dialer)
-			c.proxy = p
-
-			return true
-		}
-
-		c.tlsClient.Transport = newRoundTripper(c.clientHello, c.http2Headers, proxy.Direct)
-		c.proxy = p
-
-		return true
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	transport := &http.Transport{
-		ForceAttemptHTTP2: true,
-		TLSClientConfig:   noTlsConfig,
-	}
-
-	if len(p) > 0 {
-		proxyUrl, _ := url.Parse(p)
-		transport.Proxy = http.ProxyURL(proxyUrl)
+	b, err := newBackend(c, p)
+	if err != nil {
+		return false
 	}
 
+	c.replaceBackend(b)
 	c.proxy = p
-	c.httpClient.Transport = transport
 
 	return true
 }
@@ -265,19 +279,6 @@ func (c *Client) SetCookieValue(cookieUrl string, cookieName string, value strin
 	if len(path) > 0 {
 		_path = path[0]
 	}
-	if c.useTLS {
-		var cookies []*tlsHttp.Cookie
-		newCookie := &tlsHttp.Cookie{
-			Name:   cookieName,
-			Value:  value,
-			Domain: strings.Replace(u.Host, "www", "", -1),
-			Path:   _path,
-		}
-
-		cookies = append(cookies, newCookie)
-		c.tlsClient.Jar.SetCookies(u, cookies)
-		return
-	}
 
 	var cookies []*http.Cookie
 	newCookie := &http.Cookie{
@@ -287,7 +288,7 @@ func (c *Client) SetCookieValue(cookieUrl string, cookieName string, value strin
 		Path:   _path,
 	}
 	cookies = append(cookies, newCookie)
-	c.httpClient.Jar.SetCookies(u, cookies)
+	c.jar.SetCookies(u, cookies)
 }
 
 func (c *Client) SetCustomCookieValue(cookieData map[string]interface{}) {
@@ -298,30 +299,6 @@ func (c *Client) SetCustomCookieValue(cookieData map[string]interface{}) {
 		domain = newDomain.(string)
 	}
 
-	if c.useTLS {
-		var cookies []*tlsHttp.Cookie
-		newCookie := &tlsHttp.Cookie{
-			Name:   cookieData["name"].(string),
-			Value:  cookieData["value"].(string),
-			Domain: domain,
-			Path:   "/",
-		}
-
-		if cookieData["expires"] != nil {
-			newCookie.Expires = cookieData["expires"].(time.Time).UTC()
-		}
-		if cookieData["path"] != nil {
-			newCookie.Path = cookieData["path"].(string)
-		}
-		if cookieData["maxAge"] != nil {
-			newCookie.MaxAge = cookieData["maxAge"].(int)
-		}
-
-		cookies = append(cookies, newCookie)
-		c.tlsClient.Jar.SetCookies(u, cookies)
-		return
-	}
-
 	var cookies []*http.Cookie
 	newCookie := &http.Cookie{
 		Name:   cookieData["name"].(string),
@@ -341,146 +318,43 @@ func (c *Client) SetCustomCookieValue(cookieData map[string]interface{}) {
 	}
 
 	cookies = append(cookies, newCookie)
-	c.httpClient.Jar.SetCookies(u, cookies)
+	c.jar.SetCookies(u, cookies)
 }
 
 func (c *Client) ResetCookies() {
-	if c.useTLS {
-		jar, _ := tlsJar.New(nil)
-		c.tlsClient.Jar = jar
-		return
-	}
-
-	jar, _ := cookiejar.New(nil)
-	c.httpClient.Jar = jar
+	c.jar.reset()
 }
 
+// RemoveCookie removes the cookies with the specified name that are sent to siteUrl
 func (c *Client) RemoveCookie(siteUrl string, cookieName string) {
 	u, _ := url.Parse(siteUrl)
-	if c.useTLS {
-		cookies := c.tlsClient.Jar.Cookies(u)
-		for _, cookie := range cookies {
-			if strings.ToLower(cookie.Name) == strings.ToLower(cookieName) && cookie.MaxAge != -1 {
-				cookie.MaxAge = -1
-				cookie.Expires = time.Now().Add(time.Hour * -100)
-			}
-		}
-		c.tlsClient.Jar.SetCookies(u, cookies)
-		return
-	}
-
-	cookies := c.httpClient.Jar.Cookies(u)
-	for _, cookie := range cookies {
-		if strings.ToLower(cookie.Name) == strings.ToLower(cookieName) && cookie.MaxAge != -1 {
-			cookie.MaxAge = -1
-			cookie.Expires = time.Now().Add(time.Hour * -100)
-		}
-	}
-	c.httpClient.Jar.SetCookies(u, cookies)
+	c.cookieTracker.removeCookies(c.jar, u, cookieName)
 }
 
 func (c *Client) SetHeaderSettings() {
 
 }
 
-// Do will send the specified request
+// Do sends tlsRequest with tls clients and httpRequest with non tls clients, useTLS has to match the client
 func (c *Client) Do(tlsRequest *tlsHttp.Request, httpRequest *http.Request, useTLS bool) (*Response, error) {
-	if useTLS {
-		resp, err := c.tlsClient.Do(tlsRequest)
-		if err != nil {
-			return nil, err
-		}
-
-		defer resp.Body.Close()
-
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-
-		var headers = Header{}
-		for k, v := range resp.Header {
-			headers[k] = v
-		}
-
-		var cookies []*http.Cookie
-		for _, v := range resp.Cookies() {
-			cookies = append(cookies, &http.Cookie{
-				Name:       v.Name,
-				Value:      v.Value,
-				Path:       v.Path,
-				Domain:     v.Domain,
-				Expires:    v.Expires,
-				RawExpires: v.RawExpires,
-				MaxAge:     v.MaxAge,
-				Secure:     v.Secure,
-				HttpOnly:   v.HttpOnly,
-				SameSite:   http.SameSite(v.SameSite),
-				Raw:        v.Raw,
-				Unparsed:   v.Unparsed,
-			})
-		}
-
-		var requestCookies []*http.Cookie
-		for _, v := range tlsRequest.Cookies() {
-			cookies = append(cookies, &http.Cookie{
-				Name:       v.Name,
-				Value:      v.Value,
-				Path:       v.Path,
-				Domain:     v.Domain,
-				Expires:    v.Expires,
-				RawExpires: v.RawExpires,
-				MaxAge:     v.MaxAge,
-				Secure:     v.Secure,
-				HttpOnly:   v.HttpOnly,
-				SameSite:   http.SameSite(v.SameSite),
-				Raw:        v.Raw,
-				Unparsed:   v.Unparsed,
-			})
-		}
-
-		response := &Response{
-			request:        transformRequest(tlsRequest),
-			requestCookies: requestCookies,
-			cookies:        cookies,
-			headers:        headers,
-			body:           body,
-			status:         resp.Status,
-			reqUrl:         resp.Request.URL,
-			statusCode:     resp.StatusCode,
+	if useTLS != c.useTLS {
+		if c.useTLS {
+			return nil, errors.New("tls clients can not send net/http requests, useTLS must be set")
 		}
-		return response, nil
+		return nil, errors.New("non tls clients can not send fhttp requests, useTLS must not be set")
 	}
 
-	resp, err := c.httpClient.Do(httpRequest)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var headers = Header{}
-	for k, v := range resp.Header {
-		headers[k] = v
+	if useTLS {
+		if tlsRequest == nil {
+			return nil, errors.New("missing tls request")
+		}
+		return c.send(prepareTLSRequest(tlsRequest))
 	}
 
-	response := &Response{
-		requestCookies: httpRequest.Cookies(),
-		request:        httpRequest,
-		headers:        headers,
-		cookies:        resp.Cookies(),
-		body:           body,
-		status:         resp.Status,
-		reqUrl:         resp.Request.URL,
-		statusCode:     resp.StatusCode,
+	if httpRequest == nil {
+		return nil, errors.New("missing http request")
 	}
-
-	return response, nil
+	return c.send(prepareHTTPRequest(httpRequest))
 }
 
 func transformResponse(r *tlsHttp.Response) *http.Response {
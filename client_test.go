@@ -0,0 +1,72 @@
+package cclient_v2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+	tlsHttp "github.com/useflyent/fhttp"
+)
+
+func TestDoUseTLS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient("", 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	resp, err := c.Do(nil, httpReq, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.BodyAsString(); got != http.MethodGet {
+		t.Errorf("body: got %q", got)
+	}
+
+	tlsReq, _ := tlsHttp.NewRequest(http.MethodGet, srv.URL, nil)
+	if _, err = c.Do(tlsReq, nil, true); err == nil {
+		t.Error("non tls client sent an fhttp request")
+	}
+
+	tc, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tc.Do(nil, httpReq, false); err == nil {
+		t.Error("tls client sent a net/http request")
+	}
+	if _, err = tc.Do(nil, nil, true); err == nil {
+		t.Error("tls client sent a missing request")
+	}
+}
+
+func TestNewClientOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		useTLS bool
+		params []interface{}
+		err    bool
+	}{
+		{"tls", true, []interface{}{tlsUtls.HelloChrome_102, HTTP2Priority{}}, false},
+		{"tls without client hello", true, nil, true},
+		{"tls with invalid parameter", true, []interface{}{tlsUtls.HelloChrome_102, "chrome"}, true},
+		{"non tls", false, []interface{}{TLSVerification{}}, false},
+		{"non tls with client hello", false, []interface{}{tlsUtls.HelloChrome_102}, true},
+		{"non tls with http2 priority", false, []interface{}{HTTP2Priority{}}, true},
+		{"non tls with session cache", false, []interface{}{NewSessionCache(1)}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewClient("", 5*time.Second, test.useTLS, test.params...)
+			if (err != nil) != test.err {
+				t.Errorf("got error %v, want error %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package cclient_v2
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	tlsUtls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// ClientCertificates selects the certificate a tls client presents when a server asks for one,
+// it is passed to NewClient as optional parameter.
+// The first certificate the server accepts is presented, no certificate is presented if it accepts none
+type ClientCertificates struct {
+	// Certificates are presented to hosts without certificates in Hosts
+	Certificates []tls.Certificate
+	// Hosts maps hosts to the certificates presented to them, a host starting with "*." matches the subdomains of the
+	// rest of the host. Certificates of the host itself are preferred over those of wildcards
+	Hosts map[string][]tls.Certificate
+	// GetClientCertificate is called first when a server asks for a certificate, Certificates and Hosts are used if
+	// it returns no certificate
+	GetClientCertificate func(host string, info *tls.CertificateRequestInfo) (*tls.Certificate, error)
+}
+
+// LoadClientCertificate loads a pem encoded certificate chain and its private key, both can be in the same file
+func LoadClientCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// LoadPKCS12 loads a certificate chain and its private key from a pkcs12 file
+func LoadPKCS12(path, password string) (tls.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return ParsePKCS12(data, password)
+}
+
+// ParsePKCS12 parses a certificate chain and its private key from pkcs12 data.
+// Only the legacy pkcs12 encryption is supported, files created with openssl 3 need to be exported with -legacy
+func ParsePKCS12(data []byte, password string) (tls.Certificate, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	var key crypto.PrivateKey
+	var certificates []*x509.Certificate
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return tls.Certificate{}, err
+			}
+			certificates = append(certificates, certificate)
+		case "PRIVATE KEY":
+			if key, err = parsePrivateKey(block); err != nil {
+				return tls.Certificate{}, err
+			}
+		}
+	}
+	if key == nil {
+		return tls.Certificate{}, errors.New("pkcs12 data has no private key")
+	}
+
+	// the leaf is the certificate of the key, the others are the chain in the order they were stored
+	var chain tls.Certificate
+	for i, certificate := range certificates {
+		if matchesKey(certificate, key) {
+			chain.Leaf = certificate
+			chain.Certificate = append(chain.Certificate, certificate.Raw)
+			certificates = append(certificates[:i:i], certificates[i+1:]...)
+			break
+		}
+	}
+	if chain.Leaf == nil {
+		return tls.Certificate{}, errors.New("pkcs12 data has no certificate for its private key")
+	}
+	for _, certificate := range certificates {
+		chain.Certificate = append(chain.Certificate, certificate.Raw)
+	}
+	chain.PrivateKey = key
+	return chain, nil
+}
+
+// parsePrivateKey parses a private key of pkcs12 data, it is pkcs1 or sec1 encoded despite its pem type
+func parsePrivateKey(block *pem.Block) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("pkcs12 data has an unsupported private key")
+	}
+	return key, nil
+}
+
+// matchesKey reports whether the public key of the certificate belongs to the private key
+func matchesKey(certificate *x509.Certificate, key crypto.PrivateKey) bool {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return false
+	}
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && public.Equal(certificate.PublicKey)
+}
+
+// validate checks that the certificates have private keys
+func (c ClientCertificates) validate() error {
+	check := func(certificates []tls.Certificate) error {
+		for _, certificate := range certificates {
+			if len(certificate.Certificate) == 0 || certificate.PrivateKey == nil {
+				return errors.New("client certificate without certificate or private key")
+			}
+		}
+		return nil
+	}
+
+	if err := check(c.Certificates); err != nil {
+		return err
+	}
+	for host, certificates := range c.Hosts {
+		if err := check(certificates); err != nil {
+			return fmt.Errorf("%w of host %s", err, host)
+		}
+	}
+	return nil
+}
+
+// empty reports whether no certificates are set
+func (c ClientCertificates) empty() bool {
+	return len(c.Certificates) == 0 && len(c.Hosts) == 0 && c.GetClientCertificate == nil
+}
+
+// certificates returns the certificates presented to host
+func (c ClientCertificates) certificates(host string) []tls.Certificate {
+	var exact, wildcard []tls.Certificate
+	for pattern, certificates := range c.Hosts {
+		switch {
+		case matchesHost(pattern, host) && pattern[0] != '*':
+			exact = append(exact, certificates...)
+		case matchesHost(pattern, host):
+			wildcard = append(wildcard, certificates...)
+		}
+	}
+
+	if certificates := append(exact, wildcard...); len(certificates) > 0 {
+		return certificates
+	}
+	return c.Certificates
+}
+
+// selectCertificate returns the utls callback selecting the certificate presented to host
+func (c ClientCertificates) selectCertificate(host string) func(*tlsUtls.CertificateRequestInfo) (*tlsUtls.Certificate, error) {
+	return func(info *tlsUtls.CertificateRequestInfo) (*tlsUtls.Certificate, error) {
+		if c.GetClientCertificate != nil {
+			request := &tls.CertificateRequestInfo{AcceptableCAs: info.AcceptableCAs, Version: info.Version}
+			for _, scheme := range info.SignatureSchemes {
+				request.SignatureSchemes = append(request.SignatureSchemes, tls.SignatureScheme(scheme))
+			}
+
+			certificate, err := c.GetClientCertificate(host, request)
+			if err != nil {
+				return nil, err
+			}
+			if certificate != nil {
+				return utlsCertificate(*certificate), nil
+			}
+		}
+
+		for _, certificate := range c.certificates(host) {
+			u := utlsCertificate(certificate)
+			if info.SupportsCertificate(u) == nil {
+				return u, nil
+			}
+		}
+		return &tlsUtls.Certificate{}, nil
+	}
+}
+
+// getTLSClientCertificate returns the crypto/tls callback selecting the certificate presented to host
+func (c ClientCertificates) getTLSClientCertificate(host string) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if c.GetClientCertificate != nil {
+			certificate, err := c.GetClientCertificate(host, info)
+			if err != nil || certificate != nil {
+				return certificate, err
+			}
+		}
+
+		for _, certificate := range c.certificates(host) {
+			if info.SupportsCertificate(&certificate) == nil {
+				return &certificate, nil
+			}
+		}
+		return &tls.Certificate{}, nil
+	}
+}
+
+// utlsCertificate converts a crypto/tls certificate to a utls certificate
+func utlsCertificate(c tls.Certificate) *tlsUtls.Certificate {
+	u := &tlsUtls.Certificate{
+		Certificate:                 c.Certificate,
+		PrivateKey:                  c.PrivateKey,
+		OCSPStaple:                  c.OCSPStaple,
+		SignedCertificateTimestamps: c.SignedCertificateTimestamps,
+		Leaf:                        c.Leaf,
+	}
+	for _, scheme := range c.SupportedSignatureAlgorithms {
+		u.SupportedSignatureAlgorithms = append(u.SupportedSignatureAlgorithms, tlsUtls.SignatureScheme(scheme))
+	}
+	return u
+}
@@ -0,0 +1,78 @@
+package cclient_v2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+func newClientCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertificates(t *testing.T) {
+	certificate := newClientCertificate(t)
+	withoutExtendedMasterSecret, err := ParseJA3("771,4865-4866-4867-49195-49199-49196-49200,0-10-11-13-16-43-45-51,29-23-24,0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		maxVersion uint16
+		hello      interface{}
+	}{
+		{"tls 1.3", tls.VersionTLS13, tlsUtls.HelloChrome_102},
+		{"tls 1.2 without extended master secret", tls.VersionTLS12, withoutExtendedMasterSecret},
+		{"tls 1.2 with extended master secret", tls.VersionTLS12, tlsUtls.HelloChrome_102},
+		{"tls 1.2 with the firefox preset", tls.VersionTLS12, tlsUtls.HelloFirefox_105},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fingerprinttest.NewUnstartedServer()
+			srv.TLS.ClientAuth = tls.RequireAnyClientCert
+			srv.TLS.MaxVersion = test.maxVersion
+			srv.Start()
+			defer srv.Close()
+
+			c, err := NewClient("", 5*time.Second, true, test.hello, TLSVerification{RootCAs: srv.CertPool()},
+				ClientCertificates{Certificates: []tls.Certificate{certificate}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.NewRequest().SetURL(srv.URL).Do()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode() != http.StatusOK {
+				t.Errorf("status: got %d", resp.StatusCode())
+			}
+		})
+	}
+}
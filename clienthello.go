@@ -0,0 +1,489 @@
+package cclient_v2
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	tlsUtls "github.com/refraction-networking/utls"
+)
+
+// tls extension ids of the extensions a ClientHelloSpec can describe
+const (
+	extensionServerName              uint16 = 0
+	extensionStatusRequest           uint16 = 5
+	extensionSupportedCurves         uint16 = 10
+	extensionSupportedPoints         uint16 = 11
+	extensionSignatureAlgorithms     uint16 = 13
+	extensionALPN                    uint16 = 16
+	extensionStatusRequestV2         uint16 = 17
+	extensionSCT                     uint16 = 18
+	extensionPadding                 uint16 = 21
+	extensionEncryptThenMac          uint16 = 22
+	extensionExtendedMasterSecret    uint16 = 23
+	extensionTokenBinding            uint16 = 24
+	extensionCompressCertificate     uint16 = 27
+	extensionRecordSizeLimit         uint16 = 28
+	extensionDelegatedCredentials    uint16 = 34
+	extensionSessionTicket           uint16 = 35
+	extensionPreSharedKey            uint16 = 41
+	extensionEarlyData               uint16 = 42
+	extensionSupportedVersions       uint16 = 43
+	extensionCookie                  uint16 = 44
+	extensionPSKModes                uint16 = 45
+	extensionCertificateAuthorities  uint16 = 47
+	extensionPostHandshakeAuth       uint16 = 49
+	extensionSignatureAlgorithmsCert uint16 = 50
+	extensionKeyShare                uint16 = 51
+	extensionNextProtoNeg            uint16 = 13172
+	extensionApplicationSettings     uint16 = 17513
+	extensionChannelIDOld            uint16 = 30031
+	extensionChannelID               uint16 = 30032
+	extensionEncryptedClientHello    uint16 = 65037
+	extensionRenegotiationInfo       uint16 = 65281
+)
+
+// defaultSignatureAlgorithms are the signature algorithms of extensions that do not specify them
+var defaultSignatureAlgorithms = []uint16{
+	uint16(tlsUtls.ECDSAWithP256AndSHA256),
+	uint16(tlsUtls.PSSWithSHA256),
+	uint16(tlsUtls.PKCS1WithSHA256),
+	uint16(tlsUtls.ECDSAWithP384AndSHA384),
+	uint16(tlsUtls.PSSWithSHA384),
+	uint16(tlsUtls.PKCS1WithSHA384),
+	uint16(tlsUtls.PSSWithSHA512),
+	uint16(tlsUtls.PKCS1WithSHA512),
+}
+
+// defaultDelegatedCredentialAlgorithms are the signature algorithms of a delegated credentials extension that does not specify them
+var defaultDelegatedCredentialAlgorithms = []uint16{
+	uint16(tlsUtls.ECDSAWithP256AndSHA256),
+	uint16(tlsUtls.ECDSAWithP384AndSHA384),
+	uint16(tlsUtls.ECDSAWithP521AndSHA512),
+	uint16(tlsUtls.ECDSAWithSHA1),
+}
+
+// ClientHelloSpec describes a client hello that has no utls preset, it can be passed to NewClient instead of a client hello id.
+// Values of cipher suites, curves, versions and key shares that are GREASE values are GREASE slots, they are filled with
+// a random GREASE value for every connection. A pre_shared_key extension is a slot for the pre shared key of a resumed
+// session, it is only sent when a session is resumed
+type ClientHelloSpec struct {
+	// TLSVersMin and TLSVersMax are the tls versions, they are taken from the supported versions extension if zero
+	TLSVersMin         uint16                 `json:"tls_version_min,omitempty"`
+	TLSVersMax         uint16                 `json:"tls_version_max,omitempty"`
+	CipherSuites       []uint16               `json:"cipher_suites"`
+	CompressionMethods byteList               `json:"compression_methods,omitempty"`
+	Extensions         []ClientHelloExtension `json:"extensions"`
+}
+
+// ClientHelloExtension describes an extension of a client hello by its id and contents.
+// Contents that are not set get the value browsers use, an extension utls can not build the contents of is sent with Data
+type ClientHelloExtension struct {
+	ID uint16 `json:"id"`
+	// Curves of the supported groups extension
+	Curves []uint16 `json:"curves,omitempty"`
+	// PointFormats of the ec point formats extension
+	PointFormats byteList `json:"point_formats,omitempty"`
+	// SignatureAlgorithms of the signature algorithms, signature algorithms cert and delegated credentials extension
+	SignatureAlgorithms []uint16 `json:"signature_algorithms,omitempty"`
+	// Protocols of the alpn, application settings and npn extension
+	Protocols []string `json:"protocols,omitempty"`
+	// KeyShares of the key share extension, shares without data are generated for every connection
+	KeyShares []ClientHelloKeyShare `json:"key_shares,omitempty"`
+	// Versions of the supported versions extension
+	Versions []uint16 `json:"versions,omitempty"`
+	// PSKModes of the psk key exchange modes extension
+	PSKModes byteList `json:"psk_modes,omitempty"`
+	// CertCompressionAlgorithms of the compress certificate extension
+	CertCompressionAlgorithms []uint16 `json:"cert_compression_algorithms,omitempty"`
+	// RecordSizeLimit of the record size limit extension
+	RecordSizeLimit uint16 `json:"record_size_limit,omitempty"`
+	// Renegotiation of the renegotiation info extension
+	Renegotiation *tlsUtls.RenegotiationSupport `json:"renegotiation,omitempty"`
+	// Data is the hex encoded body of GREASE and token binding extensions and of extensions without content fields
+	Data string `json:"data,omitempty"`
+}
+
+// ClientHelloKeyShare is a key share of the key share extension, Data is hex encoded
+type ClientHelloKeyShare struct {
+	Group uint16 `json:"group"`
+	Data  string `json:"data,omitempty"`
+}
+
+// UnsupportedExtensionError is returned for an extension utls can not build
+type UnsupportedExtensionError struct {
+	ID     uint16
+	Reason string
+}
+
+func (e *UnsupportedExtensionError) Error() string {
+	return fmt.Sprintf("unsupported tls extension %d: %s", e.ID, e.Reason)
+}
+
+// byteList is a list of bytes that is a json array instead of a base64 string
+type byteList []uint8
+
+func (l byteList) MarshalJSON() ([]byte, error) {
+	values := make([]uint16, len(l))
+	for i, v := range l {
+		values[i] = uint16(v)
+	}
+	return json.Marshal(values)
+}
+
+// ParseJA3 parses a ja3 string into a client hello spec.
+// The contents of the extensions are the ones browsers use, with the curves and point formats of the ja3 string
+func ParseJA3(ja3 string) (*ClientHelloSpec, error) {
+	fields := strings.Split(ja3, ",")
+	if len(fields) != 5 {
+		return nil, errors.New("invalid ja3 string, expected 5 fields")
+	}
+
+	version, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ja3 version: %w", err)
+	}
+
+	ciphers, err := parseJA3List(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ja3 cipher suites: %w", err)
+	}
+	extensions, err := parseJA3List(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ja3 extensions: %w", err)
+	}
+	curves, err := parseJA3List(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ja3 curves: %w", err)
+	}
+	points, err := parseJA3List(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ja3 point formats: %w", err)
+	}
+
+	spec := &ClientHelloSpec{
+		CipherSuites:       ciphers,
+		CompressionMethods: byteList{0},
+	}
+
+	grease := false
+	for _, c := range ciphers {
+		grease = grease || isGREASE(c)
+	}
+
+	hasVersions := false
+	for _, id := range extensions {
+		ext := ClientHelloExtension{ID: id}
+
+		switch id {
+		case extensionSupportedCurves:
+			ext.Curves = curves
+		case extensionSupportedPoints:
+			for _, p := range points {
+				if p > 0xff {
+					return nil, fmt.Errorf("invalid ja3 point format %d", p)
+				}
+				ext.PointFormats = append(ext.PointFormats, uint8(p))
+			}
+		case extensionKeyShare:
+			ext.KeyShares, err = defaultKeyShares(curves)
+			if err != nil {
+				return nil, err
+			}
+		case extensionSupportedVersions:
+			hasVersions = true
+			if grease {
+				ext.Versions = append(ext.Versions, tlsUtls.GREASE_PLACEHOLDER)
+			}
+			ext.Versions = append(ext.Versions, tlsUtls.VersionTLS13, tlsUtls.VersionTLS12)
+		}
+
+		spec.Extensions = append(spec.Extensions, ext)
+	}
+
+	if !hasVersions {
+		spec.TLSVersMin = tlsUtls.VersionTLS10
+		spec.TLSVersMax = uint16(version)
+	}
+
+	if _, err = spec.Spec(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// ParseClientHelloSpec parses the json description of a client hello spec
+func ParseClientHelloSpec(data []byte) (*ClientHelloSpec, error) {
+	var spec ClientHelloSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+
+	if _, err := spec.Spec(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// Spec builds the utls client hello spec to use with utls.HelloCustom.
+// Every call returns a new spec, utls extensions keep connection state and can not be shared between connections
+func (s *ClientHelloSpec) Spec() (*tlsUtls.ClientHelloSpec, error) {
+	spec := &tlsUtls.ClientHelloSpec{
+		TLSVersMin:         s.TLSVersMin,
+		TLSVersMax:         s.TLSVersMax,
+		CompressionMethods: append([]uint8(nil), s.CompressionMethods...),
+	}
+
+	for _, c := range s.CipherSuites {
+		spec.CipherSuites = append(spec.CipherSuites, greaseSlot(c))
+	}
+
+	greaseExtensions := 0
+	for i, e := range s.Extensions {
+		if isGREASE(e.ID) {
+			greaseExtensions++
+			if greaseExtensions > 2 {
+				return nil, &UnsupportedExtensionError{ID: e.ID, Reason: "at most 2 GREASE extensions are supported"}
+			}
+		}
+
+		if e.ID == extensionPreSharedKey && i != len(s.Extensions)-1 {
+			return nil, &UnsupportedExtensionError{ID: e.ID, Reason: "the pre shared key must be the last extension"}
+		}
+
+		ext, err := e.extension()
+		if err != nil {
+			return nil, err
+		}
+		spec.Extensions = append(spec.Extensions, ext)
+	}
+
+	return spec, nil
+}
+
+// extension builds the utls extension described by e
+func (e ClientHelloExtension) extension() (tlsUtls.TLSExtension, error) {
+	data, err := hex.DecodeString(e.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data of tls extension %d: %w", e.ID, err)
+	}
+
+	if isGREASE(e.ID) {
+		return &tlsUtls.UtlsGREASEExtension{Body: data}, nil
+	}
+
+	switch e.ID {
+	case extensionServerName:
+		return &tlsUtls.SNIExtension{}, nil
+	case extensionStatusRequest:
+		return &tlsUtls.StatusRequestExtension{}, nil
+	case extensionSupportedCurves:
+		var curves []tlsUtls.CurveID
+		for _, c := range e.Curves {
+			curves = append(curves, tlsUtls.CurveID(greaseSlot(c)))
+		}
+		return &tlsUtls.SupportedCurvesExtension{Curves: curves}, nil
+	case extensionSupportedPoints:
+		points := []uint8(e.PointFormats)
+		if len(points) == 0 {
+			points = []uint8{0}
+		}
+		return &tlsUtls.SupportedPointsExtension{SupportedPoints: points}, nil
+	case extensionSignatureAlgorithms:
+		return &tlsUtls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: e.signatureAlgorithms(defaultSignatureAlgorithms)}, nil
+	case extensionALPN:
+		return &tlsUtls.ALPNExtension{AlpnProtocols: e.protocols([]string{"h2", "http/1.1"})}, nil
+	case extensionStatusRequestV2:
+		return &tlsUtls.StatusRequestV2Extension{}, nil
+	case extensionSCT:
+		return &tlsUtls.SCTExtension{}, nil
+	case extensionPadding:
+		return &tlsUtls.UtlsPaddingExtension{GetPaddingLen: tlsUtls.BoringPaddingStyle}, nil
+	case extensionExtendedMasterSecret:
+		return &tlsUtls.UtlsExtendedMasterSecretExtension{}, nil
+	case extensionTokenBinding:
+		if len(data) == 0 {
+			return &tlsUtls.FakeTokenBindingExtension{MajorVersion: 0, MinorVersion: 16, KeyParameters: []uint8{2}}, nil
+		}
+		if len(data) < 3 || int(data[2]) != len(data)-3 {
+			return nil, fmt.Errorf("invalid data of tls extension %d", e.ID)
+		}
+		return &tlsUtls.FakeTokenBindingExtension{MajorVersion: data[0], MinorVersion: data[1], KeyParameters: data[3:]}, nil
+	case extensionCompressCertificate:
+		algorithms := []tlsUtls.CertCompressionAlgo{tlsUtls.CertCompressionBrotli}
+		if len(e.CertCompressionAlgorithms) > 0 {
+			algorithms = nil
+			for _, a := range e.CertCompressionAlgorithms {
+				algorithms = append(algorithms, tlsUtls.CertCompressionAlgo(a))
+			}
+		}
+		return &tlsUtls.UtlsCompressCertExtension{Algorithms: algorithms}, nil
+	case extensionRecordSizeLimit:
+		limit := e.RecordSizeLimit
+		if limit == 0 {
+			limit = 0x4001
+		}
+		return &tlsUtls.FakeRecordSizeLimitExtension{Limit: limit}, nil
+	case extensionDelegatedCredentials:
+		return &tlsUtls.FakeDelegatedCredentialsExtension{SupportedSignatureAlgorithms: e.signatureAlgorithms(defaultDelegatedCredentialAlgorithms)}, nil
+	case extensionSessionTicket:
+		return &tlsUtls.SessionTicketExtension{}, nil
+	case extensionSupportedVersions:
+		versions := []uint16{tlsUtls.VersionTLS13, tlsUtls.VersionTLS12}
+		if len(e.Versions) > 0 {
+			versions = nil
+			for _, v := range e.Versions {
+				versions = append(versions, greaseSlot(v))
+			}
+		}
+		return &tlsUtls.SupportedVersionsExtension{Versions: versions}, nil
+	case extensionPSKModes:
+		modes := []uint8(e.PSKModes)
+		if len(modes) == 0 {
+			modes = []uint8{tlsUtls.PskModeDHE}
+		}
+		return &tlsUtls.PSKKeyExchangeModesExtension{Modes: modes}, nil
+	case extensionSignatureAlgorithmsCert:
+		return &tlsUtls.SignatureAlgorithmsCertExtension{SupportedSignatureAlgorithms: e.signatureAlgorithms(defaultSignatureAlgorithms)}, nil
+	case extensionKeyShare:
+		return e.keyShareExtension()
+	case extensionNextProtoNeg:
+		return &tlsUtls.NPNExtension{NextProtos: e.Protocols}, nil
+	case extensionApplicationSettings:
+		return &tlsUtls.ApplicationSettingsExtension{SupportedProtocols: e.protocols([]string{"h2"})}, nil
+	case extensionChannelIDOld:
+		return &tlsUtls.FakeChannelIDExtension{OldExtensionID: true}, nil
+	case extensionChannelID:
+		return &tlsUtls.FakeChannelIDExtension{}, nil
+	case extensionRenegotiationInfo:
+		renegotiation := tlsUtls.RenegotiateOnceAsClient
+		if e.Renegotiation != nil {
+			renegotiation = *e.Renegotiation
+		}
+		return &tlsUtls.RenegotiationInfoExtension{Renegotiation: renegotiation}, nil
+	case extensionEncryptThenMac, extensionPostHandshakeAuth:
+		return &tlsUtls.GenericExtension{Id: e.ID, Data: data}, nil
+	case extensionPreSharedKey:
+		// the slot of the pre shared key of a resumed session, it is left out without a session
+		return &tlsUtls.UtlsPreSharedKeyExtension{}, nil
+	case extensionEarlyData:
+		return nil, &UnsupportedExtensionError{ID: e.ID, Reason: "early data is not supported by utls"}
+	case extensionCookie:
+		return nil, &UnsupportedExtensionError{ID: e.ID, Reason: "cookies are only sent after a hello retry request"}
+	case extensionEncryptedClientHello:
+		return nil, &UnsupportedExtensionError{ID: e.ID, Reason: "encrypted client hello is not supported by utls"}
+	case extensionCertificateAuthorities:
+		if len(data) == 0 {
+			return nil, &UnsupportedExtensionError{ID: e.ID, Reason: "certificate authorities need data"}
+		}
+		return &tlsUtls.GenericExtension{Id: e.ID, Data: data}, nil
+	}
+
+	if len(data) == 0 {
+		return nil, &UnsupportedExtensionError{ID: e.ID, Reason: "unknown extension without data"}
+	}
+	return &tlsUtls.GenericExtension{Id: e.ID, Data: data}, nil
+}
+
+// keyShareExtension builds the key share extension, shares without data are generated by utls for every connection
+func (e ClientHelloExtension) keyShareExtension() (tlsUtls.TLSExtension, error) {
+	var shares []tlsUtls.KeyShare
+	for _, s := range e.KeyShares {
+		data, err := hex.DecodeString(s.Data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data of key share %d: %w", s.Group, err)
+		}
+
+		group := tlsUtls.CurveID(greaseSlot(s.Group))
+		if group != tlsUtls.GREASE_PLACEHOLDER && len(data) == 0 && !keyShareGroups[group] {
+			return nil, &UnsupportedExtensionError{ID: e.ID, Reason: fmt.Sprintf("utls can not generate key shares of group %d", s.Group)}
+		}
+		if group == tlsUtls.GREASE_PLACEHOLDER && len(data) == 0 {
+			data = []byte{0}
+		}
+
+		shares = append(shares, tlsUtls.KeyShare{Group: group, Data: data})
+	}
+
+	return &tlsUtls.KeyShareExtension{KeyShares: shares}, nil
+}
+
+func (e ClientHelloExtension) signatureAlgorithms(defaults []uint16) []tlsUtls.SignatureScheme {
+	algorithms := e.SignatureAlgorithms
+	if len(algorithms) == 0 {
+		algorithms = defaults
+	}
+
+	schemes := make([]tlsUtls.SignatureScheme, len(algorithms))
+	for i, a := range algorithms {
+		schemes[i] = tlsUtls.SignatureScheme(a)
+	}
+	return schemes
+}
+
+func (e ClientHelloExtension) protocols(defaults []string) []string {
+	if len(e.Protocols) == 0 {
+		return append([]string(nil), defaults...)
+	}
+	return append([]string(nil), e.Protocols...)
+}
+
+// keyShareGroups are the groups utls can generate key shares for
+var keyShareGroups = map[tlsUtls.CurveID]bool{
+	tlsUtls.X25519:    true,
+	tlsUtls.CurveP256: true,
+	tlsUtls.CurveP384: true,
+	tlsUtls.CurveP521: true,
+}
+
+// defaultKeyShares returns a GREASE share if the curves have a GREASE slot and a share for the first curve utls can generate
+func defaultKeyShares(curves []uint16) ([]ClientHelloKeyShare, error) {
+	var shares []ClientHelloKeyShare
+	for _, c := range curves {
+		if isGREASE(c) {
+			shares = append(shares, ClientHelloKeyShare{Group: tlsUtls.GREASE_PLACEHOLDER})
+			break
+		}
+	}
+
+	for _, c := range curves {
+		if keyShareGroups[tlsUtls.CurveID(c)] {
+			return append(shares, ClientHelloKeyShare{Group: c}), nil
+		}
+	}
+
+	return nil, &UnsupportedExtensionError{ID: extensionKeyShare, Reason: "none of the curves supports key shares"}
+}
+
+// parseJA3List parses a dash separated ja3 field
+func parseJA3List(field string) ([]uint16, error) {
+	if field == "" {
+		return nil, nil
+	}
+
+	var values []uint16
+	for _, v := range strings.Split(field, "-") {
+		n, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, uint16(n))
+	}
+	return values, nil
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// greaseSlot returns the GREASE placeholder for GREASE values, which utls replaces for every connection
+func greaseSlot(v uint16) uint16 {
+	if isGREASE(v) {
+		return tlsUtls.GREASE_PLACEHOLDER
+	}
+	return v
+}
@@ -0,0 +1,185 @@
+package cclient_v2
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	tlsUtls "github.com/refraction-networking/utls"
+)
+
+// chromeJA3 is the ja3 string of chrome 102
+const chromeJA3 = "771,2570-4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+	"2570-0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-2570-21,2570-29-23-24,0"
+
+// applySpec builds the client hello of spec like a connection of a client does
+func applySpec(t *testing.T, spec *ClientHelloSpec) *tlsUtls.UConn {
+	s, err := spec.Spec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	conn := tlsUtls.UClient(client, &tlsUtls.Config{ServerName: "example.com", OmitEmptyPsk: true}, tlsUtls.HelloCustom)
+	if err = conn.ApplyPreset(s); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestParseJA3(t *testing.T) {
+	tests := []struct {
+		name         string
+		ja3          string
+		extensions   []uint16
+		curves       []uint16
+		keyShares    []ClientHelloKeyShare
+		versions     []uint16
+		tlsVersMax   uint16
+		pointFormats byteList
+	}{
+		{
+			name:         "chrome",
+			ja3:          chromeJA3,
+			extensions:   []uint16{2570, 0, 23, 65281, 10, 11, 35, 16, 5, 13, 18, 51, 45, 43, 27, 17513, 2570, 21},
+			curves:       []uint16{2570, 29, 23, 24},
+			keyShares:    []ClientHelloKeyShare{{Group: tlsUtls.GREASE_PLACEHOLDER}, {Group: 29}},
+			versions:     []uint16{tlsUtls.GREASE_PLACEHOLDER, tlsUtls.VersionTLS13, tlsUtls.VersionTLS12},
+			pointFormats: byteList{0},
+		},
+		{
+			name:         "tls 1.2 without supported versions",
+			ja3:          "771,49195-49199,0-10-11-13,23-24,0-1",
+			extensions:   []uint16{0, 10, 11, 13},
+			curves:       []uint16{23, 24},
+			tlsVersMax:   tlsUtls.VersionTLS12,
+			pointFormats: byteList{0, 1},
+		},
+		{
+			name:       "key share of the first curve with shares",
+			ja3:        "772,4865,43-51,30-23,",
+			extensions: []uint16{43, 51},
+			keyShares:  []ClientHelloKeyShare{{Group: 23}},
+			versions:   []uint16{tlsUtls.VersionTLS13, tlsUtls.VersionTLS12},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec, err := ParseJA3(test.ja3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []uint16
+			for _, e := range spec.Extensions {
+				ids = append(ids, e.ID)
+				switch e.ID {
+				case extensionSupportedCurves:
+					if !reflect.DeepEqual(e.Curves, test.curves) {
+						t.Errorf("curves: got %v, want %v", e.Curves, test.curves)
+					}
+				case extensionSupportedPoints:
+					if !reflect.DeepEqual(e.PointFormats, test.pointFormats) {
+						t.Errorf("point formats: got %v, want %v", e.PointFormats, test.pointFormats)
+					}
+				case extensionKeyShare:
+					if !reflect.DeepEqual(e.KeyShares, test.keyShares) {
+						t.Errorf("key shares: got %v, want %v", e.KeyShares, test.keyShares)
+					}
+				case extensionSupportedVersions:
+					if !reflect.DeepEqual(e.Versions, test.versions) {
+						t.Errorf("versions: got %v, want %v", e.Versions, test.versions)
+					}
+				}
+			}
+			if !reflect.DeepEqual(ids, test.extensions) {
+				t.Errorf("extensions: got %v, want %v", ids, test.extensions)
+			}
+			if spec.TLSVersMax != test.tlsVersMax {
+				t.Errorf("max version: got %#x, want %#x", spec.TLSVersMax, test.tlsVersMax)
+			}
+
+			conn := applySpec(t, spec)
+			if got := len(conn.HandshakeState.Hello.CipherSuites); got != len(spec.CipherSuites) {
+				t.Errorf("cipher suites of the hello: got %d, want %d", got, len(spec.CipherSuites))
+			}
+		})
+	}
+}
+
+func TestParseJA3Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		ja3  string
+		err  string
+	}{
+		{"fields", "771,4865,0-10,29", "expected 5 fields"},
+		{"version", "tls,4865,0,29,0", "invalid ja3 version"},
+		{"cipher suites", "771,4865-x,0,29,0", "invalid ja3 cipher suites"},
+		{"extensions", "771,4865,0-65536,29,0", "invalid ja3 extensions"},
+		{"curves", "771,4865,0,29--23,0", "invalid ja3 curves"},
+		{"point formats", "771,4865,0,29,0-x", "invalid ja3 point formats"},
+		{"point format", "771,4865,11,29,256", "invalid ja3 point format 256"},
+		{"key share curves", "771,4865,51,30,0", "none of the curves supports key shares"},
+		{"early data", "771,4865,42,29,0", "early data is not supported"},
+		{"unknown extension", "771,4865,1234,29,0", "unknown extension without data"},
+		{"GREASE extensions", "771,4865,2570-6682-10794,29,0", "at most 2 GREASE extensions"},
+		{"pre shared key", "771,4865,41-0,29,0", "the pre shared key must be the last extension"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseJA3(test.ja3)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got %v, want %q", err, test.err)
+			}
+		})
+	}
+
+	var unsupported *UnsupportedExtensionError
+	if _, err := ParseJA3("771,4865,44,29,0"); !errors.As(err, &unsupported) || unsupported.ID != extensionCookie {
+		t.Errorf("got %v, want an unsupported extension error for the cookie extension", err)
+	}
+}
+
+func TestParseClientHelloSpec(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		err  string
+	}{
+		{"spec", `{"cipher_suites":[2570,4865,49195],"compression_methods":[0],"extensions":[
+			{"id":2570},{"id":0},{"id":10,"curves":[2570,29,23]},{"id":13,"signature_algorithms":[1027,2052]},
+			{"id":16,"protocols":["h2"]},{"id":51,"key_shares":[{"group":2570},{"group":29}]},{"id":45,"psk_modes":[1]},
+			{"id":43,"versions":[2570,772,771]},{"id":28,"record_size_limit":16385},{"id":65281,"renegotiation":1},
+			{"id":1234,"data":"0102"},{"id":21},{"id":41}]}`, ""},
+		{"tls 1.2", `{"tls_version_min":769,"tls_version_max":771,"cipher_suites":[49195],"extensions":[{"id":0},{"id":23}]}`, ""},
+		{"invalid json", `{"cipher_suites":"4865"}`, "cannot unmarshal"},
+		{"invalid data", `{"cipher_suites":[4865],"extensions":[{"id":1234,"data":"xy"}]}`, "invalid data of tls extension 1234"},
+		{"invalid key share", `{"cipher_suites":[4865],"extensions":[{"id":51,"key_shares":[{"group":30}]}]}`, "can not generate key shares of group 30"},
+		{"invalid token binding", `{"cipher_suites":[4865],"extensions":[{"id":24,"data":"000f05"}]}`, "invalid data of tls extension 24"},
+		{"certificate authorities", `{"cipher_suites":[4865],"extensions":[{"id":47}]}`, "certificate authorities need data"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec, err := ParseClientHelloSpec([]byte(test.json))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			applySpec(t, spec)
+		})
+	}
+}
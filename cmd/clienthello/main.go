@@ -0,0 +1,73 @@
+// Command clienthello builds a client hello spec from a captured client hello.
+//
+// The capture is read from the file argument or stdin and can be a pcap or pcapng file or the raw, hex or base64
+// encoded client hello. The json spec is written to stdout or the -o file and can be loaded with
+// cclient_v2.ParseClientHelloSpec, everything that could not be copied faithfully is reported on stderr.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	cclient "github.com/osnedaj/cclient-v2"
+)
+
+func main() {
+	output := flag.String("o", "", "write the spec to this file instead of stdout")
+	strict := flag.Bool("strict", false, "exit with status 2 if the client hello could not be copied faithfully")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-o spec.json] [-strict] [capture]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var data []byte
+	var err error
+	switch flag.NArg() {
+	case 0:
+		data, err = io.ReadAll(os.Stdin)
+	case 1:
+		data, err = os.ReadFile(flag.Arg(0))
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	spec, report, err := cclient.FingerprintClientHello(data)
+	if err != nil {
+		fatal(err)
+	}
+
+	b, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		fatal(err)
+	}
+	b = append(b, '\n')
+
+	if *output != "" {
+		err = os.WriteFile(*output, b, 0644)
+	} else {
+		_, err = os.Stdout.Write(b)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, issue := range report.Issues {
+		fmt.Fprintln(os.Stderr, issue)
+	}
+	if *strict && !report.Faithful() {
+		os.Exit(2)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "clienthello:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,252 @@
+package cclient_v2
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	tlsUtls "github.com/refraction-networking/utls"
+	tlsHttp "github.com/useflyent/fhttp"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ConnInfo describes the connection the final response of a request was received over
+type ConnInfo struct {
+	// Protocol is the http version of the response, h1, h2 or h3
+	Protocol string
+	// TLSVersion is the tls version of the connection, like tls.VersionTLS13, zero without tls
+	TLSVersion uint16
+	// CipherSuite is the cipher suite of the connection, like tls.TLS_AES_128_GCM_SHA256, zero without tls
+	CipherSuite uint16
+	// ALPN is the protocol negotiated with alpn, empty if the server selected none
+	ALPN string
+	// PeerCertificates is the certificate chain the server sent, its own certificate first.
+	// Resumed tls 1.3 sessions have the chain of the connection they were issued on
+	PeerCertificates []*x509.Certificate
+	// Resumed is whether the tls session of an earlier connection was resumed
+	Resumed bool
+	// LocalAddr is the local address of the connection, the one of the connection to the proxy if a proxy was used
+	LocalAddr net.Addr
+	// RemoteAddr is the remote address of the connection, the proxy if a proxy was used
+	RemoteAddr net.Addr
+	// Proxy is the url of the proxy of the client with its password redacted, empty if the client has no proxy.
+	// Http/3 requests are never sent through the proxy
+	Proxy string
+	// JA3 is the ja3 string of the client hello sent over the connection. It is empty for non tls clients and for
+	// http/3 connections, which do not send the client hello of the client
+	JA3 string
+}
+
+// hopRecorder records the connection the last hop of a request was sent over, the header fields written for it and
+// the header fields of its response if the connection recorded them
+type hopRecorder struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	fields   []headerField
+	received []headerField
+}
+
+// withHopRecorder returns a context recording the hops of a request with its hooks
+func withHopRecorder(ctx context.Context) (context.Context, *hopRecorder) {
+	r := &hopRecorder{}
+	hooks := hooksFrom(ctx)
+	return withHooks(ctx, append(hooks[:len(hooks):len(hooks)], &Hooks{
+		gotConn: func(conn net.Conn, _ bool) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			// every hop and every retry of a hop obtains a connection before writing its headers
+			r.conn, r.fields, r.received = conn, nil, nil
+		},
+		wroteHeaderField: func(key string, values []string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			for _, v := range values {
+				r.fields = append(r.fields, headerField{name: key, value: v})
+			}
+		},
+		readHeader: func(fields []headerField) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.received = fields
+		},
+	})), r
+}
+
+// info describes the connection of the final response, proxy is the proxy url of the client
+func (r *hopRecorder) info(resp *tlsHttp.Response, proxy string) ConnInfo {
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+
+	info := newConnInfo(conn, resp.ProtoMajor)
+	info.Proxy = proxy
+	// http/3 connections are no tls connections, their state is the one of the response
+	if info.TLSVersion == 0 && resp.TLS != nil {
+		info.setTLSState(*resp.TLS)
+	}
+	return info
+}
+
+// sent returns the final request as it was written, req is the request of the final response
+func (r *hopRecorder) sent(req *tlsHttp.Request, protocol string) *wireRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fields := r.fields
+	if protocol == "h1" {
+		fields = writtenHTTP1Fields(fields)
+	}
+	return &wireRequest{
+		protocol: protocol,
+		method:   req.Method,
+		url:      req.URL,
+		fields:   fields,
+		getBody:  req.GetBody,
+	}
+}
+
+// receivedFields returns the header fields of the final response in the order they were received, nil if the
+// connection did not record them
+func (r *hopRecorder) receivedFields() []headerField {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.received
+}
+
+// newConnInfo describes a connection of the http version protoMajor, conn may be nil
+func newConnInfo(conn net.Conn, protoMajor int) ConnInfo {
+	info := ConnInfo{Protocol: "h" + strconv.Itoa(protoMajor)}
+	if conn == nil {
+		return info
+	}
+	info.LocalAddr, info.RemoteAddr = conn.LocalAddr(), conn.RemoteAddr()
+
+	switch c := conn.(type) {
+	case *http1FieldConn:
+		conn = c.Conn
+	case *http2FieldConn:
+		conn = c.Conn
+	}
+	if c, ok := conn.(*frameConn); ok {
+		conn = c.Conn
+	}
+	switch c := conn.(type) {
+	case *tlsUtls.UConn:
+		state := c.ConnectionState()
+		info.TLSVersion = state.Version
+		info.CipherSuite = state.CipherSuite
+		info.ALPN = state.NegotiatedProtocol
+		info.PeerCertificates = state.PeerCertificates
+		info.Resumed = state.DidResume
+		if c.HandshakeState.Hello != nil {
+			info.JA3 = ja3(c.HandshakeState.Hello.Raw)
+		}
+	case *tls.Conn:
+		info.setTLSState(c.ConnectionState())
+	}
+	return info
+}
+
+// setTLSState sets the tls fields from the state of a crypto/tls connection
+func (i *ConnInfo) setTLSState(state tls.ConnectionState) {
+	i.TLSVersion = state.Version
+	i.CipherSuite = state.CipherSuite
+	i.ALPN = state.NegotiatedProtocol
+	i.PeerCertificates = state.PeerCertificates
+	i.Resumed = state.DidResume
+}
+
+// ja3 returns the ja3 string of a client hello handshake message, GREASE values are left out.
+// It returns an empty string if the message is malformed
+func ja3(hello []byte) string {
+	var version uint16
+	var body, random, sessionID, ciphers, compression, extensions cryptobyte.String
+	var cipherSuites, extensionIDs, curves, points []uint16
+
+	s := cryptobyte.String(hello)
+	if !s.Skip(1) || !s.ReadUint24LengthPrefixed(&body) ||
+		!body.ReadUint16(&version) || !body.ReadBytes((*[]byte)(&random), 32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) || !body.ReadUint16LengthPrefixed(&ciphers) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return ""
+	}
+	for !ciphers.Empty() {
+		var c uint16
+		if !ciphers.ReadUint16(&c) {
+			return ""
+		}
+		cipherSuites = appendNonGREASE(cipherSuites, c)
+	}
+
+	if !body.Empty() && !body.ReadUint16LengthPrefixed(&extensions) {
+		return ""
+	}
+	for !extensions.Empty() {
+		var id uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&id) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return ""
+		}
+		extensionIDs = appendNonGREASE(extensionIDs, id)
+
+		switch id {
+		case extensionSupportedCurves:
+			var list cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&list) {
+				return ""
+			}
+			for !list.Empty() {
+				var curve uint16
+				if !list.ReadUint16(&curve) {
+					return ""
+				}
+				curves = appendNonGREASE(curves, curve)
+			}
+		case extensionSupportedPoints:
+			var list cryptobyte.String
+			if !data.ReadUint8LengthPrefixed(&list) {
+				return ""
+			}
+			for _, p := range list {
+				points = append(points, uint16(p))
+			}
+		}
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(version)),
+		joinUint16s(cipherSuites),
+		joinUint16s(extensionIDs),
+		joinUint16s(curves),
+		joinUint16s(points),
+	}, ",")
+}
+
+func appendNonGREASE(values []uint16, v uint16) []uint16 {
+	if isGREASE(v) {
+		return values
+	}
+	return append(values, v)
+}
+
+// joinUint16s joins values with dashes, like the lists of a ja3 string
+func joinUint16s(values []uint16) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
+
+// ConnInfo returns the connection the response was received over
+func (r *Response) ConnInfo() ConnInfo {
+	return r.conn
+}
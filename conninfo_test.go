@@ -0,0 +1,127 @@
+package cclient_v2
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+func TestConnInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		nextProtos []string
+		maxVersion uint16
+		protocol   string
+	}{
+		{"h2", nil, 0, "h2"},
+		{"http/1.1", []string{"http/1.1"}, 0, "h1"},
+		{"tls 1.2", nil, tls.VersionTLS12, "h2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fingerprinttest.NewUnstartedServer()
+			if test.nextProtos != nil {
+				srv.TLS.NextProtos = test.nextProtos
+			}
+			srv.TLS.MaxVersion = test.maxVersion
+			srv.Start()
+			defer srv.Close()
+
+			c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.NewRequest().SetURL(srv.URL).Do()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, ok := srv.LastFingerprint()
+			if !ok {
+				t.Fatal("no fingerprint recorded")
+			}
+
+			info := resp.ConnInfo()
+			if info.Protocol != test.protocol || info.ALPN != f.ALPN {
+				t.Errorf("protocol: got %s over %q, want %s over %q", info.Protocol, info.ALPN, test.protocol, f.ALPN)
+			}
+			if info.TLSVersion != f.TLSVersion || info.CipherSuite == 0 {
+				t.Errorf("tls: got version %#x with cipher suite %#x, want version %#x", info.TLSVersion, info.CipherSuite, f.TLSVersion)
+			}
+			if info.JA3 == "" || info.JA3 != f.JA3 {
+				t.Errorf("ja3: got %s, server got %s", info.JA3, f.JA3)
+			}
+			if len(info.PeerCertificates) != 1 || !info.PeerCertificates[0].Equal(srv.Certificate()) {
+				t.Errorf("peer certificates: got %d, want the certificate of the server", len(info.PeerCertificates))
+			}
+			if info.RemoteAddr == nil || info.RemoteAddr.String() != srv.Listener.Addr().String() {
+				t.Errorf("remote address: got %v, want %v", info.RemoteAddr, srv.Listener.Addr())
+			}
+			if info.LocalAddr == nil || info.LocalAddr.String() != f.RemoteAddr {
+				t.Errorf("local address: got %v, server got %s", info.LocalAddr, f.RemoteAddr)
+			}
+			if info.Resumed || info.Proxy != "" {
+				t.Errorf("got resumed %v and proxy %q for a new connection without proxy", info.Resumed, info.Proxy)
+			}
+		})
+	}
+}
+
+func TestConnInfoProxy(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+	proxy := serveProxy(t)
+
+	c, err := NewClient("http://user:secret@"+proxy.Addr().String(), 5*time.Second, true, tlsUtls.HelloChrome_102,
+		TLSVerification{RootCAs: srv.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.NewRequest().SetURL(srv.URL).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := resp.ConnInfo()
+	if want := "http://user:xxxxx@" + proxy.Addr().String(); info.Proxy != want {
+		t.Errorf("proxy: got %q, want %q", info.Proxy, want)
+	}
+	if info.RemoteAddr == nil || info.RemoteAddr.String() != proxy.Addr().String() {
+		t.Errorf("remote address: got %v, want the proxy %v", info.RemoteAddr, proxy.Addr())
+	}
+	if f, ok := srv.LastFingerprint(); !ok || info.JA3 != f.JA3 || info.Protocol != "h2" {
+		t.Errorf("got %s with ja3 %s through the proxy, server got %s", info.Protocol, info.JA3, f.JA3)
+	}
+}
+
+func TestConnInfoHTTP3(t *testing.T) {
+	srv := fingerprinttest.NewUnstartedServer()
+	addr := serveHTTP3(t, srv, &http3.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})})
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()},
+		&HTTP3{Mode: HTTP3Always})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.NewRequest().SetURL("https://" + addr).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the quic handshake does not send the client hello of the client, so there is no ja3
+	info := resp.ConnInfo()
+	if info.Protocol != "h3" || info.ALPN != http3.NextProtoH3 || info.TLSVersion != tls.VersionTLS13 || info.JA3 != "" {
+		t.Errorf("got %s over %q with version %#x and ja3 %q", info.Protocol, info.ALPN, info.TLSVersion, info.JA3)
+	}
+	if len(info.PeerCertificates) != 1 || !info.PeerCertificates[0].Equal(srv.Certificate()) {
+		t.Errorf("peer certificates: got %d, want the certificate of the server", len(info.PeerCertificates))
+	}
+	if info.RemoteAddr == nil || info.RemoteAddr.String() != addr {
+		t.Errorf("remote address: got %v, want %s", info.RemoteAddr, addr)
+	}
+}
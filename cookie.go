@@ -0,0 +1,213 @@
+package cclient_v2
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	tlsHttp "github.com/useflyent/fhttp"
+)
+
+// orderCookies merges jar cookies and per-request cookies into the order a browser sends them, from the longest path to
+// the shortest and from the oldest cookie to the newest. Per-request cookies are the newest cookies and replace the jar
+// cookies of the same name and path, all cookies need their path set
+func orderCookies(jarCookies, reqCookies []*http.Cookie) []*http.Cookie {
+	type cookieKey struct{ name, path string }
+	override := make(map[cookieKey]bool)
+	for _, cookie := range reqCookies {
+		override[cookieKey{cookie.Name, cookie.Path}] = true
+	}
+
+	var ordered []*http.Cookie
+	for _, cookie := range jarCookies {
+		if !override[cookieKey{cookie.Name, cookie.Path}] {
+			ordered = append(ordered, cookie)
+		}
+	}
+	ordered = append(ordered, reqCookies...)
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return len(ordered[i].Path) > len(ordered[j].Path)
+	})
+	return ordered
+}
+
+// cookieLookup looks up the cookies a jar sends to a url
+type cookieLookup interface {
+	Cookies(u *url.URL) []*http.Cookie
+}
+
+// jarCookies returns the cookies of the jar sent to u with the path they are stored under. Jars only return names and
+// values, a cookie is stored under the shortest path prefix of u it is returned for
+func jarCookies(jar cookieLookup, u *url.URL) []*http.Cookie {
+	requestPath := u.Path
+	if requestPath == "" {
+		requestPath = "/"
+	}
+
+	stored := make(map[string][]string)
+	count := make(map[string]int)
+	var cookies []*http.Cookie
+	for i := 1; i <= len(requestPath); i++ {
+		if i < len(requestPath) && requestPath[i-1] != '/' && requestPath[i] != '/' {
+			continue
+		}
+
+		lookup := *u
+		lookup.Path, lookup.RawPath = requestPath[:i], ""
+		cookies = jar.Cookies(&lookup)
+		found := make(map[string]int)
+		for _, cookie := range cookies {
+			key := cookie.Name + "=" + cookie.Value
+			if found[key]++; found[key] > count[key] {
+				stored[key] = append(stored[key], lookup.Path)
+			}
+		}
+		count = found
+	}
+
+	// the jar returns the cookies with the longest paths first
+	pathed := make([]*http.Cookie, len(cookies))
+	for i, cookie := range cookies {
+		key := cookie.Name + "=" + cookie.Value
+		paths := stored[key]
+		pathed[i] = &http.Cookie{Name: cookie.Name, Value: cookie.Value, Path: paths[len(paths)-1]}
+		stored[key] = paths[:len(paths)-1]
+	}
+	return pathed
+}
+
+// sendsCookieTo reports whether the per-request cookie is sent to u, it is matched like the jar matches its cookies.
+// A cookie without domain is only sent to initialHost, the host of the request, a cookie without path to all paths
+func sendsCookieTo(cookie *http.Cookie, initialHost string, u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	domain := strings.TrimPrefix(strings.ToLower(cookie.Domain), ".")
+	switch {
+	case domain == "":
+		if host != strings.ToLower(initialHost) {
+			return false
+		}
+	case host != domain && (!strings.HasSuffix(host, "."+domain) || net.ParseIP(host) != nil):
+		return false
+	}
+
+	if cookie.Secure && u.Scheme != "https" {
+		return false
+	}
+	return cookiePathMatch(u.Path, requestCookiePath(cookie))
+}
+
+// requestCookiePath returns the path of a per-request cookie, cookies without valid path apply to all paths
+func requestCookiePath(cookie *http.Cookie) string {
+	if strings.HasPrefix(cookie.Path, "/") {
+		return cookie.Path
+	}
+	return "/"
+}
+
+// cookiePathMatch reports whether a cookie of path is sent to requestPath
+func cookiePathMatch(requestPath, path string) bool {
+	if requestPath == "" {
+		requestPath = "/"
+	}
+	if requestPath == path {
+		return true
+	}
+	if strings.HasPrefix(requestPath, path) {
+		return path[len(path)-1] == '/' || requestPath[len(path)] == '/'
+	}
+	return false
+}
+
+// cookieHeader builds the value of a cookie header from already ordered cookies
+func cookieHeader(cookies []*http.Cookie) string {
+	var parts []string
+	for _, cookie := range cookies {
+		if s := (&http.Cookie{Name: cookie.Name, Value: cookie.Value}).String(); s != "" {
+			parts = append(parts, s)
+		}
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// parseCookieHeader reads the cookies of a raw cookie header value
+func parseCookieHeader(value string) []*http.Cookie {
+	return (&http.Request{Header: http.Header{"Cookie": {value}}}).Cookies()
+}
+
+func fromTLSCookie(c *tlsHttp.Cookie) *http.Cookie {
+	return &http.Cookie{
+		Name:       c.Name,
+		Value:      c.Value,
+		Path:       c.Path,
+		Domain:     c.Domain,
+		Expires:    c.Expires,
+		RawExpires: c.RawExpires,
+		MaxAge:     c.MaxAge,
+		Secure:     c.Secure,
+		HttpOnly:   c.HttpOnly,
+		SameSite:   http.SameSite(c.SameSite),
+		Raw:        c.Raw,
+		Unparsed:   c.Unparsed,
+	}
+}
+
+// extractCookies removes manually set cookie headers and returns their cookies
+func extractCookies(header http.Header) []*http.Cookie {
+	var cookies []*http.Cookie
+	for k, v := range header {
+		if strings.ToLower(k) == "cookie" {
+			for _, value := range v {
+				cookies = append(cookies, parseCookieHeader(value)...)
+			}
+			delete(header, k)
+		}
+	}
+
+	return cookies
+}
+
+// cookieHandler applies the cookie mode of a request to each of its hops
+type cookieHandler struct {
+	jar     *cookieJar
+	mode    CookieMode
+	cookies []*http.Cookie
+	host    string
+}
+
+// header returns the cookie header for a hop of the request
+func (h *cookieHandler) header(u *url.URL) string {
+	var reqCookies []*http.Cookie
+	for _, cookie := range h.cookies {
+		if sendsCookieTo(cookie, h.host, u) {
+			reqCookies = append(reqCookies, &http.Cookie{Name: cookie.Name, Value: cookie.Value, Path: requestCookiePath(cookie)})
+		}
+	}
+
+	var cookies []*http.Cookie
+	switch {
+	case h.mode == CookieModeIgnore:
+		cookies = orderCookies(nil, reqCookies)
+	case len(reqCookies) == 0:
+		// the jar order is kept, the paths of its cookies are only looked up to merge them
+		cookies = h.jar.Cookies(u)
+	default:
+		cookies = orderCookies(jarCookies(h.jar, u), reqCookies)
+	}
+	return cookieHeader(cookies)
+}
+
+// stores reports whether response cookies are stored in the jar
+func (h *cookieHandler) stores() bool {
+	return h.mode == CookieModeJar
+}
+
+// store stores the cookies of a hop response in the jar
+func (h *cookieHandler) store(u *url.URL, cookies []*http.Cookie, resp *http.Response) {
+	if h.stores() {
+		h.jar.setResponseCookies(u, cookies, resp)
+	}
+}
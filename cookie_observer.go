@@ -0,0 +1,516 @@
+package cclient_v2
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CookieEventType is the kind of change reported by a CookieEvent
+type CookieEventType int
+
+const (
+	// CookieAdded is reported when a cookie is stored that was not in the jar before
+	CookieAdded CookieEventType = iota
+	// CookieUpdated is reported when the value or attributes of a stored cookie change
+	CookieUpdated
+	// CookieExpired is reported when a cookie is removed because its expiry passed or a response expired it
+	CookieExpired
+	// CookieDeleted is reported when a cookie is removed by RemoveCookie or ResetCookies
+	CookieDeleted
+)
+
+func (t CookieEventType) String() string {
+	switch t {
+	case CookieAdded:
+		return "added"
+	case CookieUpdated:
+		return "updated"
+	case CookieExpired:
+		return "expired"
+	case CookieDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// CookieEvent describes a change of a cookie in the client jar
+type CookieEvent struct {
+	Type   CookieEventType
+	Cookie *http.Cookie
+	// URL is the url the cookie was set or removed for, nil when it expired on its own
+	URL *url.URL
+	// Response is the response that caused the change, nil for changes made through the client or by expiry
+	// The response body is not available to observers
+	Response *http.Response
+}
+
+// CookieObserver receives changes of cookies in the client jar
+// Observers are called synchronously after the jar has been updated, they must not block
+type CookieObserver func(event CookieEvent)
+
+// ObserveCookies registers an observer for changes of the client jar, limited to the given cookie names if any
+// The returned function removes the observer
+func (c *Client) ObserveCookies(observer CookieObserver, names ...string) func() {
+	return c.cookieObservers.observe(observer, names)
+}
+
+type trackedCookie struct {
+	cookie   *http.Cookie
+	hostOnly bool
+	expires  time.Time
+}
+
+func (t *trackedCookie) appliesTo(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	domain := t.cookie.Domain
+	if t.hostOnly {
+		if host != domain {
+			return false
+		}
+	} else if host != domain && !strings.HasSuffix(host, "."+domain) {
+		return false
+	}
+
+	return cookiePathMatch(u.Path, t.cookie.Path)
+}
+
+// storedIn reports whether the jar stored the cookie set by a response from u. The cookie is looked up under its own
+// domain and path, cookies of other domains and paths than the one of u do not apply to u
+func (t *trackedCookie) storedIn(store cookieStore, u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	if host != t.cookie.Domain && !strings.HasSuffix(host, "."+t.cookie.Domain) {
+		return false
+	}
+
+	lookup := &url.URL{Scheme: u.Scheme, Host: t.cookie.Domain, Path: t.cookie.Path}
+	if t.cookie.Secure {
+		lookup.Scheme = "https"
+	}
+	if strings.Contains(t.cookie.Domain, ":") {
+		lookup.Host = "[" + t.cookie.Domain + "]"
+	}
+	for _, cookie := range store.cookies(lookup) {
+		if cookie.Name == t.cookie.Name && cookie.Value == t.cookie.Value {
+			return true
+		}
+	}
+	return false
+}
+
+type cookieObserverEntry struct {
+	fn    CookieObserver
+	names map[string]bool
+}
+
+// cookieObservers holds the cookie observers registered on a client
+type cookieObservers struct {
+	mu      sync.Mutex
+	entries map[int]*cookieObserverEntry
+	nextId  int
+}
+
+func newCookieObservers() *cookieObservers {
+	return &cookieObservers{entries: make(map[int]*cookieObserverEntry)}
+}
+
+// cookieTracker keeps track of the cookies stored in a client jar and reports their changes to the observers
+// of every client using the jar. The jars only return names and values, so domains, paths and expiry are tracked here
+type cookieTracker struct {
+	mu        sync.Mutex
+	cookies   map[string]*trackedCookie
+	observers []*cookieObservers
+	// refs counts the clients using each set of observers
+	refs map[*cookieObservers]int
+}
+
+func newCookieTracker(observers *cookieObservers) *cookieTracker {
+	return &cookieTracker{
+		cookies:   make(map[string]*trackedCookie),
+		observers: []*cookieObservers{observers},
+		refs:      map[*cookieObservers]int{observers: 1},
+	}
+}
+
+// cookieStore is the part of a jar the tracker works on, implemented for both jar types
+type cookieStore interface {
+	cookies(u *url.URL) []*http.Cookie
+	setCookies(u *url.URL, cookies []*http.Cookie)
+}
+
+func (o *cookieObservers) observe(fn CookieObserver, names []string) func() {
+	entry := &cookieObserverEntry{fn: fn}
+	if len(names) > 0 {
+		entry.names = make(map[string]bool)
+		for _, name := range names {
+			entry.names[name] = true
+		}
+	}
+
+	o.mu.Lock()
+	id := o.nextId
+	o.nextId++
+	o.entries[id] = entry
+	o.mu.Unlock()
+
+	return func() {
+		o.mu.Lock()
+		delete(o.entries, id)
+		o.mu.Unlock()
+	}
+}
+
+// copy returns a new set of observers with the currently registered ones
+func (o *cookieObservers) copy() *cookieObservers {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	observers := newCookieObservers()
+	for id, entry := range o.entries {
+		observers.entries[id] = entry
+	}
+	observers.nextId = o.nextId
+
+	return observers
+}
+
+func (o *cookieObservers) snapshot() []*cookieObserverEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var entries []*cookieObserverEntry
+	for _, entry := range o.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// attach makes the tracker report to observers as well, used by clients sharing a jar.
+// Every attach is undone by a detach
+func (t *cookieTracker) attach(observers *cookieObservers) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.refs[observers]++; t.refs[observers] == 1 {
+		t.observers = append(t.observers, observers)
+	}
+}
+
+// detach stops reporting to observers once every client that attached them detached them
+func (t *cookieTracker) detach(observers *cookieObservers) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.refs[observers]--; t.refs[observers] > 0 {
+		return
+	}
+	delete(t.refs, observers)
+	for i, o := range t.observers {
+		if o == observers {
+			t.observers = append(t.observers[:i:i], t.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+// setCookies stores cookies in the jar and reports the resulting changes, removals are reported as removal
+func (t *cookieTracker) setCookies(store cookieStore, u *url.URL, cookies []*http.Cookie, resp *http.Response, removal CookieEventType) {
+	t.mu.Lock()
+	now := time.Now()
+	events := t.expired(now)
+
+	before := make(map[string]string)
+	for _, cookie := range store.cookies(u) {
+		before[cookie.Name] = cookie.Value
+	}
+	store.setCookies(u, cookies)
+
+	for _, cookie := range cookies {
+		if cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && !cookie.Expires.After(now)) {
+			events = append(events, t.remove(u, cookie, before, removal, resp)...)
+			continue
+		}
+
+		tracked := newTrackedCookie(u, cookie, now)
+		key := tracked.key()
+		if !tracked.storedIn(store, u) {
+			// rejected by the jar
+			continue
+		}
+
+		old, ok := t.cookies[key]
+		t.cookies[key] = tracked
+		switch {
+		case ok && !tracked.changed(old):
+			continue
+		case ok:
+			events = append(events, CookieEvent{Type: CookieUpdated, Cookie: tracked.copyCookie(), URL: u, Response: resp})
+		default:
+			if _, existed := before[cookie.Name]; existed && tracked.appliesTo(u) {
+				events = append(events, CookieEvent{Type: CookieUpdated, Cookie: tracked.copyCookie(), URL: u, Response: resp})
+			} else {
+				events = append(events, CookieEvent{Type: CookieAdded, Cookie: tracked.copyCookie(), URL: u, Response: resp})
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	t.notify(events)
+}
+
+// removeCookies removes the cookies with the given name that apply to u, including domain cookies of parent domains
+func (t *cookieTracker) removeCookies(store cookieStore, u *url.URL, name string) {
+	t.mu.Lock()
+	events := t.expired(time.Now())
+
+	var removals []*http.Cookie
+	removed := make(map[string]bool)
+	for key, tracked := range t.cookies {
+		if !strings.EqualFold(tracked.cookie.Name, name) || !tracked.appliesTo(u) {
+			continue
+		}
+
+		removal := &http.Cookie{
+			Name:    tracked.cookie.Name,
+			Path:    tracked.cookie.Path,
+			MaxAge:  -1,
+			Expires: time.Now().Add(time.Hour * -100),
+		}
+		if !tracked.hostOnly {
+			removal.Domain = tracked.cookie.Domain
+		}
+
+		removals = append(removals, removal)
+		removed[tracked.cookie.Name] = true
+		delete(t.cookies, key)
+		events = append(events, CookieEvent{Type: CookieDeleted, Cookie: tracked.copyCookie(), URL: u})
+	}
+
+	// cookies stored before the tracker saw them
+	for _, cookie := range store.cookies(u) {
+		if strings.EqualFold(cookie.Name, name) && !removed[cookie.Name] {
+			events = append(events, CookieEvent{Type: CookieDeleted, Cookie: &http.Cookie{Name: cookie.Name, Value: cookie.Value}, URL: u})
+			removals = append(removals, &http.Cookie{
+				Name:    cookie.Name,
+				MaxAge:  -1,
+				Expires: time.Now().Add(time.Hour * -100),
+			})
+		}
+	}
+
+	if len(removals) > 0 {
+		store.setCookies(u, removals)
+	}
+	t.mu.Unlock()
+
+	t.notify(events)
+}
+
+// reset forgets all tracked cookies and reports them as deleted, used when the jar is replaced
+func (t *cookieTracker) reset() {
+	t.mu.Lock()
+	var events []CookieEvent
+	for _, tracked := range t.cookies {
+		events = append(events, CookieEvent{Type: CookieDeleted, Cookie: tracked.copyCookie()})
+	}
+	t.cookies = make(map[string]*trackedCookie)
+	t.mu.Unlock()
+
+	t.notify(events)
+}
+
+// expire reports tracked cookies whose expiry has passed
+func (t *cookieTracker) expire() {
+	t.mu.Lock()
+	events := t.expired(time.Now())
+	t.mu.Unlock()
+
+	t.notify(events)
+}
+
+// remove must be called with t.mu held
+func (t *cookieTracker) remove(u *url.URL, cookie *http.Cookie, before map[string]string, removal CookieEventType, resp *http.Response) []CookieEvent {
+	var events []CookieEvent
+	for key, tracked := range t.cookies {
+		if tracked.cookie.Name != cookie.Name {
+			continue
+		}
+		if cookie.Domain != "" && tracked.cookie.Domain != strings.TrimPrefix(strings.ToLower(cookie.Domain), ".") {
+			continue
+		}
+		if cookie.Domain == "" && (!tracked.hostOnly || tracked.cookie.Domain != strings.ToLower(u.Hostname())) {
+			continue
+		}
+		if tracked.cookie.Path != cookiePath(u, cookie) {
+			continue
+		}
+
+		delete(t.cookies, key)
+		events = append(events, CookieEvent{Type: removal, Cookie: tracked.copyCookie(), URL: u, Response: resp})
+	}
+
+	if value, ok := before[cookie.Name]; ok && len(events) == 0 {
+		events = append(events, CookieEvent{Type: removal, Cookie: &http.Cookie{Name: cookie.Name, Value: value}, URL: u, Response: resp})
+	}
+
+	return events
+}
+
+// expired must be called with t.mu held
+func (t *cookieTracker) expired(now time.Time) []CookieEvent {
+	var events []CookieEvent
+	for key, tracked := range t.cookies {
+		if !tracked.expires.IsZero() && !tracked.expires.After(now) {
+			delete(t.cookies, key)
+			events = append(events, CookieEvent{Type: CookieExpired, Cookie: tracked.copyCookie()})
+		}
+	}
+
+	return events
+}
+
+func (t *cookieTracker) notify(events []CookieEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	var observers []*cookieObserverEntry
+	// clients sharing the jar with copies of the same observers call them once
+	seen := make(map[*cookieObserverEntry]bool)
+	for _, o := range t.observers {
+		for _, entry := range o.snapshot() {
+			if !seen[entry] {
+				seen[entry] = true
+				observers = append(observers, entry)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	for _, event := range events {
+		for _, entry := range observers {
+			if entry.names == nil || entry.names[event.Cookie.Name] {
+				entry.fn(event)
+			}
+		}
+	}
+}
+
+func newTrackedCookie(u *url.URL, cookie *http.Cookie, now time.Time) *trackedCookie {
+	tracked := &trackedCookie{cookie: &http.Cookie{
+		Name:     cookie.Name,
+		Value:    cookie.Value,
+		Path:     cookiePath(u, cookie),
+		Domain:   strings.TrimPrefix(strings.ToLower(cookie.Domain), "."),
+		Expires:  cookie.Expires,
+		MaxAge:   cookie.MaxAge,
+		Secure:   cookie.Secure,
+		HttpOnly: cookie.HttpOnly,
+		SameSite: cookie.SameSite,
+	}}
+
+	if tracked.cookie.Domain == "" {
+		tracked.hostOnly = true
+		tracked.cookie.Domain = strings.ToLower(u.Hostname())
+	}
+
+	if cookie.MaxAge > 0 {
+		tracked.expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+	} else if !cookie.Expires.IsZero() {
+		tracked.expires = cookie.Expires
+	}
+
+	return tracked
+}
+
+func (t *trackedCookie) key() string {
+	return t.cookie.Domain + ";" + t.cookie.Path + ";" + t.cookie.Name
+}
+
+func (t *trackedCookie) changed(old *trackedCookie) bool {
+	return t.cookie.Value != old.cookie.Value ||
+		!t.expires.Equal(old.expires) ||
+		t.cookie.Secure != old.cookie.Secure ||
+		t.cookie.HttpOnly != old.cookie.HttpOnly ||
+		t.cookie.SameSite != old.cookie.SameSite
+}
+
+func (t *trackedCookie) copyCookie() *http.Cookie {
+	cookie := *t.cookie
+	if !t.hostOnly {
+		cookie.Domain = "." + cookie.Domain
+	}
+	return &cookie
+}
+
+// cookiePath returns the path a jar stores the cookie under
+func cookiePath(u *url.URL, cookie *http.Cookie) string {
+	if strings.HasPrefix(cookie.Path, "/") {
+		return cookie.Path
+	}
+
+	p := u.Path
+	if p == "" || p[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(p, "/")
+	if i == 0 {
+		return "/"
+	}
+	return p[:i]
+}
+
+// cookieJar is the client jar, it reports the changes of the wrapped jar through its tracker
+type cookieJar struct {
+	mu      sync.RWMutex
+	jar     http.CookieJar
+	tracker *cookieTracker
+}
+
+func newCookieJar(tracker *cookieTracker) *cookieJar {
+	jar, _ := cookiejar.New(nil)
+	return &cookieJar{jar: jar, tracker: tracker}
+}
+
+// reset replaces the wrapped jar with an empty one, for every client sharing it
+func (j *cookieJar) reset() {
+	jar, _ := cookiejar.New(nil)
+
+	j.mu.Lock()
+	j.jar = jar
+	j.mu.Unlock()
+
+	j.tracker.reset()
+}
+
+func (j *cookieJar) current() http.CookieJar {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	return j.jar
+}
+
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.tracker.setCookies(j, u, cookies, nil, CookieExpired)
+}
+
+func (j *cookieJar) Cookies(u *url.URL) []*http.Cookie {
+	j.tracker.expire()
+	return j.current().Cookies(u)
+}
+
+func (j *cookieJar) setResponseCookies(u *url.URL, cookies []*http.Cookie, resp *http.Response) {
+	j.tracker.setCookies(j, u, cookies, resp, CookieExpired)
+}
+
+func (j *cookieJar) cookies(u *url.URL) []*http.Cookie {
+	return j.current().Cookies(u)
+}
+
+func (j *cookieJar) setCookies(u *url.URL, cookies []*http.Cookie) {
+	j.current().SetCookies(u, cookies)
+}
@@ -0,0 +1,47 @@
+package cclient_v2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestObserveCookiesRejectedByJar(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "kept=1")
+		w.Header().Add("Set-Cookie", "foreign=2; Domain=evil.example")
+		w.Header().Add("Set-Cookie", "other=3; Path=/other")
+	}))
+	defer srv.Close()
+
+	c, err := NewClient("", 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	events := make(map[string]CookieEventType)
+	c.ObserveCookies(func(event CookieEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events[event.Cookie.Name] = event.Type
+	})
+
+	if _, err = c.NewRequest().SetURL(srv.URL + "/set").Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if typ, ok := events["kept"]; !ok || typ != CookieAdded {
+		t.Errorf("kept: got %v %v, want added", typ, ok)
+	}
+	if typ, ok := events["other"]; !ok || typ != CookieAdded {
+		t.Errorf("other: got %v %v, want added for a cookie of another path", typ, ok)
+	}
+	if typ, ok := events["foreign"]; ok {
+		t.Errorf("foreign: got %v, want no event for a cookie the jar rejected", typ)
+	}
+}
@@ -0,0 +1,156 @@
+package cclient_v2
+
+import (
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOrderCookies(t *testing.T) {
+	cookie := func(name, path string) *http.Cookie {
+		return &http.Cookie{Name: name, Value: "1", Path: path}
+	}
+	tests := []struct {
+		name       string
+		jarCookies []*http.Cookie
+		reqCookies []*http.Cookie
+		want       []string
+	}{
+		{
+			name:       "by path length",
+			jarCookies: []*http.Cookie{cookie("deep", "/a/b"), cookie("dir", "/a"), cookie("root", "/")},
+			reqCookies: []*http.Cookie{cookie("req-root", "/"), cookie("req-deep", "/a/b/c"), cookie("req-dir", "/a")},
+			want:       []string{"req-deep /a/b/c", "deep /a/b", "dir /a", "req-dir /a", "root /", "req-root /"},
+		},
+		{
+			name:       "replaced by name and path",
+			jarCookies: []*http.Cookie{cookie("a", "/a"), cookie("b", "/"), cookie("a", "/")},
+			reqCookies: []*http.Cookie{cookie("a", "/")},
+			want:       []string{"a /a", "b /", "a /"},
+		},
+		{
+			name:       "without jar cookies",
+			reqCookies: []*http.Cookie{cookie("b", "/"), cookie("a", "/a")},
+			want:       []string{"a /a", "b /"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, cookie := range orderCookies(test.jarCookies, test.reqCookies) {
+				got = append(got, cookie.Name+" "+cookie.Path)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestJarCookies(t *testing.T) {
+	jar, _ := cookiejar.New(nil)
+	u, _ := url.Parse("https://example.com/a/b/c")
+	for _, path := range []string{"/", "/a", "/a/", "/a/b", "/a/b/c", "/other"} {
+		jar.SetCookies(u, []*http.Cookie{{Name: "p" + path, Value: "1", Path: path}})
+	}
+	// cookies of the same name and value are told apart by their path
+	jar.SetCookies(u, []*http.Cookie{{Name: "dup", Value: "1", Path: "/"}, {Name: "dup", Value: "1", Path: "/a/b"}})
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/a/b/c", []string{"p/a/b/c /a/b/c", "p/a/b /a/b", "dup /a/b", "p/a/ /a/", "p/a /a", "p/ /", "dup /"}},
+		{"/a/b", []string{"p/a/b /a/b", "dup /a/b", "p/a/ /a/", "p/a /a", "p/ /", "dup /"}},
+		{"/a", []string{"p/a /a", "p/ /", "dup /"}},
+		{"", []string{"p/ /", "dup /"}},
+	}
+	for _, test := range tests {
+		lookup := *u
+		lookup.Path = test.path
+		var got []string
+		for _, cookie := range jarCookies(jar, &lookup) {
+			got = append(got, cookie.Name+" "+cookie.Path)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestRequestCookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/set":
+			w.Header().Add("Set-Cookie", "jar=1; Path=/")
+			w.Header().Add("Set-Cookie", "pathed=2; Path=/api")
+		case "/store":
+			w.Header().Add("Set-Cookie", "stored=1; Path=/")
+		case "/api/redirect":
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+		default:
+			_, _ = w.Write([]byte(r.Header.Get("Cookie")))
+		}
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	c, err := NewClient("", 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.NewRequest().SetURL(srv.URL + "/set").Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		cookies []*http.Cookie
+		mode    CookieMode
+		want    string
+	}{
+		{"jar", "/api/x", nil, CookieModeJar, "pathed=2; jar=1"},
+		{"merged by path", "/api/x", []*http.Cookie{{Name: "root", Value: "4"}, {Name: "req", Value: "3", Path: "/api/x"}}, CookieModeJar,
+			"req=3; pathed=2; jar=1; root=4"},
+		{"replaced", "/api/x", []*http.Cookie{{Name: "jar", Value: "5", Path: "/"}}, CookieModeJar, "pathed=2; jar=5"},
+		{"not replaced under another path", "/api/x", []*http.Cookie{{Name: "pathed", Value: "6"}}, CookieModeJar, "pathed=2; jar=1; pathed=6"},
+		{"ignored jar", "/api/x", []*http.Cookie{{Name: "req", Value: "3"}}, CookieModeIgnore, "req=3"},
+		{"not matching", "/api/x", []*http.Cookie{
+			{Name: "domain", Value: "1", Domain: "example.com"},
+			{Name: "secure", Value: "1", Secure: true},
+			{Name: "path", Value: "1", Path: "/other"},
+			{Name: "prefix", Value: "1", Path: "/ap"},
+		}, CookieModeJar, "pathed=2; jar=1"},
+		{"matching domain", "/", []*http.Cookie{{Name: "domain", Value: "1", Domain: "127.0.0.1"}}, CookieModeIgnore, "domain=1"},
+		{"redirect to another path", "/api/redirect?to=/echo", []*http.Cookie{{Name: "req", Value: "3"}, {Name: "api", Value: "1", Path: "/api"}},
+			CookieModeJar, "jar=1; req=3"},
+		{"redirect to another host", "/api/redirect?to=http://localhost:" + port + "/echo", []*http.Cookie{{Name: "req", Value: "3"}},
+			CookieModeJar, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := c.NewRequest().SetURL(srv.URL + test.url).SetCookies(test.cookies).SetCookieMode(test.mode).Do()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.BodyAsString(); got != test.want {
+				t.Errorf("cookie header: got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	for _, mode := range []CookieMode{CookieModeIgnore, CookieModeNoStore, CookieModeJar} {
+		if _, err = c.NewRequest().SetURL(srv.URL + "/store").SetCookieMode(mode).Do(); err != nil {
+			t.Fatal(err)
+		}
+		if _, stored := c.GetCookiesMap(srv.URL)["stored"]; stored != (mode == CookieModeJar) {
+			t.Errorf("mode %d: stored %v", mode, stored)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package cclient_v2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	fhttpTrace "github.com/useflyent/fhttp/httptrace"
+)
+
+// headerField is a header field as it was written to or read from a connection
+type headerField struct {
+	name, value string
+}
+
+// transferHeaders are the header fields fhttp reports twice when writing an http/1.1 request, before the header
+// fields and again when it writes them
+var transferHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Trailer":           true,
+}
+
+// writtenHTTP1Fields returns the header fields fhttp reported writing for an http/1.1 request without the early
+// reports of the transfer header fields
+func writtenHTTP1Fields(fields []headerField) []headerField {
+	for len(fields) > 0 && transferHeaders[fields[0].name] {
+		written := false
+		for _, f := range fields[1:] {
+			if f.name == fields[0].name {
+				written = true
+				break
+			}
+		}
+		if !written {
+			break
+		}
+		fields = fields[1:]
+	}
+	return fields
+}
+
+// decodedFields returns the header fields of a response without the Content-Encoding and Content-Length fields the
+// transport removed from its header when it decompressed its body
+func decodedFields(fields []headerField, header http.Header) []headerField {
+	if fields == nil {
+		return nil
+	}
+	decoded := make([]headerField, 0, len(fields))
+	for _, f := range fields {
+		name := http.CanonicalHeaderKey(f.name)
+		if (name == "Content-Encoding" || name == "Content-Length") && header[name] == nil {
+			continue
+		}
+		decoded = append(decoded, f)
+	}
+	return decoded
+}
+
+// wireRequest is a request as it was written to a connection, http/2 and http/3 requests start with their pseudo
+// header fields
+type wireRequest struct {
+	protocol string
+	method   string
+	url      *url.URL
+	fields   []headerField
+	getBody  func() (io.ReadCloser, error)
+}
+
+// body returns the body of the request, nil if it has none or it can not be read again
+func (w *wireRequest) body() ([]byte, error) {
+	if w.getBody == nil {
+		return nil, nil
+	}
+	body, err := w.getBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// dump writes the request as http/1.1 text or as the list of fields of its http/2 or http/3 HEADERS frame,
+// followed by its body
+func (w *wireRequest) dump() ([]byte, error) {
+	body, err := w.body()
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if w.protocol != "h1" {
+		for _, f := range w.fields {
+			fmt.Fprintf(&b, "%s: %s\n", f.name, f.value)
+		}
+		b.WriteString("\n")
+		b.Write(body)
+		return b.Bytes(), nil
+	}
+
+	chunked := false
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", w.method, w.url.RequestURI())
+	for _, f := range w.fields {
+		fmt.Fprintf(&b, "%s: %s\r\n", f.name, f.value)
+		if strings.EqualFold(f.name, "Transfer-Encoding") && f.value == "chunked" {
+			chunked = true
+		}
+	}
+	b.WriteString("\r\n")
+	if chunked {
+		if len(body) > 0 {
+			fmt.Fprintf(&b, "%x\r\n%s\r\n", len(body), body)
+		}
+		b.WriteString("0\r\n\r\n")
+	} else {
+		b.Write(body)
+	}
+	return b.Bytes(), nil
+}
+
+// wire returns the request as it was last written by Do, or as the client writes it over http/1.1 if it was not sent.
+// The body of an unsent request is read and replaced by a copy
+func (r *Request) wire() (*wireRequest, error) {
+	if r.sent != nil {
+		return r.sent, nil
+	}
+
+	var body []byte
+	if r.body != nil {
+		var err error
+		if body, err = io.ReadAll(r.body); err != nil {
+			return nil, err
+		}
+		r.body = bytes.NewReader(body)
+	}
+
+	req, err := r.prepare()
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.body = bytes.NewReader(body)
+	}
+	r.client.addCookies(req, req.url.Hostname())
+
+	fr, err := req.fhttpRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	// fhttp reports every header field it writes, in the order it writes them
+	var fields []headerField
+	fr = fr.WithContext(fhttpTrace.WithClientTrace(context.Background(), &fhttpTrace.ClientTrace{
+		WroteHeaderField: func(key string, values []string) {
+			for _, v := range values {
+				fields = append(fields, headerField{name: key, value: v})
+			}
+		},
+	}))
+	if err = fr.Write(io.Discard); err != nil {
+		return nil, err
+	}
+
+	return &wireRequest{
+		protocol: "h1",
+		method:   fr.Method,
+		url:      fr.URL,
+		fields:   writtenHTTP1Fields(fields),
+		getBody:  fr.GetBody,
+	}, nil
+}
+
+// Dump returns the request as it was written to the connection by the last Do, as http/1.1 text or as the list of
+// the fields of its http/2 or http/3 HEADERS frame in the order they were sent, followed by its body.
+// Redirected requests are dumped as the request of the final response. Requests that were not sent are dumped as the
+// client writes them over http/1.1, with the cookies of the jar, their body is read and replaced by a copy.
+// Bodies that can not be read again are left out
+func (r *Request) Dump() ([]byte, error) {
+	w, err := r.wire()
+	if err != nil {
+		return nil, err
+	}
+	return w.dump()
+}
+
+// ToCurl returns a curl command sending the request like Dump shows it, with its headers in order, the protocol it
+// was sent with, the proxy of the client and --compressed if it accepts encoded responses. Bodies that are no text are
+// piped to curl with printf. The command holds the credentials of the proxy and the cookies of the request
+func (r *Request) ToCurl() (string, error) {
+	sent := r.sent != nil
+	w, err := r.wire()
+	if err != nil {
+		return "", err
+	}
+	body, err := w.body()
+	if err != nil {
+		return "", err
+	}
+
+	r.client.mu.RLock()
+	proxy := r.client.proxy
+	insecure := r.client.verification.InsecureSkipVerify
+	r.client.mu.RUnlock()
+
+	args := []string{"curl " + shellQuote(w.url.String())}
+	switch {
+	case sent && w.protocol == "h1":
+		args = append(args, "--http1.1")
+	case sent && w.protocol == "h3":
+		args = append(args, "--http3")
+	case sent && w.protocol == "h2", !sent && w.url.Scheme == "https":
+		args = append(args, "--http2")
+	}
+
+	switch {
+	case w.method == http.MethodHead:
+		args = append(args, "--head")
+	case w.method == http.MethodGet && len(body) == 0, w.method == http.MethodPost && len(body) > 0:
+	default:
+		args = append(args, "-X "+shellQuote(w.method))
+	}
+
+	compressed, hasAccept, hasUserAgent := false, false, false
+	for _, f := range curlFields(w.fields) {
+		switch strings.ToLower(f.name) {
+		case ":authority", "host":
+			if f.value != w.url.Host {
+				args = append(args, "-H "+shellQuote("Host: "+f.value))
+			}
+			continue
+		case "content-length", "transfer-encoding":
+			continue
+		case "accept-encoding":
+			compressed = true
+		case "accept":
+			hasAccept = true
+		case "user-agent":
+			hasUserAgent = true
+		}
+		if strings.HasPrefix(f.name, ":") {
+			continue
+		}
+
+		if f.value == "" {
+			// curl sends headers without value given as name;
+			args = append(args, "-H "+shellQuote(f.name+";"))
+		} else {
+			args = append(args, "-H "+shellQuote(f.name+": "+f.value))
+		}
+	}
+	// curl adds these headers unless they are removed
+	if !hasAccept {
+		args = append(args, "-H "+shellQuote("Accept:"))
+	}
+	if !hasUserAgent {
+		args = append(args, "-H "+shellQuote("User-Agent:"))
+	}
+
+	// bodies that are no text are piped, arguments can not hold every byte
+	var pipe string
+	if len(body) > 0 {
+		if utf8.Valid(body) && bytes.IndexByte(body, 0) < 0 {
+			args = append(args, "--data-raw "+shellQuote(string(body)))
+		} else {
+			pipe = "printf " + printfFormat(body) + " | "
+			args = append(args, "--data-binary @-")
+		}
+	}
+	if compressed {
+		args = append(args, "--compressed")
+	}
+	if proxy != "" && w.protocol != "h3" {
+		args = append(args, "-x "+shellQuote(proxy))
+	}
+	if insecure {
+		args = append(args, "--insecure")
+	}
+
+	return pipe + strings.Join(args, " \\\n  "), nil
+}
+
+// curlFields joins the cookie fields an http/2 or http/3 request splits its cookies into, at the first one
+func curlFields(fields []headerField) []headerField {
+	joined := make([]headerField, 0, len(fields))
+	cookie := -1
+	for _, f := range fields {
+		if f.name == "cookie" {
+			if cookie >= 0 {
+				joined[cookie].value += "; " + f.value
+				continue
+			}
+			cookie = len(joined)
+		}
+		joined = append(joined, f)
+	}
+	return joined
+}
+
+// shellQuote quotes s for a posix shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// printfFormat returns a printf format writing data, non printable bytes are octal escapes
+func printfFormat(data []byte) string {
+	var b strings.Builder
+	for _, c := range data {
+		switch {
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c == '%':
+			b.WriteString("%%")
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+	}
+	return shellQuote(b.String())
+}
+
+// Dump returns the response as http/1.1 text or as the list of the fields of its http/2 or http/3 HEADERS frame,
+// followed by its body as it was received. The header fields are listed in the order they were received in, http/2
+// and http/3 responses start with their pseudo header fields. The transport of non tls clients does not keep that
+// order, their headers are listed in sorted order
+func (r *Response) Dump() []byte {
+	h2 := r.conn.Protocol == "h2" || r.conn.Protocol == "h3"
+	fields := responseFields(r.received, r.headers, r.statusCode, h2)
+
+	var b bytes.Buffer
+	if h2 {
+		for _, f := range fields {
+			fmt.Fprintf(&b, "%s: %s\n", f.name, f.value)
+		}
+		b.WriteString("\n")
+	} else {
+		fmt.Fprintf(&b, "%s %s\r\n", r.proto, r.status)
+		for _, f := range fields {
+			fmt.Fprintf(&b, "%s: %s\r\n", f.name, f.value)
+		}
+		b.WriteString("\r\n")
+	}
+	b.Write(r.body)
+	return b.Bytes()
+}
+
+// responseFields returns the header fields of a response in the order they were received, the fields of its header
+// sorted by name if the connection did not record them. Sorted fields of http/2 and http/3 responses have lowercase
+// names and start with the status like received ones
+func responseFields(received []headerField, header Header, statusCode int, h2 bool) []headerField {
+	if received != nil {
+		return received
+	}
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var fields []headerField
+	if h2 {
+		fields = append(fields, headerField{name: ":status", value: strconv.Itoa(statusCode)})
+	}
+	for _, k := range keys {
+		name := k
+		if h2 {
+			name = strings.ToLower(k)
+		}
+		for _, v := range header[k] {
+			fields = append(fields, headerField{name: name, value: v})
+		}
+	}
+	return fields
+}
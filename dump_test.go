@@ -0,0 +1,299 @@
+package cclient_v2
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+// newDumpRequest returns a POST with headers in order, sent over http2 unless the server only offers http/1.1
+func newDumpRequest(t *testing.T, srv *fingerprinttest.Server, body string) *Request {
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.NewRequest().SetURL(srv.URL+"/path?q=1").
+		SetMethod("POST").
+		SetBody(body).
+		SetHeader("content-type", "text/plain").
+		SetHeader("x-b", "b").
+		SetHeader("x-a", "a").
+		SetHeader("accept", "*/*").
+		SetHeader("user-agent", "agent").
+		SetHeaderOrder([]string{"user-agent", "x-b", "accept", "x-a", "content-type"})
+}
+
+// dumpedFields returns the names and values of the header fields of a dumped request
+func dumpedFields(dump []byte, sep string) (fields []fingerprinttest.Header, body string) {
+	head, body, _ := strings.Cut(string(dump), sep+sep)
+	for _, line := range strings.Split(head, sep) {
+		name, value, _ := strings.Cut(strings.TrimPrefix(line, ":"), ": ")
+		if strings.HasPrefix(line, ":") {
+			name = ":" + name
+		}
+		fields = append(fields, fingerprinttest.Header{Name: name, Value: value})
+	}
+	return fields, body
+}
+
+func TestRequestDump(t *testing.T) {
+	tests := []struct {
+		name       string
+		nextProtos []string
+		sep        string
+	}{
+		{"h2", nil, "\n"},
+		{"http/1.1", []string{"http/1.1"}, "\r\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fingerprinttest.NewUnstartedServer()
+			if test.nextProtos != nil {
+				srv.TLS.NextProtos = test.nextProtos
+			}
+			srv.Start()
+			defer srv.Close()
+
+			req := newDumpRequest(t, srv, "payload")
+			if _, err := req.Do(); err != nil {
+				t.Fatal(err)
+			}
+			dump, err := req.Dump()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, _ := srv.LastFingerprint()
+			r := f.Requests[0]
+
+			fields, body := dumpedFields(dump, test.sep)
+			if test.sep == "\r\n" {
+				if line := fields[0].Name; line != "POST /path?q=1 HTTP/1.1" {
+					t.Errorf("request line: got %q", line)
+				}
+				fields = fields[1:]
+			} else {
+				var pseudo []string
+				for _, field := range fields {
+					if strings.HasPrefix(field.Name, ":") {
+						pseudo = append(pseudo, field.Name)
+					}
+				}
+				if !reflect.DeepEqual(pseudo, r.PseudoHeaderOrder) {
+					t.Errorf("pseudo headers: got %v, server got %v", pseudo, r.PseudoHeaderOrder)
+				}
+				fields = fields[len(pseudo):]
+			}
+			if !reflect.DeepEqual(fields, r.Headers) {
+				t.Errorf("header fields: got %v, server got %v", fields, r.Headers)
+			}
+			if body != "payload" {
+				t.Errorf("body: got %q", body)
+			}
+		})
+	}
+}
+
+func TestRequestDumpUnsent(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+
+	// unsent requests are dumped as they are written over http/1.1 and their body is still sent
+	req := newDumpRequest(t, srv, "payload")
+	dump, err := req.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := strings.TrimPrefix(srv.URL, "https://")
+	want := "POST /path?q=1 HTTP/1.1\r\nuser-agent: agent\r\nx-b: b\r\naccept: */*\r\nx-a: a\r\ncontent-type: text/plain\r\n" +
+		"Content-Length: 7\r\nHost: " + host + "\r\n\r\npayload"
+	if string(dump) != want {
+		t.Errorf("dump: got %q, want %q", dump, want)
+	}
+
+	resp, err := req.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f fingerprinttest.Fingerprint
+	if err = json.Unmarshal(resp.Body(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if r := f.Requests[0]; r.Header("content-length") != "7" {
+		t.Errorf("content length after the dump: got %q", r.Header("content-length"))
+	}
+}
+
+// serveHTTP1Response starts an http/1.1 server with the certificate of srv writing response to every request
+func serveHTTP1Response(t *testing.T, srv *fingerprinttest.Server, response string) string {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: srv.TLS.Certificates, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					if _, err := http.ReadRequest(br); err != nil {
+						return
+					}
+					if _, err := io.WriteString(conn, response); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "https://" + ln.Addr().String()
+}
+
+func TestResponseDump(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	_, _ = zw.Write([]byte("ok"))
+	_ = zw.Close()
+	h1 := serveHTTP1Response(t, srv, "HTTP/1.1 103 Early Hints\r\nLink: </a>\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nX-Z: z\r\nx-a: a\r\n  folded\r\nContent-Length: 2\r\n\r\nok")
+	h1Gzip := serveHTTP1Response(t, srv, "HTTP/1.1 200 OK\r\nX-Z: z\r\nContent-Encoding: gzip\r\n"+
+		"Content-Length: "+strconv.Itoa(gzipped.Len())+"\r\n\r\n"+gzipped.String())
+	h3 := "https://" + serveHTTP3(t, srv, &http3.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Only", "one")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Date", "Mon, 19 Oct 2026 00:00:00 GMT")
+		_, _ = w.Write([]byte("ok"))
+	})})
+
+	tests := []struct {
+		name   string
+		url    string
+		useTLS bool
+		params []interface{}
+		// want are the headers of the dump, LENGTH is replaced with the length of the body
+		want string
+		// anyOrder is set if the server writes the header fields in random order
+		anyOrder bool
+	}{
+		{"h2", srv.URL, true, nil, ":status: 200\ncontent-type: application/json\ncontent-length: LENGTH\n\n", false},
+		{"h2 non tls client", srv.URL, false, nil, ":status: 200\ncontent-length: LENGTH\ncontent-type: application/json\n\n", false},
+		// the transport drops Content-Length if it asked for a gzip body
+		{"http/1.1", h1, true, nil, "HTTP/1.1 200 OK\r\nX-Z: z\r\nx-a: a folded\r\n\r\n", false},
+		{"http/1.1 decompressed", h1Gzip, true, nil, "HTTP/1.1 200 OK\r\nX-Z: z\r\n\r\n", false},
+		{"h3", h3, true, []interface{}{&HTTP3{Mode: HTTP3Always}}, ":status: 200\nx-only: one\ncontent-type: text/plain\ndate: Mon, 19 Oct 2026 00:00:00 GMT\n" +
+			"content-length: 2\n\n", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := append([]interface{}{TLSVerification{RootCAs: srv.CertPool()}}, test.params...)
+			if test.useTLS {
+				params = append([]interface{}{tlsUtls.HelloChrome_102}, params...)
+			}
+			c, err := NewClient("", 5*time.Second, test.useTLS, params...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			// the second response is read after the first on the same connection
+			var resp *Response
+			for i := 0; i < 2; i++ {
+				if resp, err = c.NewRequest().SetURL(test.url).Do(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := strings.ReplaceAll(test.want, "LENGTH", strconv.Itoa(len(resp.Body()))) + string(resp.Body())
+			dump := string(resp.Dump())
+			if test.anyOrder {
+				dump, want = sortedDumpFields(dump), sortedDumpFields(want)
+			}
+			if dump != want {
+				t.Errorf("dump: got %q, want %q", dump, want)
+			}
+		})
+	}
+}
+
+// sortedDumpFields returns an http/2 dump with the header fields after the status sorted
+func sortedDumpFields(dump string) string {
+	head, body, _ := strings.Cut(dump, "\n\n")
+	lines := strings.Split(head, "\n")
+	sort.Strings(lines[1:])
+	return strings.Join(lines, "\n") + "\n\n" + body
+}
+
+func TestToCurl(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+
+	req := newDumpRequest(t, srv, "payload")
+	if _, err := req.Do(); err != nil {
+		t.Fatal(err)
+	}
+	sent, _ := srv.LastFingerprint()
+	command, err := req.ToCurl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "curl '" + srv.URL + "/path?q=1' \\\n  --http2 \\\n  -H 'user-agent: agent' \\\n  -H 'x-b: b' \\\n  -H 'accept: */*' \\\n" +
+		"  -H 'x-a: a' \\\n  -H 'content-type: text/plain' \\\n  -H 'accept-encoding: gzip, deflate, br' \\\n  --data-raw 'payload' \\\n" +
+		"  --compressed"
+	if command != want {
+		t.Errorf("command: got\n%s\nwant\n%s", command, want)
+	}
+
+	binary, err := newDumpRequest(t, srv, "a'b\x00%\\\xff").ToCurl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(binary, `printf 'a'\''b\000%%\\\377' | curl `) || !strings.HasSuffix(binary, "--data-binary @-") {
+		t.Errorf("binary body: got\n%s", binary)
+	}
+
+	// curl sends the headers like the client sent them
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl is not installed")
+	}
+	certificate := filepath.Join(t.TempDir(), "cert.pem")
+	if err = os.WriteFile(certificate, srv.CertificatePEM(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv.Reset()
+	out, err := exec.Command("sh", "-c", command+" --silent --cacert "+shellQuote(certificate)).Output()
+	if err != nil {
+		t.Fatalf("curl: %v", err)
+	}
+	var f fingerprinttest.Fingerprint
+	if err = json.Unmarshal(bytes.TrimSpace(out), &f); err != nil {
+		t.Fatalf("curl output %q: %v", out, err)
+	}
+	if r, want := f.Requests[0], sent.Requests[0]; r.Method != want.Method || r.Path != want.Path || !reflect.DeepEqual(r.Headers, want.Headers) {
+		t.Errorf("curl sent %s %s with %v, the client sent %s %s with %v", r.Method, r.Path, r.Headers, want.Method, want.Path, want.Headers)
+	}
+}
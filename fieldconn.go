@@ -0,0 +1,336 @@
+package cclient_v2
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/useflyent/fhttp/http2"
+	"github.com/useflyent/fhttp/http2/hpack"
+)
+
+// maxHTTP1HeaderBytes is the size of the response headers the fhttp transport reads at most
+const maxHTTP1HeaderBytes = 1 << 20
+
+// fieldRecorder is implemented by the connections of the tls backend, which record the header fields of the responses
+// read from them in the order they were received. The fhttp transports only keep the fields in a map
+type fieldRecorder interface {
+	// recordResponse passes the header fields of the final response to the request written next to got
+	recordResponse(got func(fields []headerField))
+}
+
+// http1FieldConn records the header fields of the http/1.1 responses read from a connection, which answer its requests
+// one after the other
+type http1FieldConn struct {
+	net.Conn
+
+	mu  sync.Mutex
+	got func(fields []headerField)
+	buf []byte
+}
+
+func newHTTP1FieldConn(conn net.Conn) *http1FieldConn {
+	return &http1FieldConn{Conn: conn}
+}
+
+func (c *http1FieldConn) recordResponse(got func(fields []headerField)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.got, c.buf = got, nil
+}
+
+func (c *http1FieldConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.read(p[:n])
+	}
+	return n, err
+}
+
+// read parses the header blocks read until the one of the final response, interim responses are skipped
+func (c *http1FieldConn) read(p []byte) {
+	c.mu.Lock()
+	if c.got == nil {
+		c.mu.Unlock()
+		return
+	}
+	c.buf = append(c.buf, p...)
+
+	for {
+		end := http1HeaderEnd(c.buf)
+		if end < 0 {
+			if len(c.buf) > maxHTTP1HeaderBytes {
+				c.got, c.buf = nil, nil
+			}
+			c.mu.Unlock()
+			return
+		}
+		block := string(c.buf[:end])
+		c.buf = c.buf[end:]
+
+		lines := strings.Split(strings.TrimRight(block, "\r\n"), "\n")
+		if status := strings.Fields(lines[0]); len(status) > 1 && len(status[1]) == 3 && status[1][0] == '1' && status[1] != "101" {
+			continue
+		}
+		got := c.got
+		c.got, c.buf = nil, nil
+		c.mu.Unlock()
+
+		got(http1Fields(lines[1:]))
+		return
+	}
+}
+
+// http1HeaderEnd returns the length of the header block at the start of buf with its empty line, -1 if it is not
+// complete. Lines may end with a bare lf like the fhttp transport accepts
+func http1HeaderEnd(buf []byte) int {
+	for i := bytes.IndexByte(buf, '\n'); i >= 0; {
+		rest := buf[i+1:]
+		switch {
+		case bytes.HasPrefix(rest, []byte("\n")):
+			return i + 2
+		case bytes.HasPrefix(rest, []byte("\r\n")):
+			return i + 3
+		}
+		next := bytes.IndexByte(rest, '\n')
+		if next < 0 {
+			return -1
+		}
+		i += 1 + next
+	}
+	return -1
+}
+
+// http1Fields returns the header fields of the lines of a header block, continuation lines are joined to the field
+// they continue
+func http1Fields(lines []string) []headerField {
+	var fields []headerField
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1].value += " " + strings.Trim(line, " \t")
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, headerField{name: name, value: strings.Trim(value, " \t")})
+	}
+	return fields
+}
+
+// http2FieldConn records the header fields of the http/2 responses read from a connection. The request written next
+// is the one whose HEADERS frame opens the next stream, the header blocks of all streams are decoded to keep the
+// dynamic table of the connection
+type http2FieldConn struct {
+	net.Conn
+
+	wmu            sync.Mutex
+	wbuf           []byte
+	wskip          uint32
+	prefaceWritten bool
+	lastStreamID   uint32
+
+	mu      sync.Mutex
+	pending func(fields []headerField)
+	streams map[uint32]func(fields []headerField)
+	rbuf    []byte
+	rskip   uint32
+	block   []byte
+	// promised is whether the header block is the one of a PUSH_PROMISE frame
+	promised bool
+	decoder  *hpack.Decoder
+	// failed is set when a header block could not be decoded, the fields read after it are not recorded
+	failed bool
+}
+
+func newHTTP2FieldConn(conn net.Conn) *http2FieldConn {
+	decoder := hpack.NewDecoder(defaultHTTP2HeaderTableSize, nil)
+	decoder.SetAllowedMaxDynamicTableSize(math.MaxUint32)
+	return &http2FieldConn{
+		Conn:    conn,
+		streams: make(map[uint32]func(fields []headerField)),
+		decoder: decoder,
+	}
+}
+
+func (c *http2FieldConn) recordResponse(got func(fields []headerField)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending = got
+}
+
+func (c *http2FieldConn) Write(p []byte) (int, error) {
+	c.written(p)
+	return c.Conn.Write(p)
+}
+
+// written binds the pending recorder to the stream opened by the frames written, trailers are HEADERS frames of
+// streams that are already open
+func (c *http2FieldConn) written(p []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if !c.prefaceWritten {
+		n := len(http2.ClientPreface) - len(c.wbuf)
+		if len(p) < n {
+			c.wbuf = append(c.wbuf, p...)
+			return
+		}
+		c.wbuf, p, c.prefaceWritten = nil, p[n:], true
+	}
+	for len(p) > 0 {
+		if c.wskip > 0 {
+			n := c.wskip
+			if n > uint32(len(p)) {
+				n = uint32(len(p))
+			}
+			p, c.wskip = p[n:], c.wskip-n
+			continue
+		}
+
+		n := http2FrameHeaderLen - len(c.wbuf)
+		if n > len(p) {
+			n = len(p)
+		}
+		c.wbuf, p = append(c.wbuf, p[:n]...), p[n:]
+		if len(c.wbuf) < http2FrameHeaderLen {
+			return
+		}
+		streamID := frameStreamID(c.wbuf)
+		if http2.FrameType(c.wbuf[3]) == http2.FrameHeaders && streamID%2 == 1 && streamID > c.lastStreamID {
+			c.lastStreamID = streamID
+			c.mu.Lock()
+			if c.pending != nil && !c.failed {
+				c.streams[streamID], c.pending = c.pending, nil
+			}
+			c.mu.Unlock()
+		}
+		c.wskip, c.wbuf = frameLength(c.wbuf), nil
+	}
+}
+
+func (c *http2FieldConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.read(p[:n])
+	}
+	return n, err
+}
+
+// read decodes the header blocks of the frames read and passes the fields of final responses to their recorders
+func (c *http2FieldConn) read(p []byte) {
+	c.mu.Lock()
+	var got []func()
+	defer func() {
+		c.mu.Unlock()
+		for _, f := range got {
+			f()
+		}
+	}()
+	if c.failed {
+		return
+	}
+
+	c.rbuf = append(c.rbuf, p...)
+	for len(c.rbuf) > 0 {
+		if c.rskip > 0 {
+			n := c.rskip
+			if n > uint32(len(c.rbuf)) {
+				n = uint32(len(c.rbuf))
+			}
+			c.rbuf, c.rskip = c.rbuf[n:], c.rskip-n
+			continue
+		}
+		if len(c.rbuf) < http2FrameHeaderLen {
+			break
+		}
+		typ, length := http2.FrameType(c.rbuf[3]), frameLength(c.rbuf)
+		if !isHeaderBlock(typ) {
+			if typ == http2.FrameRSTStream {
+				delete(c.streams, frameStreamID(c.rbuf))
+			}
+			c.rbuf, c.rskip = c.rbuf[http2FrameHeaderLen:], length
+			continue
+		}
+		n := http2FrameHeaderLen + int(length)
+		if len(c.rbuf) < n {
+			break
+		}
+		frame := c.rbuf[:n]
+		c.rbuf = c.rbuf[n:]
+
+		fields, ok := c.headerBlock(frame)
+		if !ok {
+			c.failed, c.streams, c.rbuf = true, nil, nil
+			return
+		}
+		streamID := frameStreamID(frame)
+		if record := c.streams[streamID]; record != nil && fields != nil && !informational(fields) {
+			delete(c.streams, streamID)
+			got = append(got, func() { record(fields) })
+		}
+	}
+	c.rbuf = append([]byte(nil), c.rbuf...)
+}
+
+// headerBlock decodes the header block a frame completes, nil if the block continues. PUSH_PROMISE blocks are decoded
+// but not returned
+func (c *http2FieldConn) headerBlock(frame []byte) ([]headerField, bool) {
+	typ, flags := http2.FrameType(frame[3]), http2.Flags(frame[4])
+	fragment := frame[http2FrameHeaderLen:]
+	switch typ {
+	case http2.FrameHeaders:
+		c.promised = false
+		var ok bool
+		if fragment, ok = headerBlockFragment(frame); !ok {
+			return nil, false
+		}
+	case http2.FramePushPromise:
+		c.promised = true
+		padding := 0
+		if flags.Has(http2.FlagPushPromisePadded) {
+			if len(fragment) < 1 {
+				return nil, false
+			}
+			padding, fragment = int(fragment[0]), fragment[1:]
+		}
+		if len(fragment) < 4+padding {
+			return nil, false
+		}
+		fragment = fragment[4 : len(fragment)-padding]
+	}
+	c.block = append(c.block, fragment...)
+	if !flags.Has(http2.FlagHeadersEndHeaders) {
+		return nil, true
+	}
+
+	decoded, err := c.decoder.DecodeFull(c.block)
+	c.block = nil
+	if err != nil {
+		return nil, false
+	}
+	if c.promised {
+		return nil, true
+	}
+	fields := make([]headerField, len(decoded))
+	for i, f := range decoded {
+		fields[i] = headerField{name: f.Name, value: f.Value}
+	}
+	return fields, true
+}
+
+// informational is whether header fields are the ones of an interim response
+func informational(fields []headerField) bool {
+	for _, f := range fields {
+		if f.name == ":status" {
+			return len(f.value) == 3 && f.value[0] == '1'
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package cclient_v2
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/useflyent/fhttp/http2"
+	"github.com/useflyent/fhttp/http2/hpack"
+)
+
+func TestHTTP2FieldConn(t *testing.T) {
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	encode := func(fields ...hpack.HeaderField) []byte {
+		block.Reset()
+		for _, f := range fields {
+			if err := encoder.WriteField(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return append([]byte(nil), block.Bytes()...)
+	}
+	field := func(name, value string) hpack.HeaderField { return hpack.HeaderField{Name: name, Value: value} }
+
+	conn := &bufferConn{}
+	c := newHTTP2FieldConn(conn)
+	got := make(map[string][]headerField)
+	record := func(name string) func([]headerField) {
+		return func(fields []headerField) { got[name] = fields }
+	}
+
+	// frames may be split across writes
+	var written bytes.Buffer
+	fw := http2.NewFramer(&written, nil)
+	write := func() {
+		for _, b := range written.Bytes()[conn.out.Len():] {
+			if _, err := c.Write([]byte{b}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	written.WriteString(http2.ClientPreface)
+	_ = fw.WriteSettings()
+	c.recordResponse(record("first"))
+	_ = fw.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: []byte{0x82}, EndHeaders: true})
+	write()
+	// the trailers of the first stream are written before the second request opens its stream
+	c.recordResponse(record("second"))
+	_ = fw.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: []byte{0x82}, EndHeaders: true, EndStream: true})
+	_ = fw.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: []byte{0x82}, EndHeaders: true})
+	write()
+
+	var read bytes.Buffer
+	fr := http2.NewFramer(&read, nil)
+	_ = fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: encode(field(":status", "103"), field("link", "</a>")), EndHeaders: true})
+	final := encode(field(":status", "200"), field("x-z", "z"), field("content-type", "text/plain"))
+	_ = fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: final[:2], PadLength: 4, Priority: http2.PriorityParam{Weight: 1}})
+	_ = fr.WriteContinuation(3, true, final[2:])
+	_ = fr.WritePushPromise(http2.PushPromiseParam{StreamID: 3, PromiseID: 2, BlockFragment: encode(field(":path", "/pushed")), EndHeaders: true})
+	_ = fr.WriteData(3, true, []byte("body"))
+	// the dynamic table entries of the second response are referred to by the first
+	_ = fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: encode(field(":status", "404"), field("x-z", "z"), field("x-a", "a")), EndHeaders: true})
+	conn.in.Write(read.Bytes())
+	p := make([]byte, 7)
+	for {
+		if _, err := c.Read(p); err != nil {
+			break
+		}
+	}
+
+	want := map[string][]headerField{
+		"second": {{":status", "200"}, {"x-z", "z"}, {"content-type", "text/plain"}},
+		"first":  {{":status", "404"}, {"x-z", "z"}, {"x-a", "a"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !bytes.Equal(conn.out.Bytes(), written.Bytes()) {
+		t.Error("written bytes were changed")
+	}
+}
+
+func TestHTTP1FieldConn(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     []headerField
+	}{
+		{"crlf", "HTTP/1.1 200 OK\r\nX-Z: z\r\ncontent-type:text/plain\r\n\r\nbody", []headerField{{"X-Z", "z"}, {"content-type", "text/plain"}}},
+		{"lf", "HTTP/1.1 200 OK\nX-Z: z\n\nbody", []headerField{{"X-Z", "z"}}},
+		{"interim", "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 204 No Content\r\nX-A: a\r\n\r\n", []headerField{{"X-A", "a"}}},
+		{"continued", "HTTP/1.1 200 OK\r\nX-A: a\r\n\tb\r\nX-B:  c \r\n\r\n", []headerField{{"X-A", "a b"}, {"X-B", "c"}}},
+		{"switching protocols", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n", []headerField{{"Upgrade", "websocket"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &bufferConn{}
+			conn.in.WriteString(test.response)
+			c := newHTTP1FieldConn(conn)
+			var got []headerField
+			c.recordResponse(func(fields []headerField) { got = fields })
+
+			p := make([]byte, 3)
+			for {
+				if _, err := c.Read(p); err != nil {
+					break
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
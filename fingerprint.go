@@ -0,0 +1,215 @@
+package cclient_v2
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	tlsUtls "github.com/refraction-networking/utls"
+)
+
+// FingerprintReport lists the parts of a captured client hello the spec does not copy faithfully
+type FingerprintReport struct {
+	Issues []FingerprintIssue
+}
+
+// FingerprintIssue is an extension of a captured client hello that is not copied faithfully
+type FingerprintIssue struct {
+	ExtensionID uint16
+	// Dropped is set if the extension is left out of the spec, otherwise it is sent with other contents than captured
+	Dropped bool
+	Reason  string
+}
+
+func (i FingerprintIssue) String() string {
+	if i.Dropped {
+		return fmt.Sprintf("extension %d dropped: %s", i.ExtensionID, i.Reason)
+	}
+	return fmt.Sprintf("extension %d changed: %s", i.ExtensionID, i.Reason)
+}
+
+// Faithful reports whether the spec copies the captured client hello without issues
+func (r *FingerprintReport) Faithful() bool {
+	return len(r.Issues) == 0
+}
+
+func (r *FingerprintReport) add(id uint16, dropped bool, reason string) {
+	r.Issues = append(r.Issues, FingerprintIssue{ExtensionID: id, Dropped: dropped, Reason: reason})
+}
+
+// FingerprintClientHello builds a client hello spec from a captured client hello, which can be hex, base64,
+// raw bytes or a pcap file, see DecodeClientHello. The report lists what could not be copied faithfully
+func FingerprintClientHello(data []byte) (*ClientHelloSpec, *FingerprintReport, error) {
+	record, err := DecodeClientHello(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f := &tlsUtls.Fingerprinter{AllowBluntMimicry: true, RealPSKResumption: true}
+	captured, err := f.FingerprintClientHello(record)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spec, report := newClientHelloSpec(captured)
+	if _, err = spec.Spec(); err != nil {
+		return nil, nil, err
+	}
+	return spec, report, nil
+}
+
+// newClientHelloSpec describes a fingerprinted utls spec, leaving out the extensions utls can not build
+func newClientHelloSpec(captured *tlsUtls.ClientHelloSpec) (*ClientHelloSpec, *FingerprintReport) {
+	report := &FingerprintReport{}
+	spec := &ClientHelloSpec{
+		TLSVersMin:         captured.TLSVersMin,
+		TLSVersMax:         captured.TLSVersMax,
+		CipherSuites:       append([]uint16(nil), captured.CipherSuites...),
+		CompressionMethods: append(byteList(nil), captured.CompressionMethods...),
+	}
+
+	for _, e := range captured.Extensions {
+		ext, ok := describeExtension(e, report)
+		if ok {
+			spec.Extensions = append(spec.Extensions, ext)
+		}
+	}
+
+	return spec, report
+}
+
+// describeExtension describes a fingerprinted utls extension, issues are added to the report
+func describeExtension(e tlsUtls.TLSExtension, report *FingerprintReport) (ClientHelloExtension, bool) {
+	switch ext := e.(type) {
+	case *tlsUtls.SNIExtension:
+		return ClientHelloExtension{ID: extensionServerName}, true
+	case *tlsUtls.NPNExtension:
+		return ClientHelloExtension{ID: extensionNextProtoNeg}, true
+	case *tlsUtls.StatusRequestExtension:
+		return ClientHelloExtension{ID: extensionStatusRequest}, true
+	case *tlsUtls.SupportedCurvesExtension:
+		d := ClientHelloExtension{ID: extensionSupportedCurves}
+		for _, c := range ext.Curves {
+			d.Curves = append(d.Curves, uint16(c))
+		}
+		return d, true
+	case *tlsUtls.SupportedPointsExtension:
+		return ClientHelloExtension{ID: extensionSupportedPoints, PointFormats: append(byteList(nil), ext.SupportedPoints...)}, true
+	case *tlsUtls.SessionTicketExtension:
+		return ClientHelloExtension{ID: extensionSessionTicket}, true
+	case *tlsUtls.SignatureAlgorithmsExtension:
+		return ClientHelloExtension{ID: extensionSignatureAlgorithms, SignatureAlgorithms: signatureSchemes(ext.SupportedSignatureAlgorithms)}, true
+	case *tlsUtls.RenegotiationInfoExtension:
+		return ClientHelloExtension{ID: extensionRenegotiationInfo}, true
+	case *tlsUtls.ALPNExtension:
+		return ClientHelloExtension{ID: extensionALPN, Protocols: ext.AlpnProtocols}, true
+	case *tlsUtls.SCTExtension:
+		return ClientHelloExtension{ID: extensionSCT}, true
+	case *tlsUtls.SupportedVersionsExtension:
+		return ClientHelloExtension{ID: extensionSupportedVersions, Versions: append([]uint16(nil), ext.Versions...)}, true
+	case *tlsUtls.KeyShareExtension:
+		d := ClientHelloExtension{ID: extensionKeyShare}
+		for _, s := range ext.KeyShares {
+			share := ClientHelloKeyShare{Group: uint16(s.Group)}
+			switch {
+			case s.Group == tlsUtls.GREASE_PLACEHOLDER:
+				share.Data = hex.EncodeToString(s.Data)
+			case !keyShareGroups[s.Group]:
+				report.add(extensionKeyShare, false, fmt.Sprintf("key share of group %d left out, utls can not generate it", s.Group))
+				continue
+			}
+			d.KeyShares = append(d.KeyShares, share)
+		}
+		return d, true
+	case *tlsUtls.PSKKeyExchangeModesExtension:
+		return ClientHelloExtension{ID: extensionPSKModes, PSKModes: append(byteList(nil), ext.Modes...)}, true
+	case *tlsUtls.UtlsExtendedMasterSecretExtension:
+		return ClientHelloExtension{ID: extensionExtendedMasterSecret}, true
+	case *tlsUtls.UtlsPaddingExtension:
+		return ClientHelloExtension{ID: extensionPadding}, true
+	case *tlsUtls.UtlsCompressCertExtension:
+		d := ClientHelloExtension{ID: extensionCompressCertificate}
+		for _, a := range ext.Algorithms {
+			d.CertCompressionAlgorithms = append(d.CertCompressionAlgorithms, uint16(a))
+		}
+		return d, true
+	case *tlsUtls.FakeChannelIDExtension:
+		if ext.OldExtensionID {
+			return ClientHelloExtension{ID: extensionChannelIDOld}, true
+		}
+		return ClientHelloExtension{ID: extensionChannelID}, true
+	case *tlsUtls.FakeTokenBindingExtension:
+		data := append([]byte{ext.MajorVersion, ext.MinorVersion, byte(len(ext.KeyParameters))}, ext.KeyParameters...)
+		return ClientHelloExtension{ID: extensionTokenBinding, Data: hex.EncodeToString(data)}, true
+	case *tlsUtls.ApplicationSettingsExtension:
+		return ClientHelloExtension{ID: extensionApplicationSettings, Protocols: ext.SupportedProtocols}, true
+	case *tlsUtls.FakeRecordSizeLimitExtension:
+		return ClientHelloExtension{ID: extensionRecordSizeLimit, RecordSizeLimit: ext.Limit}, true
+	case *tlsUtls.FakeDelegatedCredentialsExtension:
+		return ClientHelloExtension{ID: extensionDelegatedCredentials, SignatureAlgorithms: signatureSchemes(ext.SupportedSignatureAlgorithms)}, true
+	case *tlsUtls.UtlsGREASEExtension:
+		return ClientHelloExtension{ID: tlsUtls.GREASE_PLACEHOLDER, Data: hex.EncodeToString(ext.Body)}, true
+	case *tlsUtls.UtlsPreSharedKeyExtension:
+		report.add(extensionPreSharedKey, false, "only sent with the pre shared key of a resumed session")
+		return ClientHelloExtension{ID: extensionPreSharedKey}, true
+	case *tlsUtls.GenericExtension:
+		return describeGenericExtension(ext, report)
+	}
+
+	report.add(0, true, fmt.Sprintf("unknown utls extension %T", e))
+	return ClientHelloExtension{}, false
+}
+
+// describeGenericExtension describes an extension the fingerprinter copied as raw bytes
+func describeGenericExtension(ext *tlsUtls.GenericExtension, report *FingerprintReport) (ClientHelloExtension, bool) {
+	d := ClientHelloExtension{ID: ext.Id, Data: hex.EncodeToString(ext.Data)}
+
+	switch ext.Id {
+	case extensionSignatureAlgorithmsCert:
+		algorithms, err := parseSignatureAlgorithms(ext.Data)
+		if err != nil {
+			report.add(ext.Id, true, err.Error())
+			return ClientHelloExtension{}, false
+		}
+		return ClientHelloExtension{ID: ext.Id, SignatureAlgorithms: algorithms}, true
+	case extensionStatusRequestV2:
+		report.add(ext.Id, false, "sent with the contents of utls")
+		return ClientHelloExtension{ID: ext.Id}, true
+	case extensionEncryptThenMac, extensionPostHandshakeAuth:
+		return d, true
+	}
+
+	if _, err := d.extension(); err != nil {
+		var unsupported *UnsupportedExtensionError
+		if errors.As(err, &unsupported) {
+			report.add(ext.Id, true, unsupported.Reason)
+		} else {
+			report.add(ext.Id, true, err.Error())
+		}
+		return ClientHelloExtension{}, false
+	}
+
+	report.add(ext.Id, false, "copied as raw bytes, the contents are the same for every connection")
+	return d, true
+}
+
+// parseSignatureAlgorithms parses the length prefixed signature algorithm list of an extension
+func parseSignatureAlgorithms(data []byte) ([]uint16, error) {
+	if len(data) < 2 || int(data[0])<<8|int(data[1]) != len(data)-2 || len(data)%2 != 0 {
+		return nil, errors.New("invalid signature algorithms")
+	}
+
+	var algorithms []uint16
+	for i := 2; i < len(data); i += 2 {
+		algorithms = append(algorithms, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return algorithms, nil
+}
+
+func signatureSchemes(schemes []tlsUtls.SignatureScheme) []uint16 {
+	algorithms := make([]uint16, len(schemes))
+	for i, s := range schemes {
+		algorithms[i] = uint16(s)
+	}
+	return algorithms
+}
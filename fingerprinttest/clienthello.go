@@ -0,0 +1,299 @@
+package fingerprinttest
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	extensionServerName          = 0
+	extensionSupportedGroups     = 10
+	extensionECPointFormats      = 11
+	extensionSignatureAlgorithms = 13
+	extensionALPN                = 16
+	extensionSupportedVersions   = 43
+)
+
+// clientHello holds the fields of a client hello the fingerprints are computed from
+type clientHello struct {
+	version             uint16
+	cipherSuites        []uint16
+	extensions          []uint16
+	serverName          string
+	hasServerName       bool
+	groups              []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	alpn                []string
+	supportedVersions   []uint16
+}
+
+// reader reads big endian values from a byte slice, a failed read leaves ok false
+type reader struct {
+	data []byte
+	ok   bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if !r.ok || len(r.data) < n {
+		r.ok = false
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint24() int {
+	if b := r.bytes(3); b != nil {
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	}
+	return 0
+}
+
+// prefixed reads a length prefixed value with a length of size bytes
+func (r *reader) prefixed(size int) *reader {
+	var n int
+	switch size {
+	case 1:
+		n = int(r.uint8())
+	case 2:
+		n = int(r.uint16())
+	default:
+		n = r.uint24()
+	}
+	return &reader{data: r.bytes(n), ok: r.ok}
+}
+
+func (r *reader) uint16s() []uint16 {
+	var values []uint16
+	for r.ok && len(r.data) > 0 {
+		values = append(values, r.uint16())
+	}
+	return values
+}
+
+// clientHelloMessage returns the client hello handshake message at the start of the records in data,
+// complete is false if data ends before the message does
+func clientHelloMessage(data []byte) (message []byte, complete bool, err error) {
+	for len(data) >= 5 {
+		if data[0] != 0x16 {
+			return nil, false, errors.New("client hello is not a handshake record")
+		}
+
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			return nil, false, nil
+		}
+		message = append(message, data[5:5+length]...)
+		data = data[5+length:]
+
+		if len(message) >= 4 {
+			if message[0] != 0x01 {
+				return nil, false, errors.New("handshake message is not a client hello")
+			}
+			if n := 4 + (int(message[1])<<16 | int(message[2])<<8 | int(message[3])); len(message) >= n {
+				return message[:n], true, nil
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+// parseClientHello parses a client hello handshake message
+func parseClientHello(message []byte) (*clientHello, error) {
+	r := &reader{data: message, ok: true}
+	r.uint8()
+	body := r.prefixed(3)
+
+	hello := &clientHello{version: body.uint16()}
+	body.bytes(32)
+	body.prefixed(1)
+	hello.cipherSuites = body.prefixed(2).uint16s()
+	body.prefixed(1)
+
+	extensions := body.prefixed(2)
+	for extensions.ok && len(extensions.data) > 0 {
+		id := extensions.uint16()
+		data := extensions.prefixed(2)
+		hello.extensions = append(hello.extensions, id)
+
+		switch id {
+		case extensionServerName:
+			hello.hasServerName = true
+			names := data.prefixed(2)
+			for names.ok && len(names.data) > 0 {
+				nameType := names.uint8()
+				name := names.prefixed(2)
+				if nameType == 0 {
+					hello.serverName = string(name.data)
+				}
+			}
+		case extensionSupportedGroups:
+			hello.groups = data.prefixed(2).uint16s()
+		case extensionECPointFormats:
+			hello.pointFormats = data.prefixed(1).data
+		case extensionSignatureAlgorithms:
+			hello.signatureAlgorithms = data.prefixed(2).uint16s()
+		case extensionALPN:
+			protocols := data.prefixed(2)
+			for protocols.ok && len(protocols.data) > 0 {
+				hello.alpn = append(hello.alpn, string(protocols.prefixed(1).data))
+			}
+		case extensionSupportedVersions:
+			hello.supportedVersions = data.prefixed(1).uint16s()
+		}
+	}
+
+	if !r.ok || !body.ok || !extensions.ok {
+		return nil, errors.New("malformed client hello")
+	}
+	return hello, nil
+}
+
+// ja3 returns the ja3 string of the client hello, GREASE values are left out
+func (h *clientHello) ja3() string {
+	points := make([]uint16, len(h.pointFormats))
+	for i, p := range h.pointFormats {
+		points[i] = uint16(p)
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinDecimal(h.cipherSuites),
+		joinDecimal(h.extensions),
+		joinDecimal(h.groups),
+		joinDecimal(points),
+	}, ",")
+}
+
+// ja4 returns the ja4 fingerprint of the client hello sent over tcp
+func (h *clientHello) ja4() string {
+	version := h.version
+	for _, v := range h.supportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+
+	sni := "i"
+	if h.hasServerName {
+		sni = "d"
+	}
+
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first := h.alpn[0]
+		if isAlphanumeric(first[0]) && isAlphanumeric(first[len(first)-1]) {
+			alpn = string(first[0]) + string(first[len(first)-1])
+		} else {
+			encoded := hex.EncodeToString([]byte(first))
+			alpn = string(encoded[0]) + string(encoded[len(encoded)-1])
+		}
+	}
+
+	var ciphers, extensions []string
+	for _, c := range h.cipherSuites {
+		if !isGREASE(c) {
+			ciphers = append(ciphers, fmt.Sprintf("%04x", c))
+		}
+	}
+
+	extensionCount := 0
+	for _, e := range h.extensions {
+		if isGREASE(e) {
+			continue
+		}
+		extensionCount++
+		if e != extensionServerName && e != extensionALPN {
+			extensions = append(extensions, fmt.Sprintf("%04x", e))
+		}
+	}
+
+	sort.Strings(ciphers)
+	sort.Strings(extensions)
+
+	var algorithms []string
+	for _, a := range h.signatureAlgorithms {
+		algorithms = append(algorithms, fmt.Sprintf("%04x", a))
+	}
+
+	extensionHash := "000000000000"
+	if len(extensions) > 0 {
+		value := strings.Join(extensions, ",")
+		if len(algorithms) > 0 {
+			value += "_" + strings.Join(algorithms, ",")
+		}
+		extensionHash = truncatedHash([]string{value})
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni, min99(len(ciphers)), min99(extensionCount), alpn)
+	return strings.Join([]string{a, truncatedHash(ciphers), extensionHash}, "_")
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// joinDecimal joins the values that are not GREASE values with dashes
+func joinDecimal(values []uint16) string {
+	var s []string
+	for _, v := range values {
+		if !isGREASE(v) {
+			s = append(s, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(s, "-")
+}
+
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
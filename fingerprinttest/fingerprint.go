@@ -0,0 +1,213 @@
+package fingerprinttest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Fingerprint is what a client sent on one connection to the server
+type Fingerprint struct {
+	RemoteAddr string `json:"remote_addr"`
+	// ServerName is the sni of the client hello, empty if it was not sent
+	ServerName string `json:"server_name"`
+	// TLSVersion is the negotiated tls version
+	TLSVersion uint16 `json:"tls_version"`
+	// ALPN is the negotiated protocol, OfferedALPN are the protocols of the client hello
+	ALPN        string   `json:"alpn"`
+	OfferedALPN []string `json:"offered_alpn"`
+	JA3         string   `json:"ja3"`
+	JA3Hash     string   `json:"ja3_hash"`
+	JA4         string   `json:"ja4"`
+	// ClientHello is the client hello record
+	ClientHello []byte `json:"client_hello"`
+	// HTTP2 is the http2 connection fingerprint, nil for http1 connections
+	HTTP2 *HTTP2Fingerprint `json:"http2,omitempty"`
+	// Akamai is the akamai http2 fingerprint string, set with the first request of an http2 connection
+	Akamai string `json:"akamai,omitempty"`
+	// Requests are the requests sent on the connection in the order they were received
+	Requests []RequestFingerprint `json:"requests"`
+}
+
+// HTTP2Fingerprint is the http2 connection preface a client sent before its first request
+type HTTP2Fingerprint struct {
+	// Settings are the settings of the first SETTINGS frame in the order they were sent
+	Settings []Setting `json:"settings"`
+	// WindowUpdate is the increment of the first connection WINDOW_UPDATE frame, zero if none was sent
+	WindowUpdate uint32 `json:"window_update"`
+	// Priorities are the PRIORITY frames sent before the first request
+	Priorities []Priority `json:"priorities"`
+	// PseudoHeaderOrder is the pseudo header order of the first request
+	PseudoHeaderOrder []string `json:"pseudo_header_order"`
+}
+
+// Setting is an http2 setting
+type Setting struct {
+	ID    uint16 `json:"id"`
+	Value uint32 `json:"value"`
+}
+
+// Priority is the priority of an http2 stream, Weight is the weight as sent on the wire, 0 to 255
+type Priority struct {
+	StreamID  uint32 `json:"stream_id"`
+	Exclusive bool   `json:"exclusive"`
+	DependsOn uint32 `json:"depends_on"`
+	Weight    uint8  `json:"weight"`
+}
+
+// Header is a header field as the client sent it
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// RequestFingerprint is what a client sent in one request
+type RequestFingerprint struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Proto is HTTP/1.1 or HTTP/2.0
+	Proto string `json:"proto"`
+	// Headers are the header fields in the order they were sent, http1 names keep their casing
+	Headers []Header `json:"headers"`
+	// HeaderOrder are the header names in the order they were sent, without pseudo headers
+	HeaderOrder []string `json:"header_order"`
+	// PseudoHeaderOrder is the pseudo header order of an http2 request
+	PseudoHeaderOrder []string `json:"pseudo_header_order,omitempty"`
+	// Priority is the priority of the HEADERS frame of an http2 request, nil if it had none
+	Priority *Priority `json:"priority,omitempty"`
+	JA4H     string    `json:"ja4h"`
+}
+
+// String returns the akamai http2 fingerprint string, SETTINGS|WINDOW_UPDATE|PRIORITY|pseudo header order
+func (f *HTTP2Fingerprint) String() string {
+	var settings []string
+	for _, s := range f.Settings {
+		settings = append(settings, fmt.Sprintf("%d:%d", s.ID, s.Value))
+	}
+
+	windowUpdate := "00"
+	if f.WindowUpdate != 0 {
+		windowUpdate = fmt.Sprint(f.WindowUpdate)
+	}
+
+	priorities := "0"
+	if len(f.Priorities) > 0 {
+		var p []string
+		for _, priority := range f.Priorities {
+			exclusive := 0
+			if priority.Exclusive {
+				exclusive = 1
+			}
+			p = append(p, fmt.Sprintf("%d:%d:%d:%d", priority.StreamID, exclusive, priority.DependsOn, int(priority.Weight)+1))
+		}
+		priorities = strings.Join(p, ",")
+	}
+
+	var pseudo []string
+	for _, h := range f.PseudoHeaderOrder {
+		if name := strings.TrimPrefix(h, ":"); name != "" {
+			pseudo = append(pseudo, name[:1])
+		}
+	}
+
+	return strings.Join([]string{strings.Join(settings, ";"), windowUpdate, priorities, strings.Join(pseudo, ",")}, "|")
+}
+
+// Header returns the first value of the header with the case insensitive name
+func (r *RequestFingerprint) Header(name string) string {
+	for _, h := range r.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// ja4h computes the ja4h fingerprint of the request
+func (r *RequestFingerprint) ja4h() string {
+	version := "11"
+	if r.Proto == "HTTP/2.0" {
+		version = "20"
+	}
+
+	method := strings.ToLower(r.Method)
+	if len(method) > 2 {
+		method = method[:2]
+	}
+
+	var names, cookieNames, cookies []string
+	cookie, referer := "n", "n"
+	language := "0000"
+	for _, h := range r.Headers {
+		switch strings.ToLower(h.Name) {
+		case "cookie":
+			cookie = "c"
+			for _, c := range strings.Split(h.Value, ";") {
+				c = strings.TrimSpace(c)
+				if c == "" {
+					continue
+				}
+				cookies = append(cookies, c)
+				cookieNames = append(cookieNames, strings.SplitN(c, "=", 2)[0])
+			}
+			continue
+		case "referer":
+			referer = "r"
+			continue
+		case "accept-language":
+			if language == "0000" {
+				language = ja4hLanguage(h.Value)
+			}
+		}
+		names = append(names, h.Name)
+	}
+
+	count := len(names)
+	if count > 99 {
+		count = 99
+	}
+
+	sort.Strings(cookieNames)
+	sort.Strings(cookies)
+
+	a := fmt.Sprintf("%s%s%s%s%02d%s", method, version, cookie, referer, count, language)
+	return strings.Join([]string{a, truncatedHash(names), truncatedHash(cookieNames), truncatedHash(cookies)}, "_")
+}
+
+// ja4hLanguage returns the first four characters of the primary accept language without dashes
+func ja4hLanguage(value string) string {
+	language := strings.ToLower(value)
+	language = strings.NewReplacer("-", "", ";", ",").Replace(language)
+	language = strings.SplitN(language, ",", 2)[0]
+	if len(language) > 4 {
+		language = language[:4]
+	}
+	return language + strings.Repeat("0", 4-len(language))
+}
+
+// truncatedHash is the first 12 hex characters of the sha256 of the comma joined values, zeros for no values
+func truncatedHash(values []string) string {
+	if len(values) == 0 {
+		return "000000000000"
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(values, ",")))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// clone returns a deep copy of the fingerprint
+func (f *Fingerprint) clone() Fingerprint {
+	c := *f
+	c.OfferedALPN = append([]string(nil), f.OfferedALPN...)
+	c.ClientHello = append([]byte(nil), f.ClientHello...)
+	c.Requests = append([]RequestFingerprint(nil), f.Requests...)
+	if f.HTTP2 != nil {
+		h2 := *f.HTTP2
+		h2.Settings = append([]Setting(nil), f.HTTP2.Settings...)
+		h2.Priorities = append([]Priority(nil), f.HTTP2.Priorities...)
+		c.HTTP2 = &h2
+	}
+	return c
+}
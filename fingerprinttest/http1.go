@@ -0,0 +1,75 @@
+package fingerprinttest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serveHTTP1 serves the http1 requests of a connection, header names are recorded with their casing
+func (s *Server) serveHTTP1(c net.Conn, f *Fingerprint) {
+	br := bufio.NewReader(c)
+
+	for {
+		head, err := readHead(br)
+		if err != nil {
+			return
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(io.MultiReader(bytes.NewReader(head), br)))
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, req.Body)
+		_ = req.Body.Close()
+
+		r := RequestFingerprint{
+			Method: req.Method,
+			Path:   req.RequestURI,
+			Proto:  req.Proto,
+		}
+		for _, line := range strings.Split(string(head), "\r\n")[1:] {
+			i := strings.IndexByte(line, ':')
+			if i <= 0 {
+				continue
+			}
+			name := line[:i]
+			r.Headers = append(r.Headers, Header{Name: name, Value: strings.TrimSpace(line[i+1:])})
+			r.HeaderOrder = append(r.HeaderOrder, name)
+		}
+
+		body := s.addRequest(f, r, nil)
+		_, err = fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		if err != nil || req.Close {
+			return
+		}
+	}
+}
+
+// readHead reads the request line and header lines of a request, including the empty line after them
+func readHead(br *bufio.Reader) ([]byte, error) {
+	var head []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		head = append(head, line...)
+
+		if len(head) > 1<<20 {
+			return nil, fmt.Errorf("request head too large")
+		}
+		if bytes.HasSuffix(head, []byte("\r\n\r\n")) || bytes.Equal(head, []byte("\r\n")) {
+			if bytes.Equal(head, []byte("\r\n")) {
+				// skip empty lines before the request line
+				head = nil
+				continue
+			}
+			return head, nil
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package fingerprinttest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// maxDataFrame is the largest DATA frame the server sends, the default max frame size of clients
+const maxDataFrame = 16384
+
+// http2Stream is a request stream of an http2 connection
+type http2Stream struct {
+	block     []byte
+	fields    []hpack.HeaderField
+	priority  *Priority
+	headers   bool
+	endStream bool
+}
+
+// serveHTTP2 serves the http2 requests of a connection, the frames sent before the first request make up the
+// connection fingerprint
+func (s *Server) serveHTTP2(c net.Conn, f *Fingerprint) {
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(c, preface); err != nil || string(preface) != http2.ClientPreface {
+		return
+	}
+
+	fr := http2.NewFramer(c, c)
+	if err := fr.WriteSettings(); err != nil {
+		return
+	}
+
+	decoder := hpack.NewDecoder(4096, nil)
+	var encoded bytes.Buffer
+	encoder := hpack.NewEncoder(&encoded)
+
+	h2 := &HTTP2Fingerprint{}
+	settings, windowUpdate, requested := false, false, false
+	streams := make(map[uint32]*http2Stream)
+
+	respond := func(id uint32, st *http2Stream) error {
+		delete(streams, id)
+
+		r := RequestFingerprint{Proto: "HTTP/2.0", Priority: st.priority}
+		for _, field := range st.fields {
+			if strings.HasPrefix(field.Name, ":") {
+				r.PseudoHeaderOrder = append(r.PseudoHeaderOrder, field.Name)
+				switch field.Name {
+				case ":method":
+					r.Method = field.Value
+				case ":path":
+					r.Path = field.Value
+				}
+				continue
+			}
+			r.Headers = append(r.Headers, Header{Name: field.Name, Value: field.Value})
+			r.HeaderOrder = append(r.HeaderOrder, field.Name)
+		}
+
+		var body []byte
+		if !requested {
+			requested = true
+			body = s.addRequest(f, r, h2)
+		} else {
+			body = s.addRequest(f, r, nil)
+		}
+
+		encoded.Reset()
+		_ = encoder.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+		_ = encoder.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/json"})
+		_ = encoder.WriteField(hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(body))})
+		if err := fr.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: encoded.Bytes(), EndHeaders: true}); err != nil {
+			return err
+		}
+
+		for len(body) > maxDataFrame {
+			if err := fr.WriteData(id, false, body[:maxDataFrame]); err != nil {
+				return err
+			}
+			body = body[maxDataFrame:]
+		}
+		return fr.WriteData(id, true, body)
+	}
+
+	// endHeaders decodes the header block of a stream, trailers end the request
+	endHeaders := func(id uint32, st *http2Stream) error {
+		fields, err := decoder.DecodeFull(st.block)
+		st.block = nil
+		if err != nil {
+			return err
+		}
+
+		if st.headers {
+			return respond(id, st)
+		}
+		st.fields = fields
+		st.headers = true
+
+		if st.endStream {
+			return respond(id, st)
+		}
+		return nil
+	}
+
+	for {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		switch frame := frame.(type) {
+		case *http2.SettingsFrame:
+			if frame.IsAck() {
+				continue
+			}
+			if !settings && !requested {
+				settings = true
+				_ = frame.ForeachSetting(func(setting http2.Setting) error {
+					h2.Settings = append(h2.Settings, Setting{ID: uint16(setting.ID), Value: setting.Val})
+					return nil
+				})
+			}
+			err = fr.WriteSettingsAck()
+		case *http2.WindowUpdateFrame:
+			if frame.StreamID == 0 && !windowUpdate && !requested {
+				windowUpdate = true
+				h2.WindowUpdate = frame.Increment
+			}
+		case *http2.PriorityFrame:
+			if !requested {
+				h2.Priorities = append(h2.Priorities, newPriority(frame.StreamID, frame.PriorityParam))
+			}
+		case *http2.HeadersFrame:
+			st := streams[frame.StreamID]
+			if st == nil {
+				st = &http2Stream{}
+				streams[frame.StreamID] = st
+			}
+			if frame.HasPriority() {
+				p := newPriority(frame.StreamID, frame.Priority)
+				st.priority = &p
+			}
+
+			st.block = append(st.block, frame.HeaderBlockFragment()...)
+			st.endStream = frame.StreamEnded()
+			if frame.HeadersEnded() {
+				err = endHeaders(frame.StreamID, st)
+			}
+		case *http2.ContinuationFrame:
+			st := streams[frame.StreamID]
+			if st == nil {
+				return
+			}
+			st.block = append(st.block, frame.HeaderBlockFragment()...)
+			if frame.HeadersEnded() {
+				err = endHeaders(frame.StreamID, st)
+			}
+		case *http2.DataFrame:
+			if n := uint32(len(frame.Data())); n > 0 {
+				if err = fr.WriteWindowUpdate(0, n); err == nil {
+					err = fr.WriteWindowUpdate(frame.StreamID, n)
+				}
+			}
+			if st := streams[frame.StreamID]; err == nil && st != nil && frame.StreamEnded() {
+				err = respond(frame.StreamID, st)
+			}
+		case *http2.PingFrame:
+			if !frame.IsAck() {
+				err = fr.WritePing(true, frame.Data)
+			}
+		case *http2.RSTStreamFrame:
+			delete(streams, frame.StreamID)
+		case *http2.GoAwayFrame:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func newPriority(streamID uint32, p http2.PriorityParam) Priority {
+	return Priority{
+		StreamID:  streamID,
+		Exclusive: p.Exclusive,
+		DependsOn: p.StreamDep,
+		Weight:    p.Weight,
+	}
+}
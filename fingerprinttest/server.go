@@ -0,0 +1,321 @@
+// Package fingerprinttest provides a local tls server that records the fingerprint clients send, to check them
+// without third party echo sites.
+//
+// Every request is answered with the json encoded Fingerprint of its connection, which holds the ja3 and ja4 of the
+// client hello, the akamai http2 fingerprint, the header order and ja4h of every request and the alpn.
+package fingerprinttest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Server is a tls server that records the fingerprint of every connection
+type Server struct {
+	URL      string
+	Listener net.Listener
+	// TLS is the server tls config, it can be changed before Start.
+	// The server negotiates h2 and http/1.1 unless NextProtos is changed
+	TLS *tls.Config
+
+	certificate *x509.Certificate
+
+	mu           sync.Mutex
+	fingerprints []*Fingerprint
+	conns        map[net.Conn]bool
+	closed       bool
+	wg           sync.WaitGroup
+}
+
+// NewServer starts a server on a local port
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a server that is started with Start, its tls config can be changed before
+func NewUnstartedServer() *Server {
+	certificate, err := newCertificate()
+	if err != nil {
+		panic("fingerprinttest: failed to create certificate: " + err.Error())
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		panic("fingerprinttest: failed to parse certificate: " + err.Error())
+	}
+
+	return &Server{
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			NextProtos:   []string{"h2", "http/1.1"},
+		},
+		certificate: leaf,
+		conns:       make(map[net.Conn]bool),
+	}
+}
+
+// Start starts listening on a local port
+func (s *Server) Start() {
+	if s.Listener != nil {
+		panic("fingerprinttest: server already started")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if ln, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic("fingerprinttest: failed to listen on a port: " + err.Error())
+		}
+	}
+
+	s.Listener = ln
+	s.URL = "https://" + ln.Addr().String()
+
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Close closes the listener and all connections and waits for them to finish
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	if s.Listener != nil {
+		_ = s.Listener.Close()
+	}
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// Certificate returns the self signed certificate of the server, valid for 127.0.0.1, ::1 and localhost
+func (s *Server) Certificate() *x509.Certificate {
+	return s.certificate
+}
+
+// CertificatePEM returns the pem encoded certificate of the server
+func (s *Server) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.certificate.Raw})
+}
+
+// CertPool returns a pool holding the certificate of the server
+func (s *Server) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.certificate)
+	return pool
+}
+
+// Fingerprints returns the fingerprints of all connections in the order they were accepted
+func (s *Server) Fingerprints() []Fingerprint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fingerprints := make([]Fingerprint, len(s.fingerprints))
+	for i, f := range s.fingerprints {
+		fingerprints[i] = f.clone()
+	}
+	return fingerprints
+}
+
+// LastFingerprint returns the fingerprint of the last connection, false if there was none
+func (s *Server) LastFingerprint() (Fingerprint, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.fingerprints) == 0 {
+		return Fingerprint{}, false
+	}
+	return s.fingerprints[len(s.fingerprints)-1].clone(), true
+}
+
+// Reset forgets the recorded fingerprints
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fingerprints = nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		c, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = c.Close()
+			return
+		}
+		s.conns[c] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, c)
+				s.mu.Unlock()
+				_ = c.Close()
+			}()
+
+			s.serveConn(c)
+		}()
+	}
+}
+
+// serveConn records the client hello of a connection and serves its requests
+func (s *Server) serveConn(c net.Conn) {
+	rc := &recordingConn{Conn: c}
+	conn := tls.Server(rc, s.TLS)
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	records := rc.recorded.Bytes()
+	message, _, err := clientHelloMessage(records)
+	if err == nil && message == nil {
+		err = errors.New("client hello is truncated")
+	}
+	version := []byte{0x03, 0x01}
+	if len(records) >= 3 {
+		version = []byte{records[1], records[2]}
+	}
+	rc.stop()
+	if err != nil {
+		log.Printf("fingerprinttest: %v", err)
+		return
+	}
+
+	hello, err := parseClientHello(message)
+	if err != nil {
+		log.Printf("fingerprinttest: %v", err)
+		return
+	}
+
+	state := conn.ConnectionState()
+	ja3 := hello.ja3()
+	f := &Fingerprint{
+		RemoteAddr:  c.RemoteAddr().String(),
+		ServerName:  hello.serverName,
+		TLSVersion:  state.Version,
+		ALPN:        state.NegotiatedProtocol,
+		OfferedALPN: hello.alpn,
+		JA3:         ja3,
+		JA3Hash:     md5Hex(ja3),
+		JA4:         hello.ja4(),
+		ClientHello: append([]byte{0x16, version[0], version[1], byte(len(message) >> 8), byte(len(message))}, message...),
+	}
+
+	s.mu.Lock()
+	s.fingerprints = append(s.fingerprints, f)
+	s.mu.Unlock()
+
+	if state.NegotiatedProtocol == "h2" {
+		s.serveHTTP2(conn, f)
+		return
+	}
+	s.serveHTTP1(conn, f)
+}
+
+// addRequest records a request of a connection and returns the response body,
+// h2 is the http2 connection fingerprint that is recorded with the first request of an http2 connection
+func (s *Server) addRequest(f *Fingerprint, r RequestFingerprint, h2 *HTTP2Fingerprint) []byte {
+	r.JA4H = r.ja4h()
+
+	s.mu.Lock()
+	f.Requests = append(f.Requests, r)
+	if h2 != nil {
+		h2.PseudoHeaderOrder = r.PseudoHeaderOrder
+		f.HTTP2 = h2
+		f.Akamai = h2.String()
+	}
+	body, _ := json.Marshal(f)
+	s.mu.Unlock()
+
+	return body
+}
+
+// recordingConn records what is read until stop is called
+type recordingConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	recorded bytes.Buffer
+	stopped  bool
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	c.mu.Lock()
+	if !c.stopped {
+		c.recorded.Write(b[:n])
+	}
+	c.mu.Unlock()
+
+	return n, err
+}
+
+func (c *recordingConn) stop() {
+	c.mu.Lock()
+	c.stopped = true
+	c.recorded = bytes.Buffer{}
+	c.mu.Unlock()
+}
+
+// newCertificate creates a self signed certificate for the local addresses
+func newCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"fingerprinttest"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,124 @@
+package fingerprinttest_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	cclient "github.com/osnedaj/cclient-v2"
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+const testJA3 = "771,4865-4866-4867-49195-49199-49196-49200,0-10-11-13-16-43-45-51,29-23-24,0"
+
+// sentJA3 is testJA3 without the server name extension, which is not sent to the ip of the server
+const sentJA3 = "771,4865-4866-4867-49195-49199-49196-49200,10-11-13-16-43-45-51,29-23-24,0"
+
+func TestServer(t *testing.T) {
+	// the ja4 cipher hash is the truncated sha256 of the sorted hex ciphers of testJA3
+	sum := sha256.Sum256([]byte("1301,1302,1303,c02b,c02c,c02f,c030"))
+	ciphers := hex.EncodeToString(sum[:])[:12]
+
+	tests := []struct {
+		name        string
+		nextProtos  []string
+		proto       string
+		headerOrder []string
+		ja4Prefix   string
+		ja4hPrefix  string
+	}{
+		{"h2", nil, "HTTP/2.0", []string{"user-agent", "accept", "x-b", "x-a"}, "t13i0707h2", "ge20nn05"},
+		{"http/1.1", []string{"http/1.1"}, "HTTP/1.1", []string{"Host", "user-agent", "accept", "x-b", "x-a"}, "t13i0707h2", "ge11nn06"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fingerprinttest.NewUnstartedServer()
+			if test.nextProtos != nil {
+				srv.TLS.NextProtos = test.nextProtos
+			}
+			srv.Start()
+			defer srv.Close()
+
+			hello, err := cclient.ParseJA3(testJA3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := cclient.NewClient("", 5*time.Second, true, hello, cclient.TLSVerification{RootCAs: srv.CertPool()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.NewRequest().SetURL(srv.URL+"/path").
+				SetHeader("x-b", "b").
+				SetHeader("accept", "*/*").
+				SetHeader("x-a", "a").
+				SetHeader("user-agent", "agent").
+				SetHeader("accept-encoding", "identity").
+				SetHeaderOrder([]string{"host", "user-agent", "accept", "x-b", "x-a"}).
+				Do()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f, ok := srv.LastFingerprint()
+			if !ok {
+				t.Fatal("no fingerprint recorded")
+			}
+			var body fingerprinttest.Fingerprint
+			if err = json.Unmarshal(resp.Body(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(body, f) {
+				t.Errorf("response body: got %+v, want %+v", body, f)
+			}
+
+			if f.JA3 != sentJA3 {
+				t.Errorf("ja3: got %s, want %s", f.JA3, sentJA3)
+			}
+			if f.JA3 != resp.ConnInfo().JA3 {
+				t.Errorf("ja3: server got %s, client sent %s", f.JA3, resp.ConnInfo().JA3)
+			}
+			if parts := strings.Split(f.JA4, "_"); len(parts) != 3 || parts[0] != test.ja4Prefix || parts[1] != ciphers {
+				t.Errorf("ja4: got %s, want %s_%s_...", f.JA4, test.ja4Prefix, ciphers)
+			}
+			if !reflect.DeepEqual(f.OfferedALPN, []string{"h2", "http/1.1"}) || f.ALPN != resp.ConnInfo().ALPN {
+				t.Errorf("alpn: got %s of %v", f.ALPN, f.OfferedALPN)
+			}
+
+			if len(f.Requests) != 1 {
+				t.Fatalf("requests: got %d, want 1", len(f.Requests))
+			}
+			r := f.Requests[0]
+			if r.Method != "GET" || r.Path != "/path" || r.Proto != test.proto {
+				t.Errorf("request: got %s %s %s", r.Method, r.Path, r.Proto)
+			}
+			order := r.HeaderOrder
+			if n := len(test.headerOrder); len(order) >= n {
+				order = order[:n]
+			}
+			if !reflect.DeepEqual(order, test.headerOrder) {
+				t.Errorf("header order: got %v, want %v first", r.HeaderOrder, test.headerOrder)
+			}
+			if r.Header("x-b") != "b" {
+				t.Errorf("x-b: got %q", r.Header("x-b"))
+			}
+			if !strings.HasPrefix(r.JA4H, test.ja4hPrefix) {
+				t.Errorf("ja4h: got %s, want prefix %s", r.JA4H, test.ja4hPrefix)
+			}
+
+			if test.proto == "HTTP/2.0" {
+				if f.HTTP2 == nil || f.Akamai != f.HTTP2.String() {
+					t.Fatalf("akamai: got %s of %+v", f.Akamai, f.HTTP2)
+				}
+				if !reflect.DeepEqual(r.PseudoHeaderOrder, []string{":method", ":authority", ":scheme", ":path"}) {
+					t.Errorf("pseudo header order: got %v", r.PseudoHeaderOrder)
+				}
+			} else if f.HTTP2 != nil || f.Akamai != "" {
+				t.Errorf("akamai: got %s for http/1.1", f.Akamai)
+			}
+		})
+	}
+}
@@ -0,0 +1,568 @@
+package cclient_v2
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/useflyent/fhttp/http2"
+	"github.com/useflyent/fhttp/http2/hpack"
+)
+
+const (
+	// http2FrameHeaderLen is the length of the header of every http2 frame
+	http2FrameHeaderLen = 9
+	// http2MinMaxFrameSize is the largest frame payload every peer accepts
+	http2MinMaxFrameSize = 1 << 14
+	// http2InitialConnWindow is the connection window before the first window update
+	http2InitialConnWindow = 65535
+	// fhttpConnRefresh is the connection window below which the fhttp transport sends a window update
+	fhttpConnRefresh = defaultHTTP2WindowUpdate / 2
+	// fhttpStreamWindow is the stream window of the fhttp transport, whatever initial window size it advertises
+	fhttpStreamWindow = 4 << 20
+)
+
+// frameConn rewrites the http2 frames the fhttp transport writes to send the settings, window update and priorities of
+// an http2 fingerprint, which the transport does not support.
+// It buffers written frames until they are complete, frames are written to the connection whole.
+// Client streams are shifted by the stream offset of the priorities, frames read are shifted back.
+// The transport only updates the connection window after it received half a gigabyte, frameConn updates it itself if
+// the fingerprint has a smaller window update.
+// The transport fails streams that receive more than its 4 MiB stream window, if the fingerprint advertises a larger
+// initial window size frameConn holds DATA frames beyond the stream windows of the transport until it updates them
+type frameConn struct {
+	net.Conn
+	addr        string
+	fingerprint *HTTP2Fingerprint
+	priority    HTTP2Priority
+	requests    *requestPriorities
+	offset      uint32
+	flowControl bool
+
+	wmu               sync.Mutex
+	wbuf              []byte
+	prefaceWritten    bool
+	settingsWritten   bool
+	windowWritten     bool
+	prioritiesWritten bool
+	block             [][]byte
+	lastStreamID      uint32
+	decoder           *hpack.Decoder
+	received          uint32
+	connWindowRefresh uint32
+	parseReads        bool
+	rbuf, rready      []byte
+	rskip             uint32
+	rdrop             bool
+
+	// streamWindows are the stream windows of the transport if frames are held, frames are then read in the background
+	// and Read waits for the frames released to the transport
+	streamWindows map[uint32]uint32
+	held          [][]byte
+	rmu           sync.Mutex
+	rcond         *sync.Cond
+	rerr          error
+	readOnce      sync.Once
+}
+
+// newFrameConn wraps the http2 connection to addr if it sends another fingerprint than the fhttp transport
+func newFrameConn(conn net.Conn, addr string, fingerprint *HTTP2Fingerprint, rewrite bool, priority HTTP2Priority, requests *requestPriorities) net.Conn {
+	if !rewrite {
+		return conn
+	}
+
+	decoder := hpack.NewDecoder(defaultHTTP2HeaderTableSize, nil)
+	decoder.SetAllowedMaxDynamicTableSize(math.MaxUint32)
+	c := &frameConn{
+		Conn:              conn,
+		addr:              addr,
+		fingerprint:       fingerprint,
+		priority:          priority,
+		requests:          requests,
+		offset:            fingerprint.streamOffset(),
+		flowControl:       fingerprint.WindowUpdate < fhttpConnRefresh,
+		decoder:           decoder,
+		connWindowRefresh: (http2InitialConnWindow + fingerprint.WindowUpdate) / 2,
+	}
+	if v, ok := fingerprint.setting(http2.SettingInitialWindowSize); ok && v > fhttpStreamWindow {
+		c.streamWindows = make(map[uint32]uint32)
+		c.rcond = sync.NewCond(&c.rmu)
+	}
+	c.parseReads = c.offset != 0 || c.flowControl || c.streamWindows != nil
+	return c
+}
+
+func (c *frameConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.wbuf = append(c.wbuf, p...)
+	var out []byte
+	if !c.prefaceWritten {
+		if len(c.wbuf) < len(http2.ClientPreface) {
+			return len(p), nil
+		}
+		out = append(out, c.wbuf[:len(http2.ClientPreface)]...)
+		c.wbuf = c.wbuf[len(http2.ClientPreface):]
+		c.prefaceWritten = true
+	}
+
+	for len(c.wbuf) >= http2FrameHeaderLen {
+		n := http2FrameHeaderLen + int(frameLength(c.wbuf))
+		if len(c.wbuf) < n {
+			break
+		}
+		frame := append([]byte(nil), c.wbuf[:n]...)
+		c.wbuf = c.wbuf[n:]
+		out = c.appendFrame(out, frame)
+	}
+	c.wbuf = append([]byte(nil), c.wbuf...)
+
+	if len(out) == 0 {
+		return len(p), nil
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// appendFrame appends the rewritten frame to out, header blocks are held until they are complete
+func (c *frameConn) appendFrame(out []byte, frame []byte) []byte {
+	typ, flags, streamID := http2.FrameType(frame[3]), http2.Flags(frame[4]), frameStreamID(frame)
+	if streamID%2 == 1 {
+		setFrameStreamID(frame, streamID+c.offset)
+		if c.streamWindows != nil && typ == http2.FrameWindowUpdate {
+			c.credit(streamID, binary.BigEndian.Uint32(frame[http2FrameHeaderLen:])&(1<<31-1))
+		}
+		if c.streamWindows != nil && typ == http2.FrameRSTStream {
+			c.reset(streamID)
+		}
+	}
+
+	switch {
+	case typ == http2.FrameSettings && !flags.Has(http2.FlagSettingsAck) && !c.settingsWritten:
+		c.settingsWritten = true
+		out = appendFrameHeader(out, uint32(6*len(c.fingerprint.Settings)), http2.FrameSettings, 0, 0)
+		for _, s := range c.fingerprint.Settings {
+			var b [6]byte
+			binary.BigEndian.PutUint16(b[:], uint16(s.ID))
+			binary.BigEndian.PutUint32(b[2:], s.Val)
+			out = append(out, b[:]...)
+		}
+		return out
+	case typ == http2.FrameWindowUpdate && streamID == 0:
+		if c.windowWritten {
+			if c.flowControl {
+				return out
+			}
+			return append(out, frame...)
+		}
+		c.windowWritten = true
+		if c.fingerprint.WindowUpdate != 0 {
+			out = appendWindowUpdate(out, c.fingerprint.WindowUpdate)
+		}
+		return c.appendPriorityFrames(out)
+	}
+
+	out = c.appendPriorityFrames(out)
+	switch typ {
+	case http2.FrameHeaders:
+		c.block = [][]byte{frame}
+		if flags.Has(http2.FlagHeadersEndHeaders) {
+			out = c.appendHeaderBlock(out)
+		}
+	case http2.FrameContinuation:
+		c.block = append(c.block, frame)
+		if flags.Has(http2.FlagContinuationEndHeaders) {
+			out = c.appendHeaderBlock(out)
+		}
+	default:
+		out = append(out, frame...)
+	}
+	return out
+}
+
+// appendPriorityFrames appends the priority frames of the fingerprint once, after the preface of the connection
+func (c *frameConn) appendPriorityFrames(out []byte) []byte {
+	if c.prioritiesWritten {
+		return out
+	}
+	c.prioritiesWritten = true
+	for _, f := range c.fingerprint.Priorities {
+		out = appendFrameHeader(out, 5, http2.FramePriority, 0, f.StreamID)
+		out = appendPriorityParam(out, f.Priority)
+	}
+	return out
+}
+
+// appendHeaderBlock appends the held frames of a header block, the HEADERS frame that opens a stream gets the
+// priority of its request
+func (c *frameConn) appendHeaderBlock(out []byte) []byte {
+	frames := c.block
+	c.block = nil
+
+	headers := frames[0]
+	flags, streamID := http2.Flags(headers[4]), frameStreamID(headers)
+	fragment, ok := headerBlockFragment(headers)
+	if !ok {
+		return appendFrames(out, frames)
+	}
+	for _, f := range frames[1:] {
+		fragment = append(fragment[:len(fragment):len(fragment)], f[http2FrameHeaderLen:]...)
+	}
+
+	// every header block is decoded to keep the dynamic table in sync, also those of requests with a priority
+	fields, err := c.decoder.DecodeFull(fragment)
+	if err != nil || streamID <= c.lastStreamID {
+		return appendFrames(out, frames)
+	}
+	c.lastStreamID = streamID
+	if flags.Has(http2.FlagHeadersPriority) {
+		return appendFrames(out, frames)
+	}
+
+	priority, ok := c.requests.take(c.addr, fields)
+	if !ok {
+		priority, ok = c.priority.headers(fields)
+	}
+	if !ok || priority.IsZero() {
+		return appendFrames(out, frames)
+	}
+
+	payload := appendPriorityParam(nil, priority)
+	payload = append(payload, fragment...)
+	flags = flags&^(http2.FlagHeadersEndHeaders|http2.FlagHeadersPadded) | http2.FlagHeadersPriority
+	typ := http2.FrameHeaders
+	for {
+		n := len(payload)
+		if n > http2MinMaxFrameSize {
+			n = http2MinMaxFrameSize
+		} else {
+			flags |= http2.FlagHeadersEndHeaders
+		}
+		out = appendFrameHeader(out, uint32(n), typ, flags, streamID)
+		out = append(out, payload[:n]...)
+		payload = payload[n:]
+		if len(payload) == 0 {
+			return out
+		}
+		typ, flags = http2.FrameContinuation, 0
+	}
+}
+
+func (c *frameConn) Read(p []byte) (int, error) {
+	if !c.parseReads {
+		return c.Conn.Read(p)
+	}
+	if c.streamWindows != nil {
+		return c.readReleased(p)
+	}
+
+	for len(c.rready) == 0 {
+		buf := make([]byte, len(p)+http2FrameHeaderLen)
+		n, err := c.Conn.Read(buf)
+		c.rbuf = append(c.rbuf, buf[:n]...)
+		if update := c.readFrames(); update > 0 {
+			if werr := c.writeWindowUpdate(update); werr != nil {
+				return 0, werr
+			}
+		}
+		if len(c.rready) == 0 && err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.rready)
+	c.rready = c.rready[n:]
+	return n, nil
+}
+
+// readReleased reads the frames released to the transport, the frames are read from the connection in the background
+func (c *frameConn) readReleased(p []byte) (int, error) {
+	c.readOnce.Do(func() {
+		go c.readLoop()
+	})
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.rready) == 0 && c.rerr == nil {
+		c.rcond.Wait()
+	}
+	if len(c.rready) == 0 {
+		return 0, c.rerr
+	}
+	n := copy(p, c.rready)
+	c.rready = c.rready[n:]
+	return n, nil
+}
+
+// readLoop reads the frames of the connection until it fails
+func (c *frameConn) readLoop() {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := c.Conn.Read(buf)
+
+		c.rmu.Lock()
+		c.rbuf = append(c.rbuf, buf[:n]...)
+		update := c.readFrames()
+		c.rmu.Unlock()
+
+		if update > 0 && err == nil {
+			err = c.writeWindowUpdate(update)
+		}
+
+		c.rmu.Lock()
+		if err != nil {
+			c.rerr = err
+		}
+		c.rcond.Broadcast()
+		c.rmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readFrames moves the frames read to the ready bytes, shifting client streams back, and returns the connection window
+// update for the data received. Frames of client streams below the stream offset are dropped, the transport never
+// opened them. Frames are only moved whole if they can be held
+func (c *frameConn) readFrames() uint32 {
+	var update uint32
+	for len(c.rbuf) > 0 {
+		if c.rskip > 0 {
+			n := c.rskip
+			if n > uint32(len(c.rbuf)) {
+				n = uint32(len(c.rbuf))
+			}
+			if !c.rdrop {
+				c.rready = append(c.rready, c.rbuf[:n]...)
+			}
+			c.rbuf = c.rbuf[n:]
+			c.rskip -= n
+			continue
+		}
+
+		if len(c.rbuf) < http2FrameHeaderLen {
+			return update
+		}
+		header := http2FrameHeaderLen
+		typ, length := http2.FrameType(c.rbuf[3]), frameLength(c.rbuf)
+		if typ == http2.FrameGoAway && length >= 4 {
+			header += 4
+		}
+		need := header
+		if c.streamWindows != nil {
+			need = http2FrameHeaderLen + int(length)
+		}
+		if len(c.rbuf) < need {
+			return update
+		}
+
+		streamID := frameStreamID(c.rbuf)
+		c.rdrop = streamID%2 == 1 && streamID <= c.offset
+		if streamID%2 == 1 && !c.rdrop {
+			setFrameStreamID(c.rbuf, c.unshift(streamID))
+		}
+		if header > http2FrameHeaderLen {
+			lastStreamID := binary.BigEndian.Uint32(c.rbuf[http2FrameHeaderLen:]) & (1<<31 - 1)
+			binary.BigEndian.PutUint32(c.rbuf[http2FrameHeaderLen:], c.unshift(lastStreamID))
+		}
+		if typ == http2.FrameData && c.flowControl {
+			update += c.receive(length)
+		}
+
+		if c.streamWindows != nil {
+			if !c.rdrop {
+				c.deliver(append([]byte(nil), c.rbuf[:need]...))
+			}
+			c.rbuf = c.rbuf[need:]
+			continue
+		}
+		if !c.rdrop {
+			c.rready = append(c.rready, c.rbuf[:header]...)
+		}
+		c.rbuf = c.rbuf[header:]
+		c.rskip = length - uint32(header-http2FrameHeaderLen)
+	}
+	return update
+}
+
+// receive counts the data received and returns the connection window update to send once half of it is used
+func (c *frameConn) receive(n uint32) uint32 {
+	c.received += n
+	if c.received < c.connWindowRefresh {
+		return 0
+	}
+	update := c.received
+	c.received = 0
+	return update
+}
+
+// writeWindowUpdate updates the connection window
+func (c *frameConn) writeWindowUpdate(increment uint32) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	_, err := c.Conn.Write(appendWindowUpdate(nil, increment))
+	return err
+}
+
+// deliver moves a whole frame to the ready bytes or holds it, c.rmu must be held. DATA frames are held while they exceed
+// the stream window of the transport, the frames of a stream and header blocks of all streams stay in order
+func (c *frameConn) deliver(frame []byte) {
+	typ, streamID := http2.FrameType(frame[3]), frameStreamID(frame)
+	if typ == http2.FrameData && frameLength(frame) > c.streamWindow(streamID) {
+		c.held = append(c.held, frame)
+		return
+	}
+	for _, held := range c.held {
+		if streamID != 0 && frameStreamID(held) == streamID || isHeaderBlock(typ) && isHeaderBlock(http2.FrameType(held[3])) {
+			c.held = append(c.held, frame)
+			return
+		}
+	}
+
+	switch {
+	case typ == http2.FrameRSTStream, isEndStream(frame):
+		delete(c.streamWindows, streamID)
+	case typ == http2.FrameData:
+		c.streamWindows[streamID] = c.streamWindow(streamID) - frameLength(frame)
+	}
+	c.rready = append(c.rready, frame...)
+}
+
+// credit adds to the stream window of the transport after it sent a window update and releases the held frames it
+// accepts now. Streams that ended are not tracked anymore, the transport still updates their windows while their body
+// is read
+func (c *frameConn) credit(streamID, increment uint32) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	window, ok := c.streamWindows[streamID]
+	if !ok {
+		return
+	}
+	if window+increment < window {
+		window = math.MaxUint32
+	} else {
+		window += increment
+	}
+	c.streamWindows[streamID] = window
+	c.release()
+}
+
+// reset stops holding the frames of a stream the transport reset, it does not update the window of the stream anymore
+func (c *frameConn) reset(streamID uint32) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	c.streamWindows[streamID] = math.MaxUint32
+	c.release()
+}
+
+// release delivers the held frames the transport accepts now, c.rmu must be held
+func (c *frameConn) release() {
+	held := c.held
+	c.held = nil
+	for _, frame := range held {
+		c.deliver(frame)
+	}
+	c.rcond.Broadcast()
+}
+
+// streamWindow returns the stream window of the transport, c.rmu must be held
+func (c *frameConn) streamWindow(streamID uint32) uint32 {
+	if window, ok := c.streamWindows[streamID]; ok {
+		return window
+	}
+	return fhttpStreamWindow
+}
+
+// unshift returns the stream of the transport of a client stream read from the connection, 0 for streams below the
+// offset like the last stream of a GOAWAY frame before any request
+func (c *frameConn) unshift(streamID uint32) uint32 {
+	if streamID <= c.offset {
+		return 0
+	}
+	return streamID - c.offset
+}
+
+func isHeaderBlock(typ http2.FrameType) bool {
+	return typ == http2.FrameHeaders || typ == http2.FrameContinuation || typ == http2.FramePushPromise
+}
+
+func isEndStream(frame []byte) bool {
+	typ := http2.FrameType(frame[3])
+	return (typ == http2.FrameData || typ == http2.FrameHeaders) && http2.Flags(frame[4]).Has(http2.FlagDataEndStream)
+}
+
+// headerBlockFragment returns the header block fragment of a HEADERS frame without its padding and priority, false if
+// the frame is malformed
+func headerBlockFragment(frame []byte) ([]byte, bool) {
+	flags, payload := http2.Flags(frame[4]), frame[http2FrameHeaderLen:]
+	padding := 0
+	if flags.Has(http2.FlagHeadersPadded) {
+		if len(payload) < 1 {
+			return nil, false
+		}
+		padding, payload = int(payload[0]), payload[1:]
+	}
+	if flags.Has(http2.FlagHeadersPriority) {
+		if len(payload) < 5 {
+			return nil, false
+		}
+		payload = payload[5:]
+	}
+	if padding > len(payload) {
+		return nil, false
+	}
+	return payload[:len(payload)-padding], true
+}
+
+func frameLength(frame []byte) uint32 {
+	return uint32(frame[0])<<16 | uint32(frame[1])<<8 | uint32(frame[2])
+}
+
+func frameStreamID(frame []byte) uint32 {
+	return binary.BigEndian.Uint32(frame[5:]) & (1<<31 - 1)
+}
+
+func setFrameStreamID(frame []byte, streamID uint32) {
+	binary.BigEndian.PutUint32(frame[5:], streamID)
+}
+
+func appendFrameHeader(out []byte, length uint32, typ http2.FrameType, flags http2.Flags, streamID uint32) []byte {
+	header := make([]byte, http2FrameHeaderLen)
+	header[0], header[1], header[2] = byte(length>>16), byte(length>>8), byte(length)
+	header[3], header[4] = byte(typ), byte(flags)
+	setFrameStreamID(header, streamID)
+	return append(out, header...)
+}
+
+func appendWindowUpdate(out []byte, increment uint32) []byte {
+	out = appendFrameHeader(out, 4, http2.FrameWindowUpdate, 0, 0)
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], increment)
+	return append(out, b[:]...)
+}
+
+func appendPriorityParam(out []byte, p http2.PriorityParam) []byte {
+	b := make([]byte, 5)
+	dep := p.StreamDep
+	if p.Exclusive {
+		dep |= 1 << 31
+	}
+	binary.BigEndian.PutUint32(b, dep)
+	b[4] = p.Weight
+	return append(out, b...)
+}
+
+func appendFrames(out []byte, frames [][]byte) []byte {
+	for _, f := range frames {
+		out = append(out, f...)
+	}
+	return out
+}
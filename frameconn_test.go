@@ -0,0 +1,154 @@
+package cclient_v2
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+	"github.com/useflyent/fhttp/http2"
+	"github.com/useflyent/fhttp/http2/hpack"
+)
+
+// bufferConn is a connection writing to out and reading from in
+type bufferConn struct {
+	net.Conn
+	in, out bytes.Buffer
+}
+
+func (c *bufferConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *bufferConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+
+func TestFrameConnHeaderBlocks(t *testing.T) {
+	priority := HTTP2Priority{Headers: http2.PriorityParam{StreamDep: 0, Exclusive: true, Weight: 255}}
+	conn := &bufferConn{}
+	c := newFrameConn(conn, "example.com:443", http2Fingerprint(nil, nil, priority), true, priority, &requestPriorities{})
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	encode := func(fields ...hpack.HeaderField) []byte {
+		block.Reset()
+		for _, f := range fields {
+			if err := encoder.WriteField(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return append([]byte(nil), block.Bytes()...)
+	}
+	// the header blocks after the first only refer to the dynamic table entries it adds
+	fields := []hpack.HeaderField{{Name: ":method", Value: "GET"}, {Name: ":path", Value: "/"}, {Name: "x-test", Value: "value"}}
+
+	var written bytes.Buffer
+	written.WriteString(http2.ClientPreface)
+	fr := http2.NewFramer(&written, nil)
+	_ = fr.WriteSettings()
+	_ = fr.WriteWindowUpdate(0, defaultHTTP2WindowUpdate)
+	own := http2.PriorityParam{StreamDep: 0, Weight: 15}
+	_ = fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: encode(fields...), EndHeaders: true, Priority: own})
+	_ = fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: encode(fields...), EndHeaders: true, PadLength: 8})
+	_ = fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 5, BlockFragment: encode(fields...), EndHeaders: true})
+	if _, err := c.Write(written.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewReader(conn.out.Bytes()[len(http2.ClientPreface):])
+	rd := http2.NewFramer(nil, out)
+	rd.ReadMetaHeaders = hpack.NewDecoder(defaultHTTP2HeaderTableSize, nil)
+	want := map[uint32]http2.PriorityParam{1: own, 3: priority.Headers, 5: priority.Headers}
+	for out.Len() > 0 {
+		frame, err := rd.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers, ok := frame.(*http2.MetaHeadersFrame)
+		if !ok {
+			continue
+		}
+		if got := headers.Priority; got != want[headers.StreamID] {
+			t.Errorf("priority of stream %d: got %+v, want %+v", headers.StreamID, got, want[headers.StreamID])
+		}
+		if got := headers.PseudoValue("path"); got != "/" {
+			t.Errorf("path of stream %d: got %q", headers.StreamID, got)
+		}
+		delete(want, headers.StreamID)
+	}
+	if len(want) > 0 {
+		t.Errorf("streams not written: %v", want)
+	}
+}
+
+func TestFrameConnDropsStreamsBelowOffset(t *testing.T) {
+	fingerprint := &HTTP2Fingerprint{
+		Settings:          defaultHTTP2Settings,
+		WindowUpdate:      defaultHTTP2WindowUpdate,
+		Priorities:        []PriorityFrame{{StreamID: 3, Priority: http2.PriorityParam{Weight: 200}}, {StreamID: 5, Priority: http2.PriorityParam{Weight: 100}}},
+		PseudoHeaderOrder: []string{":method", ":path", ":authority", ":scheme"},
+	}
+	conn := &bufferConn{}
+	c := newFrameConn(conn, "example.com:443", fingerprint, true, HTTP2Priority{}, &requestPriorities{})
+
+	fr := http2.NewFramer(&conn.in, nil)
+	_ = fr.WriteRSTStream(3, http2.ErrCodeCancel)
+	_ = fr.WriteWindowUpdate(5, 100)
+	_ = fr.WriteWindowUpdate(7, 200)
+	_ = fr.WriteGoAway(5, http2.ErrCodeNo, nil)
+
+	var read bytes.Buffer
+	buf := make([]byte, 1024)
+	for conn.in.Len() > 0 {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read.Write(buf[:n])
+	}
+
+	rd := http2.NewFramer(nil, &read)
+	frame, err := rd.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update, ok := frame.(*http2.WindowUpdateFrame); !ok || update.StreamID != 1 || update.Increment != 200 {
+		t.Errorf("first frame: got %v, want the window update of stream 1", frame)
+	}
+	frame, err = rd.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if goAway, ok := frame.(*http2.GoAwayFrame); !ok || goAway.LastStreamID != 0 {
+		t.Errorf("second frame: got %v, want a go away without processed streams", frame)
+	}
+	if read.Len() > 0 {
+		t.Errorf("%d more bytes read, the frames of streams below the offset are dropped", read.Len())
+	}
+}
+
+func TestFrameConnLargeInitialWindowSize(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// the initial window size of chrome is larger than the stream window of the transport
+	c, err := NewClient("", 10*time.Second, true, tlsUtls.HelloChrome_102, AkamaiFingerprint("1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p"),
+		TLSVerification{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.NewRequest().SetURL(srv.URL).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Proto() != "HTTP/2.0" {
+		t.Errorf("proto: got %s, want HTTP/2.0", resp.Proto())
+	}
+	if !bytes.Equal(resp.Body(), body) {
+		t.Errorf("body: got %d bytes, want %d", len(resp.Body()), len(body))
+	}
+}
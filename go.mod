@@ -1,11 +1,23 @@
 module github.com/osnedaj/cclient-v2
 
-go 1.16
+go 1.24
 
 require (
-	github.com/andybalholm/brotli v1.0.4
+	github.com/andybalholm/brotli v1.0.6
 	github.com/gabriel-vasile/mimetype v1.4.1
-	github.com/refraction-networking/utls v1.2.0
+	github.com/quic-go/qpack v0.5.1
+	github.com/quic-go/quic-go v0.55.0
+	github.com/refraction-networking/utls v1.8.2
 	github.com/useflyent/fhttp v0.0.0-20211004035111-333f430cfbbf
-	golang.org/x/net v0.1.0
+	golang.org/x/crypto v0.41.0
+	golang.org/x/net v0.43.0
+)
+
+require (
+	github.com/klauspost/compress v1.17.4 // indirect
+	golang.org/x/mod v0.27.0 // indirect
+	golang.org/x/sync v0.16.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+	golang.org/x/tools v0.36.0 // indirect
 )
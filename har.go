@@ -0,0 +1,816 @@
+package cclient_v2
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	tlsHttp "github.com/useflyent/fhttp"
+)
+
+// defaultHARMaxBodySize is the number of bytes of a body a HAR recorder records if no size is set
+const defaultHARMaxBodySize = 1 << 20
+
+// harTimeFormat is the iso 8601 format of the times of a HAR log
+const harTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+const (
+	harHeader  = "{\n  \"log\": {\n    \"version\": \"1.2\",\n    \"creator\": {\n      \"name\": \"cclient-v2\",\n      \"version\": \"\"\n    },\n    \"entries\": ["
+	harTrailer = "\n    ]\n  }\n}\n"
+)
+
+// HARRecorder writes the requests of the clients it is attached to to a HAR 1.2 file, to inspect them with the tools
+// that show the sessions of browsers. Every hop of a redirected request is an entry of its own, the response of a hop
+// has the url it redirects to. Requests have their header fields in the order they were written, http/2 and http/3
+// requests start with their pseudo header fields. Response headers are listed in the order they were received in like
+// Response.Dump lists them, sorted for non tls clients whose transport does not keep that order. Bodies are decoded and cut off after the size limit of the recorder.
+// Streamed responses, like the ones of event sources and websockets, are not recorded.
+// The file is a complete log after every entry and holds the cookies of the requests, it is only readable by the owner
+type HARRecorder struct {
+	mu          sync.Mutex
+	file        *os.File
+	end         int64
+	entries     int
+	maxBodySize int
+	err         error
+}
+
+// NewHARRecorder creates a recorder writing to the file at path, an existing file is replaced. maxBodySize bytes of
+// every decoded body are recorded, a default of one megabyte is used if it is zero and bodies are left out if it is
+// negative
+func NewHARRecorder(path string, maxBodySize int) (*HARRecorder, error) {
+	if maxBodySize == 0 {
+		maxBodySize = defaultHARMaxBodySize
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.WriteString(harHeader + harTrailer); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &HARRecorder{file: f, end: int64(len(harHeader)), maxBodySize: maxBodySize}, nil
+}
+
+// Close closes the file of the recorder, later requests are not recorded.
+// It returns the first error writing an entry
+func (r *HARRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return r.err
+	}
+	err := r.file.Close()
+	r.file = nil
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
+
+// write appends the entries to the log, the trailer is written again after them
+func (r *HARRecorder) write(entries []*harEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil || r.err != nil {
+		return
+	}
+
+	var b bytes.Buffer
+	for _, e := range entries {
+		data, err := json.MarshalIndent(e, "      ", "  ")
+		if err != nil {
+			r.err = err
+			return
+		}
+		if r.entries > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n      ")
+		b.Write(data)
+		r.entries++
+	}
+	end := r.end + int64(b.Len())
+	b.WriteString(harTrailer)
+
+	if _, err := r.file.WriteAt(b.Bytes(), r.end); err != nil {
+		r.err = err
+		return
+	}
+	r.end = end
+}
+
+// RecordHAR attaches a HAR recorder to the client, every request it sends is written to the recorder.
+// The returned function detaches it
+func (c *Client) RecordHAR(recorder *HARRecorder) func() {
+	c.interceptors.mu.Lock()
+	defer c.interceptors.mu.Unlock()
+
+	c.interceptors.har = append(c.interceptors.har[:len(c.interceptors.har):len(c.interceptors.har)], recorder)
+	return func() {
+		c.interceptors.mu.Lock()
+		defer c.interceptors.mu.Unlock()
+
+		for j, registered := range c.interceptors.har {
+			if registered == recorder {
+				c.interceptors.har = append(c.interceptors.har[:j:j], c.interceptors.har[j+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// harRecorders returns the HAR recorders attached to the client
+func (i *interceptors) harRecorders() []*HARRecorder {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.har
+}
+
+// harExchange records the hops of a request for HAR recorders with its hooks, the hooks are called concurrently
+type harExchange struct {
+	mu          sync.Mutex
+	maxBodySize int
+	hops        []*harHop
+}
+
+// harHop is a hop of a request, with the times of its phases
+type harHop struct {
+	start, dnsStart, dnsDone, connectStart, connectDone, tlsStart, tlsDone time.Time
+	gotConn, wrote, firstByte, headers, end                                time.Time
+
+	conn          net.Conn
+	fields        []headerField
+	received      []headerField
+	method        string
+	url           *url.URL
+	getBody       func() (io.ReadCloser, error)
+	contentLength int64
+	resp          *tlsHttp.Response
+	body          *harBody
+	err           error
+}
+
+type harKey struct{}
+
+// withHARExchange returns a context recording the hops of a request for the recorders, ctx if there are none
+func withHARExchange(ctx context.Context, recorders []*HARRecorder) context.Context {
+	if len(recorders) == 0 {
+		return ctx
+	}
+
+	x := &harExchange{}
+	for _, r := range recorders {
+		if r.maxBodySize > x.maxBodySize {
+			x.maxBodySize = r.maxBodySize
+		}
+	}
+	hooks := hooksFrom(ctx)
+	ctx = withHooks(ctx, append(hooks[:len(hooks):len(hooks)], x.hooks()))
+	return context.WithValue(ctx, harKey{}, x)
+}
+
+// harExchangeFrom returns the HAR exchange of a request, nil if it is not recorded
+func harExchangeFrom(ctx context.Context) *harExchange {
+	if ctx == nil {
+		return nil
+	}
+	x, _ := ctx.Value(harKey{}).(*harExchange)
+	return x
+}
+
+// hooks returns the hooks recording the events of the current hop
+func (x *harExchange) hooks() *Hooks {
+	at := func(record func(h *harHop, now time.Time)) {
+		now := time.Now()
+		x.mu.Lock()
+		defer x.mu.Unlock()
+
+		if len(x.hops) > 0 {
+			record(x.hops[len(x.hops)-1], now)
+		}
+	}
+	return &Hooks{
+		DNSStart: func(string) {
+			at(func(h *harHop, now time.Time) { h.dnsStart = now })
+		},
+		DNSDone: func([]net.IPAddr, error) {
+			at(func(h *harHop, now time.Time) { h.dnsDone = now })
+		},
+		DialStart: func(string, string) {
+			at(func(h *harHop, now time.Time) {
+				if h.connectStart.IsZero() {
+					h.connectStart = now
+				}
+			})
+		},
+		DialDone: func(string, string, error) {
+			at(func(h *harHop, now time.Time) { h.connectDone = now })
+		},
+		ProxyConnectDone: func(string, string, error) {
+			at(func(h *harHop, now time.Time) { h.connectDone = now })
+		},
+		TLSHandshakeStart: func(string) {
+			at(func(h *harHop, now time.Time) { h.tlsStart = now })
+		},
+		TLSHandshakeDone: func(string, error) {
+			// the connect time includes the tls handshake
+			at(func(h *harHop, now time.Time) { h.tlsDone, h.connectDone = now, now })
+		},
+		FirstByte: func() {
+			at(func(h *harHop, now time.Time) {
+				if h.firstByte.IsZero() {
+					h.firstByte = now
+				}
+			})
+		},
+		gotConn: func(conn net.Conn, _ bool) {
+			// a retried hop obtains another connection before writing its headers again
+			at(func(h *harHop, now time.Time) { h.conn, h.gotConn, h.fields, h.received = conn, now, nil, nil })
+		},
+		wroteHeaderField: func(key string, values []string) {
+			at(func(h *harHop, _ time.Time) {
+				for _, v := range values {
+					h.fields = append(h.fields, headerField{name: key, value: v})
+				}
+			})
+		},
+		wroteRequest: func() {
+			at(func(h *harHop, now time.Time) { h.wrote = now })
+		},
+		readHeader: func(fields []headerField) {
+			at(func(h *harHop, _ time.Time) { h.received = fields })
+		},
+	}
+}
+
+// startHop starts recording a hop sending req, x may be nil
+func (x *harExchange) startHop(req *tlsHttp.Request) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.hops = append(x.hops, &harHop{
+		start:         time.Now(),
+		method:        req.Method,
+		url:           req.URL,
+		getBody:       req.GetBody,
+		contentLength: req.ContentLength,
+	})
+}
+
+// endHop records the response of the current hop or the error sending it, the body of the response is recorded as it
+// is read. x may be nil
+func (x *harExchange) endHop(resp *tlsHttp.Response, err error) {
+	if x == nil {
+		return
+	}
+	now := time.Now()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	h := x.hops[len(x.hops)-1]
+	h.resp, h.err = resp, err
+	if resp != nil {
+		h.headers = now
+		h.body = &harBody{ReadCloser: resp.Body, exchange: x, hop: h}
+		resp.Body = h.body
+	}
+}
+
+// harBody records the body of the response of a hop as it is read
+type harBody struct {
+	io.ReadCloser
+	exchange *harExchange
+	hop      *harHop
+	data     []byte
+	n        int64
+	eof      bool
+}
+
+func (b *harBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.exchange.mu.Lock()
+	defer b.exchange.mu.Unlock()
+
+	if keep := b.exchange.maxBodySize - len(b.data); keep > 0 {
+		if keep > n {
+			keep = n
+		}
+		b.data = append(b.data, p[:keep]...)
+	}
+	b.n += int64(n)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *harBody) Close() error {
+	err := b.ReadCloser.Close()
+
+	b.exchange.mu.Lock()
+	defer b.exchange.mu.Unlock()
+
+	if b.hop.end.IsZero() {
+		b.hop.end = time.Now()
+	}
+	return err
+}
+
+// finish writes the recorded hops to the recorders, err is the error of the request
+func (x *harExchange) finish(recorders []*HARRecorder, err error) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	hops := x.hops
+	x.mu.Unlock()
+	if len(hops) == 0 {
+		return
+	}
+
+	for _, r := range recorders {
+		x.mu.Lock()
+		entries := make([]*harEntry, len(hops))
+		for i, h := range hops {
+			entries[i] = h.entry(r.maxBodySize)
+		}
+		if last := entries[len(entries)-1]; err != nil && hops[len(hops)-1].resp != nil && last.Comment == "" {
+			// the response of the last hop was received, reading its body or following it failed
+			last.Comment = err.Error()
+		}
+		x.mu.Unlock()
+
+		r.write(entries)
+	}
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+	SameSite string `json:"sameSite,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// entry returns the HAR entry of the hop with bodies of up to maxBodySize bytes, the exchange mutex is held
+func (h *harHop) entry(maxBodySize int) *harEntry {
+	e := &harEntry{
+		StartedDateTime: h.start.Format(harTimeFormat),
+		Request:         h.request(maxBodySize),
+		Response:        h.response(maxBodySize),
+		Timings:         h.timings(),
+	}
+	for _, t := range []float64{e.Timings.Blocked, e.Timings.DNS, e.Timings.Connect, e.Timings.Send, e.Timings.Wait, e.Timings.Receive} {
+		if t > 0 {
+			e.Time += t
+		}
+	}
+	e.Time = math.Round(e.Time*1000) / 1000
+
+	if h.conn != nil {
+		if host, _, err := net.SplitHostPort(h.conn.RemoteAddr().String()); err == nil {
+			e.ServerIPAddress = host
+		}
+		if _, port, err := net.SplitHostPort(h.conn.LocalAddr().String()); err == nil {
+			e.Connection = port
+		}
+	}
+	if h.err != nil {
+		e.Comment = h.err.Error()
+	}
+	return e
+}
+
+// httpVersion returns the http version of the hop, from the pseudo header fields written if it has no response
+func (h *harHop) httpVersion() string {
+	switch {
+	case h.resp != nil:
+		return h.resp.Proto
+	case len(h.fields) > 0 && strings.HasPrefix(h.fields[0].name, ":"):
+		return "HTTP/2.0"
+	default:
+		return "HTTP/1.1"
+	}
+}
+
+func (h *harHop) request(maxBodySize int) harRequest {
+	fields := h.fields
+	version := h.httpVersion()
+	if version == "HTTP/1.1" {
+		fields = writtenHTTP1Fields(fields)
+	}
+
+	r := harRequest{
+		Method:      h.method,
+		URL:         h.url.String(),
+		HTTPVersion: version,
+		Cookies:     []harCookie{},
+		Headers:     make([]harNameValue, len(fields)),
+		QueryString: harQuery(h.url.RawQuery),
+		HeadersSize: -1,
+		BodySize:    h.contentLength,
+	}
+
+	var contentType, encoding string
+	for i, f := range fields {
+		r.Headers[i] = harNameValue{Name: f.name, Value: f.value}
+		switch strings.ToLower(f.name) {
+		case "cookie":
+			for _, c := range parseCookieHeader(f.value) {
+				r.Cookies = append(r.Cookies, harCookie{Name: c.Name, Value: c.Value})
+			}
+		case "content-type":
+			contentType = f.value
+		case "content-encoding":
+			encoding = f.value
+		}
+	}
+	if version == "HTTP/1.1" && len(fields) > 0 {
+		// the request line and the header fields end with crlf, the header with an empty line
+		r.HeadersSize = len(h.method) + len(h.url.RequestURI()) + len(" HTTP/1.1\r\n") + len("\r\n")
+		for _, f := range fields {
+			r.HeadersSize += len(f.name) + len(": ") + len(f.value) + len("\r\n")
+		}
+	}
+
+	if h.getBody == nil || h.contentLength == 0 || maxBodySize < 0 {
+		return r
+	}
+	body, err := h.getBody()
+	if err != nil {
+		return r
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, int64(maxBodySize)))
+	if err != nil {
+		return r
+	}
+
+	r.PostData = &harPostData{MimeType: contentType}
+	partial := int64(len(data)) < h.contentLength
+	decoded, _, truncated, err := decodeHARBody(encoding, data, partial, maxBodySize)
+	truncated = truncated || partial
+	switch {
+	case err != nil:
+		decoded = data
+		r.PostData.Comment = "decoding the body failed: " + err.Error()
+	case truncated:
+		r.PostData.Comment = "body truncated to " + strconv.Itoa(len(decoded)) + " bytes"
+	}
+	if text, ok := harText(decoded, truncated); ok {
+		r.PostData.Text = text
+	} else {
+		// post data has no encoding field
+		r.PostData.Text = base64.StdEncoding.EncodeToString(decoded)
+		r.PostData.Comment = strings.TrimPrefix(r.PostData.Comment+", base64 encoded", ", ")
+	}
+	return r
+}
+
+func (h *harHop) response(maxBodySize int) harResponse {
+	r := harResponse{
+		HTTPVersion: h.httpVersion(),
+		Cookies:     []harCookie{},
+		Headers:     []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	if h.resp == nil {
+		return r
+	}
+	resp := h.resp
+
+	r.Status = resp.StatusCode
+	r.StatusText = strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+	received := decodedFields(h.received, http.Header(resp.Header))
+	for _, f := range responseFields(received, Header(resp.Header), resp.StatusCode, resp.ProtoMajor > 1) {
+		r.Headers = append(r.Headers, harNameValue{Name: f.name, Value: f.value})
+	}
+
+	for _, c := range (&http.Response{Header: http.Header(resp.Header)}).Cookies() {
+		cookie := harCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.UTC().Format(harTimeFormat)
+		}
+		switch c.SameSite {
+		case http.SameSiteLaxMode:
+			cookie.SameSite = "Lax"
+		case http.SameSiteStrictMode:
+			cookie.SameSite = "Strict"
+		case http.SameSiteNoneMode:
+			cookie.SameSite = "None"
+		}
+		r.Cookies = append(r.Cookies, cookie)
+	}
+
+	if location := resp.Header.Get("Location"); location != "" && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		if u, err := h.url.Parse(location); err == nil {
+			r.RedirectURL = u.String()
+		} else {
+			r.RedirectURL = location
+		}
+	}
+
+	r.Content.MimeType = resp.Header.Get("Content-Type")
+	if h.body == nil {
+		return r
+	}
+	b := h.body
+	if maxBodySize < 0 {
+		r.Content.Size = b.n
+		r.Content.Comment = "body not recorded"
+		return r
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	switch {
+	case resp.Uncompressed:
+		// the transports decode some responses themselves, http/2 responses keep their content encoding and length
+		encoding = ""
+		if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+			r.BodySize = n
+		}
+	case b.eof:
+		r.BodySize = b.n
+	default:
+		r.BodySize = resp.ContentLength
+	}
+
+	complete := b.eof && int64(len(b.data)) == b.n
+	decoded, size, truncated, err := decodeHARBody(encoding, b.data, !complete, maxBodySize)
+	if err != nil {
+		r.Content.Size = b.n
+		r.Content.Comment = "decoding the body failed: " + err.Error()
+		return r
+	}
+	r.Content.Size = size
+	sizeKnown := complete
+	if encoding == "" || strings.EqualFold(encoding, "identity") {
+		r.Content.Size, sizeKnown = b.n, b.eof
+	}
+	if sizeKnown && r.BodySize >= 0 {
+		r.Content.Compression = size - r.BodySize
+	}
+	switch {
+	case !b.eof:
+		r.Content.Comment = "body not read completely"
+	case truncated || !complete:
+		r.Content.Comment = "body truncated to " + strconv.Itoa(len(decoded)) + " bytes"
+	}
+
+	if text, ok := harText(decoded, truncated || !complete); ok {
+		r.Content.Text = text
+	} else {
+		r.Content.Text = base64.StdEncoding.EncodeToString(decoded)
+		r.Content.Encoding = "base64"
+	}
+	return r
+}
+
+// timings returns the durations of the phases of the hop in milliseconds, -1 for the phases that did not happen
+func (h *harHop) timings() harTimings {
+	t := harTimings{
+		Blocked: -1,
+		DNS:     harDuration(h.dnsStart, h.dnsDone),
+		Connect: harDuration(h.connectStart, h.connectDone),
+		SSL:     harDuration(h.tlsStart, h.tlsDone),
+	}
+	for _, first := range []time.Time{h.dnsStart, h.connectStart, h.gotConn} {
+		if !first.IsZero() {
+			t.Blocked = harDuration(h.start, first)
+			break
+		}
+	}
+
+	// send, wait and receive are required, transports without write or first byte events count from the events
+	// before them
+	sent := h.gotConn
+	if !h.wrote.IsZero() {
+		sent = h.wrote
+	}
+	if sent.IsZero() {
+		sent = h.start
+	}
+	t.Send = harDuration(h.gotConn, h.wrote)
+	if t.Send < 0 {
+		t.Send = 0
+	}
+
+	firstByte := h.firstByte
+	if firstByte.IsZero() {
+		firstByte = h.headers
+	}
+	if firstByte.IsZero() {
+		return t
+	}
+	t.Wait = harDuration(sent, firstByte)
+	if end := h.end; !end.IsZero() {
+		t.Receive = harDuration(firstByte, end)
+	}
+	return t
+}
+
+// harDuration returns the milliseconds from start to end, -1 if one of them is not set
+func harDuration(start, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() {
+		return -1
+	}
+	d := end.Sub(start)
+	if d < 0 {
+		d = 0
+	}
+	return float64(d.Microseconds()) / 1000
+}
+
+// harQuery returns the parameters of a query in their order
+func harQuery(query string) []harNameValue {
+	params := []harNameValue{}
+	for _, param := range strings.Split(query, "&") {
+		if param == "" {
+			continue
+		}
+		name, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			name, value = param[:i], param[i+1:]
+		}
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		params = append(params, harNameValue{Name: name, Value: value})
+	}
+	return params
+}
+
+// decodeHARBody decodes a body with the content encodings applied to it, returning up to limit bytes and the decoded
+// size. partial is whether data is only the start of the body, decoding stops at its end without error
+func decodeHARBody(encoding string, data []byte, partial bool, limit int) (decoded []byte, size int64, truncated bool, err error) {
+	var r io.Reader = bytes.NewReader(data)
+	encodings := strings.Split(encoding, ",")
+	// encodings are listed in the order they were applied
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch e := strings.ToLower(strings.TrimSpace(encodings[i])); e {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			if r, err = gzip.NewReader(r); err != nil {
+				return decodedPrefix(partial, err)
+			}
+		case "deflate":
+			r = deflateReader(r)
+		case "br":
+			r = brotli.NewReader(r)
+		default:
+			return nil, 0, false, errors.New("unsupported content encoding " + e)
+		}
+	}
+
+	var b bytes.Buffer
+	n, err := io.Copy(&b, io.LimitReader(r, int64(limit)))
+	if err == nil {
+		// the rest is counted, not kept
+		var rest int64
+		rest, err = io.Copy(io.Discard, r)
+		n += rest
+	}
+	if err != nil && !(partial && (err == io.ErrUnexpectedEOF || err == io.EOF)) {
+		return nil, 0, false, err
+	}
+	return b.Bytes(), n, n > int64(b.Len()), nil
+}
+
+// decodedPrefix is the result of decoding the start of a body that ends before its first decoded byte
+func decodedPrefix(partial bool, err error) ([]byte, int64, bool, error) {
+	if partial && (err == io.ErrUnexpectedEOF || err == io.EOF) {
+		return nil, 0, true, nil
+	}
+	return nil, 0, false, err
+}
+
+// deflateReader reads a deflate encoded body, which servers send as zlib stream or as raw deflate data
+func deflateReader(r io.Reader) io.Reader {
+	var buf bytes.Buffer
+	br := io.TeeReader(r, &buf)
+	if zr, err := zlib.NewReader(br); err == nil {
+		return zr
+	}
+	return flate.NewReader(io.MultiReader(&buf, r))
+}
+
+// harText returns data as text if it is valid utf-8, a rune cut off by the size limit is left out
+func harText(data []byte, truncated bool) (string, bool) {
+	if utf8.Valid(data) {
+		return string(data), true
+	}
+	if truncated {
+		for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+			if utf8.Valid(data[:len(data)-i]) {
+				return string(data[:len(data)-i]), true
+			}
+		}
+	}
+	return "", false
+}
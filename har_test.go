@@ -0,0 +1,293 @@
+package cclient_v2
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+// readHAR returns the entries of the HAR file at path, which is a complete log after every request
+func readHAR(t *testing.T, path string) []harEntry {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har struct {
+		Log struct {
+			Version string     `json:"version"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err = json.Unmarshal(data, &har); err != nil {
+		t.Fatalf("invalid HAR file %q: %v", data, err)
+	}
+	if har.Log.Version != "1.2" {
+		t.Errorf("version: got %q", har.Log.Version)
+	}
+	return har.Log.Entries
+}
+
+func TestHARRecorder(t *testing.T) {
+	tests := []struct {
+		name       string
+		nextProtos []string
+		version    string
+	}{
+		{"h2", nil, "HTTP/2.0"},
+		{"http/1.1", []string{"http/1.1"}, "HTTP/1.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fingerprinttest.NewUnstartedServer()
+			if test.nextProtos != nil {
+				srv.TLS.NextProtos = test.nextProtos
+			}
+			srv.Start()
+			defer srv.Close()
+
+			path := filepath.Join(t.TempDir(), "session.har")
+			recorder, err := NewHARRecorder(path, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer recorder.Close()
+			c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.RecordHAR(recorder)
+
+			resp, err := c.NewRequest().SetURL(srv.URL+"/path?q=a+b&empty").
+				SetMethod("POST").
+				SetBody("payload").
+				SetHeader("content-type", "text/plain").
+				SetHeader("cookie", "a=1; b=2").
+				SetHeader("user-agent", "agent").
+				SetHeaderOrder([]string{"user-agent", "cookie", "content-type"}).
+				Do()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, _ := srv.LastFingerprint()
+			sent := f.Requests[0]
+
+			entries := readHAR(t, path)
+			if len(entries) != 1 {
+				t.Fatalf("entries: got %d, want 1", len(entries))
+			}
+			e := entries[0]
+			req := e.Request
+			if req.Method != "POST" || req.URL != srv.URL+"/path?q=a+b&empty" || req.HTTPVersion != test.version {
+				t.Errorf("request: got %s %s %s", req.Method, req.URL, req.HTTPVersion)
+			}
+			if want := []harNameValue{{"q", "a b"}, {"empty", ""}}; !reflect.DeepEqual(req.QueryString, want) {
+				t.Errorf("query: got %v, want %v", req.QueryString, want)
+			}
+
+			// the header fields are recorded in the order the server received them
+			var pseudo []string
+			var headers []fingerprinttest.Header
+			for _, h := range req.Headers {
+				if strings.HasPrefix(h.Name, ":") {
+					pseudo = append(pseudo, h.Name)
+					continue
+				}
+				headers = append(headers, fingerprinttest.Header{Name: h.Name, Value: h.Value})
+			}
+			if !reflect.DeepEqual(pseudo, sent.PseudoHeaderOrder) {
+				t.Errorf("pseudo headers: got %v, server got %v", pseudo, sent.PseudoHeaderOrder)
+			}
+			if test.version == "HTTP/1.1" && req.HeadersSize <= 0 {
+				t.Errorf("headers size: got %d", req.HeadersSize)
+			}
+			if !reflect.DeepEqual(headers, sent.Headers) {
+				t.Errorf("headers: got %v, server got %v", headers, sent.Headers)
+			}
+			if want := []harCookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}; !reflect.DeepEqual(req.Cookies, want) {
+				t.Errorf("cookies: got %v, want %v", req.Cookies, want)
+			}
+			if req.PostData == nil || req.PostData.Text != "payload" || req.PostData.MimeType != "text/plain" || req.BodySize != 7 {
+				t.Errorf("post data: got %+v with size %d", req.PostData, req.BodySize)
+			}
+
+			r := e.Response
+			if r.Status != http.StatusOK || r.StatusText != "OK" || r.HTTPVersion != test.version {
+				t.Errorf("response: got %d %q %s", r.Status, r.StatusText, r.HTTPVersion)
+			}
+			if r.Content.Text != string(resp.Body()) || r.Content.Size != int64(len(resp.Body())) || r.Content.MimeType != "application/json" {
+				t.Errorf("content: got %+v, want the body %q", r.Content, resp.Body())
+			}
+			if e.ServerIPAddress != "127.0.0.1" || e.Connection == "" {
+				t.Errorf("connection: got %q to %q", e.Connection, e.ServerIPAddress)
+			}
+			if e.Timings.Connect < 0 || e.Timings.SSL < 0 || e.Timings.Wait < 0 || e.Time <= 0 {
+				t.Errorf("timings: got %+v in %v", e.Timings, e.Time)
+			}
+		})
+	}
+}
+
+func TestHARRecorderRedirect(t *testing.T) {
+	body := strings.Repeat("decoded ", 100)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+			http.Redirect(w, r, "/target", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		_, _ = gw.Write([]byte(body))
+		_ = gw.Close()
+	}))
+	// the certificate of the echo server is valid for localhost
+	certificates := fingerprinttest.NewUnstartedServer()
+	srv.TLS = &tls.Config{Certificates: certificates.TLS.Certificates}
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	recorder, err := NewHARRecorder(filepath.Join(dir, "truncated.har"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+	withoutBodies, err := NewHARRecorder(filepath.Join(dir, "headers.har"), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withoutBodies.Close()
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: certificates.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RecordHAR(recorder)
+	detach := c.RecordHAR(withoutBodies)
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	url := "https://localhost:" + port
+	resp, err := c.NewRequest().SetURL(url + "/redirect").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body()) != body {
+		t.Fatalf("body: got %q", resp.Body())
+	}
+
+	// every hop is an entry of its own
+	entries := readHAR(t, filepath.Join(dir, "truncated.har"))
+	if len(entries) != 2 {
+		t.Fatalf("entries: got %d, want 2", len(entries))
+	}
+	redirect, target := entries[0], entries[1]
+	if redirect.Request.URL != url+"/redirect" || redirect.Response.Status != http.StatusFound || redirect.Response.RedirectURL != url+"/target" {
+		t.Errorf("redirect: got %s answered with %d to %q", redirect.Request.URL, redirect.Response.Status, redirect.Response.RedirectURL)
+	}
+	want := []harCookie{{Name: "session", Value: "1", Path: "/", HTTPOnly: true, SameSite: "Lax"}}
+	if !reflect.DeepEqual(redirect.Response.Cookies, want) {
+		t.Errorf("response cookies: got %+v, want %+v", redirect.Response.Cookies, want)
+	}
+	if redirect.Timings.DNS < 0 || target.Timings.DNS != -1 || target.Timings.Connect != -1 {
+		t.Errorf("timings: got %+v and %+v, want the lookup and the connection only for the first hop", redirect.Timings, target.Timings)
+	}
+
+	// bodies are decoded and cut off after the size limit
+	content := target.Response.Content
+	if target.Request.URL != url+"/target" || content.Text != body[:10] || content.Size != int64(len(body)) {
+		t.Errorf("content: got %q of %d bytes from %s", content.Text, content.Size, target.Request.URL)
+	}
+	if content.Comment != "body truncated to 10 bytes" || content.MimeType != "text/plain" {
+		t.Errorf("content: got %q with comment %q", content.MimeType, content.Comment)
+	}
+
+	entries = readHAR(t, filepath.Join(dir, "headers.har"))
+	if len(entries) != 2 || entries[1].Response.Content.Text != "" || entries[1].Response.Content.Comment != "body not recorded" {
+		t.Errorf("without bodies: got %+v", entries)
+	}
+
+	// a detached recorder does not record later requests
+	detach()
+	if _, err = c.NewRequest().SetURL(url + "/target").Do(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(readHAR(t, filepath.Join(dir, "headers.har"))); n != 2 {
+		t.Errorf("detached recorder: got %d entries, want 2", n)
+	}
+	if n := len(readHAR(t, filepath.Join(dir, "truncated.har"))); n != 3 {
+		t.Errorf("attached recorder: got %d entries, want 3", n)
+	}
+}
+
+func TestHARRecorderResponseHeaders(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+	h1 := serveHTTP1Response(t, srv, "HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nX-Z: z\r\nSet-Cookie: a=1\r\nx-a: a\r\nContent-Length: 2\r\n\r\nok")
+
+	tests := []struct {
+		name   string
+		url    string
+		useTLS bool
+		// want are the response headers, LENGTH is replaced with the length of the body
+		want []harNameValue
+	}{
+		{"h2", srv.URL, true, []harNameValue{{":status", "200"}, {"content-type", "application/json"}, {"content-length", "LENGTH"}}},
+		{"h2 non tls client", srv.URL, false, []harNameValue{{":status", "200"}, {"content-length", "LENGTH"}, {"content-type", "application/json"}}},
+		// the transport drops Content-Length if it asked for a gzip body
+		{"http/1.1", h1, true, []harNameValue{{"X-Z", "z"}, {"Set-Cookie", "a=1"}, {"x-a", "a"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "session.har")
+			recorder, err := NewHARRecorder(path, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer recorder.Close()
+			params := []interface{}{TLSVerification{RootCAs: srv.CertPool()}}
+			if test.useTLS {
+				params = append([]interface{}{tlsUtls.HelloChrome_102}, params...)
+			}
+			c, err := NewClient("", 5*time.Second, test.useTLS, params...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.RecordHAR(recorder)
+
+			resp, err := c.NewRequest().SetURL(test.url).Do()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries := readHAR(t, path)
+			if len(entries) != 1 {
+				t.Fatalf("entries: got %d, want 1", len(entries))
+			}
+			want := make([]harNameValue, len(test.want))
+			for i, h := range test.want {
+				want[i] = harNameValue{h.Name, strings.ReplaceAll(h.Value, "LENGTH", strconv.Itoa(len(resp.Body())))}
+			}
+			if got := entries[0].Response.Headers; !reflect.DeepEqual(got, want) {
+				t.Errorf("headers: got %v, want %v", got, want)
+			}
+		})
+	}
+}
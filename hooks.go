@@ -0,0 +1,363 @@
+package cclient_v2
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+
+	fhttpTrace "github.com/useflyent/fhttp/httptrace"
+)
+
+// Handler sends a request and returns its response
+type Handler func(req *http.Request) (*Response, error)
+
+// Middleware wraps the handler sending the requests of a client, like to log, sign or measure them.
+// The request is built completely when it reaches the middleware, with the header order and pseudo header order under
+// the fhttp HeaderOrderKey and PHeaderOrderKey of its header.
+// Middleware may change the request or pass another one to next, the request after the last middleware is sent.
+// The innermost handler adds the cookies of the jar for the url of that request, cookie headers set by middleware are
+// sent as cookies of the request. Redirects are followed by the innermost handler
+type Middleware func(next Handler) Handler
+
+// Hooks are called with the events of sending the requests of a client, nil hooks are not called.
+// Hooks are called by the goroutines sending the requests and must not block. Http/3 connections report no dial
+// and tls handshake events
+type Hooks struct {
+	// DNSStart is called when looking up the addresses of host begins
+	DNSStart func(host string)
+	// DNSDone is called when looking up addresses ended
+	DNSDone func(addrs []net.IPAddr, err error)
+	// DialStart is called when connecting to addr begins, for every address tried
+	DialStart func(network, addr string)
+	// DialDone is called when connecting to addr ended
+	DialDone func(network, addr string, err error)
+	// ProxyConnectStart is called when opening a tunnel to addr through the proxy at proxy begins
+	ProxyConnectStart func(proxy, addr string)
+	// ProxyConnectDone is called when the tunnel is open or opening it failed
+	ProxyConnectDone func(proxy, addr string, err error)
+	// TLSHandshakeStart is called when the tls handshake with host begins
+	TLSHandshakeStart func(host string)
+	// TLSHandshakeDone is called when the tls handshake with host ended
+	TLSHandshakeDone func(host string, err error)
+	// FirstByte is called when the first byte of the response headers is read
+	FirstByte func()
+	// Redirect is called before following a redirect to req, via are the requests sent before, oldest first
+	Redirect func(req *http.Request, via []*http.Request)
+	// Retry is called when a request is sent again after err, attempt counts the retries starting at one.
+	// Requests are retried over the next route when connecting to an alternative service failed, event sources
+	// retry when they reconnect
+	Retry func(attempt int, err error)
+
+	// gotConn is called when a connection for a hop was obtained, with whether it served earlier requests
+	gotConn func(conn net.Conn, reused bool)
+	// wroteHeaderField is called when a header field of a hop was written to the connection
+	wroteHeaderField func(key string, values []string)
+	// wroteRequest is called when a hop was written to the connection with its body
+	wroteRequest func()
+	// readHeader is called with the header fields of the final response of a hop in the order they were received, by
+	// the transports recording them
+	readHeader func(fields []headerField)
+}
+
+// interceptors are the middleware, hooks and HAR recorders registered on a client
+type interceptors struct {
+	mu         sync.RWMutex
+	middleware []Middleware
+	hooks      []*Hooks
+	har        []*HARRecorder
+}
+
+func newInterceptors() *interceptors {
+	return &interceptors{}
+}
+
+// copy returns new interceptors with the currently registered middleware, hooks and HAR recorders
+func (i *interceptors) copy() *interceptors {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return &interceptors{
+		middleware: append([]Middleware(nil), i.middleware...),
+		hooks:      append([]*Hooks(nil), i.hooks...),
+		har:        append([]*HARRecorder(nil), i.har...),
+	}
+}
+
+// snapshot returns the registered middleware and hooks
+func (i *interceptors) snapshot() ([]Middleware, hookSet) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.middleware, i.hooks
+}
+
+// Use adds middleware to the requests of the client, the middleware added first is called first
+func (c *Client) Use(middleware ...Middleware) {
+	c.interceptors.mu.Lock()
+	defer c.interceptors.mu.Unlock()
+
+	c.interceptors.middleware = append(c.interceptors.middleware[:len(c.interceptors.middleware):len(c.interceptors.middleware)], middleware...)
+}
+
+// AddHooks adds hooks called with the events of the requests of the client, hooks added first are called first.
+// The returned function removes them
+func (c *Client) AddHooks(hooks Hooks) func() {
+	h := &hooks
+
+	c.interceptors.mu.Lock()
+	defer c.interceptors.mu.Unlock()
+
+	c.interceptors.hooks = append(c.interceptors.hooks[:len(c.interceptors.hooks):len(c.interceptors.hooks)], h)
+	return func() {
+		c.interceptors.mu.Lock()
+		defer c.interceptors.mu.Unlock()
+
+		for j, registered := range c.interceptors.hooks {
+			if registered == h {
+				c.interceptors.hooks = append(c.interceptors.hooks[:j:j], c.interceptors.hooks[j+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// hookSet are the hooks of a request
+type hookSet []*Hooks
+
+type hooksKey struct{}
+
+// withHooks returns a context carrying the hooks of a request to the backends, ctx if there are none
+func withHooks(ctx context.Context, hooks hookSet) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if len(hooks) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, hooksKey{}, hooks)
+}
+
+// hooksFrom returns the hooks of a request, nil if it has none
+func hooksFrom(ctx context.Context) hookSet {
+	hooks, _ := ctx.Value(hooksKey{}).(hookSet)
+	return hooks
+}
+
+// withTrace returns a context reporting the dns, dial, header and first byte events of a hop of a request to host, and
+// the tls handshake events of the fhttp transport of non tls clients. The net package reports to the trace of net/http.
+// Connections recording the header fields of responses record the ones of the response to the hop
+func withTrace(ctx context.Context, host string) context.Context {
+	hooks := hooksFrom(ctx)
+	if len(hooks) == 0 {
+		return ctx
+	}
+
+	connect := &proxyConnect{hooks: hooks}
+	var recorder fieldRecorder
+	ctx = context.WithValue(ctx, proxyConnectKey{}, connect)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:             func(info httptrace.DNSStartInfo) { hooks.dnsStart(info.Host) },
+		DNSDone:              func(info httptrace.DNSDoneInfo) { hooks.dnsDone(info.Addrs, info.Err) },
+		ConnectStart:         hooks.dialStart,
+		ConnectDone:          hooks.dialDone,
+		GotConn:              func(info httptrace.GotConnInfo) { hooks.gotConnection(info.Conn, info.Reused) },
+		WroteHeaderField:     hooks.wroteField,
+		WroteRequest:         func(httptrace.WroteRequestInfo) { hooks.wroteReq() },
+		GotFirstResponseByte: hooks.firstByte,
+	})
+	return fhttpTrace.WithClientTrace(ctx, &fhttpTrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			connect.done(nil)
+			hooks.tlsHandshakeStart(host)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			name := host
+			if state.ServerName != "" {
+				name = state.ServerName
+			}
+			hooks.tlsHandshakeDone(name, err)
+		},
+		GotConn: func(info fhttpTrace.GotConnInfo) {
+			recorder, _ = info.Conn.(fieldRecorder)
+			hooks.gotConnection(info.Conn, info.Reused)
+		},
+		WroteHeaderField: func(key string, values []string) {
+			// the fields of the hop are written before the ones of any later request on the connection
+			if recorder != nil {
+				recorder.recordResponse(hooks.readFields)
+				recorder = nil
+			}
+			hooks.wroteField(key, values)
+		},
+		WroteRequest:         func(fhttpTrace.WroteRequestInfo) { hooks.wroteReq() },
+		GotFirstResponseByte: hooks.firstByte,
+	})
+}
+
+// proxyConnect reports the CONNECT requests of the fhttp transport of non tls clients, which has no hook after the
+// CONNECT. The tunnel is open when the tls handshake with the target starts, a failed CONNECT fails the round trip
+type proxyConnect struct {
+	hooks hookSet
+
+	mu      sync.Mutex
+	proxy   string
+	addr    string
+	pending bool
+}
+
+type proxyConnectKey struct{}
+
+// proxyConnectFrom returns the CONNECT reporter of a hop, nil if the request has no hooks
+func proxyConnectFrom(ctx context.Context) *proxyConnect {
+	p, _ := ctx.Value(proxyConnectKey{}).(*proxyConnect)
+	return p
+}
+
+func (p *proxyConnect) start(proxy, addr string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.proxy, p.addr, p.pending = proxy, addr, true
+	p.mu.Unlock()
+
+	p.hooks.proxyConnectStart(proxy, addr)
+}
+
+// done reports the end of a started CONNECT
+func (p *proxyConnect) done(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	pending, proxy, addr := p.pending, p.proxy, p.addr
+	p.pending = false
+	p.mu.Unlock()
+
+	if pending {
+		p.hooks.proxyConnectDone(proxy, addr, err)
+	}
+}
+
+func (hs hookSet) dnsStart(host string) {
+	for _, h := range hs {
+		if h.DNSStart != nil {
+			h.DNSStart(host)
+		}
+	}
+}
+
+func (hs hookSet) dnsDone(addrs []net.IPAddr, err error) {
+	for _, h := range hs {
+		if h.DNSDone != nil {
+			h.DNSDone(addrs, err)
+		}
+	}
+}
+
+func (hs hookSet) dialStart(network, addr string) {
+	for _, h := range hs {
+		if h.DialStart != nil {
+			h.DialStart(network, addr)
+		}
+	}
+}
+
+func (hs hookSet) dialDone(network, addr string, err error) {
+	for _, h := range hs {
+		if h.DialDone != nil {
+			h.DialDone(network, addr, err)
+		}
+	}
+}
+
+func (hs hookSet) proxyConnectStart(proxy, addr string) {
+	for _, h := range hs {
+		if h.ProxyConnectStart != nil {
+			h.ProxyConnectStart(proxy, addr)
+		}
+	}
+}
+
+func (hs hookSet) proxyConnectDone(proxy, addr string, err error) {
+	for _, h := range hs {
+		if h.ProxyConnectDone != nil {
+			h.ProxyConnectDone(proxy, addr, err)
+		}
+	}
+}
+
+func (hs hookSet) tlsHandshakeStart(host string) {
+	for _, h := range hs {
+		if h.TLSHandshakeStart != nil {
+			h.TLSHandshakeStart(host)
+		}
+	}
+}
+
+func (hs hookSet) tlsHandshakeDone(host string, err error) {
+	for _, h := range hs {
+		if h.TLSHandshakeDone != nil {
+			h.TLSHandshakeDone(host, err)
+		}
+	}
+}
+
+func (hs hookSet) firstByte() {
+	for _, h := range hs {
+		if h.FirstByte != nil {
+			h.FirstByte()
+		}
+	}
+}
+
+func (hs hookSet) gotConnection(conn net.Conn, reused bool) {
+	for _, h := range hs {
+		if h.gotConn != nil {
+			h.gotConn(conn, reused)
+		}
+	}
+}
+
+func (hs hookSet) wroteField(key string, values []string) {
+	for _, h := range hs {
+		if h.wroteHeaderField != nil {
+			h.wroteHeaderField(key, values)
+		}
+	}
+}
+
+func (hs hookSet) wroteReq() {
+	for _, h := range hs {
+		if h.wroteRequest != nil {
+			h.wroteRequest()
+		}
+	}
+}
+
+func (hs hookSet) readFields(fields []headerField) {
+	for _, h := range hs {
+		if h.readHeader != nil {
+			h.readHeader(fields)
+		}
+	}
+}
+
+func (hs hookSet) redirect(req *http.Request, via []*http.Request) {
+	for _, h := range hs {
+		if h.Redirect != nil {
+			h.Redirect(req, via)
+		}
+	}
+}
+
+func (hs hookSet) retry(attempt int, err error) {
+	for _, h := range hs {
+		if h.Retry != nil {
+			h.Retry(attempt, err)
+		}
+	}
+}
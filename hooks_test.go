@@ -0,0 +1,316 @@
+package cclient_v2
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+	tlsHttp "github.com/useflyent/fhttp"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+// eventLog records the events of hooks in the order they were called
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.events = append(l.events, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+// take returns the recorded events and clears them
+func (l *eventLog) take() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := l.events
+	l.events = nil
+	return events
+}
+
+// hooks returns hooks recording their events with prefix
+func (l *eventLog) hooks(prefix string) Hooks {
+	return Hooks{
+		DNSStart:          func(host string) { l.add("%sdns start %s", prefix, host) },
+		DNSDone:           func(_ []net.IPAddr, err error) { l.add("%sdns done %v", prefix, err) },
+		DialStart:         func(network, addr string) { l.add("%sdial start %s %s", prefix, network, addr) },
+		DialDone:          func(network, addr string, err error) { l.add("%sdial done %s %s %v", prefix, network, addr, err) },
+		TLSHandshakeStart: func(host string) { l.add("%stls start %s", prefix, host) },
+		TLSHandshakeDone:  func(host string, err error) { l.add("%stls done %s %v", prefix, host, err) },
+		FirstByte:         func() { l.add("%sfirst byte", prefix) },
+		ProxyConnectStart: func(proxy, addr string) { l.add("%sproxy start %s %s", prefix, proxy, addr) },
+		ProxyConnectDone: func(proxy, addr string, err error) {
+			l.add("%sproxy done %s %s %v", prefix, proxy, addr, err != nil)
+		},
+		Redirect: func(req *http.Request, via []*http.Request) {
+			l.add("%sredirect %s %d", prefix, req.URL.Path, len(via))
+		},
+	}
+}
+
+func TestHooks(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log eventLog
+	c.AddHooks(log.hooks(""))
+	remove := c.AddHooks(log.hooks("second "))
+
+	addr := srv.Listener.Addr().String()
+	host, _, _ := net.SplitHostPort(addr)
+	want := []string{
+		"dial start tcp " + addr, "second dial start tcp " + addr,
+		"dial done tcp " + addr + " <nil>", "second dial done tcp " + addr + " <nil>",
+		"tls start " + host, "second tls start " + host,
+		"tls done " + host + " <nil>", "second tls done " + host + " <nil>",
+		"first byte", "second first byte",
+	}
+	if _, err = c.NewRequest().SetURL(srv.URL).Do(); err != nil {
+		t.Fatal(err)
+	}
+	if got := log.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("new connection: got %q, want %q", got, want)
+	}
+
+	// the connection is reused and hooks removed are not called anymore
+	remove()
+	if _, err = c.NewRequest().SetURL(srv.URL).Do(); err != nil {
+		t.Fatal(err)
+	}
+	if got := log.take(); !reflect.DeepEqual(got, []string{"first byte"}) {
+		t.Errorf("reused connection: got %q, want the first byte", got)
+	}
+}
+
+func TestHooksLookupAndRedirect(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/target", http.StatusFound)
+		}
+	}))
+	// the certificate of the echo server is valid for localhost
+	certificates := fingerprinttest.NewUnstartedServer()
+	srv.TLS = &tls.Config{Certificates: certificates.TLS.Certificates}
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: certificates.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log eventLog
+	c.AddHooks(log.hooks(""))
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	if _, err = c.NewRequest().SetURL("https://localhost:" + port + "/redirect").Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := log.take()
+	if len(events) < 2 || events[0] != "dns start localhost" || events[1] != "dns done <nil>" {
+		t.Errorf("lookup: got %q, want the lookup of localhost first", events)
+	}
+	var redirects, firstBytes int
+	for _, event := range events {
+		switch {
+		case event == "redirect /target 1":
+			redirects++
+		case event == "first byte":
+			firstBytes++
+		case strings.HasPrefix(event, "redirect"):
+			t.Errorf("redirect: got %q", event)
+		}
+	}
+	if redirects != 1 || firstBytes != 2 {
+		t.Errorf("events: got %q, want one redirect between two responses", events)
+	}
+}
+
+func TestHooksProxyConnect(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+	proxy := serveProxy(t).Addr().String()
+	target := srv.Listener.Addr().String()
+
+	// a closed port the proxy fails to connect to
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := closed.Addr().String()
+	_ = closed.Close()
+
+	tests := []struct {
+		name   string
+		target string
+		want   []string
+	}{
+		{"tunnel", target, []string{"proxy start " + proxy + " " + target, "proxy done " + proxy + " " + target + " false"}},
+		{"failed tunnel", unreachable, []string{"proxy start " + proxy + " " + unreachable, "proxy done " + proxy + " " + unreachable + " true"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, c := range verificationClients(t, "http://"+proxy, TLSVerification{RootCAs: srv.CertPool()}) {
+				t.Run(name, func(t *testing.T) {
+					var log eventLog
+					c.AddHooks(log.hooks(""))
+					_, err := c.NewRequest().SetURL("https://" + test.target).Do()
+					if (err != nil) != (test.target == unreachable) {
+						t.Fatalf("got %v", err)
+					}
+
+					var got []string
+					for _, event := range log.take() {
+						if strings.HasPrefix(event, "proxy ") {
+							got = append(got, event)
+						}
+					}
+					if !reflect.DeepEqual(got, test.want) {
+						t.Errorf("got %q, want %q", got, test.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestMiddlewareCookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Cookie")))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	other := "http://localhost:" + port
+
+	tests := []struct {
+		name string
+		// rewrite changes the request in middleware
+		rewrite func(req *http.Request)
+		want    string
+	}{
+		{"unchanged", func(*http.Request) {}, "jar=1; req=2"},
+		{"rewritten to another host", func(req *http.Request) { req.URL, _ = req.URL.Parse(other + "/") }, "other=3"},
+		{"cookie header of middleware", func(req *http.Request) { req.Header.Set("Cookie", "added=4") }, "jar=1; added=4; req=2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewClient("", 5*time.Second, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			for _, cookie := range []struct{ url, name, value string }{{srv.URL, "jar", "1"}, {other, "other", "3"}} {
+				u, _ := url.Parse(cookie.url)
+				c.jar.SetCookies(u, []*http.Cookie{{Name: cookie.name, Value: cookie.value, Path: "/"}})
+			}
+
+			var seen string
+			c.Use(func(next Handler) Handler {
+				return func(req *http.Request) (*Response, error) {
+					seen = req.Header.Get("Cookie")
+					test.rewrite(req)
+					req.Host = req.URL.Host
+					return next(req)
+				}
+			})
+			resp, err := c.NewRequest().SetURL(srv.URL + "/").SetCookies([]*http.Cookie{{Name: "req", Value: "2"}}).Do()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen != "" {
+				t.Errorf("middleware: got the cookie header %q, want none", seen)
+			}
+			if got := resp.BodyAsString(); got != test.want {
+				t.Errorf("cookie header: got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log eventLog
+	cache := make(map[string]*Response)
+	c.Use(func(next Handler) Handler {
+		return func(req *http.Request) (*Response, error) {
+			log.add("outer %s", strings.Join(req.Header[tlsHttp.HeaderOrderKey], ","))
+			// the signature is sent where the header order of the request puts it
+			req.Header.Set("X-Signature", "signed "+req.Header.Get("X-Payload"))
+			req.Header[tlsHttp.HeaderOrderKey] = []string{"x-signature", "x-payload"}
+			resp, err := next(req)
+			log.add("outer done")
+			return resp, err
+		}
+	}, func(next Handler) Handler {
+		return func(req *http.Request) (*Response, error) {
+			log.add("inner %s", req.Header.Get("X-Signature"))
+			if resp, ok := cache[req.URL.Path]; ok {
+				return resp, nil
+			}
+			resp, err := next(req)
+			if err == nil {
+				cache[req.URL.Path] = resp
+			}
+			return resp, err
+		}
+	})
+
+	resp, err := c.NewRequest().SetURL(srv.URL+"/signed").
+		SetHeader("X-Payload", "payload").
+		SetHeaderOrder([]string{"x-payload"}).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"outer x-payload", "inner signed payload", "outer done"}
+	if got := log.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("middleware calls: got %q, want %q", got, want)
+	}
+
+	f, ok := srv.LastFingerprint()
+	if !ok || len(f.Requests) != 1 {
+		t.Fatalf("requests: got %+v", f.Requests)
+	}
+	r := f.Requests[0]
+	if r.Header("x-signature") != "signed payload" || len(r.HeaderOrder) < 2 || !reflect.DeepEqual(r.HeaderOrder[:2], []string{"x-signature", "x-payload"}) {
+		t.Errorf("sent request: got headers %v in the order %v", r.Headers, r.HeaderOrder)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		t.Errorf("status: got %d", resp.StatusCode())
+	}
+
+	// middleware answering itself sends no request
+	srv.Reset()
+	cached, err := c.NewRequest().SetURL(srv.URL+"/signed").SetHeader("X-Payload", "payload").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != resp || len(srv.Fingerprints()) != 0 {
+		t.Errorf("cached: got another response or %d connections", len(srv.Fingerprints()))
+	}
+}
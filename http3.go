@@ -0,0 +1,451 @@
+package cclient_v2
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	tlsHttp "github.com/useflyent/fhttp"
+)
+
+// HTTP3Mode selects which requests of a tls client are sent over http/3
+type HTTP3Mode int
+
+const (
+	// HTTP3AltSvc sends requests over http/3 to origins that advertised h3 in an Alt-Svc header, the default.
+	// It needs an AltSvcCache, clients without one are not created
+	HTTP3AltSvc HTTP3Mode = iota
+	// HTTP3Always tries http/3 first for every https request, requests to origins with alternative services are sent to
+	// those
+	HTTP3Always
+)
+
+const (
+	// http3SettingQPACKMaxTableCapacity is the SETTINGS_QPACK_MAX_TABLE_CAPACITY http/3 setting
+	http3SettingQPACKMaxTableCapacity = 0x1
+	// http3SettingMaxFieldSectionSize is the SETTINGS_MAX_FIELD_SECTION_SIZE http/3 setting
+	http3SettingMaxFieldSectionSize = 0x6
+	// http3SettingH3Datagram is the SETTINGS_H3_DATAGRAM http/3 setting
+	http3SettingH3Datagram = 0x33
+
+	// http3DefaultMaxFieldSectionSize limits the size of response headers without SETTINGS_MAX_FIELD_SECTION_SIZE
+	http3DefaultMaxFieldSectionSize = 10 << 20
+)
+
+// HTTP3 enables http/3 over quic for a tls client, it is passed to NewClient as optional parameter or set on the Profile.
+// Requests fall back to tcp when the quic handshake fails, the origin is then not tried over http/3 for five minutes.
+// Clients with a proxy send every request over tcp, quic can not be tunneled through http and socks5 proxies.
+// Requests are sent with the pseudo header order and header order of the client like over http2, connections send the
+// SETTINGS frame of the client and open the qpack streams like chrome. The quic handshake is made with crypto/tls, the
+// client hello and ja3 of the client are not sent over quic, servers fingerprinting the quic client hello see the one
+// of go. quic-go needs go 1.24
+type HTTP3 struct {
+	// Mode selects the requests sent over http/3
+	Mode HTTP3Mode
+	// QUIC are the quic transport parameters of connections
+	QUIC QUICParameters
+	// Settings are the settings of the SETTINGS frame, sent in ascending order of their ids.
+	// SETTINGS_H3_DATAGRAM (0x33) enables http datagrams, SETTINGS_MAX_FIELD_SECTION_SIZE (0x6) also limits the
+	// size of response headers. SETTINGS_QPACK_MAX_TABLE_CAPACITY (0x1) can only be zero, the qpack decoder has no
+	// dynamic table
+	Settings map[uint64]uint64
+	// GreaseSetting sends a setting of a reserved id with a random value after the settings, like chrome. Id and value
+	// are chosen once per client
+	GreaseSetting bool
+}
+
+// QUICParameters are the quic transport parameters a client sends, zero values use the defaults of quic-go
+type QUICParameters struct {
+	// MaxIdleTimeout is the max_idle_timeout parameter
+	MaxIdleTimeout time.Duration
+	// InitialStreamReceiveWindow is the initial_max_stream_data parameters
+	InitialStreamReceiveWindow uint64
+	// MaxStreamReceiveWindow is the size the stream receive windows grow to
+	MaxStreamReceiveWindow uint64
+	// InitialConnectionReceiveWindow is the initial_max_data parameter
+	InitialConnectionReceiveWindow uint64
+	// MaxConnectionReceiveWindow is the size the connection receive window grows to
+	MaxConnectionReceiveWindow uint64
+	// MaxIncomingStreams is the initial_max_streams_bidi parameter, servers do not open bidirectional streams over
+	// http/3. Negative values send zero
+	MaxIncomingStreams int64
+	// MaxIncomingUniStreams is the initial_max_streams_uni parameter, negative values send zero
+	MaxIncomingUniStreams int64
+	// InitialPacketSize is the size initial packets are padded to, browsers pad them to 1250 to 1350 bytes
+	InitialPacketSize uint16
+	// HandshakeTimeout is how long the quic handshake may take before the request falls back to tcp
+	HandshakeTimeout time.Duration
+	// KeepAlivePeriod is the interval of keep alive packets, none are sent if it is zero
+	KeepAlivePeriod time.Duration
+}
+
+// checkAltSvcCache checks that a client sending requests to alternative services over http/3 has an alt-svc cache
+func (h *HTTP3) checkAltSvcCache(altSvc *AltSvcCache) error {
+	if h != nil && h.Mode == HTTP3AltSvc && altSvc == nil {
+		return errors.New("http3 mode HTTP3AltSvc needs an AltSvcCache")
+	}
+	return nil
+}
+
+// validate checks the settings and the transport parameters of the client
+func (h *HTTP3) validate() error {
+	if h.Mode != HTTP3AltSvc && h.Mode != HTTP3Always {
+		return fmt.Errorf("invalid http3 mode %d", h.Mode)
+	}
+	for id, v := range h.Settings {
+		switch {
+		case id >= 0x2 && id <= 0x5:
+			return fmt.Errorf("http3 setting %#x is reserved for http2", id)
+		case id == http3SettingQPACKMaxTableCapacity && v != 0:
+			return errors.New("http3 setting SETTINGS_QPACK_MAX_TABLE_CAPACITY can only be zero")
+		case id == http3SettingH3Datagram && v > 1:
+			return fmt.Errorf("invalid http3 setting SETTINGS_H3_DATAGRAM %d", v)
+		case id >= 1<<62 || v >= 1<<62:
+			return fmt.Errorf("http3 setting %#x larger than 2^62-1", id)
+		}
+	}
+	if size := h.QUIC.InitialPacketSize; size != 0 && size < 1200 {
+		return fmt.Errorf("quic initial packet size %d smaller than 1200", size)
+	}
+	return nil
+}
+
+// datagrams reports whether http datagrams are enabled
+func (h *HTTP3) datagrams() bool {
+	return h.Settings[http3SettingH3Datagram] == 1
+}
+
+// maxFieldSectionSize returns the size response headers are limited to
+func (h *HTTP3) maxFieldSectionSize() uint64 {
+	if v, ok := h.Settings[http3SettingMaxFieldSectionSize]; ok {
+		return v
+	}
+	return http3DefaultMaxFieldSectionSize
+}
+
+// controlStream returns what the control stream of a connection starts with, its stream type and the SETTINGS frame
+func (h *HTTP3) controlStream() []byte {
+	ids := make([]uint64, 0, len(h.Settings))
+	for id := range h.Settings {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var settings []byte
+	for _, id := range ids {
+		settings = quicvarint.Append(settings, id)
+		settings = quicvarint.Append(settings, h.Settings[id])
+	}
+	if h.GreaseSetting {
+		// reserved ids are 0x1f * N + 0x21
+		settings = quicvarint.Append(settings, 0x1f*uint64(rand.Intn(1<<16))+0x21)
+		settings = quicvarint.Append(settings, uint64(rand.Uint32()))
+	}
+	return appendHTTP3Frame(quicvarint.Append(nil, http3StreamControl), http3FrameSettings, settings)
+}
+
+// config returns the quic config of connections
+func (p QUICParameters) config(datagrams bool) *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:           p.HandshakeTimeout,
+		MaxIdleTimeout:                 p.MaxIdleTimeout,
+		InitialStreamReceiveWindow:     p.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         p.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: p.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     p.MaxConnectionReceiveWindow,
+		MaxIncomingStreams:             p.MaxIncomingStreams,
+		MaxIncomingUniStreams:          p.MaxIncomingUniStreams,
+		KeepAlivePeriod:                p.KeepAlivePeriod,
+		InitialPacketSize:              p.InitialPacketSize,
+		EnableDatagrams:                datagrams,
+	}
+}
+
+// http3RoundTripper sends the requests of a tls client over http/3
+type http3RoundTripper struct {
+	config    *HTTP3
+	tlsConfig func(host string) *tls.Config
+	quic      *quic.Config
+	control   []byte
+	broken    *brokenAlternatives
+	pool      *http3Pool
+}
+
+// newHTTP3RoundTripper creates the http3 round tripper of a tls client, connections are verified and present client
+// certificates like the tcp connections of the client
+func newHTTP3RoundTripper(config *HTTP3, verification TLSVerification, clientCerts ClientCertificates, keyLog io.Writer, resume bool, broken *brokenAlternatives) *http3RoundTripper {
+	var sessions tls.ClientSessionCache
+	if resume {
+		sessions = tls.NewLRUClientSessionCache(0)
+	}
+
+	rt := &http3RoundTripper{
+		config: config,
+		tlsConfig: func(host string) *tls.Config {
+			c := verification.tlsConfig()
+			c.ServerName = host
+			c.NextProtos = []string{http3.NextProtoH3}
+			c.KeyLogWriter = keyLog
+			c.ClientSessionCache = sessions
+			if !clientCerts.empty() {
+				c.GetClientCertificate = clientCerts.getTLSClientCertificate(host)
+			}
+			return c
+		},
+		quic:    config.QUIC.config(config.datagrams()),
+		control: config.controlStream(),
+		broken:  broken,
+		pool:    &http3Pool{conns: make(map[string]*http3Conn)},
+	}
+	return rt
+}
+
+// originAlternative is the h3 endpoint of the origin at addr itself, which HTTP3Always tries
+func originAlternative(addr string) AltService {
+	_, port, _ := net.SplitHostPort(addr)
+	return AltService{Protocol: http3.NextProtoH3, Port: port}
+}
+
+// roundTrip sends the request over http/3 to the origin at addr, over a connection to the alternative or to the origin
+// itself if it is nil. Failing to connect returns an *altSvcDialError, the request is then sent over another route
+func (rt *http3RoundTripper) roundTrip(req *tlsHttp.Request, addr string, alternative *AltService) (*tlsHttp.Response, error) {
+	target := originAlternative(addr)
+	if alternative != nil {
+		target = *alternative
+	}
+	key := transportKey(addr, target.endpoint(addr))
+	ctx := req.Context()
+
+	fields, gzip, err := http3Fields(req)
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		c, reused, err := rt.pool.get(ctx, key, func(ctx context.Context, c *http3Conn) error {
+			return rt.dial(ctx, c, addr, target)
+		})
+		if err != nil {
+			closeRequestBody(req)
+			return nil, err
+		}
+
+		done, ok := c.begin()
+		if !ok {
+			closeRequestBody(req)
+			return nil, errHTTP3Closed
+		}
+		str, err := c.conn.OpenStreamSync(ctx)
+		if err != nil {
+			done()
+			rt.pool.remove(key, c)
+			if reused && attempt == 1 && ctx.Err() == nil {
+				// the connection was closed after its last request, the request is sent over a new one
+				continue
+			}
+			closeRequestBody(req)
+			return nil, err
+		}
+		return rt.send(ctx, c, str, req, fields, gzip, reused, done)
+	}
+}
+
+// dial opens the quic connection of c for the origin at addr to the alternative target.
+// Failures return an *altSvcDialError, the request was not sent
+func (rt *http3RoundTripper) dial(ctx context.Context, c *http3Conn, addr string, target AltService) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	udp, err := rt.pool.transport()
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := resolveUDPAddr(ctx, target.endpoint(addr))
+	if err == nil {
+		c.conn, err = udp.Dial(ctx, endpoint, rt.tlsConfig(host), rt.quic)
+	}
+	if err == nil {
+		if err = c.open(rt.control); err != nil {
+			c.close()
+		}
+	}
+	if err != nil {
+		return &altSvcDialError{alternative: target, err: err}
+	}
+	return nil
+}
+
+// resolveUDPAddr looks up the address of endpoint with the dns hooks of the request, preferring ipv4 like the net
+// package
+func resolveUDPAddr(ctx context.Context, endpoint string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	p, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := ips[0]
+	for _, candidate := range ips {
+		if candidate.IP.To4() != nil {
+			ip = candidate
+			break
+		}
+	}
+	return &net.UDPAddr{IP: ip.IP, Port: p, Zone: ip.Zone}, nil
+}
+
+// closeRequestBody closes the body of a request that is not sent
+func closeRequestBody(req *tlsHttp.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
+
+var errHTTP3Closed = errors.New("http3 connections of the client were closed")
+
+// http3Pool are the quic connections of a http3 round tripper and the udp socket they are sent over.
+// Connections are keyed by the origin and the endpoint they were opened to
+type http3Pool struct {
+	mu     sync.Mutex
+	conns  map[string]*http3Conn
+	udp    *quic.Transport
+	closed bool
+}
+
+// get returns the connection for key and whether an earlier request opened it, dial opens it if there is none.
+// Requests waiting for the dial of a canceled request dial again
+func (p *http3Pool) get(ctx context.Context, key string, dial func(ctx context.Context, c *http3Conn) error) (*http3Conn, bool, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, false, errHTTP3Closed
+		}
+		c, ok := p.conns[key]
+		if !ok {
+			c = &http3Conn{ready: make(chan struct{})}
+			p.conns[key] = c
+		}
+		p.mu.Unlock()
+
+		if !ok {
+			return p.open(key, c, dial(ctx, c))
+		}
+
+		select {
+		case <-c.ready:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if c.err == nil && c.usable() {
+			return c, true, nil
+		}
+		p.remove(key, c)
+		if c.err != nil && !errors.Is(c.err, context.Canceled) && !errors.Is(c.err, context.DeadlineExceeded) {
+			return nil, false, c.err
+		}
+	}
+}
+
+// open finishes the dial of c with its error, c is closed if the pool was closed meanwhile
+func (p *http3Pool) open(key string, c *http3Conn, err error) (*http3Conn, bool, error) {
+	p.mu.Lock()
+	closed := p.closed
+	if err == nil && closed {
+		err = errHTTP3Closed
+		defer c.close()
+	}
+	c.err = err
+	if err != nil && p.conns[key] == c {
+		delete(p.conns, key)
+	}
+	close(c.ready)
+	p.mu.Unlock()
+
+	if err != nil {
+		return nil, false, err
+	}
+	return c, false, nil
+}
+
+// remove removes c unless another connection replaced it, the next request for key opens a new connection
+func (p *http3Pool) remove(key string, c *http3Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns[key] == c {
+		delete(p.conns, key)
+	}
+}
+
+// transport returns the quic transport of the udp socket of the pool, the socket is opened with the first connection
+func (p *http3Pool) transport() (*quic.Transport, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errHTTP3Closed
+	}
+	if p.udp == nil {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+		p.udp = &quic.Transport{Conn: conn}
+	}
+	return p.udp, nil
+}
+
+// close retires the connections of the pool and closes its udp socket once they were closed, the quic transport does
+// not close a socket it was created with. Responses that are read meanwhile are not cut off
+func (p *http3Pool) close() {
+	p.mu.Lock()
+	var conns []*http3Conn
+	for _, c := range p.conns {
+		select {
+		case <-c.ready:
+			if c.err == nil {
+				conns = append(conns, c)
+			}
+		default:
+			// the dial sees the pool closed
+		}
+	}
+	udp := p.udp
+	p.conns, p.udp, p.closed = nil, nil, true
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		c.retire()
+	}
+	if udp == nil {
+		return
+	}
+	go func() {
+		for _, c := range conns {
+			<-c.conn.Context().Done()
+		}
+		_ = udp.Close()
+		_ = udp.Conn.Close()
+	}()
+}
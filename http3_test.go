@@ -0,0 +1,416 @@
+package cclient_v2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/qpack"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+// http3Recording is what a client sent to a recordHTTP3 server
+type http3Recording struct {
+	mu          sync.Mutex
+	streamTypes map[quic.StreamID]uint64
+	settings    []uint64
+	fields      []qpack.HeaderField
+}
+
+// recordHTTP3 starts a quic server with the certificate of srv that records the unidirectional streams, the SETTINGS
+// frame and the header fields of the last request a client sends, and answers requests with ok
+func recordHTTP3(t *testing.T, srv *fingerprinttest.Server) (string, *http3Recording) {
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: srv.TLS.Certificates, NextProtos: []string{http3.NextProtoH3}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	rec := &http3Recording{streamTypes: make(map[quic.StreamID]uint64)}
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go rec.acceptUniStreams(conn)
+			go rec.acceptStreams(conn)
+		}
+	}()
+	return ln.Addr().String(), rec
+}
+
+func (rec *http3Recording) acceptUniStreams(conn *quic.Conn) {
+	for {
+		str, err := conn.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			r := quicvarint.NewReader(str)
+			streamType, err := quicvarint.Read(r)
+			if err != nil {
+				return
+			}
+			rec.mu.Lock()
+			rec.streamTypes[str.StreamID()] = streamType
+			rec.mu.Unlock()
+			if streamType != http3StreamControl {
+				return
+			}
+
+			frame, length, err := readHTTP3FrameHeader(r)
+			if err != nil || frame != http3FrameSettings {
+				return
+			}
+			payload := make([]byte, length)
+			if _, err = io.ReadFull(str, payload); err != nil {
+				return
+			}
+			settings := quicvarint.NewReader(bytes.NewReader(payload))
+			for {
+				id, err := quicvarint.Read(settings)
+				if err != nil {
+					return
+				}
+				if _, err = quicvarint.Read(settings); err != nil {
+					return
+				}
+				rec.mu.Lock()
+				rec.settings = append(rec.settings, id)
+				rec.mu.Unlock()
+			}
+		}()
+	}
+}
+
+func (rec *http3Recording) acceptStreams(conn *quic.Conn) {
+	for {
+		str, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			frame, length, err := readHTTP3FrameHeader(quicvarint.NewReader(str))
+			if err != nil || frame != http3FrameHeaders {
+				return
+			}
+			fields, err := readHTTP3HeaderBlock(str, length, http3DefaultMaxFieldSectionSize)
+			if err != nil {
+				return
+			}
+			rec.mu.Lock()
+			rec.fields = fields
+			rec.mu.Unlock()
+
+			var block bytes.Buffer
+			encoder := qpack.NewEncoder(&block)
+			_ = encoder.WriteField(qpack.HeaderField{Name: ":status", Value: "200"})
+			_ = encoder.WriteField(qpack.HeaderField{Name: "content-length", Value: "2"})
+			response := appendHTTP3Frame(nil, http3FrameHeaders, block.Bytes())
+			response = appendHTTP3Frame(response, http3FrameData, []byte("ok"))
+			_, _ = str.Write(response)
+			_ = str.Close()
+		}()
+	}
+}
+
+func (rec *http3Recording) names() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	names := make([]string, len(rec.fields))
+	for i, f := range rec.fields {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// serveHTTP3 starts a http3 server with the certificate of srv
+func serveHTTP3(t *testing.T, srv *fingerprinttest.Server, server *http3.Server) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLSConfig = http3.ConfigureTLSConfig(&tls.Config{Certificates: srv.TLS.Certificates})
+	go func() { _ = server.Serve(conn) }()
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = conn.Close()
+	})
+	return conn.LocalAddr().String()
+}
+
+func TestHTTP3Options(t *testing.T) {
+	tests := []struct {
+		name   string
+		useTLS bool
+		params []interface{}
+		err    string
+	}{
+		{"alt-svc mode with cache", true, []interface{}{HTTP3{}, NewAltSvcCache()}, ""},
+		{"alt-svc mode without cache", true, []interface{}{&HTTP3{Mode: HTTP3AltSvc}}, "needs an AltSvcCache"},
+		{"always without cache", true, []interface{}{HTTP3{Mode: HTTP3Always}}, ""},
+		{"invalid mode", true, []interface{}{HTTP3{Mode: 2}, NewAltSvcCache()}, "invalid http3 mode"},
+		{"reserved setting", true, []interface{}{HTTP3{Mode: HTTP3Always, Settings: map[uint64]uint64{0x4: 1}}}, "reserved for http2"},
+		{"table capacity", true, []interface{}{HTTP3{Mode: HTTP3Always, Settings: map[uint64]uint64{0x1: 4096}}}, "can only be zero"},
+		{"initial packet size", true, []interface{}{HTTP3{Mode: HTTP3Always, QUIC: QUICParameters{InitialPacketSize: 1000}}}, "smaller than 1200"},
+		{"non tls client", false, []interface{}{HTTP3{Mode: HTTP3Always}}, "needs a tls client"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := test.params
+			if test.useTLS {
+				params = append([]interface{}{tlsUtls.HelloChrome_102}, params...)
+			}
+			c, err := NewClient("", 5*time.Second, test.useTLS, params...)
+			if err == nil {
+				c.Close()
+			}
+			if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("got %v, want %q", err, test.err)
+			}
+		})
+	}
+
+	// clones of a client without alt-svc cache can not use alternative services either
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.Clone(CloneOptions{Profile: Profile{ClientHello: tlsUtls.HelloChrome_102, HTTP3: &HTTP3{}}})
+	if err == nil || !strings.Contains(err.Error(), "needs an AltSvcCache") {
+		t.Errorf("clone: got %v, want an error for the missing alt-svc cache", err)
+	}
+}
+
+func TestHTTP3Fingerprint(t *testing.T) {
+	srv := fingerprinttest.NewUnstartedServer()
+	addr, rec := recordHTTP3(t, srv)
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()},
+		AkamaiFingerprint("1:65536;2:0;4:6291456;6:262144|15663105|0|m,p,a,s"),
+		&HTTP3{
+			Mode:          HTTP3Always,
+			Settings:      map[uint64]uint64{0x33: 1, 0x6: 262144, 0x7: 100, 0x1: 0},
+			GreaseSetting: true,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.NewRequest().SetURL("https://"+addr+"/path?q=1").
+		SetHeader("x-b", "b").
+		SetHeader("accept", "*/*").
+		SetHeader("x-a", "a").
+		SetHeader("user-agent", "agent").
+		SetHeaderOrder([]string{"user-agent", "accept", "x-b", "x-a"}).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Proto() != "HTTP/3.0" || string(resp.Body()) != "ok" {
+		t.Fatalf("response: got %s %q", resp.Proto(), resp.Body())
+	}
+
+	want := []string{":method", ":path", ":authority", ":scheme", "user-agent", "accept", "x-b", "x-a", "accept-encoding"}
+	if got := rec.names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("header fields: got %v, want %v", got, want)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	ids := make([]quic.StreamID, 0, len(rec.streamTypes))
+	for id := range rec.streamTypes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var types []uint64
+	for _, id := range ids {
+		types = append(types, rec.streamTypes[id])
+	}
+	if !reflect.DeepEqual(types, []uint64{http3StreamControl, http3StreamQPACKEncoder, http3StreamQPACKDecoder}) {
+		t.Errorf("stream types: got %v", types)
+	}
+	if len(rec.settings) != 5 || !reflect.DeepEqual(rec.settings[:4], []uint64{0x1, 0x6, 0x7, 0x33}) || (rec.settings[4]-0x21)%0x1f != 0 {
+		t.Errorf("settings: got %#x", rec.settings)
+	}
+}
+
+func TestHTTP3Server(t *testing.T) {
+	srv := fingerprinttest.NewUnstartedServer()
+	var mu sync.Mutex
+	conns := 0
+	addr := serveHTTP3(t, srv, &http3.Server{
+		ConnContext: func(ctx context.Context, _ *quic.Conn) context.Context {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+			return ctx
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if r.Header.Get("Accept-Encoding") == "gzip" {
+				w.Header().Set("Content-Encoding", "gzip")
+				zw := gzip.NewWriter(w)
+				_, _ = zw.Write([]byte("compressed"))
+				_ = zw.Close()
+				return
+			}
+			_, _ = w.Write(body)
+		}),
+	})
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()},
+		&HTTP3{Mode: HTTP3Always})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent requests share the connection the first of them dials
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.NewRequest().SetURL("https://" + addr).Do()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(resp.Body()) != "compressed" {
+				t.Errorf("gzip: got %q", resp.Body())
+			}
+		}()
+	}
+	wg.Wait()
+
+	resp, err := c.NewRequest().SetURL("https://"+addr).SetMethod("POST").SetBody("posted").
+		SetHeader("accept-encoding", "identity").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Proto() != "HTTP/3.0" || string(resp.Body()) != "posted" {
+		t.Errorf("post: got %s %q", resp.Proto(), resp.Body())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Errorf("connections: got %d, want 1", conns)
+	}
+}
+
+func TestHTTP3Fallback(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()},
+		&HTTP3{Mode: HTTP3Always, QUIC: QUICParameters{HandshakeTimeout: 200 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var retries []error
+	c.AddHooks(Hooks{Retry: func(_ int, err error) { retries = append(retries, err) }})
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.NewRequest().SetURL(srv.URL).Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Proto() != "HTTP/2.0" {
+			t.Errorf("proto: got %s", resp.Proto())
+		}
+	}
+	var dialErr *altSvcDialError
+	if len(retries) != 1 || !errors.As(retries[0], &dialErr) {
+		t.Errorf("retries: got %v, want one failed quic handshake", retries)
+	}
+}
+
+// http3PoolOf returns the http3 connections of the backend of the client
+func http3PoolOf(c *Client) *http3Pool {
+	return c.backend.backend.(*fhttpBackend).transport.(*roundTripper).http3.pool
+}
+
+func TestHTTP3ClosesReplacedConnections(t *testing.T) {
+	srv := fingerprinttest.NewUnstartedServer()
+	release := make(chan struct{})
+	addr := serveHTTP3(t, srv, &http3.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			return
+		}
+		_, _ = w.Write([]byte("started "))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("finished"))
+	})})
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()},
+		&HTTP3{Mode: HTTP3Always})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.NewRequest().SetURL("https://" + addr).Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the response to a request sent before the replacement is read after it
+	req, err := c.NewRequest().SetURL("https://" + addr + "/slow").prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.stream = true
+	resp, err := c.open(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.body.Close()
+
+	pool := http3PoolOf(c)
+	pool.mu.Lock()
+	socket := pool.udp.Conn
+	pool.mu.Unlock()
+
+	if !c.UpdateProxy("") {
+		t.Fatal("UpdateProxy failed")
+	}
+	pool.mu.Lock()
+	closed := pool.closed
+	pool.mu.Unlock()
+	if !closed {
+		t.Fatal("connections of the replaced backend were not closed")
+	}
+	close(release)
+	if body, err := io.ReadAll(resp.body); err != nil || string(body) != "started finished" {
+		t.Fatalf("body of the replaced backend: got %q, %v", body, err)
+	}
+	// the socket is closed once the connections were closed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := socket.WriteTo([]byte{0}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}); errors.Is(err, net.ErrClosed) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("udp socket of the replaced backend was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
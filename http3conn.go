@@ -0,0 +1,564 @@
+package cclient_v2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/qpack"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	tlsHttp "github.com/useflyent/fhttp"
+	"golang.org/x/net/http/httpguts"
+)
+
+const (
+	http3FrameData     = 0x0
+	http3FrameHeaders  = 0x1
+	http3FrameSettings = 0x4
+	http3FrameGoAway   = 0x7
+
+	http3StreamControl      = 0x0
+	http3StreamQPACKEncoder = 0x2
+	http3StreamQPACKDecoder = 0x3
+
+	http3NoError             = 0x100
+	http3StreamCreationError = 0x103
+	http3RequestCancelled    = 0x10c
+)
+
+// http3Conn is a quic connection of a http3 round tripper, ready is closed when the dial of the connection ended
+type http3Conn struct {
+	ready chan struct{}
+	conn  *quic.Conn
+	err   error
+
+	// streams are the control and qpack streams of the client, closing them would close the connection
+	streams []*quic.SendStream
+
+	mu     sync.Mutex
+	goAway bool
+	// requests are the requests whose response is not read yet, a retired connection is closed after the last one
+	requests int
+	retired  bool
+}
+
+// open opens the control stream with the SETTINGS frame of the client and the qpack encoder and decoder streams like
+// chrome, and reads the streams of the server
+func (c *http3Conn) open(control []byte) error {
+	for _, start := range [][]byte{control, {http3StreamQPACKEncoder}, {http3StreamQPACKDecoder}} {
+		str, err := c.conn.OpenUniStream()
+		if err != nil {
+			return err
+		}
+		if _, err = str.Write(start); err != nil {
+			return err
+		}
+		c.streams = append(c.streams, str)
+	}
+
+	go c.acceptStreams()
+	return nil
+}
+
+// acceptStreams reads the unidirectional streams of the server until the connection is closed
+func (c *http3Conn) acceptStreams() {
+	for {
+		str, err := c.conn.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go c.readStream(str)
+	}
+}
+
+// readStream reads a unidirectional stream of the server, a GOAWAY frame on the control stream stops new requests
+// from using the connection
+func (c *http3Conn) readStream(str *quic.ReceiveStream) {
+	r := quicvarint.NewReader(str)
+	streamType, err := quicvarint.Read(r)
+	if err != nil {
+		return
+	}
+
+	switch streamType {
+	case http3StreamControl:
+		for {
+			frame, length, err := readHTTP3FrameHeader(r)
+			if err != nil {
+				return
+			}
+			if frame == http3FrameGoAway {
+				c.mu.Lock()
+				c.goAway = true
+				c.mu.Unlock()
+			}
+			if _, err = io.CopyN(io.Discard, str, int64(length)); err != nil {
+				return
+			}
+		}
+	case http3StreamQPACKEncoder, http3StreamQPACKDecoder:
+		// the dynamic table has no capacity, the instructions of the server are not needed
+		_, _ = io.Copy(io.Discard, str)
+	default:
+		// pushes are not allowed without MAX_PUSH_ID, streams of unknown types are ignored
+		str.CancelRead(http3StreamCreationError)
+	}
+}
+
+// usable reports whether new requests can be sent over the connection
+func (c *http3Conn) usable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.goAway && c.conn.Context().Err() == nil
+}
+
+func (c *http3Conn) close() {
+	_ = c.conn.CloseWithError(http3NoError, "")
+}
+
+// begin counts a request sent over the connection, done is called once its response was read or failed.
+// It returns false if the connection was retired
+func (c *http3Conn) begin() (done func(), ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.retired {
+		return nil, false
+	}
+	c.requests++
+	var once sync.Once
+	return func() { once.Do(c.end) }, true
+}
+
+func (c *http3Conn) end() {
+	c.mu.Lock()
+	c.requests--
+	closing := c.retired && c.requests == 0
+	c.mu.Unlock()
+
+	if closing {
+		c.close()
+	}
+}
+
+// retire stops new requests from using the connection, it is closed once the responses of its requests were read
+func (c *http3Conn) retire() {
+	c.mu.Lock()
+	c.retired = true
+	closing := c.requests == 0
+	c.mu.Unlock()
+
+	if closing {
+		c.close()
+	}
+}
+
+// send writes the request to the stream str of c and reads its response, fields are the header fields of the request
+// and gzip is whether they ask for a gzip response
+func (rt *http3RoundTripper) send(ctx context.Context, c *http3Conn, str *quic.Stream, req *tlsHttp.Request, fields []qpack.HeaderField, gzip, reused bool, done func()) (*tlsHttp.Response, error) {
+	stop := context.AfterFunc(ctx, func() {
+		str.CancelWrite(http3RequestCancelled)
+		str.CancelRead(http3RequestCancelled)
+	})
+	fail := func(err error) (*tlsHttp.Response, error) {
+		stop()
+		done()
+		str.CancelWrite(http3RequestCancelled)
+		str.CancelRead(http3RequestCancelled)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+
+	hooks := hooksFrom(ctx)
+	hooks.gotConnection(http3NetConn{conn: c.conn}, reused)
+
+	var block bytes.Buffer
+	encoder := qpack.NewEncoder(&block)
+	for _, f := range fields {
+		_ = encoder.WriteField(f)
+		hooks.wroteField(f.Name, []string{f.Value})
+	}
+	if _, err := str.Write(appendHTTP3Frame(nil, http3FrameHeaders, block.Bytes())); err != nil {
+		closeRequestBody(req)
+		return fail(err)
+	}
+	if req.Body == nil || req.Body == tlsHttp.NoBody {
+		_ = str.Close()
+		hooks.wroteReq()
+	} else {
+		go writeHTTP3Body(str, req.Body, hooks)
+	}
+
+	r := quicvarint.NewReader(str)
+	limit := rt.config.maxFieldSectionSize()
+	status, header, err := readHTTP3ResponseHeader(str, r, limit, hooks)
+	if err != nil {
+		return fail(err)
+	}
+
+	state := c.conn.ConnectionState().TLS
+	resp := &tlsHttp.Response{
+		Status:        strconv.Itoa(status) + " " + tlsHttp.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/3.0",
+		ProtoMajor:    3,
+		Header:        header,
+		ContentLength: -1,
+		Request:       req,
+		TLS:           &state,
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = length
+	}
+
+	body := &http3Body{str: str, r: r, stop: stop, done: done, resp: resp, limit: limit}
+	resp.Body = body
+	if gzip && strings.EqualFold(header.Get("Content-Encoding"), "gzip") {
+		header.Del("Content-Encoding")
+		header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+		resp.Body = &http3GzipBody{body: body}
+	}
+	return resp, nil
+}
+
+// http3Fields returns the header fields of a request in its pseudo header order and header order, pseudo headers
+// missing in the order follow in the default order. gzip is whether the fields ask for a gzip response, like the
+// fhttp transports do for requests without Accept-Encoding header
+func http3Fields(req *tlsHttp.Request) (fields []qpack.HeaderField, gzip bool, err error) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if host, err = httpguts.PunycodeHostPort(host); err != nil {
+		return nil, false, err
+	}
+	method := req.Method
+	if method == "" {
+		method = tlsHttp.MethodGet
+	}
+
+	pseudo := map[string]string{":method": method, ":authority": host}
+	if method != tlsHttp.MethodConnect {
+		pseudo[":scheme"] = req.URL.Scheme
+		pseudo[":path"] = req.URL.RequestURI()
+	}
+	for _, name := range append(append([]string(nil), req.Header[tlsHttp.PHeaderOrderKey]...), defaultPHeaderOrder...) {
+		if v, ok := pseudo[name]; ok {
+			fields = append(fields, qpack.HeaderField{Name: name, Value: v})
+			delete(pseudo, name)
+		}
+	}
+
+	gzip = len(headerValues(http.Header(req.Header), "Accept-Encoding")) == 0 &&
+		len(headerValues(http.Header(req.Header), "Range")) == 0 && method != tlsHttp.MethodHead
+
+	header := make(tlsHttp.Header, len(req.Header)+2)
+	for k, v := range req.Header {
+		if k == tlsHttp.HeaderOrderKey || k == tlsHttp.PHeaderOrderKey {
+			continue
+		}
+		switch strings.ToLower(k) {
+		case "host", "content-length", "connection", "proxy-connection", "transfer-encoding", "upgrade", "keep-alive":
+			// host is :authority, content-length is set from the body and the others are connection specific
+			continue
+		}
+		header[k] = v
+	}
+	length := http3ContentLength(req)
+	if length > 0 || length == 0 && (method == tlsHttp.MethodPost || method == tlsHttp.MethodPut || method == tlsHttp.MethodPatch) {
+		header["content-length"] = []string{strconv.FormatInt(length, 10)}
+	}
+	if gzip {
+		header["accept-encoding"] = []string{"gzip"}
+	}
+
+	order := make(map[string]int)
+	for i, name := range req.Header[tlsHttp.HeaderOrderKey] {
+		order[strings.ToLower(name)] = i
+	}
+	kvs, _ := header.SortedKeyValuesBy(order, nil)
+	for _, kv := range kvs {
+		if !httpguts.ValidHeaderFieldName(kv.Key) {
+			return nil, false, fmt.Errorf("invalid http header name %q", kv.Key)
+		}
+		for _, v := range kv.Values {
+			if !httpguts.ValidHeaderFieldValue(v) {
+				return nil, false, fmt.Errorf("invalid http header value %q for header %q", v, kv.Key)
+			}
+			fields = append(fields, qpack.HeaderField{Name: strings.ToLower(kv.Key), Value: v})
+		}
+	}
+	return fields, gzip, nil
+}
+
+// http3ContentLength returns the length of the body of a request, -1 if it is not known
+func http3ContentLength(req *tlsHttp.Request) int64 {
+	if req.Body == nil || req.Body == tlsHttp.NoBody {
+		return 0
+	}
+	if req.ContentLength != 0 {
+		return req.ContentLength
+	}
+	return -1
+}
+
+// writeHTTP3Body writes the body of a request in DATA frames and closes the stream
+func writeHTTP3Body(str *quic.Stream, body io.ReadCloser, hooks hookSet) {
+	defer body.Close()
+
+	buf := make([]byte, 16<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := str.Write(appendHTTP3Frame(nil, http3FrameData, buf[:n])); werr != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			str.CancelWrite(http3RequestCancelled)
+			return
+		}
+	}
+	_ = str.Close()
+	hooks.wroteReq()
+}
+
+// readHTTP3ResponseHeader reads the frames of a response stream until its final response headers, informational
+// responses and frames of unknown types are skipped
+func readHTTP3ResponseHeader(str *quic.Stream, r quicvarint.Reader, limit uint64, hooks hookSet) (int, tlsHttp.Header, error) {
+	first := true
+	for {
+		frame, length, err := readHTTP3FrameHeader(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if first {
+			hooks.firstByte()
+			first = false
+		}
+
+		switch frame {
+		case http3FrameHeaders:
+		case http3FrameData:
+			return 0, nil, errors.New("http3: DATA frame before the response headers")
+		default:
+			if _, err = io.CopyN(io.Discard, str, int64(length)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		fields, err := readHTTP3HeaderBlock(str, length, limit)
+		if err != nil {
+			return 0, nil, err
+		}
+		status, header, err := http3ResponseHeader(fields)
+		if err != nil {
+			return 0, nil, err
+		}
+		if status >= 200 {
+			received := make([]headerField, len(fields))
+			for i, f := range fields {
+				received[i] = headerField{name: f.Name, value: f.Value}
+			}
+			hooks.readFields(received)
+			return status, header, nil
+		}
+	}
+}
+
+// readHTTP3HeaderBlock reads and decodes the header block of a HEADERS frame of length bytes
+func readHTTP3HeaderBlock(str *quic.Stream, length, limit uint64) ([]qpack.HeaderField, error) {
+	if length > limit {
+		return nil, fmt.Errorf("http3: response headers of %d bytes larger than %d bytes", length, limit)
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(str, block); err != nil {
+		return nil, err
+	}
+	return qpack.NewDecoder(nil).DecodeFull(block)
+}
+
+// http3ResponseHeader returns the status and headers of decoded response header fields
+func http3ResponseHeader(fields []qpack.HeaderField) (int, tlsHttp.Header, error) {
+	status := 0
+	header := make(tlsHttp.Header)
+	for _, f := range fields {
+		if !f.IsPseudo() {
+			header.Add(f.Name, f.Value)
+			continue
+		}
+		if f.Name != ":status" {
+			return 0, nil, fmt.Errorf("http3: invalid response pseudo header %s", f.Name)
+		}
+		var err error
+		if status, err = strconv.Atoi(f.Value); err != nil || status < 100 || status > 999 {
+			return 0, nil, fmt.Errorf("http3: invalid response status %q", f.Value)
+		}
+	}
+	if status == 0 {
+		return 0, nil, errors.New("http3: response without status")
+	}
+	return status, header, nil
+}
+
+// http3Body reads the DATA frames of a response, trailers are set on the response when the body was read
+type http3Body struct {
+	str  *quic.Stream
+	r    quicvarint.Reader
+	stop func() bool
+	// done ends the request on its connection
+	done  func()
+	resp  *tlsHttp.Response
+	limit uint64
+
+	remaining uint64
+	err       error
+}
+
+func (b *http3Body) Read(p []byte) (int, error) {
+	for b.remaining == 0 && b.err == nil {
+		frame, length, err := readHTTP3FrameHeader(b.r)
+		if err != nil {
+			b.fail(err)
+			continue
+		}
+		switch frame {
+		case http3FrameData:
+			b.remaining = length
+		case http3FrameHeaders:
+			b.fail(b.readTrailers(length))
+		default:
+			if _, err = io.CopyN(io.Discard, b.str, int64(length)); err != nil {
+				b.fail(err)
+			}
+		}
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	if uint64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.str.Read(p)
+	b.remaining -= uint64(n)
+	if err == io.EOF && b.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		b.fail(err)
+	}
+	return n, err
+}
+
+// readTrailers reads the trailers of the response from a HEADERS frame of length bytes
+func (b *http3Body) readTrailers(length uint64) error {
+	fields, err := readHTTP3HeaderBlock(b.str, length, b.limit)
+	if err != nil {
+		return err
+	}
+
+	trailer := make(tlsHttp.Header)
+	for _, f := range fields {
+		if f.IsPseudo() {
+			return fmt.Errorf("http3: invalid trailer pseudo header %s", f.Name)
+		}
+		trailer.Add(f.Name, f.Value)
+	}
+	b.resp.Trailer = trailer
+	return nil
+}
+
+// fail ends reading the body with err unless it already ended, err may be nil
+func (b *http3Body) fail(err error) {
+	if err == nil || b.err != nil {
+		return
+	}
+	b.err = err
+	b.stop()
+	b.done()
+}
+
+func (b *http3Body) Close() error {
+	b.stop()
+	// reading a stream that was read to its end is not canceled
+	b.str.CancelRead(http3RequestCancelled)
+	b.done()
+	return nil
+}
+
+// http3GzipBody decompresses the body of a response to a request the round tripper asked a gzip response for
+type http3GzipBody struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (b *http3GzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil {
+		if b.err == nil {
+			b.zr, b.err = gzip.NewReader(b.body)
+		}
+		if b.err != nil {
+			return 0, b.err
+		}
+	}
+	return b.zr.Read(p)
+}
+
+func (b *http3GzipBody) Close() error {
+	return b.body.Close()
+}
+
+// appendHTTP3Frame appends a frame of the type frame with payload to b
+func appendHTTP3Frame(b []byte, frame uint64, payload []byte) []byte {
+	b = quicvarint.Append(b, frame)
+	b = quicvarint.Append(b, uint64(len(payload)))
+	return append(b, payload...)
+}
+
+// readHTTP3FrameHeader reads the type and length of the next frame of a stream
+func readHTTP3FrameHeader(r quicvarint.Reader) (frame, length uint64, err error) {
+	if frame, err = quicvarint.Read(r); err != nil {
+		return 0, 0, err
+	}
+	if length, err = quicvarint.Read(r); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return frame, length, err
+}
+
+var errHTTP3NetConn = errors.New("quic connections can not be read and written as net.Conn")
+
+// http3NetConn describes a quic connection to the hooks of a request, it can not be read, written or closed
+type http3NetConn struct {
+	conn *quic.Conn
+}
+
+func (c http3NetConn) Read([]byte) (int, error)         { return 0, errHTTP3NetConn }
+func (c http3NetConn) Write([]byte) (int, error)        { return 0, errHTTP3NetConn }
+func (c http3NetConn) Close() error                     { return errHTTP3NetConn }
+func (c http3NetConn) LocalAddr() net.Addr              { return c.conn.LocalAddr() }
+func (c http3NetConn) RemoteAddr() net.Addr             { return c.conn.RemoteAddr() }
+func (c http3NetConn) SetDeadline(time.Time) error      { return errHTTP3NetConn }
+func (c http3NetConn) SetReadDeadline(time.Time) error  { return errHTTP3NetConn }
+func (c http3NetConn) SetWriteDeadline(time.Time) error { return errHTTP3NetConn }
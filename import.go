@@ -0,0 +1,547 @@
+package cclient_v2
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// importedRequest collects the parts of a request read from a curl command or a fetch snippet
+type importedRequest struct {
+	method     string
+	url        string
+	header     http.Header
+	order      []string
+	body       []string
+	hasBody    bool
+	compressed bool
+	get        bool
+}
+
+// add adds a header, keys are kept as written and ordered by their first appearance.
+// A content-length header only keeps its position, the length of the body is sent
+func (r *importedRequest) add(key, value string) {
+	if _, ok := r.header[key]; !ok {
+		r.order = append(r.order, key)
+	}
+	if strings.EqualFold(key, "Content-Length") {
+		r.header[key] = nil
+		return
+	}
+	r.header[key] = append(r.header[key], value)
+}
+
+// has reports whether the request has a header, ignoring the casing of key
+func (r *importedRequest) has(key string) bool {
+	for _, k := range r.order {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// casing returns key in the casing of the headers of the request, lowercase if its first header is lowercase
+func (r *importedRequest) casing(key string) string {
+	if len(r.order) > 0 && r.order[0] == strings.ToLower(r.order[0]) {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// request builds the request of c
+func (r *importedRequest) request(c *Client) (*Request, error) {
+	if r.url == "" {
+		return nil, errors.New("no url")
+	}
+	u, err := url.Parse(r.url)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" {
+		// curl defaults to http
+		if u, err = url.Parse("http://" + r.url); err != nil {
+			return nil, err
+		}
+	}
+
+	body := strings.Join(r.body, "&")
+	method := r.method
+	if r.get && r.hasBody {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += body
+		body, r.hasBody = "", false
+		if method == "" {
+			method = http.MethodGet
+		}
+	}
+	if method == "" {
+		method = http.MethodGet
+		if r.hasBody {
+			method = http.MethodPost
+		}
+	}
+
+	if r.compressed && !r.has("Accept-Encoding") {
+		r.add(r.casing("Accept-Encoding"), "gzip, deflate, br")
+	}
+
+	req := c.NewRequest().SetURL(u.String()).SetMethod(method)
+	for k, v := range r.header {
+		if len(v) > 0 {
+			req.header[k] = v
+		}
+	}
+	order := r.order
+	if !r.has("Host") {
+		// curl and browsers send the host first
+		order = append([]string{r.casing("Host")}, order...)
+	}
+	req.SetHeaderOrder(order)
+	if r.hasBody {
+		req.SetBody(body)
+	}
+	return req, nil
+}
+
+// curlOptionsWithValue are the curl options that take a value and are ignored, they configure curl itself
+var curlOptionsWithValue = map[string]bool{
+	"-o": true, "--output": true, "-x": true, "--proxy": true, "-U": true, "--proxy-user": true,
+	"-m": true, "--max-time": true, "--connect-timeout": true, "--retry": true, "-w": true, "--write-out": true,
+	"--cacert": true, "--capath": true, "-E": true, "--cert": true, "--key": true, "--resolve": true,
+	"--connect-to": true, "-c": true, "--cookie-jar": true, "--interface": true, "--limit-rate": true,
+	"--max-redirs": true, "--proxy-header": true, "-D": true, "--dump-header": true, "--trace": true,
+	"--trace-ascii": true,
+}
+
+// curlFlags are the curl options without value that are ignored, they configure curl itself
+var curlFlags = map[string]bool{
+	"-s": true, "--silent": true, "-S": true, "--show-error": true, "-v": true, "--verbose": true, "-k": true,
+	"--insecure": true, "-L": true, "--location": true, "-i": true, "--include": true, "-f": true, "--fail": true,
+	"-g": true, "--globoff": true, "-N": true, "--no-buffer": true, "-#": true, "--progress-bar": true,
+	"--http1.0": true, "--http1.1": true, "--http2": true, "--http2-prior-knowledge": true, "--http3": true,
+	"--tlsv1.2": true, "--tlsv1.3": true, "--path-as-is": true, "--raw": true, "--tr-encoding": true,
+	"--location-trusted": true, "--fail-with-body": true, "-O": true, "--remote-name": true,
+}
+
+// ParseCurl parses a curl command, like the ones browser devtools copy as cURL (bash), into a request of the client.
+// Headers of -H, -A, -e, -b and -u keep the order and casing they were written with and become the header order of
+// the request. Data of -d, --data-raw, --data-binary and --data-urlencode is joined with & and sent as body, as
+// application/x-www-form-urlencoded unless a content type is set. --compressed adds an Accept-Encoding header at the
+// end of the header order if there is none. Options configuring curl itself, like --proxy or --insecure, are ignored,
+// data and cookies read from files are not supported
+func (c *Client) ParseCurl(command string) (*Request, error) {
+	words, err := shellWords(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 || words[0] != "curl" {
+		return nil, errors.New("not a curl command")
+	}
+
+	r := &importedRequest{header: make(http.Header)}
+	args := words[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			if r.url != "" {
+				return nil, fmt.Errorf("more than one url: %s", arg)
+			}
+			r.url = arg
+			continue
+		}
+
+		name, value, hasValue := arg, "", false
+		if strings.HasPrefix(arg, "--") {
+			if n, v, ok := strings.Cut(arg, "="); ok && curlOptionTakesValue(n) {
+				name, value, hasValue = n, v, true
+			}
+		} else if len(arg) > 2 {
+			if curlOptionTakesValue(arg[:2]) {
+				name, value, hasValue = arg[:2], arg[2:], true
+			} else {
+				// combined short flags like -sSL
+				for _, f := range arg[1:] {
+					if err := r.curlFlag("-" + string(f)); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+		}
+
+		if !curlOptionTakesValue(name) {
+			if err := r.curlFlag(name); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !hasValue {
+			if i++; i == len(args) {
+				return nil, fmt.Errorf("curl option %s without value", name)
+			}
+			value = args[i]
+		}
+		if err := r.curlOption(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.hasBody && !r.get && !r.has("Content-Type") {
+		r.add(r.casing("Content-Type"), "application/x-www-form-urlencoded")
+	}
+	return r.request(c)
+}
+
+// curlOptionTakesValue reports whether a curl option takes a value
+func curlOptionTakesValue(name string) bool {
+	switch name {
+	case "-X", "--request", "-H", "--header", "-d", "--data", "--data-ascii", "--data-raw", "--data-binary",
+		"--data-urlencode", "-b", "--cookie", "-A", "--user-agent", "-e", "--referer", "-u", "--user", "--url":
+		return true
+	}
+	return curlOptionsWithValue[name]
+}
+
+// curlFlag applies a curl option without value
+func (r *importedRequest) curlFlag(name string) error {
+	switch name {
+	case "--compressed":
+		r.compressed = true
+	case "-I", "--head":
+		r.method = http.MethodHead
+	case "-G", "--get":
+		r.get = true
+	default:
+		if !curlFlags[name] {
+			return fmt.Errorf("unsupported curl option %s", name)
+		}
+	}
+	return nil
+}
+
+// curlOption applies a curl option with value
+func (r *importedRequest) curlOption(name, value string) error {
+	switch name {
+	case "-X", "--request":
+		r.method = value
+	case "--url":
+		r.url = value
+	case "-H", "--header":
+		key, v, ok := strings.Cut(value, ":")
+		if !ok {
+			// curl sends "name;" as header without value
+			if strings.HasSuffix(value, ";") {
+				r.add(strings.TrimSpace(strings.TrimSuffix(value, ";")), "")
+				return nil
+			}
+			return fmt.Errorf("invalid curl header %q", value)
+		}
+		if v = strings.TrimSpace(v); v == "" {
+			// "name:" removes a header curl would send
+			return nil
+		}
+		r.add(strings.TrimSpace(key), v)
+	case "-A", "--user-agent":
+		r.add(r.casing("User-Agent"), value)
+	case "-e", "--referer":
+		r.add(r.casing("Referer"), value)
+	case "-u", "--user":
+		r.add(r.casing("Authorization"), "Basic "+base64.StdEncoding.EncodeToString([]byte(value)))
+	case "-b", "--cookie":
+		if !strings.Contains(value, "=") {
+			return fmt.Errorf("reading cookies from file %s is not supported", value)
+		}
+		key := r.casing("Cookie")
+		for _, k := range r.order {
+			if strings.EqualFold(k, "Cookie") {
+				key = k
+			}
+		}
+		if values := r.header[key]; len(values) > 0 {
+			values[len(values)-1] += "; " + value
+			return nil
+		}
+		r.add(key, value)
+	case "-d", "--data", "--data-ascii", "--data-binary":
+		if strings.HasPrefix(value, "@") {
+			return fmt.Errorf("reading data from file %s is not supported", value[1:])
+		}
+		r.body, r.hasBody = append(r.body, value), true
+	case "--data-raw":
+		r.body, r.hasBody = append(r.body, value), true
+	case "--data-urlencode":
+		if strings.Contains(value, "@") && !strings.Contains(value, "=") {
+			return fmt.Errorf("reading data from file %s is not supported", value)
+		}
+		if key, content, ok := strings.Cut(value, "="); ok {
+			value = url.QueryEscape(content)
+			if key != "" {
+				value = key + "=" + value
+			}
+		} else {
+			value = url.QueryEscape(value)
+		}
+		r.body, r.hasBody = append(r.body, value), true
+	}
+	return nil
+}
+
+// shellWords splits a command into words like a posix shell, with single and double quotes, $'...' strings of bash,
+// backslash escapes and line continuations
+func shellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			if i+1 < len(s) && s[i+1] == '\n' {
+				i++
+				continue
+			}
+			if i+2 < len(s) && s[i+1] == '\r' && s[i+2] == '\n' {
+				i += 2
+				continue
+			}
+			if i+1 < len(s) {
+				i++
+				word.WriteByte(s[i])
+			}
+			inWord = true
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '$' && i+1 < len(s) && s[i+1] == '\'':
+			n, err := ansiCString(s[i+2:], &word)
+			if err != nil {
+				return nil, err
+			}
+			i += n + 2
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					switch s[i+1] {
+					case '$', '`', '"', '\\':
+						i++
+					case '\n':
+						i++
+						continue
+					}
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+		case c == '#' && !inWord:
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// ansiCString writes the contents of a $'...' string of bash starting after the opening quote, it returns the number of
+// bytes read including the closing quote
+func ansiCString(s string, word *strings.Builder) (int, error) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\'' {
+			return i + 1, nil
+		}
+		if c != '\\' || i+1 == len(s) {
+			word.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case 'n':
+			word.WriteByte('\n')
+		case 't':
+			word.WriteByte('\t')
+		case 'r':
+			word.WriteByte('\r')
+		case 'a':
+			word.WriteByte('\a')
+		case 'b':
+			word.WriteByte('\b')
+		case 'f':
+			word.WriteByte('\f')
+		case 'v':
+			word.WriteByte('\v')
+		case 'e', 'E':
+			word.WriteByte(0x1b)
+		case 'x', 'u', 'U':
+			size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[i]]
+			n := 0
+			for n < size && i+1+n < len(s) && isHexDigit(s[i+1+n]) {
+				n++
+			}
+			if n == 0 {
+				word.WriteByte('\\')
+				word.WriteByte(s[i])
+				continue
+			}
+			v, _ := strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+			if s[i] == 'x' {
+				word.WriteByte(byte(v))
+			} else {
+				word.WriteString(string(rune(v)))
+			}
+			i += n
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			n := 1
+			for n < 3 && i+n < len(s) && s[i+n] >= '0' && s[i+n] <= '7' {
+				n++
+			}
+			v, _ := strconv.ParseUint(s[i:i+n], 8, 16)
+			word.WriteByte(byte(v))
+			i += n - 1
+		default:
+			// \\, \', \" and \? stand for the character, other escapes are kept
+			if !strings.ContainsRune(`\'"?`, rune(s[i])) {
+				word.WriteByte('\\')
+			}
+			word.WriteByte(s[i])
+		}
+	}
+	return 0, errors.New("unterminated $' quote")
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// ParseFetch parses a fetch call, like the ones browser devtools copy as fetch or as fetch (Node.js), into a request
+// of the client. Headers keep the order and casing they were written with and become the header order of the
+// request, a referrer option is sent as Referer header. The url and the options must be written as json, like
+// devtools write them
+func (c *Client) ParseFetch(snippet string) (*Request, error) {
+	start := strings.Index(snippet, "fetch(")
+	if start < 0 {
+		return nil, errors.New("not a fetch call")
+	}
+	dec := json.NewDecoder(strings.NewReader(snippet[start+len("fetch("):]))
+
+	r := &importedRequest{header: make(http.Header)}
+	if err := dec.Decode(&r.url); err != nil {
+		return nil, fmt.Errorf("invalid fetch url: %w", err)
+	}
+
+	// the options follow the url after a comma, which is no json
+	rest := strings.TrimLeft(snippet[start+len("fetch("):][dec.InputOffset():], " \t\r\n")
+	if !strings.HasPrefix(rest, ",") {
+		return r.request(c)
+	}
+	dec = json.NewDecoder(strings.NewReader(rest[1:]))
+	if err := r.fetchOptions(dec); err != nil {
+		return nil, fmt.Errorf("invalid fetch options: %w", err)
+	}
+	return r.request(c)
+}
+
+// fetchOptions reads the options object of a fetch call, the headers are read in order
+func (r *importedRequest) fetchOptions(dec *json.Decoder) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	var referrer string
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "headers":
+			if err := expectDelim(dec, '{'); err != nil {
+				return err
+			}
+			for dec.More() {
+				name, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				var value string
+				if err := dec.Decode(&value); err != nil {
+					return err
+				}
+				r.add(name.(string), value)
+			}
+			if _, err := dec.Token(); err != nil {
+				return err
+			}
+		case "method":
+			if err := dec.Decode(&r.method); err != nil {
+				return err
+			}
+		case "body":
+			var body *string
+			if err := dec.Decode(&body); err != nil {
+				return err
+			}
+			if body != nil {
+				r.body, r.hasBody = []string{*body}, true
+			}
+		case "referrer":
+			if err := dec.Decode(&referrer); err != nil {
+				return err
+			}
+		default:
+			var ignored json.RawMessage
+			if err := dec.Decode(&ignored); err != nil {
+				return err
+			}
+		}
+	}
+
+	if referrer != "" && referrer != "about:client" && !r.has("Referer") {
+		r.add(r.casing("Referer"), referrer)
+	}
+	return nil
+}
+
+// expectDelim reads the json delimiter delim
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %s", delim)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package cclient_v2
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+func newImportClient(t *testing.T, srv *fingerprinttest.Server) *Client {
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// sentRequest sends req and returns what the server received, the last request of the last connection
+func sentRequest(t *testing.T, srv *fingerprinttest.Server, req *Request, err error) fingerprinttest.RequestFingerprint {
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = req.Do(); err != nil {
+		t.Fatal(err)
+	}
+	f, ok := srv.LastFingerprint()
+	if !ok || len(f.Requests) == 0 {
+		t.Fatal("no request received")
+	}
+	return f.Requests[len(f.Requests)-1]
+}
+
+func TestImport(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+	c := newImportClient(t, srv)
+
+	tests := []struct {
+		name    string
+		parse   func(string) (*Request, error)
+		snippet string
+		method  string
+		path    string
+		headers []fingerprinttest.Header
+	}{
+		{
+			name:  "curl",
+			parse: c.ParseCurl,
+			snippet: `curl '` + srv.URL + `/api?x=1' \
+  -H 'accept: application/json' \
+  -H 'accept-language: en-US,en;q=0.9' \
+  -b 'a=1; b=2' \
+  -H 'content-type: application/json' \
+  -H 'x-empty;' \
+  -H 'user-agent: agent' \
+  --data-raw $'{"text":"it\'s\\u0021"}' \
+  --compressed`,
+			method: "POST",
+			path:   "/api?x=1",
+			headers: []fingerprinttest.Header{
+				{Name: "accept", Value: "application/json"},
+				{Name: "accept-language", Value: "en-US,en;q=0.9"},
+				{Name: "cookie", Value: "a=1"},
+				{Name: "cookie", Value: "b=2"},
+				{Name: "content-type", Value: "application/json"},
+				{Name: "x-empty", Value: ""},
+				{Name: "user-agent", Value: "agent"},
+				{Name: "accept-encoding", Value: "gzip, deflate, br"},
+				{Name: "content-length", Value: "21"},
+			},
+		},
+		{
+			name:    "curl get",
+			parse:   c.ParseCurl,
+			snippet: `curl -sSL -G "` + srv.URL + `/search" -A agent -d q=go --data-urlencode 'w=a b' -u user:pass`,
+			method:  "GET",
+			path:    "/search?q=go&w=a+b",
+			headers: []fingerprinttest.Header{
+				{Name: "user-agent", Value: "agent"},
+				{Name: "authorization", Value: "Basic dXNlcjpwYXNz"},
+				{Name: "accept-encoding", Value: "gzip, deflate, br"},
+			},
+		},
+		{
+			name:  "fetch",
+			parse: c.ParseFetch,
+			snippet: `fetch("` + srv.URL + `/api", {
+  "headers": {
+    "accept": "*/*",
+    "content-type": "text/plain;charset=UTF-8",
+    "sec-fetch-mode": "cors",
+    "user-agent": "agent"
+  },
+  "referrer": "https://example.com/page",
+  "referrerPolicy": "strict-origin-when-cross-origin",
+  "body": "hello",
+  "method": "PUT",
+  "mode": "cors",
+  "credentials": "include"
+});`,
+			method: "PUT",
+			path:   "/api",
+			headers: []fingerprinttest.Header{
+				{Name: "accept", Value: "*/*"},
+				{Name: "content-type", Value: "text/plain;charset=UTF-8"},
+				{Name: "sec-fetch-mode", Value: "cors"},
+				{Name: "user-agent", Value: "agent"},
+				{Name: "referer", Value: "https://example.com/page"},
+				{Name: "accept-encoding", Value: "gzip, deflate, br"},
+				{Name: "content-length", Value: "5"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := test.parse(test.snippet)
+			r := sentRequest(t, srv, req, err)
+			if r.Method != test.method || r.Path != test.path {
+				t.Errorf("request: got %s %s, want %s %s", r.Method, r.Path, test.method, test.path)
+			}
+			if !reflect.DeepEqual(r.Headers, test.headers) {
+				t.Errorf("headers: got %v, want %v", r.Headers, test.headers)
+			}
+		})
+	}
+}
+
+func TestImportCurlExport(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+	c := newImportClient(t, srv)
+
+	// a request exported with ToCurl is imported as it was sent, curl sends bodies without content type as forms
+	newRequest := func() *Request {
+		return c.NewRequest().SetURL(srv.URL+"/path").SetMethod("PATCH").SetBody("a'b").
+			SetHeader("x-b", "b").
+			SetHeader("user-agent", "agent").
+			SetHeader("x-a", "a").
+			SetHeader("content-type", "text/plain").
+			SetHeaderOrder([]string{"x-b", "user-agent", "x-a", "content-type"})
+	}
+	sent := sentRequest(t, srv, newRequest(), nil)
+	command, err := newRequest().ToCurl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := c.ParseCurl(command)
+	imported := sentRequest(t, srv, req, err)
+	if imported.Method != sent.Method || imported.Path != sent.Path || !reflect.DeepEqual(imported.Headers, sent.Headers) {
+		t.Errorf("request: got %s %s with %v, want %s %s with %v", imported.Method, imported.Path, imported.Headers,
+			sent.Method, sent.Path, sent.Headers)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		parse   func(string) (*Request, error)
+		snippet string
+		err     string
+	}{
+		{"not curl", c.ParseCurl, "wget https://example.com", "not a curl command"},
+		{"unterminated quote", c.ParseCurl, "curl 'https://example.com", "unterminated"},
+		{"unsupported option", c.ParseCurl, "curl --unknown https://example.com", "unsupported curl option --unknown"},
+		{"missing value", c.ParseCurl, "curl https://example.com -H", "without value"},
+		{"data from file", c.ParseCurl, "curl https://example.com -d @body.json", "not supported"},
+		{"no url", c.ParseCurl, "curl -s", "no url"},
+		{"not fetch", c.ParseFetch, `await get("https://example.com")`, "not a fetch call"},
+		{"invalid options", c.ParseFetch, `fetch("https://example.com", {method: "POST"})`, "invalid fetch options"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.parse(test.snippet); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error: got %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package cclient_v2
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// KeyLog writes the tls secrets of the connections of a client in the NSS key log format, to decrypt captured traffic
+// with wireshark. It is passed to NewClient as optional parameter and covers the connections to targets and to https
+// proxies. Clients without KeyLog write to the file named by the SSLKEYLOGFILE environment variable if it is set,
+// a KeyLog without Writer disables that.
+// Anyone reading the key log can decrypt the traffic, it is meant for debugging only
+type KeyLog struct {
+	Writer io.Writer
+}
+
+var (
+	envKeyLogOnce sync.Once
+	envKeyLog     io.Writer
+)
+
+// writer returns the key log writer of the connections of a client, nil if secrets are not logged
+func (k KeyLog) writer() io.Writer {
+	if k.Writer == nil {
+		return nil
+	}
+	return &keyLogWriter{w: k.Writer}
+}
+
+// sslKeyLogFile returns the writer of the file named by SSLKEYLOGFILE, it is opened once and shared by all clients
+func sslKeyLogFile() io.Writer {
+	envKeyLogOnce.Do(func() {
+		path := os.Getenv("SSLKEYLOGFILE")
+		if path == "" {
+			return
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Printf("failed to open SSLKEYLOGFILE: %v", err)
+			return
+		}
+		log.Printf("writing tls secrets to %s, they decrypt all traffic of the process", path)
+		envKeyLog = KeyLog{Writer: f}.writer()
+	})
+	return envKeyLog
+}
+
+// keyLogWriter serializes the lines of the crypto/tls and utls connections of a client, each writes a line at once
+type keyLogWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (k *keyLogWriter) Write(p []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.w.Write(p)
+}
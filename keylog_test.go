@@ -0,0 +1,184 @@
+package cclient_v2
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+// clientRandom returns the hex encoded random of a client hello record
+func clientRandom(t *testing.T, record []byte) string {
+	// record and handshake header and version
+	if len(record) < 5+4+2+32 {
+		t.Fatalf("client hello is truncated: %x", record)
+	}
+	return hex.EncodeToString(record[11:43])
+}
+
+// keyLogLabels returns the labels of the lines of a key log, the lines must be of the client random
+func keyLogLabels(t *testing.T, log, random string) []string {
+	var labels []string
+	for _, line := range strings.Split(strings.TrimSpace(log), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("invalid key log line %q", line)
+		}
+		if fields[1] != random {
+			t.Errorf("client random: got %s, want %s", fields[1], random)
+		}
+		labels = append(labels, fields[0])
+	}
+	return labels
+}
+
+// resetSSLKeyLogFile makes the next client open the file named by SSLKEYLOGFILE again
+func resetSSLKeyLogFile(t *testing.T, path string) {
+	t.Setenv("SSLKEYLOGFILE", path)
+	envKeyLogOnce, envKeyLog = sync.Once{}, nil
+	t.Cleanup(func() { envKeyLogOnce, envKeyLog = sync.Once{}, nil })
+}
+
+func TestKeyLog(t *testing.T) {
+	tls13 := []string{"CLIENT_HANDSHAKE_TRAFFIC_SECRET", "SERVER_HANDSHAKE_TRAFFIC_SECRET", "CLIENT_TRAFFIC_SECRET_0", "SERVER_TRAFFIC_SECRET_0"}
+	tests := []struct {
+		name   string
+		useTLS bool
+		maxTLS uint16
+		want   []string
+	}{
+		{"tls 1.3", true, 0, tls13},
+		{"tls 1.2", true, tlsUtls.VersionTLS12, []string{"CLIENT_RANDOM"}},
+		{"plain tls 1.3", false, 0, tls13},
+		{"plain tls 1.2", false, tlsUtls.VersionTLS12, []string{"CLIENT_RANDOM"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fingerprinttest.NewUnstartedServer()
+			srv.TLS.MaxVersion = test.maxTLS
+			srv.Start()
+			defer srv.Close()
+
+			var log bytes.Buffer
+			params := []interface{}{TLSVerification{RootCAs: srv.CertPool()}, KeyLog{Writer: &log}}
+			if test.useTLS {
+				params = append([]interface{}{tlsUtls.HelloChrome_102}, params...)
+			}
+			c, err := NewClient("", 5*time.Second, test.useTLS, params...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if _, err = c.NewRequest().SetURL(srv.URL).Do(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, _ := srv.LastFingerprint()
+			labels := keyLogLabels(t, log.String(), clientRandom(t, f.ClientHello))
+			if strings.Join(labels, " ") != strings.Join(test.want, " ") {
+				t.Errorf("labels: got %v, want %v", labels, test.want)
+			}
+		})
+	}
+}
+
+func TestKeyLogProxy(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(serveTLSProxy(t, srv).Addr().String())
+
+	for name, useTLS := range map[string]bool{"tls": true, "plain": false} {
+		t.Run(name, func(t *testing.T) {
+			var log bytes.Buffer
+			params := []interface{}{TLSVerification{RootCAs: srv.CertPool()}, KeyLog{Writer: &log}}
+			if useTLS {
+				params = append([]interface{}{tlsUtls.HelloChrome_102}, params...)
+			}
+			c, err := NewClient("https://localhost:"+port, 5*time.Second, useTLS, params...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if _, err = c.NewRequest().SetURL(srv.URL).Do(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the secrets of the connection to the proxy and of the tunneled connection to the server
+			randoms := make(map[string]bool)
+			for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+				if fields := strings.Fields(line); len(fields) == 3 {
+					randoms[fields[1]] = true
+				}
+			}
+			f, _ := srv.LastFingerprint()
+			if len(randoms) != 2 || !randoms[clientRandom(t, f.ClientHello)] {
+				t.Errorf("got secrets of %d connections, want those of the proxy and the server", len(randoms))
+			}
+		})
+	}
+}
+
+func TestSSLKeyLogFile(t *testing.T) {
+	tests := []struct {
+		name string
+		// keyLog is passed to the client unless it is nil
+		keyLog *KeyLog
+		file   bool
+	}{
+		{"without key log", nil, true},
+		{"with writer", &KeyLog{Writer: &bytes.Buffer{}}, false},
+		{"disabled", &KeyLog{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fingerprinttest.NewServer()
+			defer srv.Close()
+			path := filepath.Join(t.TempDir(), "keys.log")
+			resetSSLKeyLogFile(t, path)
+
+			params := []interface{}{tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()}}
+			if test.keyLog != nil {
+				params = append(params, *test.keyLog)
+			}
+			c, err := NewClient("", 5*time.Second, true, params...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if _, err = c.NewRequest().SetURL(srv.URL).Do(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path)
+			if !test.file {
+				if !os.IsNotExist(err) {
+					t.Errorf("got %q, %v, want no key log file", data, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, _ := srv.LastFingerprint()
+			if labels := keyLogLabels(t, string(data), clientRandom(t, f.ClientHello)); len(labels) == 0 {
+				t.Error("got no secrets in the key log file")
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("file mode: got %v, want 0600", info.Mode().Perm())
+			}
+		})
+	}
+}
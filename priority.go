@@ -0,0 +1,122 @@
+package cclient_v2
+
+import (
+	"context"
+	"sync"
+
+	"github.com/useflyent/fhttp/http2"
+	"github.com/useflyent/fhttp/http2/hpack"
+)
+
+// PriorityFrame is a PRIORITY frame a tls client sends when it opens an http2 connection
+type PriorityFrame struct {
+	StreamID uint32
+	Priority http2.PriorityParam
+}
+
+// HTTP2Priority is the http2 stream prioritization of a tls client, it is passed to NewClient as optional parameter
+// or set on the Profile. Weights are the weights as sent on the wire, one less than the weight
+type HTTP2Priority struct {
+	// Frames are sent after the settings and window update of every connection, like firefox does.
+	// Their streams are never opened, requests start at the stream after the highest of them.
+	// The priorities of an HTTP2Fingerprint replace them
+	Frames []PriorityFrame
+	// Headers is the priority of the HEADERS frames of requests, HEADERS frames have no priority if it is zero
+	Headers http2.PriorityParam
+	// Destinations maps the sec-fetch-dest header of requests to the priority of their HEADERS frames, like chrome
+	// weights documents, scripts and images differently. Requests with other destinations use Headers
+	Destinations map[string]http2.PriorityParam
+}
+
+// enabled reports whether connections send priorities
+func (p HTTP2Priority) enabled() bool {
+	return len(p.Frames) > 0 || !p.Headers.IsZero() || len(p.Destinations) > 0
+}
+
+// headers returns the priority of the HEADERS frame of a request with fields, false if it has none
+func (p HTTP2Priority) headers(fields []hpack.HeaderField) (http2.PriorityParam, bool) {
+	for _, f := range fields {
+		if f.Name == "sec-fetch-dest" {
+			if priority, ok := p.Destinations[f.Value]; ok {
+				return priority, true
+			}
+			break
+		}
+	}
+	return p.Headers, !p.Headers.IsZero()
+}
+
+// SetHTTP2Priority sets the priority of the HEADERS frame of the request, overriding the priority of the client.
+// A zero priority sends the HEADERS frame without priority
+func (r *Request) SetHTTP2Priority(priority http2.PriorityParam) *Request {
+	r.http2Priority = &priority
+
+	return r
+}
+
+type http2PriorityKey struct{}
+
+// withHTTP2Priority returns a context carrying the http2 priority of a request to the round tripper
+func withHTTP2Priority(ctx context.Context, priority http2.PriorityParam) context.Context {
+	return context.WithValue(ctx, http2PriorityKey{}, priority)
+}
+
+// requestPriority is the priority of a request waiting for its HEADERS frame to be written
+type requestPriority struct {
+	addr, method, path string
+	priority           http2.PriorityParam
+}
+
+// requestPriorities hands the priorities of requests to the connections writing their HEADERS frames, requests are
+// matched by address, method and path
+type requestPriorities struct {
+	mu       sync.Mutex
+	requests []*requestPriority
+}
+
+// add registers the priority of a request that is sent to addr
+func (r *requestPriorities) add(addr, method, path string, priority http2.PriorityParam) *requestPriority {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	request := &requestPriority{addr: addr, method: method, path: path, priority: priority}
+	r.requests = append(r.requests, request)
+	return request
+}
+
+// remove removes a request that was sent or failed
+func (r *requestPriorities) remove(request *requestPriority) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, pending := range r.requests {
+		if pending == request {
+			r.requests = append(r.requests[:i], r.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+// take removes and returns the priority of the first request to addr matching the pseudo headers of fields
+func (r *requestPriorities) take(addr string, fields []hpack.HeaderField) (http2.PriorityParam, bool) {
+	var method, path string
+	for _, f := range fields {
+		switch f.Name {
+		case ":method":
+			method = f.Value
+		case ":path":
+			path = f.Value
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, pending := range r.requests {
+		if pending.addr == addr && pending.method == method && pending.path == path {
+			r.requests = append(r.requests[:i], r.requests[i+1:]...)
+			return pending.priority, true
+		}
+	}
+	return http2.PriorityParam{}, false
+}
@@ -0,0 +1,63 @@
+package cclient_v2
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+	"github.com/useflyent/fhttp/http2"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+func TestHTTP2Priority(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+
+	priority := HTTP2Priority{
+		Frames: []PriorityFrame{
+			{StreamID: 3, Priority: http2.PriorityParam{Weight: 200}},
+			{StreamID: 5, Priority: http2.PriorityParam{Weight: 100}},
+		},
+		Headers:      http2.PriorityParam{StreamDep: 3, Weight: 41},
+		Destinations: map[string]http2.PriorityParam{"image": {StreamDep: 5, Weight: 21}},
+	}
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, priority, TLSVerification{RootCAs: srv.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []struct {
+		dest string
+		want fingerprinttest.Priority
+	}{
+		{"document", fingerprinttest.Priority{StreamID: 1, DependsOn: 3, Weight: 41}},
+		{"image", fingerprinttest.Priority{StreamID: 3, DependsOn: 5, Weight: 21}},
+	}
+	for _, r := range requests {
+		if _, err = c.NewRequest().SetURL(srv.URL).SetHeader("sec-fetch-dest", r.dest).Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, ok := srv.LastFingerprint()
+	if !ok {
+		t.Fatal("no fingerprint recorded")
+	}
+	wantFrames := []fingerprinttest.Priority{{StreamID: 3, Weight: 200}, {StreamID: 5, Weight: 100}}
+	if !reflect.DeepEqual(f.HTTP2.Priorities, wantFrames) {
+		t.Errorf("priority frames: got %+v, want %+v", f.HTTP2.Priorities, wantFrames)
+	}
+	if len(f.Requests) != len(requests) {
+		t.Fatalf("requests on the connection: got %d, want %d", len(f.Requests), len(requests))
+	}
+	for i, r := range requests {
+		// the server sees the streams after the offset of the priority frames
+		want := r.want
+		want.StreamID += 6
+		if got := f.Requests[i].Priority; got == nil || *got != want {
+			t.Errorf("priority of the %s request: got %+v, want %+v", r.dest, got, want)
+		}
+	}
+}
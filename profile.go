@@ -0,0 +1,174 @@
+package cclient_v2
+
+import (
+	"reflect"
+
+	tlsUtls "github.com/refraction-networking/utls"
+	"github.com/useflyent/fhttp/http2"
+)
+
+// Profile is the fingerprint a client presents: its client hello and its randomization, http2 settings, fingerprint and
+// priority, http3 and header order.
+// ClientHelloSpec is set for clients with a custom client hello, ClientHello is then tlsUtls.HelloCustom
+type Profile struct {
+	ClientHello      tlsUtls.ClientHelloID
+	ClientHelloSpec  *ClientHelloSpec
+	Randomization    Randomization
+	HTTP2Settings    map[http2.SettingID]uint32
+	HTTP2Priority    HTTP2Priority
+	HTTP2Fingerprint *HTTP2Fingerprint
+	HTTP3            *HTTP3
+	HeaderOrder      []string
+}
+
+// Profile returns the profile the client currently uses
+func (c *Client) Profile() Profile {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return Profile{
+		ClientHello:      c.clientHello,
+		ClientHelloSpec:  c.clientHelloSpec,
+		Randomization:    c.randomization,
+		HTTP2Settings:    c.http2Headers,
+		HTTP2Priority:    c.http2Priority,
+		HTTP2Fingerprint: c.http2Fingerprint,
+		HTTP3:            c.http3,
+		HeaderOrder:      c.MasterHeaderOrder,
+	}
+}
+
+// CloneOptions selects the state a cloned client shares with the client it was cloned from
+type CloneOptions struct {
+	// ShareJar shares the cookie jar, otherwise the clone starts with an empty jar
+	ShareJar bool
+	// ShareTransport shares the transport and its connection pool.
+	// The clone then keeps the proxy, client hello, randomization, http2 settings, fingerprint and priority, http3, session cache and alt-svc cache of the shared transport
+	ShareTransport bool
+	// Proxy replaces the proxy of the client if it is set
+	Proxy string
+	// NoProxy clones the client without proxy
+	NoProxy bool
+	// Profile replaces the profile of the client if it is not the zero Profile
+	Profile Profile
+	// ShareHooks shares the registered cookie observers, middleware and hooks, otherwise the clone gets a copy of them
+	ShareHooks bool
+	// ShareSessionCache shares the tls session cache, otherwise the clone starts with an empty cache.
+	// A clone of a client that does not resume sessions does not resume them either
+	ShareSessionCache bool
+	// ShareAltSvcCache shares the alt-svc cache, otherwise the clone starts with an empty cache.
+	// A clone of a client that does not use alternative services does not use them either
+	ShareAltSvcCache bool
+}
+
+// Clone creates a new client that shares the state selected by opts with the client, the zero CloneOptions clone the
+// profile and proxy of the client with state of its own.
+// Clients sharing state are safe to use concurrently. The observers of a clone sharing the jar observe it until the
+// clone is closed
+func (c *Client) Clone(opts CloneOptions) (*Client, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	clone := &Client{
+		Context:           c.Context,
+		useTLS:            c.useTLS,
+		proxy:             c.proxy,
+		MasterHeaderOrder: c.MasterHeaderOrder,
+		http2Headers:      c.http2Headers,
+		http2Priority:     c.http2Priority,
+		http2Fingerprint:  c.http2Fingerprint,
+		http3:             c.http3,
+		clientHello:       c.clientHello,
+		clientHelloSpec:   c.clientHelloSpec,
+		randomization:     c.randomization,
+		sessionCache:      c.sessionCache,
+		altSvc:            c.altSvc,
+		verification:      c.verification,
+		clientCerts:       c.clientCerts,
+		keyLog:            c.keyLog,
+		timeout:           c.timeout,
+	}
+
+	switch {
+	case opts.NoProxy:
+		clone.proxy = ""
+	case opts.Proxy != "":
+		clone.proxy = opts.Proxy
+	}
+	if !reflect.ValueOf(opts.Profile).IsZero() {
+		if err := opts.Profile.validate(); err != nil {
+			return nil, err
+		}
+		clone.clientHello = opts.Profile.ClientHello
+		clone.clientHelloSpec = opts.Profile.ClientHelloSpec
+		if clone.clientHelloSpec != nil {
+			clone.clientHello = tlsUtls.HelloCustom
+		}
+		clone.randomization = opts.Profile.Randomization.seeded()
+		clone.http2Headers = opts.Profile.HTTP2Settings
+		clone.http2Priority = opts.Profile.HTTP2Priority
+		clone.http2Fingerprint = opts.Profile.HTTP2Fingerprint
+		clone.http3 = opts.Profile.HTTP3
+		clone.MasterHeaderOrder = opts.Profile.HeaderOrder
+	}
+	if opts.ShareTransport {
+		clone.proxy = c.proxy
+		clone.clientHello = c.clientHello
+		clone.clientHelloSpec = c.clientHelloSpec
+		clone.randomization = c.randomization
+		clone.http2Headers = c.http2Headers
+		clone.http2Priority = c.http2Priority
+		clone.http2Fingerprint = c.http2Fingerprint
+		clone.http3 = c.http3
+	}
+
+	if !opts.ShareSessionCache && !opts.ShareTransport && c.sessionCache != nil {
+		clone.sessionCache = NewSessionCache(c.sessionCache.capacity)
+	}
+	if !opts.ShareAltSvcCache && !opts.ShareTransport && c.altSvc != nil {
+		clone.altSvc = NewAltSvcCache()
+	}
+	if err := clone.http3.checkAltSvcCache(clone.altSvc); err != nil {
+		return nil, err
+	}
+
+	clone.cookieObservers = c.cookieObservers
+	clone.interceptors = c.interceptors
+	if !opts.ShareHooks {
+		clone.cookieObservers = c.cookieObservers.copy()
+		clone.interceptors = c.interceptors.copy()
+	}
+
+	clone.cookieTracker = c.cookieTracker
+	clone.jar = c.jar
+	if !opts.ShareJar {
+		clone.cookieTracker = newCookieTracker(clone.cookieObservers)
+		clone.jar = newCookieJar(clone.cookieTracker)
+	}
+
+	if opts.ShareTransport {
+		clone.backend = c.backend.share()
+	} else {
+		b, err := newBackend(clone, clone.proxy)
+		if err != nil {
+			return nil, err
+		}
+		clone.backend = newSharedBackend(b)
+	}
+	clone.cookieTracker.attach(clone.cookieObservers)
+
+	return clone, nil
+}
+
+// validate checks the settings of a profile like NewClient checks them
+func (p Profile) validate() error {
+	if p.HTTP2Fingerprint != nil {
+		if err := p.HTTP2Fingerprint.validate(); err != nil {
+			return err
+		}
+	}
+	if p.HTTP3 != nil {
+		return p.HTTP3.validate()
+	}
+	return nil
+}
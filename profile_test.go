@@ -0,0 +1,115 @@
+package cclient_v2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+func TestCloneZeroOptions(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone, err := c.Clone(CloneOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := clone.Profile().ClientHello; got != tlsUtls.HelloChrome_102 {
+		t.Errorf("client hello of clone: got %v, want %v", got, tlsUtls.HelloChrome_102)
+	}
+
+	resp, err := clone.NewRequest().SetURL(srv.URL).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		t.Errorf("status: got %d", resp.StatusCode())
+	}
+}
+
+func TestCloneOptions(t *testing.T) {
+	c, err := NewClient("http://127.0.0.1:8080", 5*time.Second, true, tlsUtls.HelloChrome_102)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		opts        CloneOptions
+		proxy       string
+		clientHello tlsUtls.ClientHelloID
+		err         bool
+	}{
+		{"zero options", CloneOptions{}, "http://127.0.0.1:8080", tlsUtls.HelloChrome_102, false},
+		{"proxy", CloneOptions{Proxy: "http://127.0.0.1:8081"}, "http://127.0.0.1:8081", tlsUtls.HelloChrome_102, false},
+		{"no proxy", CloneOptions{NoProxy: true}, "", tlsUtls.HelloChrome_102, false},
+		{"profile", CloneOptions{Profile: Profile{ClientHello: tlsUtls.HelloFirefox_105}}, "http://127.0.0.1:8080", tlsUtls.HelloFirefox_105, false},
+		{"shared transport", CloneOptions{ShareTransport: true, NoProxy: true, Profile: Profile{ClientHello: tlsUtls.HelloFirefox_105}},
+			"http://127.0.0.1:8080", tlsUtls.HelloChrome_102, false},
+		{"invalid profile", CloneOptions{Profile: Profile{ClientHello: tlsUtls.HelloChrome_102, HTTP2Fingerprint: &HTTP2Fingerprint{}}}, "", tlsUtls.ClientHelloID{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clone, err := c.Clone(test.opts)
+			if test.err {
+				if err == nil {
+					t.Error("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clone.Close()
+			if clone.proxy != test.proxy || clone.Profile().ClientHello != test.clientHello {
+				t.Errorf("got proxy %q with %v, want %q with %v", clone.proxy, clone.Profile().ClientHello, test.proxy, test.clientHello)
+			}
+		})
+	}
+}
+
+func TestCloneSharedJarObserversDetached(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "n="+r.URL.Query().Get("n"))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient("", 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls, cloneCalls int32
+	c.ObserveCookies(func(CookieEvent) { atomic.AddInt32(&calls, 1) })
+
+	clone, err := c.Clone(CloneOptions{ShareJar: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone.ObserveCookies(func(CookieEvent) { atomic.AddInt32(&cloneCalls, 1) })
+	if _, err = clone.NewRequest().SetURL(srv.URL + "/?n=1").Do(); err != nil {
+		t.Fatal(err)
+	}
+	// the clone has a copy of the observer, it is called once
+	if got, gotClone := atomic.LoadInt32(&calls), atomic.LoadInt32(&cloneCalls); got != 1 || gotClone != 1 {
+		t.Errorf("observer calls: got %d and %d of the clone, want 1 and 1", got, gotClone)
+	}
+
+	// the observers of a closed clone do not observe the shared jar anymore
+	clone.Close()
+	clone.Close()
+	if _, err = c.NewRequest().SetURL(srv.URL + "/?n=2").Do(); err != nil {
+		t.Fatal(err)
+	}
+	if got, gotClone := atomic.LoadInt32(&calls), atomic.LoadInt32(&cloneCalls); got != 2 || gotClone != 1 {
+		t.Errorf("observer calls: got %d and %d of the clone, want 2 and 1", got, gotClone)
+	}
+}
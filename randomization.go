@@ -0,0 +1,187 @@
+package cclient_v2
+
+import (
+	cryptoRand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	tlsUtls "github.com/refraction-networking/utls"
+)
+
+// RandomizationMode selects when a tls client randomizes its client hello
+type RandomizationMode int
+
+const (
+	// RandomizeNever sends the extensions in the order of the client hello, the default.
+	// GREASE values are picked by utls for every connection
+	RandomizeNever RandomizationMode = iota
+	// RandomizePerClient randomizes the client hello once, every connection of the client sends the same
+	// extension order and GREASE values
+	RandomizePerClient
+	// RandomizePerConnection randomizes the client hello of every connection, like chrome does since version 106
+	RandomizePerConnection
+)
+
+// Randomization is the client hello randomization of a tls client, it is passed to NewClient as optional parameter
+// or set on the Profile.
+// Extensions are permuted the way chrome does it, GREASE and padding extensions keep their position
+type Randomization struct {
+	Mode RandomizationMode
+	// Seed makes the randomization reproducible, a random seed is picked if it is zero.
+	// Profile reports the seed a client uses
+	Seed int64
+	// KeepExtensionOrder only reseeds the GREASE values
+	KeepExtensionOrder bool
+	// KeepGREASE only permutes the extensions, GREASE values are then picked by utls for every connection
+	KeepGREASE bool
+}
+
+// seeded returns the randomization with a random seed if it is enabled without one
+func (r Randomization) seeded() Randomization {
+	if r.Mode == RandomizeNever || r.Seed != 0 {
+		return r
+	}
+
+	var b [8]byte
+	if _, err := cryptoRand.Read(b[:]); err != nil {
+		panic("cclient: failed to read random seed: " + err.Error())
+	}
+	r.Seed = int64(binary.LittleEndian.Uint64(b[:])>>1) | 1
+	return r
+}
+
+// helloRandomizer randomizes the client hellos of the connections of a round tripper
+type helloRandomizer struct {
+	mu            sync.Mutex
+	randomization Randomization
+	rand          *rand.Rand
+}
+
+// newHelloRandomizer returns the randomizer for r, nil if r is disabled
+func newHelloRandomizer(r Randomization) *helloRandomizer {
+	if r.Mode == RandomizeNever {
+		return nil
+	}
+	return &helloRandomizer{
+		randomization: r,
+		rand:          rand.New(rand.NewSource(r.Seed)),
+	}
+}
+
+// next returns the source of randomness of the next connection
+func (h *helloRandomizer) next() *rand.Rand {
+	if h.randomization.Mode == RandomizePerClient {
+		return rand.New(rand.NewSource(h.randomization.Seed))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return rand.New(rand.NewSource(h.rand.Int63()))
+}
+
+// apply applies the randomized spec to a connection, the spec must not be shared with other connections
+func (h *helloRandomizer) apply(conn *tlsUtls.UConn, spec *tlsUtls.ClientHelloSpec) error {
+	r := h.next()
+	if !h.randomization.KeepExtensionOrder {
+		shuffleExtensions(spec.Extensions, r)
+	}
+	if err := conn.ApplyPreset(spec); err != nil {
+		return err
+	}
+	if !h.randomization.KeepGREASE {
+		reseedGREASE(conn, r)
+	}
+	return nil
+}
+
+// shuffleExtensions permutes the extensions like chrome, GREASE, padding and pre shared key extensions are pinned
+func shuffleExtensions(extensions []tlsUtls.TLSExtension, r *rand.Rand) {
+	var movable []int
+	for i, e := range extensions {
+		switch e.(type) {
+		case *tlsUtls.UtlsGREASEExtension, *tlsUtls.UtlsPaddingExtension, tlsUtls.PreSharedKeyExtension:
+			continue
+		}
+		movable = append(movable, i)
+	}
+
+	r.Shuffle(len(movable), func(i, j int) {
+		extensions[movable[i]], extensions[movable[j]] = extensions[movable[j]], extensions[movable[i]]
+	})
+}
+
+// GREASE value indices, the group value is shared by the supported groups and key share extensions like boringssl does
+const (
+	greaseCipher = iota
+	greaseGroup
+	greaseExtension1
+	greaseExtension2
+	greaseVersion
+	greaseCount
+)
+
+// reseedGREASE replaces the GREASE values utls picked for a connection with values drawn from r
+func reseedGREASE(conn *tlsUtls.UConn, r *rand.Rand) {
+	var values [greaseCount]uint16
+	for i := range values {
+		w := uint16(r.Intn(16))
+		values[i] = w<<12 | w<<4 | 0x0a0a
+	}
+	if values[greaseExtension1] == values[greaseExtension2] {
+		values[greaseExtension2] ^= 0x1010
+	}
+
+	hello := conn.HandshakeState.Hello
+	for i, c := range hello.CipherSuites {
+		if isGREASE(c) {
+			hello.CipherSuites[i] = values[greaseCipher]
+		}
+	}
+
+	extensionsSeen := 0
+	for _, e := range conn.Extensions {
+		switch ext := e.(type) {
+		case *tlsUtls.UtlsGREASEExtension:
+			if extensionsSeen == 0 {
+				ext.Value = values[greaseExtension1]
+			} else {
+				ext.Value = values[greaseExtension2]
+			}
+			extensionsSeen++
+		case *tlsUtls.SupportedCurvesExtension:
+			for i, c := range ext.Curves {
+				if isGREASE(uint16(c)) {
+					ext.Curves[i] = tlsUtls.CurveID(values[greaseGroup])
+				}
+			}
+		case *tlsUtls.KeyShareExtension:
+			for i, s := range ext.KeyShares {
+				if isGREASE(uint16(s.Group)) {
+					ext.KeyShares[i].Group = tlsUtls.CurveID(values[greaseGroup])
+				}
+			}
+		case *tlsUtls.SupportedVersionsExtension:
+			for i, v := range ext.Versions {
+				if isGREASE(v) {
+					ext.Versions[i] = values[greaseVersion]
+				}
+			}
+		}
+	}
+}
+
+// randomizableSpec returns the spec of a client hello, client hellos without a fixed spec like the randomized utls
+// client hellos cannot be randomized
+func randomizableSpec(clientHello tlsUtls.ClientHelloID, clientHelloSpec *ClientHelloSpec) (*tlsUtls.ClientHelloSpec, error) {
+	if clientHelloSpec != nil {
+		return clientHelloSpec.Spec()
+	}
+
+	spec, err := tlsUtls.UTLSIdToSpec(clientHello)
+	if err != nil {
+		return nil, fmt.Errorf("client hello %s cannot be randomized: %w", clientHello.Str(), err)
+	}
+	return &spec, nil
+}
@@ -0,0 +1,141 @@
+package cclient_v2
+
+import (
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+// greaseCipherSuite returns the first cipher suite of a client hello record, the GREASE value of chrome client hellos
+func greaseCipherSuite(t *testing.T, record []byte) uint16 {
+	// record and handshake header, version and random
+	i := 5 + 4 + 2 + 32
+	if len(record) <= i {
+		t.Fatalf("client hello is truncated: %x", record)
+	}
+	i += 1 + int(record[i]) + 2
+	if len(record) < i+2 {
+		t.Fatalf("client hello is truncated: %x", record)
+	}
+	return uint16(record[i])<<8 | uint16(record[i+1])
+}
+
+// helloFingerprints sends requests on new connections and returns the ja3 and GREASE cipher suite of every connection
+func helloFingerprints(t *testing.T, srv *fingerprinttest.Server, randomization Randomization) (ja3 []string, grease []uint16) {
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, randomization, TLSVerification{RootCAs: srv.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	srv.Reset()
+	for i := 0; i < 3; i++ {
+		if _, err = c.NewRequest().SetURL(srv.URL).SetHeader("connection", "close").Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range srv.Fingerprints() {
+		ja3 = append(ja3, f.JA3)
+		grease = append(grease, greaseCipherSuite(t, f.ClientHello))
+	}
+	if len(ja3) != 3 {
+		t.Fatalf("connections: got %d, want 3", len(ja3))
+	}
+	return ja3, grease
+}
+
+func allEqual(values []string) bool {
+	for _, v := range values {
+		if v != values[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRandomization(t *testing.T) {
+	srv := fingerprinttest.NewUnstartedServer()
+	srv.TLS.NextProtos = []string{"http/1.1"}
+	srv.Start()
+	defer srv.Close()
+
+	preset, _ := helloFingerprints(t, srv, Randomization{})
+
+	tests := []struct {
+		name          string
+		randomization Randomization
+		// perConnection is true if the connections of a client send different client hellos
+		perConnection bool
+		presetOrder   bool
+		sameGREASE    bool
+	}{
+		{"never", Randomization{}, false, true, false},
+		{"per client", Randomization{Mode: RandomizePerClient, Seed: 1}, false, false, true},
+		{"per client keeping the extension order", Randomization{Mode: RandomizePerClient, Seed: 1, KeepExtensionOrder: true}, false, true, true},
+		{"per client keeping GREASE", Randomization{Mode: RandomizePerClient, Seed: 1, KeepGREASE: true}, false, false, false},
+		{"per connection", Randomization{Mode: RandomizePerConnection, Seed: 1}, true, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ja3, grease := helloFingerprints(t, srv, test.randomization)
+			if allEqual(ja3) == test.perConnection {
+				t.Errorf("extension orders: got %q, want them to differ per connection: %v", ja3, test.perConnection)
+			}
+			if (ja3[0] == preset[0]) != test.presetOrder {
+				t.Errorf("extension order: got %q, want the order of the preset %q: %v", ja3[0], preset[0], test.presetOrder)
+			}
+			// utls picks GREASE values for every connection, they can repeat by chance
+			if test.sameGREASE && (grease[1] != grease[0] || grease[2] != grease[0]) {
+				t.Errorf("GREASE values: got %x, want the same for every connection", grease)
+			}
+
+			// the seed makes the client hellos of another client reproducible
+			if test.randomization.Mode == RandomizeNever {
+				return
+			}
+			again, againGREASE := helloFingerprints(t, srv, test.randomization)
+			for i := range ja3 {
+				if again[i] != ja3[i] {
+					t.Errorf("connection %d: got %q, want %q", i, again[i], ja3[i])
+				}
+				if !test.randomization.KeepGREASE && againGREASE[i] != grease[i] {
+					t.Errorf("connection %d: got GREASE %x, want %x", i, againGREASE[i], grease[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRandomizationSeed(t *testing.T) {
+	tests := []struct {
+		name          string
+		randomization Randomization
+		seeded        bool
+	}{
+		{"never", Randomization{}, false},
+		{"random seed", Randomization{Mode: RandomizePerConnection}, true},
+		{"fixed seed", Randomization{Mode: RandomizePerClient, Seed: 42}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, test.randomization)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			got := c.Profile().Randomization
+			if (got.Seed != 0) != test.seeded || test.randomization.Seed != 0 && got.Seed != test.randomization.Seed {
+				t.Errorf("seed: got %d, want a seed %v", got.Seed, test.seeded)
+			}
+		})
+	}
+
+	// client hellos without a spec can not be randomized
+	if _, err := NewClient("", 5*time.Second, true, tlsUtls.HelloGolang, Randomization{Mode: RandomizePerClient}); err == nil {
+		t.Error("got no error for the golang client hello")
+	}
+}
@@ -7,28 +7,53 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-
-	tlsHttp "github.com/useflyent/fhttp"
 )
 
+// defaultHeaderOrder is the header order used when neither the request nor the client specify one
+var defaultHeaderOrder = []string{
+	"host",
+	"connection",
+	"cache-control",
+	"device-memory",
+	"viewport-width",
+	"rtt",
+	"downlink",
+	"ect",
+	"sec-ch-ua",
+	"sec-ch-ua-mobile",
+	"sec-ch-ua-full-version",
+	"sec-ch-ua-arch",
+	"sec-ch-ua-platform",
+	"sec-ch-ua-platform-version",
+	"sec-ch-ua-model",
+	"upgrade-insecure-requests",
+	"user-agent",
+	"accept",
+	"sec-fetch-site",
+	"sec-fetch-mode",
+	"sec-fetch-user",
+	"sec-fetch-dest",
+	"referer",
+	"accept-encoding",
+	"accept-language",
+	"cookie",
+	"content-type",
+	"authorization",
+}
+
+// defaultPHeaderOrder is the http2 pseudo header order of all requests
+var defaultPHeaderOrder = []string{":method", ":authority", ":scheme", ":path"}
+
 // SetURL sets the url of the request
 func (r *Request) SetURL(url string) *Request {
-	if r.useTLS {
-		r.TLSRequest.url = url
-	} else {
-		r.HTTPRequest.url = url
-	}
+	r.url = url
 
 	return r
 }
 
 // SetMethod sets the method of the request
 func (r *Request) SetMethod(method string) *Request {
-	if r.useTLS {
-		r.TLSRequest.method = method
-	} else {
-		r.HTTPRequest.method = method
-	}
+	r.method = method
 
 	return r
 }
@@ -41,20 +66,11 @@ func (r *Request) AddHeader(key, value string) *Request {
 		return r
 	}
 
-	if r.useTLS {
-		if header, ok := r.TLSRequest.header[key]; ok {
-			header = append(header, value)
-			r.TLSRequest.header[key] = header
-		} else {
-			r.TLSRequest.header[key] = []string{value}
-		}
+	if header, ok := r.header[key]; ok {
+		header = append(header, value)
+		r.header[key] = header
 	} else {
-		if header, ok := r.HTTPRequest.header[key]; ok {
-			header = append(header, value)
-			r.HTTPRequest.header[key] = header
-		} else {
-			r.HTTPRequest.header[key] = []string{value}
-		}
+		r.header[key] = []string{value}
 	}
 
 	return r
@@ -100,21 +116,13 @@ func (r *Request) SetHeader(key, value string) *Request {
 		return r
 	}
 
-	if r.useTLS {
-		r.TLSRequest.header[key] = []string{value}
-	} else {
-		r.HTTPRequest.header[key] = []string{value}
-	}
+	r.header[key] = []string{value}
 	return r
 }
 
 // SetHost sets the host of the request
 func (r *Request) SetHost(value string) *Request {
-	if r.useTLS {
-		r.TLSRequest.host = value
-	} else {
-		r.HTTPRequest.host = value
-	}
+	r.host = value
 
 	return r
 }
@@ -122,167 +130,115 @@ func (r *Request) SetHost(value string) *Request {
 // SetJSONBody sets the body to a json value
 func (r *Request) SetJSONBody(body interface{}) *Request {
 	b, _ := json.Marshal(body)
-	if r.useTLS {
-		r.TLSRequest.body = bytes.NewBuffer(b)
-	} else {
-		r.HTTPRequest.body = bytes.NewBuffer(b)
-	}
+	r.body = bytes.NewBuffer(b)
 
 	return r
 }
 
 func (r *Request) SetBody(body string) *Request {
-	if r.useTLS {
-		r.TLSRequest.body = strings.NewReader(body)
-	} else {
-		r.HTTPRequest.body = strings.NewReader(body)
-	}
+	r.body = strings.NewReader(body)
 
 	return r
 }
 
 // SetFormBody sets the body to a form value
 func (r *Request) SetFormBody(body url.Values) *Request {
-	b := strings.NewReader(body.Encode())
-	if r.useTLS {
-		r.TLSRequest.body = b
-	} else {
-		r.HTTPRequest.body = b
-	}
+	r.body = strings.NewReader(body.Encode())
 
 	return r
 }
 
-// SetHeaderOrder sets the http header order, only works for tls requests
-func (r *Request) SetHeaderOrder(order []string) *Request {
-	if r.useTLS {
-		//r.HeaderOrder = order
+// AddCookie adds a cookie that is only sent with this request, to the urls its domain, path and secure attribute match
+// A cookie without domain is sent to the host of the request, a cookie without path to all of its paths
+// A cookie with the same name and path as one in the jar replaces the jar cookie for this request
+func (r *Request) AddCookie(cookie *http.Cookie) *Request {
+	if cookie == nil {
+		return r
 	}
 
+	r.cookies = append(r.cookies, cookie)
+
 	return r
 }
 
-// Do will send the request with all specified request values
-func (r *Request) Do() (*Response, error) {
-	if r.useTLS {
-		req, err := tlsHttp.NewRequest(r.TLSRequest.method, r.TLSRequest.url, r.TLSRequest.body)
-
-		if err != nil {
-			return nil, err
-		}
-
-		var headerOrder []string
-
-		if len(r.HeaderOrder) != 0 {
-			// request specific header order - override master header order
-			headerOrder = r.HeaderOrder
-		} else {
-			// default header order
-			headerOrder = []string{
-				"host",
-				"connection",
-				"cache-control",
-				"device-memory",
-				"viewport-width",
-				"rtt",
-				"downlink",
-				"ect",
-				"sec-ch-ua",
-				"sec-ch-ua-mobile",
-				"sec-ch-ua-full-version",
-				"sec-ch-ua-arch",
-				"sec-ch-ua-platform",
-				"sec-ch-ua-platform-version",
-				"sec-ch-ua-model",
-				"upgrade-insecure-requests",
-				"user-agent",
-				"accept",
-				"sec-fetch-site",
-				"sec-fetch-mode",
-				"sec-fetch-user",
-				"sec-fetch-dest",
-				"referer",
-				"accept-encoding",
-				"accept-language",
-				"cookie",
-				"content-type",
-				"authorization",
-			}
-
-			// override default header order with master header order
-			if len(r.TLSRequest.client.MasterHeaderOrder) != 0 {
-				headerOrder = r.TLSRequest.client.MasterHeaderOrder
-			}
-		}
-
-		headerMap := make(map[string]string)
-
-		var headerOrderKey []string
-		for _, key := range headerOrder {
-			headerOrderKey = append(headerOrderKey, key)
-			for k, v := range r.TLSRequest.header {
-				lowerCaseKey := strings.ToLower(k)
-				if key == lowerCaseKey {
-					headerMap[k] = v[0]
-				}
-			}
-		}
-
-		for k, v := range req.Header {
-			if _, ok := headerMap[k]; !ok {
-				headerMap[k] = v[0]
-				headerOrderKey = append(headerOrderKey, strings.ToLower(k))
-			}
-		}
-
-		req.Header = tlsHttp.Header{
-			tlsHttp.HeaderOrderKey:  headerOrderKey,
-			tlsHttp.PHeaderOrderKey: {":method", ":authority", ":scheme", ":path"},
-		}
-
-		//u, err := url.Parse(r.TLSRequest.url)
-		//if err != nil {
-		//	panic(err)
-		//}
-
-		for k, v := range r.TLSRequest.header {
-			req.Header.Set(k, v[0])
-		}
-
-		if len(r.TLSRequest.host) > 0 {
-			req.Host = r.TLSRequest.host
-		} else {
-			//req.Header.Set("Host", u.Host)
-		}
-
-		if r.Context != nil {
-			req = req.WithContext(r.Context)
-		}
-
-		return r.TLSRequest.client.Do(req, nil, true)
+// SetCookies sets the cookies that are only sent with this request
+// This overrides any previously added request cookies
+func (r *Request) SetCookies(cookies []*http.Cookie) *Request {
+	r.cookies = nil
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
 	}
 
-	req, err := http.NewRequest(r.HTTPRequest.method, r.HTTPRequest.url, r.HTTPRequest.body)
+	return r
+}
+
+// SetCookieMode sets how the request uses the client cookie jar, CookieModeJar by default
+func (r *Request) SetCookieMode(mode CookieMode) *Request {
+	r.cookieMode = mode
+
+	return r
+}
+
+// SetHeaderOrder sets the http header order of the request, overriding the master header order of the client
+// Headers are written with the key casing they were set with
+func (r *Request) SetHeaderOrder(order []string) *Request {
+	r.HeaderOrder = order
+
+	return r
+}
 
+// Do will send the request with all specified request values
+func (r *Request) Do() (*Response, error) {
+	req, err := r.prepare()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, cookie := range r.HTTPRequest.cookies {
-		if cookie != nil {
-			req.AddCookie(cookie)
-		}
+	resp, err := r.client.send(req)
+	if err != nil {
+		return nil, err
 	}
+	r.sent = resp.sent
+	return resp, nil
+}
 
-	req.Header = r.HTTPRequest.header
-
-	if len(r.HTTPRequest.host) > 0 {
-		req.Host = r.HTTPRequest.host
+// prepare builds the backend independent form of the request
+func (r *Request) prepare() (*preparedRequest, error) {
+	u, err := url.Parse(r.url)
+	if err != nil {
+		return nil, err
 	}
 
-	if r.Context != nil {
-		req = req.WithContext(r.Context)
-	}
+	header := r.header.Clone()
+	cookies := append(extractCookies(header), r.cookies...)
 
-	return r.HTTPRequest.client.Do(nil, req, false)
+	var headerOrder []string
+	if len(r.HeaderOrder) != 0 {
+		// request specific header order - override master header order
+		headerOrder = r.HeaderOrder
+	} else if len(r.client.MasterHeaderOrder) != 0 {
+		// override default header order with master header order
+		headerOrder = r.client.MasterHeaderOrder
+	} else {
+		headerOrder = defaultHeaderOrder
+	}
+
+	pHeaderOrder := defaultPHeaderOrder
+	if f := r.client.http2Fingerprint; f != nil {
+		pHeaderOrder = f.PseudoHeaderOrder
+	}
+
+	return &preparedRequest{
+		ctx:           r.Context,
+		method:        r.method,
+		url:           u,
+		host:          r.host,
+		header:        header,
+		headerOrder:   headerOrder,
+		pHeaderOrder:  pHeaderOrder,
+		body:          r.body,
+		cookies:       cookies,
+		cookieMode:    r.cookieMode,
+		http2Priority: r.http2Priority,
+	}, nil
 }
@@ -5,13 +5,51 @@ import (
 	"compress/gzip"
 	"compress/zlib"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/andybalholm/brotli"
 )
 
+// newResponse reads the body of a backend response and builds the response from it
+func newResponse(req *preparedRequest, resp *backendResponse) (*Response, error) {
+	defer resp.body.Close()
+	headers := time.Now()
+
+	body, err := io.ReadAll(resp.body)
+	if err != nil {
+		return nil, err
+	}
+
+	var header = Header{}
+	for k, v := range resp.header {
+		header[k] = v
+	}
+
+	request := req.sentRequest()
+	response := &Response{
+		request:        request,
+		requestCookies: request.Cookies(),
+		cookies:        (&http.Response{Header: resp.header}).Cookies(),
+		headers:        header,
+		body:           body,
+		status:         resp.status,
+		reqUrl:         resp.url,
+		statusCode:     resp.statusCode,
+		proto:          resp.proto,
+		altSvc:         resp.altSvc,
+		timings:        timingsFrom(req.ctx).finish(headers),
+		conn:           resp.conn,
+		sent:           resp.sent,
+		received:       resp.received,
+	}
+
+	return response, nil
+}
+
 // Header returns the response headers
 func (r *Response) Header() Header {
 	return r.headers
@@ -135,3 +173,13 @@ func (r *Response) Status() string {
 func (r *Response) StatusCode() int {
 	return r.statusCode
 }
+
+// Proto returns the protocol the response was received over, like HTTP/2.0 or HTTP/3.0
+func (r *Response) Proto() string {
+	return r.proto
+}
+
+// AltSvc returns the alternative service the response was received from, nil if it was received from the origin
+func (r *Response) AltSvc() *AltService {
+	return r.altSvc
+}
@@ -2,13 +2,14 @@ package cclient_v2
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
 
+	"github.com/quic-go/quic-go/http3"
 	utls "github.com/refraction-networking/utls"
 	http "github.com/useflyent/fhttp"
 	"github.com/useflyent/fhttp/http2"
@@ -20,8 +21,21 @@ var errProtocolNegotiated = errors.New("protocol negotiated")
 type roundTripper struct {
 	sync.Mutex
 
-	clientHelloId      utls.ClientHelloID
-	overriddenSettings map[http2.SettingID]uint32
+	clientHelloId   utls.ClientHelloID
+	clientHelloSpec *ClientHelloSpec
+	randomizer      *helloRandomizer
+	sessionCache    *SessionCache
+	verification    TLSVerification
+	clientCerts     ClientCertificates
+	keyLog          io.Writer
+	priority        HTTP2Priority
+	fingerprint     *HTTP2Fingerprint
+	rewriteFrames   bool
+
+	requestPriorities requestPriorities
+	http3             *http3RoundTripper
+	altSvc            *AltSvcCache
+	broken            brokenAlternatives
 
 	cachedConnections map[string]net.Conn
 	cachedTransports  map[string]http.RoundTripper
@@ -31,25 +45,144 @@ type roundTripper struct {
 
 func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	addr := rt.getDialTLSAddr(req)
-	if _, ok := rt.cachedTransports[addr]; !ok {
-		if err := rt.getTransport(req, addr); err != nil {
+	if priority, ok := req.Context().Value(http2PriorityKey{}).(http2.PriorityParam); ok {
+		method := req.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		request := rt.requestPriorities.add(addr, method, req.URL.RequestURI(), priority)
+		defer rt.requestPriorities.remove(request)
+	}
+
+	for attempt := 1; ; attempt++ {
+		alternative, h3 := rt.route(req, addr)
+
+		var resp *http.Response
+		var err error
+		if h3 {
+			resp, err = rt.http3.roundTrip(req, addr, alternative)
+		} else {
+			resp, err = rt.roundTripTCP(req, addr, alternative)
+		}
+
+		var dialErr *altSvcDialError
+		if errors.As(err, &dialErr) && req.Context().Err() == nil {
+			// the request was not sent, it is sent over the next route
+			rt.broken.mark(addr, dialErr.alternative)
+			if req, err = rewindBody(req); err != nil {
+				return nil, err
+			}
+			hooksFrom(req.Context()).retry(attempt, dialErr)
+			continue
+		}
+		if err != nil {
 			return nil, err
 		}
+
+		if r, ok := req.Context().Value(routeKey{}).(*route); ok {
+			r.set(alternative)
+		}
+		if v := resp.Header.Get("Alt-Svc"); v != "" && rt.altSvc != nil && strings.EqualFold(req.URL.Scheme, "https") {
+			rt.altSvc.observe(addr, v)
+		}
+		return resp, nil
+	}
+}
+
+// route returns the alternative a request to the origin at addr is sent to, nil for the origin itself, and whether
+// it is sent over http/3
+func (rt *roundTripper) route(req *http.Request, addr string) (*AltService, bool) {
+	if !strings.EqualFold(req.URL.Scheme, "https") {
+		return nil, false
+	}
+
+	if rt.altSvc != nil {
+		alternative, ok := rt.altSvc.find(addr, func(s AltService) bool {
+			switch s.Protocol {
+			case http3.NextProtoH3:
+				if rt.http3 == nil {
+					return false
+				}
+			case http2.NextProtoTLS, "http/1.1":
+			default:
+				return false
+			}
+			return !rt.broken.broken(addr, s)
+		})
+		if ok {
+			return &alternative, alternative.Protocol == http3.NextProtoH3
+		}
+	}
+
+	h3 := rt.http3 != nil && rt.http3.config.Mode == HTTP3Always && !rt.broken.broken(addr, originAlternative(addr))
+	return nil, h3
+}
+
+// roundTripTCP sends the request to the origin at addr over tcp, to the alternative if it is not nil
+func (rt *roundTripper) roundTripTCP(req *http.Request, addr string, alternative *AltService) (*http.Response, error) {
+	endpoint := addr
+	if alternative != nil {
+		endpoint = alternative.endpoint(addr)
 	}
-	return rt.cachedTransports[addr].RoundTrip(req)
+
+	key := transportKey(addr, endpoint)
+	transport := rt.cachedTransport(key)
+	if transport == nil {
+		if err := rt.getTransport(req, addr, alternative); err != nil {
+			return nil, err
+		}
+		transport = rt.cachedTransport(key)
+	}
+	return transport.RoundTrip(req)
+}
+
+// transportKey is the key of the transport and connections of the origin at addr over endpoint
+func transportKey(addr, endpoint string) string {
+	if endpoint == addr {
+		return addr
+	}
+	return addr + " " + endpoint
+}
+
+// rewindBody returns the request with a new body to send it again after the body was closed by a failed attempt
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("request body can not be sent again after connecting to an alternative service failed")
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	rewound := *req
+	rewound.Body = body
+	return &rewound, nil
+}
+
+// cachedTransport returns the transport for key, the round tripper may be shared between cloned clients
+func (rt *roundTripper) cachedTransport(key string) http.RoundTripper {
+	rt.Lock()
+	defer rt.Unlock()
+
+	return rt.cachedTransports[key]
 }
 
-func (rt *roundTripper) getTransport(req *http.Request, addr string) error {
+func (rt *roundTripper) getTransport(req *http.Request, addr string, alternative *AltService) error {
 	switch strings.ToLower(req.URL.Scheme) {
 	case "http":
-		rt.cachedTransports[addr] = &http.Transport{DialContext: rt.dialer.DialContext}
+		rt.Lock()
+		rt.cachedTransports[addr] = &http.Transport{DialContext: rt.dialHTTP}
+		rt.Unlock()
 		return nil
 	case "https":
 	default:
 		return fmt.Errorf("invalid URL scheme: [%v]", req.URL.Scheme)
 	}
 
-	_, err := rt.dialTLS(context.Background(), "tcp", addr)
+	_, err := rt.dialTLS(alternative)(req.Context(), "tcp", addr)
 	switch err {
 	case errProtocolNegotiated:
 	case nil:
@@ -62,57 +195,337 @@ func (rt *roundTripper) getTransport(req *http.Request, addr string) error {
 	return nil
 }
 
-func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+// dialHTTP dials the connections of http urls
+func (rt *roundTripper) dialHTTP(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := rt.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTP1FieldConn(conn), nil
+}
+
+// dialTLS returns the function dialing the tls connections of an origin, to the alternative if it is not nil.
+// Failing to connect to an alternative returns an *altSvcDialError
+func (rt *roundTripper) dialTLS(alternative *AltService) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if alternative == nil {
+			return rt.dialTLSEndpoint(ctx, network, addr, nil)
+		}
+
+		conn, err := rt.dialTLSEndpoint(ctx, network, addr, alternative)
+		if err != nil && err != errProtocolNegotiated {
+			return nil, &altSvcDialError{alternative: *alternative, err: err}
+		}
+		return conn, err
+	}
+}
+
+func (rt *roundTripper) dialTLSEndpoint(ctx context.Context, network, addr string, alternative *AltService) (net.Conn, error) {
 	rt.Lock()
 	defer rt.Unlock()
 
+	endpoint := addr
+	if alternative != nil {
+		endpoint = alternative.endpoint(addr)
+	}
+
 	// If we have the connection from when we determined the HTTPS
 	// cachedTransports to use, return that.
-	if conn := rt.cachedConnections[addr]; conn != nil {
-		delete(rt.cachedConnections, addr)
+	key := transportKey(addr, endpoint)
+	if conn := rt.cachedConnections[key]; conn != nil {
+		delete(rt.cachedConnections, key)
 		return conn, nil
 	}
 
-	rawConn, err := rt.dialer.DialContext(ctx, network, addr)
+	conn, err := rt.handshake(ctx, network, addr, endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	var host string
-	if host, _, err = net.SplitHostPort(addr); err != nil {
-		host = addr
-	}
-
-	conn := utls.UClient(rawConn, &utls.Config{ServerName: host}, rt.clientHelloId)
-	if err = conn.Handshake(); err != nil {
-		_ = conn.Close()
-		return nil, err
+	negotiated := conn.ConnectionState().NegotiatedProtocol
+	var c net.Conn = newHTTP1FieldConn(conn)
+	if negotiated == http2.NextProtoTLS {
+		c = newHTTP2FieldConn(newFrameConn(conn, addr, rt.fingerprint, rt.rewriteFrames, rt.priority, &rt.requestPriorities))
 	}
 
-	if rt.cachedTransports[addr] != nil {
-		return conn, nil
+	if rt.cachedTransports[key] != nil {
+		return c, nil
 	}
 
 	// No http.Transport constructed yet, create one based on the results
 	// of ALPN.
-	switch conn.ConnectionState().NegotiatedProtocol {
+	dial := rt.dialTLS(alternative)
+	switch negotiated {
 	case http2.NextProtoTLS:
 		// The remote peer is speaking HTTP 2 + TLS.
-		rt.cachedTransports[addr] = &http2.Transport{DialTLS: rt.dialTLSHTTP2}
+		rt.cachedTransports[key] = rt.http2Transport(dial)
 	default:
 		// Assume the remote peer is speaking HTTP 1.x + TLS.
-		rt.cachedTransports[addr] = &http.Transport{DialTLSContext: rt.dialTLS}
+		rt.cachedTransports[key] = &http.Transport{DialTLSContext: dial}
 	}
 
 	// Stash the connection just established for use servicing the
 	// actual request (should be near-immediate).
-	rt.cachedConnections[addr] = conn
+	rt.cachedConnections[key] = c
 
 	return nil, errProtocolNegotiated
 }
 
-func (rt *roundTripper) dialTLSHTTP2(network, addr string, _ *tls.Config) (net.Conn, error) {
-	return rt.dialTLS(context.Background(), network, addr)
+// handshake dials endpoint and makes the tls handshake for the origin at addr, offering alpn instead of the protocols
+// of the client hello if it is not nil
+func (rt *roundTripper) handshake(ctx context.Context, network, addr, endpoint string, alpn []string) (*utls.UConn, error) {
+	rawConn, err := rt.dialer.DialContext(ctx, network, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var host string
+	if host, _, err = net.SplitHostPort(addr); err != nil {
+		host = addr
+	}
+
+	conn, session, err := rt.uClient(rawConn, addr, host, alpn)
+	if err != nil {
+		_ = rawConn.Close()
+		return nil, err
+	}
+	hooks := hooksFrom(ctx)
+	hooks.tlsHandshakeStart(host)
+	err = conn.HandshakeContext(ctx)
+	hooks.tlsHandshakeDone(host, err)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	session.done(conn)
+	return conn, nil
+}
+
+// uClient creates the utls client of a connection and the session offer of the session cache, custom and randomized
+// client hellos, client hellos resuming a session and client hellos offering alpn are applied from a spec built for
+// the connection
+func (rt *roundTripper) uClient(rawConn net.Conn, addr, host string, alpn []string) (*utls.UConn, *sessionOffer, error) {
+	config := rt.verification.utlsConfig(host)
+	if !rt.clientCerts.empty() {
+		config.GetClientCertificate = rt.clientCerts.selectCertificate(host)
+	}
+	config.KeyLogWriter = rt.keyLog
+	// the pre_shared_key extension of a spec is left out if there is no session to resume
+	config.OmitEmptyPsk = true
+
+	spec, err := rt.spec()
+	if err != nil {
+		return nil, nil, err
+	}
+	if alpn != nil {
+		if spec == nil {
+			preset, err := utls.UTLSIdToSpec(rt.clientHelloId)
+			if err != nil {
+				return nil, nil, err
+			}
+			spec = &preset
+		}
+		spec = withALPN(spec, alpn)
+	}
+
+	var session *sessionOffer
+	if rt.sessionCache != nil {
+		session = rt.sessionCache.offer(addr, spec)
+		config.ClientSessionCache = session
+		// sessions are only offered by client hellos with the extension of their version
+		config.PreferSkipResumptionOnNilExtension = true
+	}
+
+	if spec == nil {
+		return utls.UClient(rawConn, config, rt.clientHelloId), session, nil
+	}
+
+	conn := utls.UClient(rawConn, config, utls.HelloCustom)
+	if rt.randomizer != nil {
+		err = rt.randomizer.apply(conn, spec)
+	} else {
+		err = conn.ApplyPreset(spec)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, session, nil
+}
+
+// withALPN returns a copy of spec offering the protocols of alpn in its alpn extension
+func withALPN(spec *utls.ClientHelloSpec, alpn []string) *utls.ClientHelloSpec {
+	copied := *spec
+	copied.Extensions = make([]utls.TLSExtension, len(spec.Extensions))
+	for i, extension := range spec.Extensions {
+		if _, ok := extension.(*utls.ALPNExtension); ok {
+			extension = &utls.ALPNExtension{AlpnProtocols: alpn}
+		}
+		copied.Extensions[i] = extension
+	}
+	return &copied
+}
+
+// spec builds the spec of the client hello of a connection, nil if the utls preset is applied by utls.
+// Presets are built as spec to resume tls 1.3 sessions, utls can not add a pre shared key to them
+func (rt *roundTripper) spec() (*utls.ClientHelloSpec, error) {
+	if rt.clientHelloSpec != nil || rt.randomizer != nil {
+		return randomizableSpec(rt.clientHelloId, rt.clientHelloSpec)
+	}
+	if rt.sessionCache == nil {
+		return nil, nil
+	}
+
+	spec, err := utls.UTLSIdToSpec(rt.clientHelloId)
+	if err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// close closes the idle connections of the cached transports and the connections stashed for them, and the http3
+// connections once their responses were read. Requests that are sent meanwhile keep their connections
+func (rt *roundTripper) close() {
+	rt.Lock()
+	transports := make([]http.RoundTripper, 0, len(rt.cachedTransports))
+	for _, t := range rt.cachedTransports {
+		transports = append(transports, t)
+	}
+	conns := rt.cachedConnections
+	rt.cachedConnections = make(map[string]net.Conn)
+	rt.Unlock()
+
+	for _, t := range transports {
+		switch t := t.(type) {
+		case *http2.Transport:
+			t.ConnPool.(*http2ConnPool).close()
+		case *http.Transport:
+			t.CloseIdleConnections()
+		}
+	}
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	if rt.http3 != nil {
+		rt.http3.pool.close()
+	}
+}
+
+// http2Transport creates the http2 transport of an address dialing with dial, it reads frames with the settings of the
+// fingerprint
+func (rt *roundTripper) http2Transport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http2.Transport {
+	t := &http2.Transport{}
+	t.ConnPool = &http2ConnPool{t: t, dial: dial}
+	if v, ok := rt.fingerprint.setting(http2.SettingHeaderTableSize); ok {
+		t.HeaderTableSize = v
+	}
+	if v, ok := rt.fingerprint.setting(http2.SettingMaxHeaderListSize); ok {
+		t.MaxHeaderListSize = v
+	}
+	if v, ok := rt.fingerprint.setting(http2.SettingEnablePush); !ok || v == 1 {
+		t.PushHandler = refusePushes{}
+	}
+	return t
+}
+
+// http2ConnPool is the connection pool of the http2 transport of an address. Unlike the pool of the transport, which
+// dials without context, connections are dialed with the context of the request needing them, so that the handshake
+// reports to its hooks, timings and ConnInfo
+type http2ConnPool struct {
+	t    *http2.Transport
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu      sync.Mutex
+	conns   []*http2.ClientConn
+	dialing *http2Dial
+}
+
+// http2Dial is the dial of a connection of a pool, requests needing a connection meanwhile wait for it
+type http2Dial struct {
+	done chan struct{}
+	cc   *http2.ClientConn
+	err  error
+}
+
+func (p *http2ConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	ctx := req.Context()
+	for {
+		p.mu.Lock()
+		for _, cc := range p.conns {
+			if cc.CanTakeNewRequest() {
+				p.mu.Unlock()
+				return cc, nil
+			}
+		}
+		d := p.dialing
+		if d == nil {
+			d = &http2Dial{done: make(chan struct{})}
+			p.dialing = d
+			p.mu.Unlock()
+			p.open(ctx, addr, d)
+			return d.cc, d.err
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// requests waiting for the dial of a canceled request dial again
+		if d.err != nil && !errors.Is(d.err, context.Canceled) && !errors.Is(d.err, context.DeadlineExceeded) {
+			return nil, d.err
+		}
+	}
+}
+
+// open dials the connection of d with the context of the request needing it
+func (p *http2ConnPool) open(ctx context.Context, addr string, d *http2Dial) {
+	conn, err := p.dial(ctx, "tcp", addr)
+	if err == nil {
+		if d.cc, err = p.t.NewClientConn(conn); err != nil {
+			_ = conn.Close()
+		}
+	}
+	d.err = err
+
+	p.mu.Lock()
+	if err == nil {
+		p.conns = append(p.conns, d.cc)
+	}
+	p.dialing = nil
+	p.mu.Unlock()
+	close(d.done)
+}
+
+func (p *http2ConnPool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, c := range p.conns {
+		if c == cc {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// close shuts the connections of the pool down, they are closed once their requests finished
+func (p *http2ConnPool) close() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+
+	for _, cc := range conns {
+		go func(cc *http2.ClientConn) { _ = cc.Shutdown(context.Background()) }(cc)
+	}
+}
+
+// refusePushes cancels the pushes of servers, fingerprints enabling push would fail with them otherwise
+type refusePushes struct{}
+
+func (refusePushes) HandlePush(r *http2.PushedRequest) {
+	r.Cancel()
 }
 
 func (rt *roundTripper) getDialTLSAddr(req *http.Request) string {
@@ -123,26 +536,32 @@ func (rt *roundTripper) getDialTLSAddr(req *http.Request) string {
 	return net.JoinHostPort(req.URL.Host, "443") // we can assume port is 443 at this point
 }
 
-func newRoundTripper(clientHello utls.ClientHelloID, overriddenSettings map[http2.SettingID]uint32, dialer ...proxy.ContextDialer) http.RoundTripper {
-	if len(dialer) > 0 {
-		return &roundTripper{
-			dialer: dialer[0],
-
-			clientHelloId:      clientHello,
-			overriddenSettings: overriddenSettings,
-
-			cachedTransports:  make(map[string]http.RoundTripper),
-			cachedConnections: make(map[string]net.Conn),
-		}
-	} else {
-		return &roundTripper{
-			dialer: proxy.Direct,
+// newRoundTripper creates the round tripper of the profile, tls settings and caches of the client, requests are only
+// sent over http3 if h3 is set
+func newRoundTripper(c *Client, h3 *HTTP3, dialer ...proxy.ContextDialer) http.RoundTripper {
+	rt := &roundTripper{
+		dialer: proxy.Direct,
 
-			clientHelloId:      clientHello,
-			overriddenSettings: overriddenSettings,
+		clientHelloId:   c.clientHello,
+		clientHelloSpec: c.clientHelloSpec,
+		randomizer:      newHelloRandomizer(c.randomization),
+		sessionCache:    c.sessionCache,
+		verification:    c.verification,
+		clientCerts:     c.clientCerts,
+		keyLog:          c.keyLog,
+		priority:        c.http2Priority,
+		fingerprint:     http2Fingerprint(c.http2Fingerprint, c.http2Headers, c.http2Priority),
+		rewriteFrames:   c.http2Fingerprint != nil || len(c.http2Headers) > 0 || c.http2Priority.enabled(),
+		altSvc:          c.altSvc,
 
-			cachedTransports:  make(map[string]http.RoundTripper),
-			cachedConnections: make(map[string]net.Conn),
-		}
+		cachedTransports:  make(map[string]http.RoundTripper),
+		cachedConnections: make(map[string]net.Conn),
+	}
+	if len(dialer) > 0 {
+		rt.dialer = dialer[0]
+	}
+	if h3 != nil {
+		rt.http3 = newHTTP3RoundTripper(h3, c.verification, c.clientCerts, c.keyLog, c.sessionCache != nil, &rt.broken)
 	}
+	return rt
 }
@@ -0,0 +1,409 @@
+package cclient_v2
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+)
+
+// defaultSessionCacheCapacity is the number of hosts a session cache keeps a session for if no capacity is set
+const defaultSessionCacheCapacity = 64
+
+// SessionCache caches the tls sessions of clients to resume them on later connections, tls 1.3 sessions are resumed
+// with a pre shared key and tls 1.2 sessions with a session ticket. It is safe for concurrent use and can be shared
+// between clients.
+// A pre_shared_key extension is only sent by client hellos with a psk_key_exchange_modes extension, it is always sent
+// as the last extension. A session ticket is only sent by client hellos with a session_ticket extension
+type SessionCache struct {
+	// the counters are accessed atomically and come first to be 64 bit aligned
+	handshakes int64
+	offered    int64
+	resumed    int64
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List
+	capacity int
+	path     string
+	// changed is set when the sessions changed since they were last written, saving while the file is written
+	changed bool
+	saving  bool
+	saved   *sync.Cond
+	// err is the error of the last save
+	err error
+}
+
+// sessionEntry is the session cached for a host
+type sessionEntry struct {
+	key     string
+	session *tlsUtls.ClientSessionState
+}
+
+// SessionMetrics counts the handshakes of the connections using a session cache
+type SessionMetrics struct {
+	// Handshakes is the number of completed handshakes
+	Handshakes int64
+	// Offered is the number of handshakes that offered a cached session
+	Offered int64
+	// Resumed is the number of handshakes the server resumed the offered session in
+	Resumed int64
+}
+
+// ResumptionRate is the share of offered sessions the server resumed, zero if none were offered
+func (m SessionMetrics) ResumptionRate() float64 {
+	if m.Offered == 0 {
+		return 0
+	}
+	return float64(m.Resumed) / float64(m.Offered)
+}
+
+// NewSessionCache creates a session cache in memory that keeps the sessions of up to capacity hosts,
+// a default capacity is used if it is less than 1
+func NewSessionCache(capacity int) *SessionCache {
+	if capacity < 1 {
+		capacity = defaultSessionCacheCapacity
+	}
+	c := &SessionCache{
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		capacity: capacity,
+	}
+	c.saved = sync.NewCond(&c.mu)
+	return c
+}
+
+// OpenSessionCache creates a session cache that is saved to the file at path whenever a session is stored,
+// sessions saved to the file before are loaded. The file is written in the background, Flush waits for it.
+// It holds the secrets of the sessions and is only readable by the owner
+func OpenSessionCache(path string, capacity int) (*SessionCache, error) {
+	c := NewSessionCache(capacity)
+	c.path = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved []savedSession
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	// the file lists the most recently used session first
+	for i := len(saved) - 1; i >= 0; i-- {
+		session, err := saved[i].state()
+		if err != nil {
+			return nil, err
+		}
+		if !sessionExpired(session) {
+			c.store(saved[i].Key, session)
+		}
+	}
+	return c, nil
+}
+
+// Metrics returns the handshake counts of the connections using the cache
+func (c *SessionCache) Metrics() SessionMetrics {
+	return SessionMetrics{
+		Handshakes: atomic.LoadInt64(&c.handshakes),
+		Offered:    atomic.LoadInt64(&c.offered),
+		Resumed:    atomic.LoadInt64(&c.resumed),
+	}
+}
+
+// Len returns the number of cached sessions
+func (c *SessionCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// Clear removes all cached sessions
+func (c *SessionCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.save()
+}
+
+func (c *SessionCache) get(key string) *tlsUtls.ClientSessionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*sessionEntry).session
+}
+
+// put stores the session for key, a nil session removes the session of key if it is still old
+func (c *SessionCache) put(key string, session, old *tlsUtls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if session == nil {
+		elem, ok := c.entries[key]
+		if !ok || elem.Value.(*sessionEntry).session != old {
+			return
+		}
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	} else {
+		c.store(key, session)
+	}
+	c.save()
+}
+
+// store stores the session for key and evicts the least recently used session if the cache is full, c.mu must be held
+func (c *SessionCache) store(key string, session *tlsUtls.ClientSessionState) {
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*sessionEntry).session = session
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*sessionEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&sessionEntry{key: key, session: session})
+}
+
+// save writes the sessions to the file of the cache in the background, c.mu must be held.
+// One goroutine writes the file at a time, it writes it again if the sessions changed while it was writing
+func (c *SessionCache) save() {
+	if c.path == "" {
+		return
+	}
+
+	c.changed = true
+	if !c.saving {
+		c.saving = true
+		go c.write()
+	}
+}
+
+// write writes the sessions to the file of the cache until they no longer change
+func (c *SessionCache) write() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.changed {
+		c.changed = false
+		entries := make([]sessionEntry, 0, c.order.Len())
+		for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+			entries = append(entries, *elem.Value.(*sessionEntry))
+		}
+
+		c.mu.Unlock()
+		data, err := marshalSessions(entries)
+		if err == nil {
+			err = writeFile(c.path, data)
+		}
+		c.mu.Lock()
+		c.err = err
+	}
+	c.saving = false
+	c.saved.Broadcast()
+}
+
+// Flush waits until the sessions stored before are written to the file of the cache and returns the error of the save
+func (c *SessionCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.saving {
+		c.saved.Wait()
+	}
+	return c.err
+}
+
+// Err returns the error of the last attempt to save the sessions to the file of the cache, nil if it succeeded
+func (c *SessionCache) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// record counts a completed handshake
+func (c *SessionCache) record(offered, resumed bool) {
+	atomic.AddInt64(&c.handshakes, 1)
+	if offered {
+		atomic.AddInt64(&c.offered, 1)
+	}
+	if resumed {
+		atomic.AddInt64(&c.resumed, 1)
+	}
+}
+
+// offer picks the session a connection to addr offers and adds the pre_shared_key extension to spec if it can resume
+// a tls 1.3 session. Without a spec only tls 1.2 sessions are offered, utls does not resume tls 1.3 sessions with its presets.
+// Sessions are cached by host and port like browsers do, utls checks that they did not expire and are valid for the host
+// before it offers them
+func (c *SessionCache) offer(addr string, spec *tlsUtls.ClientHelloSpec) *sessionOffer {
+	o := &sessionOffer{cache: c, key: addr, session: c.get(addr)}
+	if spec == nil {
+		return o
+	}
+
+	spec.Extensions = withoutPreSharedKey(spec.Extensions)
+	if o.session != nil && o.session.Vers() >= tlsUtls.VersionTLS13 && offersPreSharedKey(spec, o.session) {
+		spec.Extensions = append(spec.Extensions, &tlsUtls.UtlsPreSharedKeyExtension{})
+	}
+	return o
+}
+
+// sessionOffer is the session cache of one connection, it hands the cached session to utls and stores the sessions
+// of the connection in the shared cache
+type sessionOffer struct {
+	cache   *SessionCache
+	key     string
+	session *tlsUtls.ClientSessionState
+}
+
+func (o *sessionOffer) Get(string) (*tlsUtls.ClientSessionState, bool) {
+	return o.session, o.session != nil
+}
+
+// Put stores a session of the connection, utls passes its own key that only holds the server name.
+// utls puts nil to remove a session it did not offer because it expired
+func (o *sessionOffer) Put(_ string, session *tlsUtls.ClientSessionState) {
+	o.cache.put(o.key, session, o.session)
+}
+
+// done records the handshake of the connection, utls sets the session of the handshake state if it offered one
+func (o *sessionOffer) done(conn *tlsUtls.UConn) {
+	if o != nil {
+		o.cache.record(conn.HandshakeState.Session != nil, conn.ConnectionState().DidResume)
+	}
+}
+
+// withoutPreSharedKey removes the pre_shared_key slot of a client hello spec, it is only sent when a session is resumed
+func withoutPreSharedKey(extensions []tlsUtls.TLSExtension) []tlsUtls.TLSExtension {
+	kept := extensions[:0]
+	for _, e := range extensions {
+		if _, ok := e.(tlsUtls.PreSharedKeyExtension); ok {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// offersPreSharedKey reports whether the spec can resume a tls 1.3 session, it needs the psk_key_exchange_modes
+// extension, tls 1.3 and a cipher suite with the hash of the session
+func offersPreSharedKey(spec *tlsUtls.ClientHelloSpec, session *tlsUtls.ClientSessionState) bool {
+	modes, versions := false, false
+	for _, e := range spec.Extensions {
+		switch ext := e.(type) {
+		case *tlsUtls.PSKKeyExchangeModesExtension:
+			modes = true
+		case *tlsUtls.SupportedVersionsExtension:
+			for _, v := range ext.Versions {
+				versions = versions || v == tlsUtls.VersionTLS13
+			}
+		}
+	}
+	if !modes || !versions {
+		return false
+	}
+
+	for _, suite := range spec.CipherSuites {
+		if isTLS13CipherSuite(suite) && binderSize(suite) == binderSize(session.CipherSuite()) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTLS13CipherSuite(suite uint16) bool {
+	return suite == tlsUtls.TLS_AES_128_GCM_SHA256 || suite == tlsUtls.TLS_AES_256_GCM_SHA384 || suite == tlsUtls.TLS_CHACHA20_POLY1305_SHA256
+}
+
+// binderSize is the size of the hash of a tls 1.3 cipher suite
+func binderSize(suite uint16) int {
+	if suite == tlsUtls.TLS_AES_256_GCM_SHA384 {
+		return 48
+	}
+	return 32
+}
+
+// sessionExpired reports whether the certificate of a session expired, utls drops sessions whose ticket expired when
+// it would offer them
+func sessionExpired(session *tlsUtls.ClientSessionState) bool {
+	certificates := session.ServerCertificates()
+	return len(certificates) > 0 && time.Now().After(certificates[0].NotAfter)
+}
+
+// savedSession is a session as it is saved to the file of a session cache, the state is encoded by utls
+type savedSession struct {
+	Key    string `json:"key"`
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+// marshalSessions encodes the sessions of a cache to save them, the most recently used session comes first
+func marshalSessions(entries []sessionEntry) ([]byte, error) {
+	saved := make([]savedSession, 0, len(entries))
+	for _, entry := range entries {
+		ticket, state, err := entry.session.ResumptionState()
+		if err != nil {
+			return nil, err
+		}
+		if state == nil {
+			continue
+		}
+		encoded, err := state.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		saved = append(saved, savedSession{Key: entry.key, Ticket: ticket, State: encoded})
+	}
+	return json.Marshal(saved)
+}
+
+// state returns the utls session of a saved session
+func (s savedSession) state() (*tlsUtls.ClientSessionState, error) {
+	if len(s.Ticket) == 0 {
+		return nil, errors.New("saved tls session of " + s.Key + " has no ticket")
+	}
+	state, err := tlsUtls.ParseSessionState(s.State)
+	if err != nil {
+		return nil, fmt.Errorf("saved tls session of %s: %w", s.Key, err)
+	}
+	return tlsUtls.NewResumptionState(s.Ticket, state)
+}
+
+// writeFile replaces the file at path with data, readable only by the owner
+func writeFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,147 @@
+package cclient_v2
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+// resumeSessions sends a request with a new client for every cache, the clients share the sessions of the caches
+func resumeSessions(t *testing.T, srv *fingerprinttest.Server, clientHello interface{}, caches ...*SessionCache) {
+	for _, cache := range caches {
+		c, err := NewClient("", 5*time.Second, true, clientHello, cache, TLSVerification{RootCAs: srv.CertPool()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.NewRequest().SetURL(srv.URL).Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode() != http.StatusOK {
+			t.Fatalf("status: got %d", resp.StatusCode())
+		}
+		c.Close()
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	spec, err := ParseJA3("771,4865-4866-4867-49195-49199,0-10-11-13-16-35-43-45-51,29-23-24,0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		clientHello   interface{}
+		randomization Randomization
+		maxVersion    uint16
+	}{
+		{"tls 1.3 preset", tlsUtls.HelloChrome_102, Randomization{}, 0},
+		{"tls 1.3 spec", spec, Randomization{}, 0},
+		{"tls 1.3 randomized", tlsUtls.HelloChrome_102, Randomization{Mode: RandomizePerConnection}, 0},
+		{"tls 1.2 preset", tlsUtls.HelloChrome_102, Randomization{}, tls.VersionTLS12},
+		{"tls 1.2 spec", spec, Randomization{}, tls.VersionTLS12},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fingerprinttest.NewUnstartedServer()
+			srv.TLS.MaxVersion = test.maxVersion
+			srv.Start()
+			defer srv.Close()
+
+			cache := NewSessionCache(0)
+			// every client has connections of its own, the second one resumes the session of the first
+			for i := 0; i < 2; i++ {
+				c, err := NewClient("", 5*time.Second, true, test.clientHello, test.randomization, cache, TLSVerification{RootCAs: srv.CertPool()})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = c.NewRequest().SetURL(srv.URL).Do(); err != nil {
+					t.Fatal(err)
+				}
+				c.Close()
+			}
+			m := cache.Metrics()
+			if m.Handshakes != 2 || m.Offered != 1 || m.Resumed != 1 {
+				t.Errorf("metrics: got %+v, want 2 handshakes, 1 offered and 1 resumed", m)
+			}
+			if f, _ := srv.LastFingerprint(); test.maxVersion == 0 && !strings.HasSuffix(strings.Split(f.JA3, ",")[2], "-41") {
+				t.Errorf("ja3: got %q, want the pre shared key as last extension", f.JA3)
+			}
+		})
+	}
+}
+
+func TestSessionCacheFile(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	cache, err := OpenSessionCache(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumeSessions(t, srv, tlsUtls.HelloChrome_102, cache)
+	if err = cache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("file mode: got %v, want only readable by the owner", info.Mode())
+	}
+
+	// the session saved by the first cache is resumed with a cache opened later
+	reopened, err := OpenSessionCache(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Len() != 1 {
+		t.Fatalf("sessions: got %d, want 1", reopened.Len())
+	}
+	resumeSessions(t, srv, tlsUtls.HelloChrome_102, reopened)
+	if m := reopened.Metrics(); m.Offered != 1 || m.Resumed != 1 {
+		t.Errorf("metrics: got %+v, want the saved session resumed", m)
+	}
+
+	reopened.Clear()
+	if err = reopened.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if cleared, err := OpenSessionCache(path, 0); err != nil || cleared.Len() != 0 {
+		t.Errorf("cleared cache: got %v sessions, error %v", cleared, err)
+	}
+
+	if err = os.WriteFile(path, []byte(`[{"key":"example.com:443","ticket":"AQ==","state":"AQ=="}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenSessionCache(path, 0); err == nil {
+		t.Error("got no error for an invalid saved session")
+	}
+}
+
+func TestSessionCacheClientHello(t *testing.T) {
+	// the golang client hello has no spec to add the pre shared key to
+	if _, err := NewClient("", 5*time.Second, true, tlsUtls.HelloGolang, NewSessionCache(0)); err == nil {
+		t.Error("got no error for a client hello that can not resume sessions")
+	}
+}
+
+func TestClientDoesNotResumeByDefault(t *testing.T) {
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SessionCache() != nil {
+		t.Error("client has a session cache without passing one")
+	}
+}
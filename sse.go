@@ -0,0 +1,347 @@
+package cclient_v2
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// defaultEventSourceRetry is the reconnection delay until the server sends a retry field, the one of browsers
+const defaultEventSourceRetry = 3 * time.Second
+
+// Event is an event of a server sent event stream
+type Event struct {
+	// ID is the last event id of the stream when the event was dispatched
+	ID string
+	// Event is the type of the event, message if the server sent no event field
+	Event string
+	// Data is the data of the event, the lines of its data fields joined with newlines
+	Data string
+	// Retry is the reconnection delay the event set with a retry field, zero if it had none
+	Retry time.Duration
+}
+
+// EventSourceError is returned when the server refused the event stream with a status other than 200 OK or a content
+// type other than text/event-stream, the event source does not reconnect then
+type EventSourceError struct {
+	// Response is the response of the server, its body is read
+	Response *Response
+}
+
+func (e *EventSourceError) Error() string {
+	return fmt.Sprintf("event stream refused with status %d and content type %q", e.Response.StatusCode(), e.Response.Header().Get("Content-Type"))
+}
+
+// EventSource streams the server sent events of a request like the EventSource of browsers. It reconnects when the
+// stream ends or fails, after the reconnection delay and with a Last-Event-ID header of the last event id.
+// The timeout of the client applies until the response headers of a connection arrived, events are read without
+// timeout
+type EventSource struct {
+	request *Request
+
+	mu          sync.Mutex
+	retry       time.Duration
+	lastEventID string
+	body        []byte
+	bodyRead    bool
+}
+
+// EventSource returns an event source streaming the events of the request. Accept: text/event-stream and
+// Cache-Control: no-cache are sent unless the request sets them
+func (r *Request) EventSource() *EventSource {
+	return &EventSource{request: r, retry: defaultEventSourceRetry}
+}
+
+// SetRetry sets the reconnection delay until the server sends a retry field
+func (s *EventSource) SetRetry(retry time.Duration) *EventSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retry = retry
+	return s
+}
+
+// SetLastEventID sets the last event id sent when connecting, like resuming a stream of an earlier event source
+func (s *EventSource) SetLastEventID(id string) *EventSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastEventID = id
+	return s
+}
+
+// LastEventID returns the last event id the server sent
+func (s *EventSource) LastEventID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastEventID
+}
+
+// Listen connects and calls handler with the events of the stream until ctx is done or the server refuses the
+// stream, it returns the error of ctx or an *EventSourceError then. A server responding 204 No Content ends the
+// stream and nil is returned. Handler is called by the goroutine calling Listen and delays reading the stream
+func (s *EventSource) Listen(ctx context.Context, handler func(Event)) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := s.connect(ctx, handler)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, ok := err.(*EventSourceError); ok {
+			return err
+		}
+		if err == errEventStreamEnded {
+			return nil
+		}
+
+		s.mu.Lock()
+		retry := s.retry
+		s.mu.Unlock()
+
+		timer := time.NewTimer(retry)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		_, hooks := s.request.client.interceptors.snapshot()
+		hooks.retry(attempt, err)
+	}
+}
+
+// Events streams the events of the stream on a channel until ctx is done or the server refuses the stream, the
+// channel is closed then and the error Listen returns is sent on the error channel
+func (s *EventSource) Events(ctx context.Context) (<-chan Event, <-chan error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	events := make(chan Event)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(events)
+
+		errs <- s.Listen(ctx, func(event Event) {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return events, errs
+}
+
+// errEventStreamEnded is returned by connect when the server responded 204 No Content
+var errEventStreamEnded = errors.New("event stream ended")
+
+// connect opens a connection of the stream and reads its events until it ends, nil is never returned
+func (s *EventSource) connect(ctx context.Context, handler func(Event)) error {
+	req, err := s.prepare(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.request.client.open(req)
+	if err != nil {
+		return err
+	}
+	defer resp.body.Close()
+
+	if resp.statusCode == http.StatusNoContent {
+		return errEventStreamEnded
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.header.Get("Content-Type"))
+	if resp.statusCode != http.StatusOK || mediaType != "text/event-stream" {
+		response, err := newResponse(req, resp)
+		if err != nil {
+			return err
+		}
+		return &EventSourceError{Response: response}
+	}
+
+	body := io.Reader(resp.body)
+	if !resp.uncompressed {
+		if body, err = decodedBody(resp.header.Get("Content-Encoding"), body); err != nil {
+			return err
+		}
+	}
+	if err = s.read(body, handler); err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+// prepare builds the request of a connection, the body of the request is read once and sent with every connection
+func (s *EventSource) prepare(ctx context.Context) (*preparedRequest, error) {
+	r := s.request
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.bodyRead {
+		if r.body != nil {
+			body, err := io.ReadAll(r.body)
+			if err != nil {
+				return nil, err
+			}
+			s.body = body
+		}
+		s.bodyRead = true
+	}
+
+	req, err := r.prepare()
+	if err != nil {
+		return nil, err
+	}
+	req.ctx = ctx
+	req.stream = true
+	if s.body != nil {
+		body := s.body
+		req.body = bytes.NewReader(body)
+		req.contentLength = int64(len(body))
+		req.getBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	if len(req.header.Values("Accept")) == 0 {
+		req.header.Set("Accept", "text/event-stream")
+	}
+	if len(req.header.Values("Cache-Control")) == 0 {
+		req.header.Set("Cache-Control", "no-cache")
+	}
+	if s.lastEventID != "" {
+		req.header.Set("Last-Event-ID", s.lastEventID)
+	}
+	return req, nil
+}
+
+// decodedBody decodes a streamed body with content encoding, fhttp does not decode http/1.1 bodies of requests that
+// set an Accept-Encoding header
+func decodedBody(encoding string, body io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return zlib.NewReader(body)
+	case "br":
+		return brotli.NewReader(body), nil
+	default:
+		return nil, fmt.Errorf("unsupported event stream content encoding %s", encoding)
+	}
+}
+
+// read parses the events of a stream as the html standard specifies and calls handler with them
+func (s *EventSource) read(body io.Reader, handler func(Event)) error {
+	br := bufio.NewReader(body)
+
+	var data strings.Builder
+	var eventType string
+	var retry time.Duration
+	hasData := false
+
+	s.mu.Lock()
+	id := s.lastEventID
+	s.mu.Unlock()
+
+	skipLF, first := false, true
+	for {
+		line, err := readEventLine(br, &skipLF)
+		if err != nil {
+			return err
+		}
+		if first {
+			// a byte order mark at the start of the stream is ignored
+			line, first = strings.TrimPrefix(line, "\ufeff"), false
+		}
+
+		if line == "" {
+			s.mu.Lock()
+			s.lastEventID = id
+			s.mu.Unlock()
+
+			if hasData {
+				event := Event{ID: id, Event: eventType, Data: strings.TrimSuffix(data.String(), "\n"), Retry: retry}
+				if event.Event == "" {
+					event.Event = "message"
+				}
+				handler(event)
+			}
+			data.Reset()
+			eventType, retry, hasData = "", 0, false
+			continue
+		}
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				id = value
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 63); err == nil && strings.Trim(value, "0123456789") == "" {
+				retry = time.Duration(ms) * time.Millisecond
+				s.mu.Lock()
+				s.retry = retry
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// readEventLine reads a line ending in CRLF, LF or CR. A CR ends the line at once, the LF following it is skipped
+// with the next line
+func readEventLine(br *bufio.Reader, skipLF *bool) (string, error) {
+	var line []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if *skipLF {
+			*skipLF = false
+			if b == '\n' {
+				continue
+			}
+		}
+		switch b {
+		case '\r':
+			*skipLF = true
+			return string(line), nil
+		case '\n':
+			return string(line), nil
+		}
+		line = append(line, b)
+	}
+}
@@ -0,0 +1,151 @@
+package cclient_v2
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+)
+
+// newEventSourceClient starts an http2 server with handler and returns a client trusting it
+func newEventSourceClient(t *testing.T, handler http.HandlerFunc) (*Client, *httptest.Server) {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, srv
+}
+
+func TestEventSource(t *testing.T) {
+	var mu sync.Mutex
+	var requests []http.Header
+	c, srv := newEventSourceClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Header.Clone())
+		connection := len(requests)
+		mu.Unlock()
+
+		switch connection {
+		case 1:
+			// the first stream ends after its events, the client reconnects after the retry it sets
+			w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+			_, _ = w.Write([]byte("\ufeff: comment\r\nretry: 10\r\ndata: first\r\ndata: line\r\n\r\n"))
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte("id: 1\revent: update\rdata:second\r\rdata\n\n"))
+		case 2:
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			_, _ = zw.Write([]byte("id: 2\ndata: compressed\n\nid\n\n"))
+			_ = zw.Close()
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	var retries []int
+	c.AddHooks(Hooks{Retry: func(attempt int, _ error) { retries = append(retries, attempt) }})
+
+	source := c.NewRequest().SetURL(srv.URL).EventSource()
+	var events []Event
+	if err := source.Listen(context.Background(), func(event Event) { events = append(events, event) }); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Event{
+		{Event: "message", Data: "first\nline", Retry: 10 * time.Millisecond},
+		{ID: "1", Event: "update", Data: "second"},
+		{ID: "1", Event: "message", Data: ""},
+		{ID: "2", Event: "message", Data: "compressed"},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events: got %+v, want %+v", events, want)
+	}
+	if source.LastEventID() != "" {
+		t.Errorf("last event id: got %q, want the id the last event reset", source.LastEventID())
+	}
+	if !reflect.DeepEqual(retries, []int{1, 2}) {
+		t.Errorf("retries: got %v, want [1 2]", retries)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 3 {
+		t.Fatalf("connections: got %d, want 3", len(requests))
+	}
+	for i, header := range requests {
+		if header.Get("Accept") != "text/event-stream" || header.Get("Cache-Control") != "no-cache" {
+			t.Errorf("connection %d: got Accept %q and Cache-Control %q", i+1, header.Get("Accept"), header.Get("Cache-Control"))
+		}
+	}
+	for i, id := range []string{"", "1", ""} {
+		if got := requests[i].Get("Last-Event-ID"); got != id {
+			t.Errorf("Last-Event-ID of connection %d: got %q, want %q", i+1, got, id)
+		}
+	}
+}
+
+func TestEventSourceRefused(t *testing.T) {
+	c, srv := newEventSourceClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/json" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte("{}"))
+			return
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/", http.StatusServiceUnavailable},
+		{"/json", http.StatusOK},
+	} {
+		events, errs := c.NewRequest().SetURL(srv.URL + test.path).EventSource().Events(context.Background())
+		for event := range events {
+			t.Errorf("%s: unexpected event %+v", test.path, event)
+		}
+		var refused *EventSourceError
+		if err := <-errs; !errors.As(err, &refused) || refused.Response.StatusCode() != test.status {
+			t.Errorf("%s: got %v, want a refused stream with status %d", test.path, err, test.status)
+		}
+	}
+}
+
+func TestEventSourceCanceled(t *testing.T) {
+	c, srv := newEventSourceClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: open\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, errs := c.NewRequest().SetURL(srv.URL).EventSource().SetLastEventID("resumed").Events(ctx)
+	if event := <-events; event.Data != "open" || event.ID != "resumed" {
+		t.Errorf("event: got %+v", event)
+	}
+	cancel()
+	for range events {
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("error: got %v, want %v", err, context.Canceled)
+	}
+}
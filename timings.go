@@ -0,0 +1,192 @@
+package cclient_v2
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timings are the durations of the phases of a request. The phases of all hops of a redirected request add up,
+// phases that did not happen are zero
+type Timings struct {
+	// DNS is the time spent looking up addresses
+	DNS time.Duration
+	// Connect is the time spent connecting to the server or the proxy over tcp
+	Connect time.Duration
+	// ProxyConnect is the time from connecting to the proxy until the tunnel through it was open, non tls clients
+	// end it when the tls handshake through the tunnel starts
+	ProxyConnect time.Duration
+	// TLSHandshake is the time spent in tls handshakes with the server
+	TLSHandshake time.Duration
+	// FirstByte is the time from sending the request until the first byte of the final response headers was read
+	FirstByte time.Duration
+	// Transfer is the time from the first byte of the final response until its body was read
+	Transfer time.Duration
+	// Total is the time from sending the request until the body of the final response was read
+	Total time.Duration
+	// Reused is whether the final response was received over a connection that served earlier requests
+	Reused bool
+}
+
+// timingRecorder records the timings of a request with its hooks, the hooks are called concurrently
+type timingRecorder struct {
+	mu           sync.Mutex
+	start        time.Time
+	firstByte    time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	connecting   int
+	proxyStart   time.Time
+	tlsStart     time.Time
+	timings      Timings
+}
+
+type timingsKey struct{}
+
+// withTimings returns a context recording the timings of a request from now on
+func withTimings(ctx context.Context) context.Context {
+	r := &timingRecorder{start: time.Now()}
+	hooks := hooksFrom(ctx)
+	ctx = withHooks(ctx, append(hooks[:len(hooks):len(hooks)], r.hooks()))
+	return context.WithValue(ctx, timingsKey{}, r)
+}
+
+// timingsFrom returns the timing recorder of a request, nil if its timings are not recorded
+func timingsFrom(ctx context.Context) *timingRecorder {
+	if ctx == nil {
+		return nil
+	}
+	r, _ := ctx.Value(timingsKey{}).(*timingRecorder)
+	return r
+}
+
+// hooks returns the hooks recording the timings
+func (r *timingRecorder) hooks() *Hooks {
+	return &Hooks{
+		DNSStart: func(string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.dnsStart = time.Now()
+		},
+		DNSDone: func([]net.IPAddr, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.timings.DNS += since(r.dnsStart)
+		},
+		DialStart: func(string, string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			// addresses dialed in parallel count once, from the first dial until the last one ended
+			if r.connecting == 0 {
+				r.connectStart = time.Now()
+			}
+			r.connecting++
+		},
+		DialDone: func(string, string, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if r.connecting == 0 {
+				return
+			}
+			if r.connecting--; r.connecting == 0 {
+				r.timings.Connect += since(r.connectStart)
+			}
+		},
+		ProxyConnectStart: func(string, string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.proxyStart = time.Now()
+		},
+		ProxyConnectDone: func(string, string, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.endProxyConnect()
+		},
+		TLSHandshakeStart: func(string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.endProxyConnect()
+			r.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(string, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.timings.TLSHandshake += since(r.tlsStart)
+			r.tlsStart = time.Time{}
+		},
+		FirstByte: func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.firstByte = time.Now()
+		},
+		Redirect: func(*http.Request, []*http.Request) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.firstByte = time.Time{}
+			r.timings.Reused = false
+		},
+		gotConn: func(_ net.Conn, reused bool) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.timings.Reused = reused
+		},
+	}
+}
+
+// endProxyConnect ends a pending proxy connect, r.mu is held
+func (r *timingRecorder) endProxyConnect() {
+	if !r.proxyStart.IsZero() {
+		r.timings.ProxyConnect += since(r.proxyStart)
+		r.proxyStart = time.Time{}
+	}
+}
+
+// finish returns the timings of a request whose final response headers were read at headers and whose body was
+// read now, the zero timings if r is nil
+func (r *timingRecorder) finish(headers time.Time) Timings {
+	if r == nil {
+		return Timings{}
+	}
+	end := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// transports without first byte event report the first byte when the response headers were read
+	firstByte := r.firstByte
+	if firstByte.IsZero() {
+		firstByte = headers
+	}
+
+	timings := r.timings
+	timings.FirstByte = firstByte.Sub(r.start)
+	timings.Transfer = end.Sub(firstByte)
+	timings.Total = end.Sub(r.start)
+	return timings
+}
+
+// since returns the time since start, zero if start is not set
+func since(start time.Time) time.Duration {
+	if start.IsZero() {
+		return 0
+	}
+	return time.Since(start)
+}
+
+// Timings returns the durations of the phases of the request
+func (r *Response) Timings() Timings {
+	return r.timings
+}
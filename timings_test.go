@@ -0,0 +1,135 @@
+package cclient_v2
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+// timingsDelay is how long the server waits before the response headers and before the end of the body
+const timingsDelay = 50 * time.Millisecond
+
+func TestTimings(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		time.Sleep(timingsDelay)
+		_, _ = w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		time.Sleep(timingsDelay)
+		_, _ = w.Write([]byte("last"))
+	}))
+	// the certificate of the echo server is valid for localhost, which is looked up
+	certificates := fingerprinttest.NewUnstartedServer()
+	srv.TLS = &tls.Config{Certificates: certificates.TLS.Certificates}
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: certificates.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	url := "https://localhost:" + port
+
+	for _, test := range []struct {
+		name   string
+		path   string
+		reused bool
+	}{
+		{"new connection", "/", false},
+		{"reused connection", "/", true},
+		{"redirect", "/redirect", true},
+	} {
+		resp, err := c.NewRequest().SetURL(url + test.path).Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body()) != "firstlast" {
+			t.Fatalf("%s: body %q", test.name, resp.Body())
+		}
+
+		timings := resp.Timings()
+		if timings.Reused != test.reused {
+			t.Errorf("%s: reused %v, want %v", test.name, timings.Reused, test.reused)
+		}
+		if test.reused {
+			if timings.DNS != 0 || timings.Connect != 0 || timings.TLSHandshake != 0 {
+				t.Errorf("%s: got %+v, want no connection phases", test.name, timings)
+			}
+		} else if timings.DNS <= 0 || timings.Connect <= 0 || timings.TLSHandshake <= 0 {
+			t.Errorf("%s: got %+v, want dns, connect and tls handshake phases", test.name, timings)
+		}
+		if timings.ProxyConnect != 0 {
+			t.Errorf("%s: proxy connect %v without proxy", test.name, timings.ProxyConnect)
+		}
+		// the delays are measured by the server, they are compared with some slack
+		if timings.FirstByte < timingsDelay/2+timings.DNS+timings.Connect+timings.TLSHandshake {
+			t.Errorf("%s: first byte %v, want the delay and the connection phases of %+v", test.name, timings.FirstByte, timings)
+		}
+		if timings.Transfer < timingsDelay/2 {
+			t.Errorf("%s: transfer %v, want about %v", test.name, timings.Transfer, timingsDelay)
+		}
+		if timings.Total != timings.FirstByte+timings.Transfer {
+			t.Errorf("%s: total %v, want first byte and transfer %v", test.name, timings.Total, timings.FirstByte+timings.Transfer)
+		}
+	}
+}
+
+func TestTimingsRedial(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	certificates := fingerprinttest.NewUnstartedServer()
+	srv.TLS = &tls.Config{Certificates: certificates.TLS.Certificates}
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: certificates.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var log eventLog
+	c.AddHooks(log.hooks(""))
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	url := "https://localhost:" + port
+
+	if _, err = c.NewRequest().SetURL(url).Do(); err != nil {
+		t.Fatal(err)
+	}
+	// the http2 transport of the origin dials the next connection itself
+	srv.CloseClientConnections()
+	time.Sleep(50 * time.Millisecond)
+	log.take()
+
+	resp, err := c.NewRequest().SetURL(url).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timings := resp.Timings()
+	if timings.Reused || timings.Connect <= 0 || timings.TLSHandshake <= 0 {
+		t.Errorf("got %+v, want the connect and tls handshake phases of a new connection", timings)
+	}
+	if info := resp.ConnInfo(); info.JA3 == "" || info.Protocol != "h2" {
+		t.Errorf("conn info: got %s with ja3 %q, want h2 with the ja3 of the new connection", info.Protocol, info.JA3)
+	}
+	var handshakes int
+	for _, event := range log.take() {
+		if event == "tls start localhost" {
+			handshakes++
+		}
+	}
+	if handshakes != 1 {
+		t.Errorf("hooks: got %d tls handshakes, want 1", handshakes)
+	}
+}
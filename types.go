@@ -6,50 +6,81 @@ import (
 	"net/http"
 	"net/textproto"
 	"net/url"
+	"sync"
+	"time"
 
 	tlsUtls "github.com/refraction-networking/utls"
-	tlsHttp "github.com/useflyent/fhttp"
 	"github.com/useflyent/fhttp/http2"
 )
 
 type Client struct {
+	mu                sync.RWMutex
 	Context           context.Context
 	proxy             string
 	useTLS            bool
+	timeout           time.Duration
 	MasterHeaderOrder []string
 	http2Headers      map[http2.SettingID]uint32
-	tlsClient         *tlsHttp.Client
+	http2Priority     HTTP2Priority
+	http2Fingerprint  *HTTP2Fingerprint
+	http3             *HTTP3
 	clientHello       tlsUtls.ClientHelloID
-	httpClient        *http.Client
+	clientHelloSpec   *ClientHelloSpec
+	randomization     Randomization
+	sessionCache      *SessionCache
+	altSvc            *AltSvcCache
+	verification      TLSVerification
+	clientCerts       ClientCertificates
+	keyLog            io.Writer
+	backend           *sharedBackend
+	jar               *cookieJar
+	cookieTracker     *cookieTracker
+	cookieObservers   *cookieObservers
+	closed            bool
+	interceptors      *interceptors
 }
 
 // Request base request struct
 type Request struct {
-	useTLS      bool
-	Context     context.Context
-	HeaderOrder []string
-	TLSRequest  TLSRequest
-	HTTPRequest HTTPRequest
-}
-
-// TLSRequest tls request struct
-type TLSRequest struct {
-	client            *Client
-	method, url, host string
-	header            tlsHttp.Header
-	body              io.Reader
-	cookies           []*tlsHttp.Cookie
-}
-
-// HTTPRequest non-tls request struct
-type HTTPRequest struct {
 	client            *Client
+	Context           context.Context
+	HeaderOrder       []string
 	method, url, host string
 	header            http.Header
 	body              io.Reader
 	cookies           []*http.Cookie
+	cookieMode        CookieMode
+	http2Priority     *http2.PriorityParam
+	sent              *wireRequest
+
+	// Deprecated: requests of tls and non tls clients are built by the methods of Request, TLSRequest is not used
+	TLSRequest TLSRequest
+	// Deprecated: requests of tls and non tls clients are built by the methods of Request, HTTPRequest is not used
+	HTTPRequest HTTPRequest
 }
 
+// TLSRequest tls request struct
+//
+// Deprecated: requests of tls clients are built by the methods of Request
+type TLSRequest struct{}
+
+// HTTPRequest non-tls request struct
+//
+// Deprecated: requests of non tls clients are built by the methods of Request
+type HTTPRequest struct{}
+
+// CookieMode controls how a request uses the client cookie jar
+type CookieMode int
+
+const (
+	// CookieModeJar sends cookies from the jar and stores response cookies in it, the default
+	CookieModeJar CookieMode = iota
+	// CookieModeNoStore sends cookies from the jar but does not store response cookies
+	CookieModeNoStore
+	// CookieModeIgnore neither sends cookies from the jar nor stores response cookies
+	CookieModeIgnore
+)
+
 // Response base response struct
 type Response struct {
 	request        *http.Request
@@ -61,6 +92,12 @@ type Response struct {
 	reqUrl         *url.URL
 	status         string
 	statusCode     int
+	proto          string
+	altSvc         *AltService
+	timings        Timings
+	conn           ConnInfo
+	sent           *wireRequest
+	received       []headerField
 }
 
 type Header map[string][]string
@@ -0,0 +1,162 @@
+package cclient_v2
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+
+	tlsUtls "github.com/refraction-networking/utls"
+)
+
+// TLSVerification controls how a client verifies the certificates of servers and of https proxies,
+// it is passed to NewClient as optional parameter and applies to tls and non tls clients.
+// The zero value verifies certificates against the system roots
+type TLSVerification struct {
+	// RootCAs verifies certificates against the pool instead of the system roots
+	RootCAs *x509.CertPool
+	// Pins maps hosts to the base64 encoded sha256 hashes of the subject public key info of certificates, optionally
+	// prefixed with "sha256/". A certificate chain of a pinned host needs a certificate matching one of its pins.
+	// A host starting with "*." matches the subdomains of the rest of the host.
+	// Non tls clients do not know the ip address of a connection without server name, the pins of all pinned addresses
+	// the verified certificate is valid for apply to it
+	Pins map[string][]string
+	// InsecureSkipVerify accepts any certificate, pins are then matched against the certificates the server sent
+	InsecureSkipVerify bool
+	// VerifyPeerCertificate is called for every connection after the certificate was verified and matched against the
+	// pins, verifiedChains are empty with InsecureSkipVerify. Resumed connections pass the certificates of the
+	// resumed session
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+}
+
+// CertificatePinError is returned when no certificate of a pinned host matches its pins
+type CertificatePinError struct {
+	Host string
+}
+
+func (e *CertificatePinError) Error() string {
+	return fmt.Sprintf("certificate of %s does not match its pins", e.Host)
+}
+
+// validate checks that the pins are sha256 hashes
+func (v TLSVerification) validate() error {
+	for host, pins := range v.Pins {
+		for _, pin := range pins {
+			hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if err != nil || len(hash) != sha256.Size {
+				return fmt.Errorf("invalid pin %q of host %s", pin, host)
+			}
+		}
+	}
+	return nil
+}
+
+// tlsConfig returns the crypto/tls config of the non tls backend and of https proxies
+func (v TLSVerification) tlsConfig() *tls.Config {
+	return &tls.Config{
+		RootCAs:            v.RootCAs,
+		InsecureSkipVerify: v.InsecureSkipVerify,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if state.ServerName == "" {
+				return v.verifyAddress(state.PeerCertificates, state.VerifiedChains)
+			}
+			return v.verify(state.ServerName, state.PeerCertificates, state.VerifiedChains)
+		},
+	}
+}
+
+// utlsConfig returns the utls config of a connection to host
+func (v TLSVerification) utlsConfig(host string) *tlsUtls.Config {
+	return &tlsUtls.Config{
+		ServerName:         host,
+		RootCAs:            v.RootCAs,
+		InsecureSkipVerify: v.InsecureSkipVerify,
+		VerifyConnection: func(state tlsUtls.ConnectionState) error {
+			return v.verify(host, state.PeerCertificates, state.VerifiedChains)
+		},
+	}
+}
+
+// verify matches the certificates of a connection against the pins of host and calls VerifyPeerCertificate
+func (v TLSVerification) verify(host string, certificates []*x509.Certificate, chains [][]*x509.Certificate) error {
+	return v.verifyPins(host, v.pins(host), certificates, chains)
+}
+
+// verifyAddress verifies a crypto/tls connection to an ip address, it sends no server name and the address is unknown.
+// The pins of the pinned addresses the verified certificate is valid for apply, without verification all pins of
+// addresses apply
+func (v TLSVerification) verifyAddress(certificates []*x509.Certificate, chains [][]*x509.Certificate) error {
+	var hosts []string
+	var pins []string
+	for host, p := range v.Pins {
+		if net.ParseIP(host) == nil {
+			continue
+		}
+		if len(chains) > 0 && chains[0][0].VerifyHostname(host) != nil {
+			continue
+		}
+		hosts = append(hosts, host)
+		pins = append(pins, p...)
+	}
+	return v.verifyPins(strings.Join(hosts, ", "), pins, certificates, chains)
+}
+
+// verifyPins matches the certificates of a connection against pins and calls VerifyPeerCertificate
+func (v TLSVerification) verifyPins(host string, pins []string, certificates []*x509.Certificate, chains [][]*x509.Certificate) error {
+	if len(pins) > 0 {
+		candidates := certificates
+		if len(chains) > 0 {
+			candidates = nil
+			for _, chain := range chains {
+				candidates = append(candidates, chain...)
+			}
+		}
+		if !matchesPin(candidates, pins) {
+			return &CertificatePinError{Host: host}
+		}
+	}
+
+	if v.VerifyPeerCertificate == nil {
+		return nil
+	}
+	raw := make([][]byte, len(certificates))
+	for i, certificate := range certificates {
+		raw[i] = certificate.Raw
+	}
+	return v.VerifyPeerCertificate(raw, chains)
+}
+
+// pins returns the pins of host, of the host itself and of wildcards matching it
+func (v TLSVerification) pins(host string) []string {
+	var pins []string
+	for pattern, p := range v.Pins {
+		if matchesHost(pattern, host) {
+			pins = append(pins, p...)
+		}
+	}
+	return pins
+}
+
+// matchesHost reports whether pattern is host or a wildcard starting with "*." matching a subdomain of the rest of it
+func matchesHost(pattern, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	return pattern == host || strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])
+}
+
+// matchesPin reports whether the subject public key info of one of the certificates matches one of the pins
+func matchesPin(certificates []*x509.Certificate, pins []string) bool {
+	for _, certificate := range certificates {
+		sum := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		hash := base64.StdEncoding.EncodeToString(sum[:])
+		for _, pin := range pins {
+			if strings.TrimPrefix(pin, "sha256/") == hash {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package cclient_v2
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+// certificatePin returns the pin of the certificate of srv
+func certificatePin(srv *fingerprinttest.Server) string {
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// serveTLSProxy starts an https proxy with the certificate of srv tunneling CONNECT requests
+func serveTLSProxy(t *testing.T, srv *fingerprinttest.Server) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go tunnel(tls.NewListener(ln, &tls.Config{Certificates: srv.TLS.Certificates, NextProtos: []string{"http/1.1"}}))
+	return ln
+}
+
+// serveProxy starts an http proxy tunneling CONNECT requests
+func serveProxy(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go tunnel(ln)
+	return ln
+}
+
+// tunnel serves CONNECT requests of the connections accepted by ln until it is closed
+func tunnel(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			req, err := http.ReadRequest(br)
+			if err != nil || req.Method != http.MethodConnect {
+				return
+			}
+			target, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+				return
+			}
+			defer target.Close()
+			if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(target, br) }()
+			_, _ = io.Copy(conn, target)
+		}()
+	}
+}
+
+// verificationClients creates a tls and a non tls client with the verification
+func verificationClients(t *testing.T, proxyUrl string, verification TLSVerification) map[string]*Client {
+	clients := make(map[string]*Client)
+	for name, useTLS := range map[string]bool{"tls": true, "plain": false} {
+		params := []interface{}{verification}
+		if useTLS {
+			params = []interface{}{tlsUtls.HelloChrome_102, verification}
+		}
+		c, err := NewClient(proxyUrl, 5*time.Second, useTLS, params...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		clients[name] = c
+	}
+	return clients
+}
+
+// checkVerificationError checks that err is nil if want is empty and a pin error of host want or an error containing
+// want otherwise
+func checkVerificationError(t *testing.T, err error, want string) {
+	t.Helper()
+
+	var pinErr *CertificatePinError
+	switch {
+	case want == "":
+		if err != nil {
+			t.Errorf("got %v, want no error", err)
+		}
+	case strings.HasPrefix(want, "pin "):
+		if !errors.As(err, &pinErr) || pinErr.Host != strings.TrimPrefix(want, "pin ") {
+			t.Errorf("got %v, want a pin error of %s", err, strings.TrimPrefix(want, "pin "))
+		}
+	case err == nil || !strings.Contains(err.Error(), want):
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestTLSVerification(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+	other := fingerprinttest.NewUnstartedServer()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	errPeer := errors.New("rejected by callback")
+	tests := []struct {
+		name         string
+		url          string
+		verification TLSVerification
+		err          string
+	}{
+		{"system roots", srv.URL, TLSVerification{}, "certificate"},
+		{"custom roots", srv.URL, TLSVerification{RootCAs: srv.CertPool()}, ""},
+		{"roots of another server", srv.URL, TLSVerification{RootCAs: other.CertPool()}, "certificate"},
+		{"matching pin", "https://localhost:" + port, TLSVerification{RootCAs: srv.CertPool(),
+			Pins: map[string][]string{"localhost": {"sha256/" + certificatePin(other), "sha256/" + certificatePin(srv)}}}, ""},
+		{"other pin", "https://localhost:" + port, TLSVerification{RootCAs: srv.CertPool(),
+			Pins: map[string][]string{"localhost": {certificatePin(other)}}}, "pin localhost"},
+		{"pin of another host", "https://localhost:" + port, TLSVerification{RootCAs: srv.CertPool(),
+			Pins: map[string][]string{"example.com": {certificatePin(other)}}}, ""},
+		{"wildcard pin", "https://localhost:" + port, TLSVerification{RootCAs: srv.CertPool(),
+			Pins: map[string][]string{"*.localhost": {certificatePin(other)}}}, ""},
+		{"pin of an address", srv.URL, TLSVerification{RootCAs: srv.CertPool(),
+			Pins: map[string][]string{"127.0.0.1": {certificatePin(other)}}}, "pin 127.0.0.1"},
+		{"insecure", srv.URL, TLSVerification{InsecureSkipVerify: true}, ""},
+		{"insecure with other pin", "https://localhost:" + port, TLSVerification{InsecureSkipVerify: true,
+			Pins: map[string][]string{"localhost": {certificatePin(other)}}}, "pin localhost"},
+		{"insecure with matching pin", "https://localhost:" + port, TLSVerification{InsecureSkipVerify: true,
+			Pins: map[string][]string{"localhost": {certificatePin(srv)}}}, ""},
+		{"peer certificate callback", srv.URL, TLSVerification{RootCAs: srv.CertPool(),
+			VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error { return errPeer }}, errPeer.Error()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, c := range verificationClients(t, "", test.verification) {
+				_, err := c.NewRequest().SetURL(test.url).Do()
+				t.Run(name, func(t *testing.T) {
+					checkVerificationError(t, err, test.err)
+				})
+			}
+		})
+	}
+
+	if _, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102,
+		TLSVerification{Pins: map[string][]string{"localhost": {"sha1/abc"}}}); err == nil {
+		t.Error("got no error for an invalid pin")
+	}
+}
+
+func TestTLSVerificationProxy(t *testing.T) {
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+	other := fingerprinttest.NewUnstartedServer()
+
+	_, port, _ := net.SplitHostPort(serveTLSProxy(t, srv).Addr().String())
+	httpsProxy := "https://localhost:" + port
+	httpProxy := "http://" + serveProxy(t).Addr().String()
+
+	tests := []struct {
+		name         string
+		proxy        string
+		verification TLSVerification
+		err          string
+	}{
+		{"http proxy", httpProxy, TLSVerification{RootCAs: srv.CertPool()}, ""},
+		{"http proxy with other pin", httpProxy, TLSVerification{RootCAs: srv.CertPool(),
+			Pins: map[string][]string{"127.0.0.1": {certificatePin(other)}}}, "pin 127.0.0.1"},
+		{"https proxy", httpsProxy, TLSVerification{RootCAs: srv.CertPool()}, ""},
+		{"https proxy with system roots", httpsProxy, TLSVerification{}, "certificate"},
+		{"https proxy with other pin", httpsProxy, TLSVerification{RootCAs: srv.CertPool(),
+			Pins: map[string][]string{"localhost": {certificatePin(other)}}}, "pin localhost"},
+		{"https proxy with matching pin", httpsProxy, TLSVerification{RootCAs: srv.CertPool(),
+			Pins: map[string][]string{"localhost": {certificatePin(srv)}}}, ""},
+		{"insecure https proxy", httpsProxy, TLSVerification{InsecureSkipVerify: true}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, c := range verificationClients(t, test.proxy, test.verification) {
+				_, err := c.NewRequest().SetURL(srv.URL).Do()
+				t.Run(name, func(t *testing.T) {
+					checkVerificationError(t, err, test.err)
+				})
+			}
+		})
+	}
+}
+
+func TestSetTLSVerificationClosesConnections(t *testing.T) {
+	certificates := fingerprinttest.NewUnstartedServer()
+	closed := make(chan struct{}, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: certificates.TLS.Certificates}
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	for name, c := range verificationClients(t, "", TLSVerification{RootCAs: certificates.CertPool()}) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := c.NewRequest().SetURL(srv.URL).Do(); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.SetTLSVerification(TLSVerification{InsecureSkipVerify: true}); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("idle connection of the replaced backend was not closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,835 @@
+package cclient_v2
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	tlsHttp "github.com/useflyent/fhttp"
+)
+
+// MessageType is the type of a websocket message
+type MessageType int
+
+const (
+	// TextMessage is a message of utf-8 text
+	TextMessage MessageType = 1
+	// BinaryMessage is a message of binary data
+	BinaryMessage MessageType = 2
+)
+
+// Close codes of websocket close frames
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseInternalServerErr       = 1011
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	// wsAcceptGUID is appended to the key of the handshake to compute the accept header of the server
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// wsDefaultReadLimit is the largest message read unless SetReadLimit is called
+	wsDefaultReadLimit = 32 << 20
+	// wsCloseTimeout is how long Close waits for the peer to answer the close frame
+	wsCloseTimeout = 5 * time.Second
+	// wsDeflateWindow is the size of the window of permessage-deflate
+	wsDeflateWindow = 32 << 10
+	// wsDeflateTail terminates a compressed message, the flush marker the sender removed and an empty final block
+	wsDeflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+)
+
+// defaultWebSocketHeaderOrder is the header order of the websocket handshakes of chrome
+var defaultWebSocketHeaderOrder = []string{
+	"host",
+	"connection",
+	"pragma",
+	"cache-control",
+	"user-agent",
+	"upgrade",
+	"origin",
+	"sec-websocket-version",
+	"accept-encoding",
+	"accept-language",
+	"cookie",
+	"sec-websocket-key",
+	"sec-websocket-extensions",
+	"sec-websocket-protocol",
+}
+
+// ErrWebSocketCloseSent is returned when writing a message after the close frame was sent
+var ErrWebSocketCloseSent = errors.New("websocket close frame sent")
+
+// CloseError is returned by ReadMessage once the peer closed the websocket
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("websocket closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed with code %d: %s", e.Code, e.Text)
+}
+
+// WebSocketHandshakeError is returned by DialWebSocket when the server did not accept the websocket
+type WebSocketHandshakeError struct {
+	// Response is the response of the server, its body is read
+	Response *Response
+	reason   string
+}
+
+func (e *WebSocketHandshakeError) Error() string {
+	return fmt.Sprintf("websocket handshake failed with status %d: %s", e.Response.StatusCode(), e.reason)
+}
+
+// WebSocket is a websocket connection of a client. Messages are read by one goroutine at a time and written by any,
+// pings of the peer are answered when messages are read
+type WebSocket struct {
+	conn     io.ReadWriteCloser
+	br       *bufio.Reader
+	client   bool
+	response *Response
+
+	subprotocol     string
+	deflate         bool
+	compress        bool
+	contextTakeover bool
+	window          []byte
+
+	rmu         sync.Mutex
+	readLimit   int64
+	readErr     error
+	done        chan struct{}
+	pongHandler func(data []byte)
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// DialWebSocket opens a websocket to a ws or wss url, the handshake is sent with the headers in their header order
+// and the cookies of the jar and response cookies are stored in the jar.
+// Wss connections are made with the client hello and proxy of the client. If the server negotiates http2 and allows
+// websockets over http2 the websocket is a stream of an http2 connection of its own, otherwise the connection is made
+// again offering only http/1.1 in the alpn extension, like browsers do.
+// A header order set with the tlsHttp.HeaderOrderKey of headers overrides the master header order of the client.
+// Permessage-deflate is offered unless headers set Sec-WebSocket-Extensions, an empty value offers no extensions
+func (c *Client) DialWebSocket(ctx context.Context, rawURL string, headers http.Header) (*WebSocket, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "ws", "http":
+		u.Scheme = "http"
+	case "wss", "https":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("invalid websocket URL scheme: [%v]", u.Scheme)
+	}
+
+	c.mu.RLock()
+	b := c.backend
+	masterHeaderOrder := c.MasterHeaderOrder
+	c.mu.RUnlock()
+
+	f, ok := b.backend.(*fhttpBackend)
+	if !ok {
+		return nil, errors.New("websockets need a tls client")
+	}
+	rt, ok := f.transport.(*roundTripper)
+	if !ok {
+		return nil, errors.New("websockets need a tls client")
+	}
+
+	_, hooks := c.interceptors.snapshot()
+	ctx = withTrace(withTimings(withHooks(ctx, hooks)), u.Hostname())
+	req := &preparedRequest{ctx: ctx, method: http.MethodGet, url: u, pHeaderOrder: rt.fingerprint.PseudoHeaderOrder}
+	req.setHeader(headers)
+	if len(req.headerOrder) == 0 {
+		req.headerOrder = masterHeaderOrder
+	}
+	if len(req.headerOrder) == 0 {
+		req.headerOrder = defaultWebSocketHeaderOrder
+	}
+	req.cookies = extractCookies(req.header)
+
+	cookies := &cookieHandler{jar: c.jar, cookies: req.cookies, host: u.Hostname()}
+	if value := cookies.header(u); value != "" {
+		req.header.Set("Cookie", value)
+	}
+	if extensions := headerValues(req.header, "Sec-WebSocket-Extensions"); extensions == nil {
+		setHeader(req.header, "Sec-WebSocket-Extensions", "permessage-deflate; client_max_window_bits")
+	} else if strings.Join(extensions, "") == "" {
+		deleteHeader(req.header, "Sec-WebSocket-Extensions")
+	}
+	setHeader(req.header, "Sec-WebSocket-Version", "13")
+
+	ws, resp, err := rt.dialWebSocket(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.conn.Proxy = f.proxy
+
+	if rc := (&http.Response{Header: resp.header}).Cookies(); len(rc) > 0 && cookies.stores() {
+		cookies.store(u, rc, &http.Response{StatusCode: resp.statusCode, Header: resp.header, Body: http.NoBody})
+	}
+	response, err := newResponse(req, resp)
+	if err != nil {
+		if ws != nil {
+			_ = ws.conn.Close()
+		}
+		return nil, err
+	}
+
+	if ws == nil {
+		return nil, &WebSocketHandshakeError{Response: response, reason: "server did not switch protocols"}
+	}
+	if err := ws.negotiate(req.header, http.Header(response.Header())); err != nil {
+		_ = ws.conn.Close()
+		return nil, &WebSocketHandshakeError{Response: response, reason: err.Error()}
+	}
+	ws.response = response
+	return ws, nil
+}
+
+// dialWebSocket opens the connection of a websocket and sends its handshake, the websocket is nil if the server
+// did not accept it
+func (rt *roundTripper) dialWebSocket(req *preparedRequest) (*WebSocket, *backendResponse, error) {
+	addr := rt.getDialTLSAddr(&tlsHttp.Request{URL: req.url})
+	if req.url.Scheme == "http" {
+		if _, _, err := net.SplitHostPort(req.url.Host); err != nil {
+			addr = net.JoinHostPort(req.url.Host, "80")
+		}
+		conn, err := rt.dialer.DialContext(req.ctx, "tcp", addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return webSocketHTTP1(conn, req)
+	}
+
+	conn, err := rt.handshake(req.ctx, "tcp", addr, addr, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol == "h2" {
+		stream, resp, err := openHTTP2WebSocket(conn, rt.fingerprint, rt.priority, req)
+		if resp != nil {
+			resp.conn = newConnInfo(conn, 2)
+		}
+		if err != errExtendedConnectUnsupported {
+			if err != nil || resp.statusCode != http.StatusOK {
+				_ = conn.Close()
+				return nil, resp, err
+			}
+			return newWebSocket(stream, bufio.NewReader(stream), true), resp, nil
+		}
+		_ = conn.Close()
+
+		if conn, err = rt.handshake(req.ctx, "tcp", addr, addr, []string{"http/1.1"}); err != nil {
+			return nil, nil, err
+		}
+	}
+	return webSocketHTTP1(conn, req)
+}
+
+// webSocketHTTP1 sends the upgrade request of a websocket over an http/1.1 connection
+func webSocketHTTP1(conn net.Conn, req *preparedRequest) (*WebSocket, *backendResponse, error) {
+	stop := closeOnDone(req.ctx, conn)
+	ws, resp, err := upgradeHTTP1(conn, req)
+	if !stop() && err == nil {
+		err = req.ctx.Err()
+	}
+	if err != nil || ws == nil {
+		_ = conn.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return ws, resp, nil
+}
+
+// upgradeHTTP1 writes the upgrade request and reads the response
+func upgradeHTTP1(conn net.Conn, req *preparedRequest) (*WebSocket, *backendResponse, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+
+	header := req.header.Clone()
+	setHeader(header, "Connection", "Upgrade")
+	setHeader(header, "Upgrade", "websocket")
+	setHeader(header, "Sec-WebSocket-Key", encodedKey)
+	prepared := *req
+	prepared.header = header
+
+	r := &tlsHttp.Request{
+		Method:     http.MethodGet,
+		URL:        req.url,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       req.url.Host,
+	}
+	var host string
+	r.Header, host = prepared.fhttpHeader()
+	if len(req.host) > 0 {
+		r.Host = req.host
+	} else if len(host) > 0 {
+		r.Host = host
+	}
+
+	if err := r.Write(conn); err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := tlsHttp.ReadResponse(br, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backendResp := &backendResponse{
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+		header:     http.Header(resp.Header),
+		body:       http.NoBody,
+		url:        req.url,
+		proto:      resp.Proto,
+		conn:       newConnInfo(conn, 1),
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return nil, nil, err
+		}
+		backendResp.body = io.NopCloser(bytes.NewReader(body))
+		return nil, backendResp, nil
+	}
+
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || !headerContains(http.Header(resp.Header), "Connection", "upgrade") {
+		return nil, backendResp, errors.New("websocket handshake response does not upgrade the connection")
+	}
+	sum := sha1.Sum([]byte(encodedKey + wsAcceptGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, backendResp, errors.New("websocket handshake response has an invalid Sec-WebSocket-Accept header")
+	}
+	return newWebSocket(conn, br, true), backendResp, nil
+}
+
+// closeOnDone closes conn when ctx is done until stop is called, stop reports whether ctx was not done before
+func closeOnDone(ctx context.Context, conn io.Closer) (stop func() bool) {
+	finished := make(chan struct{})
+	result := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+			result <- false
+		case <-finished:
+			result <- true
+		}
+	}()
+	return func() bool {
+		close(finished)
+		return <-result
+	}
+}
+
+// headerValues returns the values of the keys of header matching key in any case, handshake headers are sent with
+// the case of their keys
+func headerValues(header http.Header, key string) []string {
+	var values []string
+	for k, v := range header {
+		if strings.EqualFold(k, key) {
+			values = append(values, v...)
+		}
+	}
+	return values
+}
+
+// setHeader sets a handshake header, keeping the case of the key it already has
+func setHeader(header http.Header, key, value string) {
+	for k := range header {
+		if strings.EqualFold(k, key) {
+			delete(header, k)
+			key = k
+		}
+	}
+	header[key] = []string{value}
+}
+
+// deleteHeader deletes a handshake header in any case
+func deleteHeader(header http.Header, key string) {
+	for k := range header {
+		if strings.EqualFold(k, key) {
+			delete(header, k)
+		}
+	}
+}
+
+// headerContains reports whether a comma separated header contains token
+func headerContains(header http.Header, key, token string) bool {
+	for _, v := range headerValues(header, key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newWebSocket(conn io.ReadWriteCloser, br *bufio.Reader, client bool) *WebSocket {
+	return &WebSocket{
+		conn:      conn,
+		br:        br,
+		client:    client,
+		readLimit: wsDefaultReadLimit,
+		done:      make(chan struct{}),
+	}
+}
+
+// negotiate applies the subprotocol and extensions the server accepted
+func (ws *WebSocket) negotiate(request, response http.Header) error {
+	ws.subprotocol = response.Get("Sec-WebSocket-Protocol")
+	if ws.subprotocol != "" && !headerContains(request, "Sec-WebSocket-Protocol", ws.subprotocol) {
+		return fmt.Errorf("server selected the subprotocol %s that was not offered", ws.subprotocol)
+	}
+
+	for _, v := range response.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(v, ",") {
+			params := strings.Split(extension, ";")
+			name := strings.TrimSpace(params[0])
+			if name == "" {
+				continue
+			}
+			if name != "permessage-deflate" || !offersExtension(request, name) || ws.deflate {
+				return fmt.Errorf("server accepted the extension %s that was not offered", name)
+			}
+
+			ws.deflate, ws.compress, ws.contextTakeover = true, true, true
+			for _, param := range params[1:] {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				switch strings.TrimSpace(key) {
+				case "server_no_context_takeover":
+					ws.contextTakeover = false
+				case "client_no_context_takeover", "server_max_window_bits":
+				case "client_max_window_bits":
+					// compress/flate always uses the full window, messages are sent uncompressed if it is smaller
+					if bits, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && bits < 15 {
+						ws.compress = false
+					}
+				default:
+					return fmt.Errorf("invalid permessage-deflate parameter %s", key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// offersExtension reports whether the handshake offered the extension
+func offersExtension(request http.Header, name string) bool {
+	for _, v := range headerValues(request, "Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(v, ",") {
+			offered, _, _ := strings.Cut(extension, ";")
+			if strings.EqualFold(strings.TrimSpace(offered), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Response returns the response of the server to the handshake
+func (ws *WebSocket) Response() *Response {
+	return ws.response
+}
+
+// Subprotocol returns the subprotocol the server selected, empty if it selected none
+func (ws *WebSocket) Subprotocol() string {
+	return ws.subprotocol
+}
+
+// SetReadLimit sets the size of the largest message read, larger messages close the websocket
+func (ws *WebSocket) SetReadLimit(limit int64) {
+	ws.rmu.Lock()
+	defer ws.rmu.Unlock()
+
+	ws.readLimit = limit
+}
+
+// SetPongHandler sets the function called with the data of pongs when messages are read
+func (ws *WebSocket) SetPongHandler(handler func(data []byte)) {
+	ws.rmu.Lock()
+	defer ws.rmu.Unlock()
+
+	ws.pongHandler = handler
+}
+
+// ReadMessage reads the next message, a *CloseError is returned once the peer closed the websocket
+func (ws *WebSocket) ReadMessage() (MessageType, []byte, error) {
+	ws.rmu.Lock()
+	defer ws.rmu.Unlock()
+
+	return ws.readMessage()
+}
+
+// readMessage reads the next message, ws.rmu is held
+func (ws *WebSocket) readMessage() (MessageType, []byte, error) {
+	if ws.readErr != nil {
+		return 0, nil, ws.readErr
+	}
+
+	var typ MessageType
+	var data []byte
+	var compressed bool
+	for {
+		fin, rsv1, op, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, ws.fail(CloseProtocolError, err)
+		}
+
+		switch op {
+		case wsOpPing:
+			if err := ws.writeControl(wsOpPong, payload); err != nil && err != ErrWebSocketCloseSent {
+				return 0, nil, ws.fail(0, err)
+			}
+			continue
+		case wsOpPong:
+			if ws.pongHandler != nil {
+				ws.pongHandler(payload)
+			}
+			continue
+		case wsOpClose:
+			return 0, nil, ws.receiveClose(payload)
+		case wsOpText, wsOpBinary:
+			if typ != 0 {
+				return 0, nil, ws.fail(CloseProtocolError, errors.New("websocket message started before the last one ended"))
+			}
+			typ, compressed = MessageType(op), rsv1
+		case wsOpContinuation:
+			if typ == 0 {
+				return 0, nil, ws.fail(CloseProtocolError, errors.New("websocket continuation frame without message"))
+			}
+		default:
+			return 0, nil, ws.fail(CloseProtocolError, fmt.Errorf("websocket frame with reserved opcode %d", op))
+		}
+		if rsv1 && (op == wsOpContinuation || !ws.deflate) {
+			return 0, nil, ws.fail(CloseProtocolError, errors.New("websocket frame with reserved bit set"))
+		}
+
+		data = append(data, payload...)
+		if int64(len(data)) > ws.readLimit {
+			return 0, nil, ws.fail(CloseMessageTooBig, errors.New("websocket message larger than the read limit"))
+		}
+		if fin {
+			break
+		}
+	}
+
+	if compressed {
+		var err error
+		if data, err = ws.decompress(data); err != nil {
+			return 0, nil, ws.fail(CloseMessageTooBig, err)
+		}
+	}
+	if typ == TextMessage && !utf8.Valid(data) {
+		return 0, nil, ws.fail(CloseInvalidFramePayloadData, errors.New("websocket text message is not valid utf-8"))
+	}
+	return typ, data, nil
+}
+
+// readFrame reads a frame, control frames are checked for their size and fragmentation
+func (ws *WebSocket) readFrame() (fin, rsv1 bool, op byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(ws.br, header[:]); err != nil {
+		return
+	}
+	fin, rsv1, op = header[0]&0x80 != 0, header[0]&0x40 != 0, header[0]&0x0f
+	if header[0]&0x30 != 0 {
+		err = errors.New("websocket frame with reserved bit set")
+		return
+	}
+	masked := header[1]&0x80 != 0
+	if masked == ws.client {
+		err = errors.New("websocket frame with invalid masking")
+		return
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(ws.br, b[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(ws.br, b[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if op >= wsOpClose && (length > 125 || !fin) {
+		err = errors.New("websocket control frame is too large or fragmented")
+		return
+	}
+	if length > uint64(ws.readLimit) {
+		err = errors.New("websocket frame larger than the read limit")
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(ws.br, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.br, payload); err != nil {
+		return
+	}
+	if masked {
+		maskBytes(mask, payload)
+	}
+	return
+}
+
+// receiveClose answers the close frame of the peer and closes the connection
+func (ws *WebSocket) receiveClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Text = string(payload[2:])
+	}
+	if len(payload) == 1 || !utf8.ValidString(closeErr.Text) {
+		return ws.fail(CloseProtocolError, errors.New("websocket close frame is invalid"))
+	}
+
+	reply := CloseNormalClosure
+	if closeErr.Code != CloseNoStatusReceived {
+		reply = closeErr.Code
+	}
+	_ = ws.writeClose(reply, "")
+	_ = ws.conn.Close()
+	ws.setReadErr(closeErr)
+	return closeErr
+}
+
+// fail sends a close frame with code if it is not zero, closes the connection and returns err for all later reads
+func (ws *WebSocket) fail(code int, err error) error {
+	if code != 0 {
+		_ = ws.writeClose(code, "")
+	}
+	_ = ws.conn.Close()
+	ws.setReadErr(err)
+	return err
+}
+
+func (ws *WebSocket) setReadErr(err error) {
+	if ws.readErr == nil {
+		ws.readErr = err
+		close(ws.done)
+	}
+}
+
+// decompress inflates a permessage-deflate message, the window of earlier messages is kept with context takeover
+func (ws *WebSocket) decompress(data []byte) ([]byte, error) {
+	input := io.MultiReader(bytes.NewReader(data), strings.NewReader(wsDeflateTail))
+	r := flate.NewReaderDict(input, ws.window)
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, ws.readLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > ws.readLimit {
+		return nil, errors.New("websocket message larger than the read limit")
+	}
+
+	if ws.contextTakeover {
+		ws.window = append(ws.window, out...)
+		if len(ws.window) > wsDeflateWindow {
+			ws.window = append([]byte(nil), ws.window[len(ws.window)-wsDeflateWindow:]...)
+		}
+	}
+	return out, nil
+}
+
+// WriteMessage writes a message in a single frame, compressed if permessage-deflate was negotiated
+func (ws *WebSocket) WriteMessage(typ MessageType, data []byte) error {
+	if typ != TextMessage && typ != BinaryMessage {
+		return fmt.Errorf("invalid websocket message type %d", typ)
+	}
+
+	rsv1 := false
+	if ws.compress {
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+		data, rsv1 = bytes.TrimSuffix(buf.Bytes(), []byte{0x00, 0x00, 0xff, 0xff}), true
+	}
+
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	if ws.closeSent {
+		return ErrWebSocketCloseSent
+	}
+	return ws.writeFrame(byte(typ), rsv1, data)
+}
+
+// Ping sends a ping with data of at most 125 bytes, the pong of the peer is handed to the pong handler
+func (ws *WebSocket) Ping(data []byte) error {
+	return ws.writeControl(wsOpPing, data)
+}
+
+// writeControl writes a ping or pong frame
+func (ws *WebSocket) writeControl(op byte, data []byte) error {
+	if len(data) > 125 {
+		return errors.New("websocket control frame payload larger than 125 bytes")
+	}
+
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	if ws.closeSent {
+		return ErrWebSocketCloseSent
+	}
+	return ws.writeFrame(op, false, data)
+}
+
+// writeClose writes the close frame once
+func (ws *WebSocket) writeClose(code int, text string) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	if ws.closeSent {
+		return nil
+	}
+	ws.closeSent = true
+
+	payload := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, text...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	return ws.writeFrame(wsOpClose, false, payload)
+}
+
+// writeFrame writes a final frame, masked by clients, ws.wmu is held
+func (ws *WebSocket) writeFrame(op byte, rsv1 bool, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	b0 := 0x80 | op
+	if rsv1 {
+		b0 |= 0x40
+	}
+	frame = append(frame, b0)
+
+	var maskBit byte
+	if ws.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if !ws.client {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(mask, frame[start:])
+	}
+
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// Close sends a normal closure and closes the connection once the peer answered it or after five seconds.
+// Messages received meanwhile are discarded unless a ReadMessage is in progress
+func (ws *WebSocket) Close() error {
+	return ws.CloseWithCode(CloseNormalClosure, "")
+}
+
+// CloseWithCode sends a close frame with code and text and closes the connection once the peer answered it or after
+// five seconds. Messages received meanwhile are discarded unless a ReadMessage is in progress
+func (ws *WebSocket) CloseWithCode(code int, text string) error {
+	err := ws.writeClose(code, text)
+
+	timer := time.AfterFunc(wsCloseTimeout, func() { _ = ws.conn.Close() })
+	defer timer.Stop()
+
+	if ws.rmu.TryLock() {
+		for ws.readErr == nil {
+			_, _, _ = ws.readMessage()
+		}
+		ws.rmu.Unlock()
+	} else {
+		<-ws.done
+	}
+
+	if cerr := ws.conn.Close(); err == nil && cerr != nil && !errors.Is(cerr, net.ErrClosed) {
+		err = cerr
+	}
+	return err
+}
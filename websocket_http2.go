@@ -0,0 +1,512 @@
+package cclient_v2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/useflyent/fhttp/http2"
+	"github.com/useflyent/fhttp/http2/hpack"
+)
+
+const (
+	// http2SettingEnableConnectProtocol is the setting of servers accepting the extended CONNECT of rfc 8441
+	http2SettingEnableConnectProtocol http2.SettingID = 0x8
+	// http2DefaultWindow is the initial flow control window of http2 connections and streams
+	http2DefaultWindow = 65535
+	// http2RefundThreshold is how many read bytes are given back to the server with one WINDOW_UPDATE
+	http2RefundThreshold = 32 << 10
+	// http2MaxErrorBody is the largest body read of a refused websocket
+	http2MaxErrorBody = 1 << 20
+)
+
+// errExtendedConnectUnsupported is returned when an http2 server does not accept websockets over http2
+var errExtendedConnectUnsupported = errors.New("http2 server does not support extended connect")
+
+// http2ConnectionHeaders are the headers of http/1.1 handshakes that are not sent over http2
+var http2ConnectionHeaders = map[string]bool{
+	"connection":        true,
+	"host":              true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+	"sec-websocket-key": true,
+}
+
+// http2Stream is the stream of a websocket over an http2 connection of its own, like browsers only one websocket is
+// opened on the connection
+type http2Stream struct {
+	conn     net.Conn
+	framer   *http2.Framer
+	streamID uint32
+	wmu      sync.Mutex
+
+	mu               sync.Mutex
+	cond             *sync.Cond
+	buf              bytes.Buffer
+	unrefunded       uint32
+	sendWindow       int64
+	connSendWindow   int64
+	initialWindow    int64
+	maxFrameSize     uint32
+	ended            bool
+	err              error
+	settingsReceived bool
+}
+
+// openHTTP2WebSocket opens a websocket stream with the extended CONNECT of rfc 8441 on a tls connection that
+// negotiated http2, the connection starts like the http2 connections of the fingerprint. The stream is nil if the
+// server refused the websocket, errExtendedConnectUnsupported is returned if the server does not accept websockets
+// over http2
+func openHTTP2WebSocket(conn net.Conn, fingerprint *HTTP2Fingerprint, priority HTTP2Priority, req *preparedRequest) (*http2Stream, *backendResponse, error) {
+	stop := closeOnDone(req.ctx, conn)
+	s, resp, err := newHTTP2Stream(conn, fingerprint, priority, req)
+	if !stop() && err == nil {
+		err = req.ctx.Err()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, resp, nil
+}
+
+func newHTTP2Stream(conn net.Conn, fingerprint *HTTP2Fingerprint, priority HTTP2Priority, req *preparedRequest) (*http2Stream, *backendResponse, error) {
+	s := &http2Stream{
+		conn:           conn,
+		framer:         http2.NewFramer(conn, conn),
+		streamID:       1 + fingerprint.streamOffset(),
+		sendWindow:     http2DefaultWindow,
+		connSendWindow: http2DefaultWindow,
+		initialWindow:  http2DefaultWindow,
+		maxFrameSize:   16 << 10,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	tableSize := uint32(defaultHTTP2HeaderTableSize)
+	if v, ok := fingerprint.setting(http2.SettingHeaderTableSize); ok {
+		tableSize = v
+	}
+	s.framer.ReadMetaHeaders = hpack.NewDecoder(tableSize, nil)
+	if v, ok := fingerprint.setting(http2.SettingMaxHeaderListSize); ok {
+		s.framer.MaxHeaderListSize = v
+	}
+
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return nil, nil, err
+	}
+	if err := s.framer.WriteSettings(fingerprint.Settings...); err != nil {
+		return nil, nil, err
+	}
+	if fingerprint.WindowUpdate > 0 {
+		if err := s.framer.WriteWindowUpdate(0, fingerprint.WindowUpdate); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, p := range fingerprint.Priorities {
+		if err := s.framer.WritePriority(p.StreamID, p.Priority); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// the server announces extended connect in its first SETTINGS frame
+	for !s.settingsReceived {
+		frame, err := s.framer.ReadFrame()
+		if err != nil {
+			return nil, nil, err
+		}
+		if settings, ok := frame.(*http2.SettingsFrame); ok && !settings.IsAck() {
+			if v, ok := settings.Value(http2SettingEnableConnectProtocol); !ok || v != 1 {
+				return nil, nil, errExtendedConnectUnsupported
+			}
+		}
+		if err = s.handle(frame); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := s.writeHeaders(req, priority); err != nil {
+		return nil, nil, err
+	}
+
+	var resp *backendResponse
+	for resp == nil {
+		frame, err := s.framer.ReadFrame()
+		if err != nil {
+			return nil, nil, err
+		}
+		headers, ok := frame.(*http2.MetaHeadersFrame)
+		if !ok || headers.StreamID != s.streamID {
+			if err = s.handle(frame); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if resp, err = s.response(headers, req); err != nil {
+			return nil, nil, err
+		}
+		if resp.statusCode != http.StatusOK {
+			return nil, resp, s.readBody(resp, headers.StreamEnded())
+		}
+		if headers.StreamEnded() {
+			return nil, nil, errors.New("http2 server ended the websocket stream")
+		}
+	}
+
+	go s.readLoop()
+	return s, resp, nil
+}
+
+// writeHeaders writes the extended CONNECT of the websocket, pseudo headers are sent in the order of the fingerprint
+// followed by :protocol and headers in their header order
+func (s *http2Stream) writeHeaders(req *preparedRequest, priority HTTP2Priority) error {
+	host := req.host
+	if host == "" {
+		host = req.header.Get("Host")
+	}
+	if host == "" {
+		host = req.url.Host
+	}
+	path := req.url.RequestURI()
+
+	pseudo := map[string]string{":method": http.MethodConnect, ":authority": host, ":scheme": req.url.Scheme, ":path": path}
+	order := req.pHeaderOrder
+	if len(order) == 0 {
+		order = defaultPHeaderOrder
+	}
+
+	var fields []hpack.HeaderField
+	for _, k := range order {
+		if v, ok := pseudo[k]; ok {
+			fields = append(fields, hpack.HeaderField{Name: k, Value: v})
+			delete(pseudo, k)
+		}
+	}
+	for _, k := range []string{":method", ":authority", ":scheme", ":path"} {
+		if v, ok := pseudo[k]; ok {
+			fields = append(fields, hpack.HeaderField{Name: k, Value: v})
+		}
+	}
+	fields = append(fields, hpack.HeaderField{Name: ":protocol", Value: "websocket"})
+
+	header, _ := req.fhttpHeader()
+	written := make(map[string]bool)
+	writeHeader := func(k string) {
+		name := strings.ToLower(k)
+		if written[name] || http2ConnectionHeaders[name] {
+			return
+		}
+		written[name] = true
+		for key, values := range header {
+			if strings.ToLower(key) == name {
+				for _, v := range values {
+					fields = append(fields, hpack.HeaderField{Name: name, Value: v})
+				}
+			}
+		}
+	}
+	for _, k := range req.headerOrder {
+		writeHeader(k)
+	}
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		if !strings.HasSuffix(k, ":") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeHeader(k)
+	}
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	for _, f := range fields {
+		if err := encoder.WriteField(f); err != nil {
+			return err
+		}
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	param := http2.HeadersFrameParam{StreamID: s.streamID, EndHeaders: true}
+	if p, ok := priority.headers(fields); ok {
+		param.Priority = p
+	}
+
+	// header blocks larger than a frame continue in CONTINUATION frames
+	fragment := block.Bytes()
+	size := int(s.maxFrameSize)
+	if len(fragment) <= size {
+		param.BlockFragment = fragment
+		return s.framer.WriteHeaders(param)
+	}
+	param.BlockFragment, param.EndHeaders = fragment[:size], false
+	if err := s.framer.WriteHeaders(param); err != nil {
+		return err
+	}
+	for fragment = fragment[size:]; len(fragment) > 0; {
+		n := len(fragment)
+		if n > size {
+			n = size
+		}
+		if err := s.framer.WriteContinuation(s.streamID, n == len(fragment), fragment[:n]); err != nil {
+			return err
+		}
+		fragment = fragment[n:]
+	}
+	return nil
+}
+
+// response converts the response headers of the stream
+func (s *http2Stream) response(headers *http2.MetaHeadersFrame, req *preparedRequest) (*backendResponse, error) {
+	status := headers.PseudoValue("status")
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, fmt.Errorf("http2 response with invalid status %q", status)
+	}
+
+	header := make(http.Header)
+	for _, f := range headers.RegularFields() {
+		header.Add(f.Name, f.Value)
+	}
+	return &backendResponse{
+		status:     status + " " + http.StatusText(code),
+		statusCode: code,
+		header:     header,
+		body:       http.NoBody,
+		url:        req.url,
+		proto:      "HTTP/2.0",
+	}, nil
+}
+
+// readBody reads the body of a refused websocket
+func (s *http2Stream) readBody(resp *backendResponse, ended bool) error {
+	var body bytes.Buffer
+	for !ended {
+		frame, err := s.framer.ReadFrame()
+		if err != nil {
+			return err
+		}
+		switch f := frame.(type) {
+		case *http2.DataFrame:
+			if f.StreamID == s.streamID {
+				if body.Len()+len(f.Data()) > http2MaxErrorBody {
+					return errors.New("http2 response body too large")
+				}
+				body.Write(f.Data())
+				ended = f.StreamEnded()
+				continue
+			}
+		case *http2.MetaHeadersFrame:
+			if f.StreamID == s.streamID {
+				ended = f.StreamEnded()
+				continue
+			}
+		}
+		if err = s.handle(frame); err != nil {
+			return err
+		}
+	}
+	resp.body = io.NopCloser(&body)
+	return nil
+}
+
+// readLoop reads the frames of the connection until it fails
+func (s *http2Stream) readLoop() {
+	for {
+		frame, err := s.framer.ReadFrame()
+		if err == nil {
+			err = s.handle(frame)
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// fail fails the stream with the error of its connection, reads return it once the buffered data is read
+func (s *http2Stream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+// handle handles a frame of the connection
+func (s *http2Stream) handle(frame http2.Frame) error {
+	switch f := frame.(type) {
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			return nil
+		}
+		s.mu.Lock()
+		err := f.ForeachSetting(func(setting http2.Setting) error {
+			switch setting.ID {
+			case http2.SettingInitialWindowSize:
+				s.sendWindow += int64(setting.Val) - s.initialWindow
+				s.initialWindow = int64(setting.Val)
+			case http2.SettingMaxFrameSize:
+				s.maxFrameSize = setting.Val
+			}
+			return nil
+		})
+		s.settingsReceived = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		return s.write(func() error { return s.framer.WriteSettingsAck() })
+	case *http2.PingFrame:
+		if f.IsAck() {
+			return nil
+		}
+		return s.write(func() error { return s.framer.WritePing(true, f.Data) })
+	case *http2.WindowUpdateFrame:
+		s.mu.Lock()
+		if f.StreamID == 0 {
+			s.connSendWindow += int64(f.Increment)
+		} else if f.StreamID == s.streamID {
+			s.sendWindow += int64(f.Increment)
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	case *http2.DataFrame:
+		if f.StreamID != s.streamID {
+			return s.refund(0, f.Length)
+		}
+		if padding := f.Length - uint32(len(f.Data())); padding > 0 {
+			if err := s.refund(s.streamID, padding); err != nil {
+				return err
+			}
+		}
+		s.mu.Lock()
+		s.buf.Write(f.Data())
+		s.ended = s.ended || f.StreamEnded()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	case *http2.MetaHeadersFrame:
+		if f.StreamID == s.streamID && f.StreamEnded() {
+			s.mu.Lock()
+			s.ended = true
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		}
+	case *http2.RSTStreamFrame:
+		if f.StreamID == s.streamID {
+			return fmt.Errorf("http2 server reset the websocket stream: %v", f.ErrCode)
+		}
+	case *http2.GoAwayFrame:
+		if f.LastStreamID < s.streamID || f.ErrCode != http2.ErrCodeNo {
+			return fmt.Errorf("http2 server closed the connection: %v", f.ErrCode)
+		}
+	}
+	return nil
+}
+
+// refund gives n bytes back to the flow control window of the connection and of the stream if it is not zero
+func (s *http2Stream) refund(streamID, n uint32) error {
+	return s.write(func() error {
+		if err := s.framer.WriteWindowUpdate(0, n); err != nil || streamID == 0 {
+			return err
+		}
+		return s.framer.WriteWindowUpdate(streamID, n)
+	})
+}
+
+// write writes frames with the framer, s.wmu is not held
+func (s *http2Stream) write(f func() error) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	return f()
+}
+
+// Read reads the data of the stream and gives it back to the flow control windows once enough is read
+func (s *http2Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && !s.ended && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.buf.Len() == 0 {
+		err := s.err
+		if s.ended {
+			err = io.EOF
+		}
+		s.mu.Unlock()
+		return 0, err
+	}
+	n, _ := s.buf.Read(p)
+	s.unrefunded += uint32(n)
+	refund := s.unrefunded
+	if refund < http2RefundThreshold {
+		refund = 0
+	} else {
+		s.unrefunded = 0
+	}
+	s.mu.Unlock()
+
+	if refund > 0 {
+		if err := s.refund(s.streamID, refund); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Write writes p in DATA frames as the flow control windows of the server allow
+func (s *http2Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		s.mu.Lock()
+		for (s.sendWindow <= 0 || s.connSendWindow <= 0) && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		}
+		n := int64(len(p))
+		for _, limit := range []int64{s.sendWindow, s.connSendWindow, int64(s.maxFrameSize)} {
+			if n > limit {
+				n = limit
+			}
+		}
+		s.sendWindow -= n
+		s.connSendWindow -= n
+		s.mu.Unlock()
+
+		if err := s.write(func() error { return s.framer.WriteData(s.streamID, false, p[:n]) }); err != nil {
+			return written, err
+		}
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close ends the stream and closes the connection
+func (s *http2Stream) Close() error {
+	s.fail(net.ErrClosed)
+	_ = s.write(func() error {
+		if err := s.framer.WriteData(s.streamID, true, nil); err != nil {
+			return err
+		}
+		return s.framer.WriteGoAway(0, http2.ErrCodeNo, nil)
+	})
+	return s.conn.Close()
+}
@@ -0,0 +1,384 @@
+package cclient_v2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tlsUtls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/osnedaj/cclient-v2/fingerprinttest"
+)
+
+// webSocketServer accepts websockets with the certificate of a fingerprinttest server and echoes their messages.
+// It records the header names of the handshakes, pseudo headers included
+type webSocketServer struct {
+	url string
+
+	mu         sync.Mutex
+	handshakes [][]string
+}
+
+// serveWebSocket starts a websocket server, over http2 with the extended CONNECT of rfc 8441 if h2 is set
+func serveWebSocket(t *testing.T, srv *fingerprinttest.Server, h2 bool) *webSocketServer {
+	proto := "http/1.1"
+	if h2 {
+		proto = "h2"
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: srv.TLS.Certificates, NextProtos: []string{proto}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	s := &webSocketServer{url: "wss://" + ln.Addr().String() + "/socket"}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if h2 {
+					s.serveHTTP2(conn)
+				} else {
+					s.serveHTTP1(conn)
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *webSocketServer) record(names []string) {
+	s.mu.Lock()
+	s.handshakes = append(s.handshakes, names)
+	s.mu.Unlock()
+}
+
+// accept negotiates the extensions and subprotocol of a handshake and returns the headers of the response
+func (s *webSocketServer) accept(request http.Header) http.Header {
+	response := make(http.Header)
+	if offersExtension(request, "permessage-deflate") {
+		response.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+	}
+	if protocol := request.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		response.Set("Sec-WebSocket-Protocol", strings.TrimSpace(strings.Split(protocol, ",")[0]))
+	}
+	return response
+}
+
+// echo echoes the messages of a websocket until it is closed
+func echo(conn io.ReadWriteCloser, br *bufio.Reader, request, response http.Header) {
+	ws := newWebSocket(conn, br, false)
+	if err := ws.negotiate(request, response); err != nil {
+		return
+	}
+	for {
+		typ, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err = ws.WriteMessage(typ, data); err != nil {
+			return
+		}
+	}
+}
+
+func (s *webSocketServer) serveHTTP1(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	if _, err := br.ReadString('\n'); err != nil {
+		return
+	}
+	request := make(http.Header)
+	var names []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		names = append(names, name)
+		request.Add(name, strings.TrimSpace(value))
+	}
+	s.record(names)
+
+	sum := sha1.Sum([]byte(request.Get("Sec-WebSocket-Key") + wsAcceptGUID))
+	response := s.accept(request)
+	response.Set("Upgrade", "websocket")
+	response.Set("Connection", "Upgrade")
+	response.Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(sum[:]))
+
+	var head bytes.Buffer
+	head.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	_ = response.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := conn.Write(head.Bytes()); err != nil {
+		return
+	}
+	echo(conn, br, request, response)
+}
+
+// http2WebSocketConn is the server side of the stream of a websocket over http2, the server uses the framer of
+// golang.org/x/net which decodes the :protocol pseudo header
+type http2WebSocketConn struct {
+	*io.PipeReader
+	mu       *sync.Mutex
+	framer   *http2.Framer
+	streamID uint32
+}
+
+func (c *http2WebSocketConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.framer.WriteData(c.streamID, false, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *http2WebSocketConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_ = c.PipeReader.Close()
+	return c.framer.WriteData(c.streamID, true, nil)
+}
+
+func (s *webSocketServer) serveHTTP2(conn net.Conn) {
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil || string(preface) != http2.ClientPreface {
+		return
+	}
+	var mu sync.Mutex
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(defaultHTTP2HeaderTableSize, nil)
+	if err := framer.WriteSettings(http2.Setting{ID: http2.SettingEnableConnectProtocol, Val: 1}); err != nil {
+		return
+	}
+
+	var pw *io.PipeWriter
+	defer func() {
+		if pw != nil {
+			_ = pw.Close()
+		}
+	}()
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch frame := frame.(type) {
+		case *http2.SettingsFrame:
+			if !frame.IsAck() {
+				mu.Lock()
+				err = framer.WriteSettingsAck()
+				mu.Unlock()
+			}
+		case *http2.MetaHeadersFrame:
+			request := make(http.Header)
+			var names []string
+			for _, f := range frame.Fields {
+				names = append(names, f.Name)
+				if !f.IsPseudo() {
+					request.Add(f.Name, f.Value)
+				}
+			}
+			s.record(names)
+			if frame.PseudoValue("method") != http.MethodConnect || frame.PseudoValue("protocol") != "websocket" {
+				return
+			}
+
+			response := s.accept(request)
+			var block bytes.Buffer
+			encoder := hpack.NewEncoder(&block)
+			_ = encoder.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+			for k := range response {
+				_ = encoder.WriteField(hpack.HeaderField{Name: strings.ToLower(k), Value: response.Get(k)})
+			}
+			mu.Lock()
+			err = framer.WriteHeaders(http2.HeadersFrameParam{StreamID: frame.StreamID, BlockFragment: block.Bytes(), EndHeaders: true})
+			mu.Unlock()
+
+			var pr *io.PipeReader
+			pr, pw = io.Pipe()
+			stream := &http2WebSocketConn{PipeReader: pr, mu: &mu, framer: framer, streamID: frame.StreamID}
+			go echo(stream, bufio.NewReader(stream), request, response)
+		case *http2.DataFrame:
+			if pw == nil {
+				return
+			}
+			if len(frame.Data()) > 0 {
+				_, _ = pw.Write(frame.Data())
+				mu.Lock()
+				_ = framer.WriteWindowUpdate(0, uint32(len(frame.Data())))
+				err = framer.WriteWindowUpdate(frame.StreamID, uint32(len(frame.Data())))
+				mu.Unlock()
+			}
+			if frame.StreamEnded() {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	tests := []struct {
+		name      string
+		h2        bool
+		proto     string
+		status    int
+		handshake []string
+	}{
+		{"http/1.1", false, "HTTP/1.1", http.StatusSwitchingProtocols, []string{"Host", "Connection", "User-Agent", "Upgrade", "Origin",
+			"Sec-WebSocket-Version", "Sec-WebSocket-Key", "Sec-WebSocket-Extensions", "Sec-WebSocket-Protocol"}},
+		{"http2", true, "HTTP/2.0", http.StatusOK, []string{":method", ":authority", ":scheme", ":path", ":protocol", "user-agent", "origin",
+			"sec-websocket-version", "sec-websocket-extensions", "sec-websocket-protocol"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fingerprinttest.NewUnstartedServer()
+			ws := serveWebSocket(t, srv, test.h2)
+
+			c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := c.DialWebSocket(context.Background(), ws.url, http.Header{
+				"Sec-WebSocket-Protocol": {"chat, superchat"},
+				"User-Agent":             {"agent"},
+				"Origin":                 {"https://example.com"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp := conn.Response(); resp.Proto() != test.proto || resp.StatusCode() != test.status {
+				t.Errorf("handshake response: got %s %d, want %s %d", resp.Proto(), resp.StatusCode(), test.proto, test.status)
+			}
+			if conn.Subprotocol() != "chat" {
+				t.Errorf("subprotocol: got %q, want chat", conn.Subprotocol())
+			}
+			ws.mu.Lock()
+			handshakes := ws.handshakes
+			ws.mu.Unlock()
+			if len(handshakes) != 1 || !reflect.DeepEqual(handshakes[0], test.handshake) {
+				t.Errorf("handshake headers: got %v, want %v", handshakes, test.handshake)
+			}
+
+			// the large message is compressed with permessage-deflate, the second one refers to the window of the first
+			messages := []struct {
+				typ  MessageType
+				data []byte
+			}{
+				{TextMessage, []byte("hello")},
+				{BinaryMessage, bytes.Repeat([]byte{0, 1, 2, 3}, 50000)},
+				{BinaryMessage, bytes.Repeat([]byte{0, 1, 2, 3}, 100)},
+			}
+			for _, m := range messages {
+				if err = conn.WriteMessage(m.typ, m.data); err != nil {
+					t.Fatal(err)
+				}
+				typ, data, err := conn.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if typ != m.typ || !bytes.Equal(data, m.data) {
+					t.Errorf("echo: got %d with %d bytes, want %d with %d bytes", typ, len(data), m.typ, len(m.data))
+				}
+			}
+
+			pong := make(chan string, 1)
+			conn.SetPongHandler(func(data []byte) { pong <- string(data) })
+			if err = conn.Ping([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if err = conn.WriteMessage(TextMessage, []byte("after ping")); err != nil {
+				t.Fatal(err)
+			}
+			if _, data, err := conn.ReadMessage(); err != nil || string(data) != "after ping" {
+				t.Fatalf("read after ping: got %q, %v", data, err)
+			}
+			select {
+			case data := <-pong:
+				if data != "ping" {
+					t.Errorf("pong: got %q", data)
+				}
+			default:
+				t.Error("pong not handled")
+			}
+
+			if err = conn.Close(); err != nil {
+				t.Fatal(err)
+			}
+			var closeErr *CloseError
+			if _, _, err = conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != CloseNormalClosure {
+				t.Errorf("read after close: got %v, want a normal closure", err)
+			}
+			if err = conn.WriteMessage(TextMessage, []byte("closed")); err != ErrWebSocketCloseSent {
+				t.Errorf("write after close: got %v, want %v", err, ErrWebSocketCloseSent)
+			}
+		})
+	}
+}
+
+func TestWebSocketFallback(t *testing.T) {
+	// the echo server negotiates http2 but does not accept websockets over it, nor upgrades http/1.1 requests
+	srv := fingerprinttest.NewServer()
+	defer srv.Close()
+
+	c, err := NewClient("", 5*time.Second, true, tlsUtls.HelloChrome_102, TLSVerification{RootCAs: srv.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.DialWebSocket(context.Background(), "wss"+strings.TrimPrefix(srv.URL, "https"), nil)
+	var handshakeErr *WebSocketHandshakeError
+	if !errors.As(err, &handshakeErr) || handshakeErr.Response.StatusCode() != http.StatusOK {
+		t.Fatalf("error: got %v, want a handshake error", err)
+	}
+
+	fingerprints := srv.Fingerprints()
+	if len(fingerprints) != 2 {
+		t.Fatalf("connections: got %d, want 2", len(fingerprints))
+	}
+	if fingerprints[0].ALPN != "h2" || len(fingerprints[0].Requests) != 0 {
+		t.Errorf("first connection: got %s with %d requests, want h2 without requests", fingerprints[0].ALPN, len(fingerprints[0].Requests))
+	}
+	second := fingerprints[1]
+	if !reflect.DeepEqual(second.OfferedALPN, []string{"http/1.1"}) {
+		t.Errorf("alpn of the second connection: got %v, want only http/1.1", second.OfferedALPN)
+	}
+	if second.JA3 != fingerprints[0].JA3 {
+		t.Errorf("ja3 of the second connection: got %s, first %s", second.JA3, fingerprints[0].JA3)
+	}
+	if len(second.Requests) != 1 || second.Requests[0].Header("Upgrade") != "websocket" {
+		t.Fatalf("requests of the second connection: got %+v", second.Requests)
+	}
+	want := []string{"Host", "Connection", "User-Agent", "Upgrade", "Sec-WebSocket-Version", "Sec-WebSocket-Key", "Sec-WebSocket-Extensions"}
+	if got := second.Requests[0].HeaderOrder; !reflect.DeepEqual(got, want) {
+		t.Errorf("header order: got %v, want %v", got, want)
+	}
+}